@@ -1,33 +1,20 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
-func BenchmarkSendMetricJSON(b *testing.B) {
+func BenchmarkSendBatchJSONFrom(b *testing.B) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
 	defer server.Close()
 
-	client := &http.Client{}
-	value := 123.45
-
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		sendMetricJSON(client, "test_metric", "gauge", server.URL[7:], &value, nil)
-	}
-}
-
-func BenchmarkSendBatchJSON(b *testing.B) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	}))
-	defer server.Close()
-
-	client := &http.Client{}
+	sender := newTestSender(b, server.URL[7:])
 	metricsList := make([]Metrics, 10)
 	for i := 0; i < 10; i++ {
 		value := float64(i)
@@ -40,14 +27,15 @@ func BenchmarkSendBatchJSON(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		sendBatchJSON(client, metricsList, server.URL[7:])
+		sendBatchJSONFrom(sender, metricsList, startTime)
 	}
 }
 
-func BenchmarkCollectRuntimeMetrics(b *testing.B) {
-	ms := make(map[string]float64)
+func BenchmarkRuntimeCollector(b *testing.B) {
+	c := newRuntimeCollector(time.Second)
+	ctx := context.Background()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		CollectRuntimeMetrics(ms)
+		c.Collect(ctx)
 	}
 }
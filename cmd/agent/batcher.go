@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+const (
+	// DefaultBatchMaxCount is the default maximum number of metrics per /updates request.
+	// One poll produces about 35 metrics, so a poll usually fits into a single request.
+	DefaultBatchMaxCount = 100
+	// DefaultBatchMaxBytes is the default maximum size of the uncompressed JSON body of a
+	// batch, well below the server's default body limit of 1 MiB.
+	DefaultBatchMaxBytes = 512 << 10
+	// DefaultBatchLinger is the default time a worker waits for more metrics before it
+	// sends a batch that is not full.
+	DefaultBatchLinger = 200 * time.Millisecond
+)
+
+// batchLimits bound the batches the workers send through /updates. A batch is sent
+// as soon as any limit is reached.
+type batchLimits struct {
+	maxCount int           // Maximum number of metrics per request
+	maxBytes int           // Maximum size of the uncompressed JSON body; a larger single metric is sent alone
+	linger   time.Duration // How long to wait for more metrics after the first one of a batch
+}
+
+// metricBatch accumulates the metrics of one /updates request.
+type metricBatch struct {
+	items []Metrics // Metrics in queue order
+	size  int       // Size of the items encoded as a JSON array
+}
+
+// fits reports whether a metric of the given encoded size can be added without
+// exceeding the byte limit. An empty batch takes any metric.
+//
+// Parameters:
+//   - size: Size of the metric encoded as JSON
+//   - limits: Batch limits
+//
+// Returns:
+//   - bool: true if the metric fits
+func (b *metricBatch) fits(size int, limits batchLimits) bool {
+	// One byte for the separating comma
+	return len(b.items) == 0 || b.size+1+size <= limits.maxBytes
+}
+
+// add appends a metric to the batch.
+//
+// Parameters:
+//   - m: Metric to add
+//   - size: Size of the metric encoded as JSON
+func (b *metricBatch) add(m Metrics, size int) {
+	if len(b.items) == 0 {
+		b.size = 2 // Brackets of the array
+	} else {
+		b.size++
+	}
+	b.items = append(b.items, m)
+	b.size += size
+}
+
+// encodedSize returns the size of a metric encoded as JSON.
+//
+// Parameters:
+//   - m: Metric to measure
+//
+// Returns:
+//   - int: Size in bytes, or 0 if the metric cannot be encoded
+func encodedSize(m Metrics) int {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return 0
+	}
+	return len(body)
+}
+
+// prepare builds the metric sent for a queued metric: only the value field matching
+// its type, and its metadata until the server has accepted it once.
+//
+// Parameters:
+//   - metric: Queued metric
+//
+// Returns:
+//   - Metrics: Metric to send
+func (wp *WorkerPool) prepare(metric Metrics) Metrics {
+	m := Metrics{ID: metric.ID, MType: metric.MType, Temporality: metric.Temporality}
+	switch metric.MType {
+	case "gauge":
+		m.Value = metric.Value
+	case "histogram":
+		m.Histogram = metric.Histogram
+	case "summary":
+		m.Summary = metric.Summary
+	default:
+		m.Delta = metric.Delta
+	}
+	if _, sent := wp.metaSent.Load(metric.ID); !sent {
+		m.Meta = metricMetadata(metric.ID, metric.MType)
+	}
+	return m
+}
+
+// nextBatch collects a batch starting with first. It takes further metrics from the
+// queue until the batch is full, the linger time has passed, the pool is stopped or
+// the queue is closed.
+//
+// Parameters:
+//   - first: First metric of the batch
+//
+// Returns:
+//   - []Metrics: Prepared metrics to send
+//   - *Metrics: Metric taken from the queue that did not fit into the byte limit and
+//     starts the next batch, or nil
+func (wp *WorkerPool) nextBatch(first Metrics) ([]Metrics, *Metrics) {
+	var b metricBatch
+	m := wp.prepare(first)
+	b.add(m, encodedSize(m))
+
+	timer := time.NewTimer(wp.limits.linger)
+	defer timer.Stop()
+	for len(b.items) < wp.limits.maxCount {
+		select {
+		case <-wp.ctx.Done():
+			return b.items, nil
+		case <-timer.C:
+			return b.items, nil
+		case metric, ok := <-wp.queue.queue:
+			if !ok {
+				return b.items, nil
+			}
+			m := wp.prepare(metric)
+			size := encodedSize(m)
+			if !b.fits(size, wp.limits) {
+				return b.items, &metric
+			}
+			b.add(m, size)
+		}
+	}
+	return b.items, nil
+}
+
+// sendBatch sends a batch through /updates. If the server cannot be reached and a
+// spool is configured, the metrics not delivered yet are kept in the spool until the
+// server is back; while older batches wait there, newer ones are appended behind
+// them so that the server receives the reports in order. Without a spool they are
+// dropped.
+//
+// Parameters:
+//   - id: Worker ID for logging purposes
+//   - batch: Prepared metrics to send
+func (wp *WorkerPool) sendBatch(id int, batch []Metrics) {
+	if len(batch) == 0 {
+		return
+	}
+	if wp.spool != nil && wp.spool.len() > 0 {
+		wp.spoolBatch(id, batch)
+		return
+	}
+
+	rest, err := wp.deliver(id, batch, startTime)
+	if err == nil {
+		return
+	}
+	if wp.spool != nil {
+		wp.spoolBatch(id, rest)
+		return
+	}
+	log.Printf("Worker %d: Failed to send batch of %d metric(s) starting with %s: %v\n", id, len(rest), rest[0].ID, err)
+	wp.restoreLatency(rest)
+}
+
+// deliver sends a batch with retries. The server applies a batch atomically, so a
+// batch it rejects with a client error (e.g. one metric conflicting with its
+// registered type, or a body that is too large) is split into halves that are sent
+// separately, until the rejected metrics are isolated and dropped.
+//
+// Parameters:
+//   - id: Worker ID for logging purposes
+//   - batch: Prepared metrics to send
+//   - start: Start time of the agent run that collected the metrics
+//
+// Returns:
+//   - []Metrics: Metrics not delivered because of the error, in order; halves the
+//     server accepted before the error are not part of it, since sending them again
+//     would count their histograms, summaries and increments twice
+//   - error: nil if every metric was delivered or rejected by the server, otherwise
+//     the error of the retries for server and network errors
+func (wp *WorkerPool) deliver(id int, batch []Metrics, start time.Time) ([]Metrics, error) {
+	// Retries are not cut short on shutdown, so that flushQueue can still deliver
+	err := client.Retry(context.Background(), retryDelays, func() error {
+		begin := time.Now()
+		err := sendBatchJSONFrom(wp.sender, batch, start)
+		if wp.latency != nil {
+			wp.latency.observe(time.Since(begin))
+		}
+		return err
+	})
+	if err == nil {
+		for _, m := range batch {
+			if m.Meta != nil {
+				wp.metaSent.Store(m.ID, struct{}{})
+			}
+		}
+		return nil, nil
+	}
+
+	var statusErr *client.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Retriable() {
+		return batch, err
+	}
+	if len(batch) == 1 {
+		log.Printf("Worker %d: Server rejected metric %s: %v\n", id, batch[0].ID, err)
+		wp.restoreLatency(batch)
+		return nil, nil
+	}
+	mid := len(batch) / 2
+	if rest, err := wp.deliver(id, batch[:mid], start); err != nil {
+		return slices.Concat(rest, batch[mid:]), err
+	}
+	return wp.deliver(id, batch[mid:], start)
+}
+
+// spoolBatch appends a batch to the spool, dropping it if that fails.
+//
+// Parameters:
+//   - id: Worker ID for logging purposes
+//   - batch: Prepared metrics to keep
+func (wp *WorkerPool) spoolBatch(id int, batch []Metrics) {
+	if err := wp.spool.append(startTime, batch); err != nil {
+		log.Printf("Worker %d: Failed to spool batch of %d metric(s) starting with %s: %v\n", id, len(batch), batch[0].ID, err)
+		wp.restoreLatency(batch)
+	}
+}
+
+// restoreLatency puts the observations of a report latency histogram that could
+// not be delivered back, so that they are reported again with the next histogram.
+//
+// Parameters:
+//   - batch: Metrics that were not delivered
+func (wp *WorkerPool) restoreLatency(batch []Metrics) {
+	if wp.latency == nil {
+		return
+	}
+	for _, m := range batch {
+		if m.ID == reportLatencyName && m.Histogram != nil {
+			wp.latency.restore(*m.Histogram)
+		}
+	}
+}
+
+// replay sends the spooled batches oldest first, right away and then every
+// spoolReplayInterval, until the pool is stopped.
+//
+// Parameters:
+//   - id: Worker ID for logging purposes
+func (wp *WorkerPool) replay(id int) {
+	defer wp.wg.Done()
+
+	var rest spoolRemainder
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+	for {
+		wp.replaySpool(id, &rest)
+		select {
+		case <-wp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// spoolRemainder is the part of the next spooled batch that is left after the server
+// accepted only some of its halves.
+type spoolRemainder struct {
+	pos     spoolPosition // Record the remainder belongs to
+	metrics []Metrics     // Metrics of the record not delivered yet
+}
+
+// replaySpool sends spooled batches until the spool is empty, the server cannot be
+// reached or the pool is stopped. A batch delivered in part is resumed with its
+// remainder, so the delivered halves are not sent again; after an agent restart the
+// whole batch is replayed.
+//
+// Parameters:
+//   - id: Worker ID for logging purposes
+//   - rest: Remainder of a batch delivered in part, updated by the call
+func (wp *WorkerPool) replaySpool(id int, rest *spoolRemainder) {
+	for wp.ctx.Err() == nil {
+		rec, pos, ok, err := wp.spool.peek()
+		if err != nil {
+			log.Printf("Worker %d: Failed to read spool: %v\n", id, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		batch := rec.Metrics
+		if rest.metrics != nil && rest.pos == pos {
+			batch = rest.metrics
+		}
+		undelivered, err := wp.deliver(id, batch, rec.Start)
+		if err != nil {
+			// Try again later with what is left
+			*rest = spoolRemainder{pos: pos, metrics: undelivered}
+			return
+		}
+		*rest = spoolRemainder{}
+		if err := wp.spool.commit(pos); err != nil {
+			log.Printf("Worker %d: Failed to update spool: %v\n", id, err)
+			return
+		}
+	}
+}
+
+// flushQueue sends the metrics left in the queue in batches, without waiting for
+// more. It is called after Stop so that no metrics are lost on shutdown.
+func (wp *WorkerPool) flushQueue() {
+	for !wp.queue.IsEmpty() {
+		var b metricBatch
+		for len(b.items) < wp.limits.maxCount && !wp.queue.IsEmpty() {
+			m := wp.prepare(wp.queue.Pop())
+			size := encodedSize(m)
+			if !b.fits(size, wp.limits) {
+				wp.sendBatch(0, b.items)
+				b = metricBatch{}
+			}
+			b.add(m, size)
+		}
+		wp.sendBatch(0, b.items)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readBatch returns the uncompressed body of a /updates request.
+func readBatch(t *testing.T, r *http.Request) []byte {
+	assert.Equal(t, "/updates", r.URL.Path)
+	gz, err := gzip.NewReader(r.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	return body
+}
+
+// decodeBatch returns the metrics of a /updates request.
+func decodeBatch(t *testing.T, r *http.Request) []Metrics {
+	var batch []Metrics
+	require.NoError(t, json.Unmarshal(readBatch(t, r), &batch))
+	return batch
+}
+
+// newTestPool creates a worker pool with one worker sending to the test server.
+func newTestPool(server *httptest.Server, limits batchLimits) *WorkerPool {
+	sender, err := newSender(&http.Client{Timeout: 5 * time.Second}, strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		panic(err)
+	}
+	return NewWorkerPool(1, NewMetricQueue(100), sender, limits)
+}
+
+// batchRecorder records the batches received by a test server.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]string // IDs of the metrics of every request, in order
+	sizes   []int      // Uncompressed body size of every request
+}
+
+func (rec *batchRecorder) handler(t *testing.T, status func(ids []string) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := readBatch(t, r)
+		var batch []Metrics
+		require.NoError(t, json.Unmarshal(body, &batch))
+		ids := make([]string, len(batch))
+		for i, m := range batch {
+			ids[i] = m.ID
+		}
+
+		rec.mu.Lock()
+		rec.batches = append(rec.batches, ids)
+		rec.sizes = append(rec.sizes, len(body))
+		rec.mu.Unlock()
+		w.WriteHeader(status(ids))
+	}
+}
+
+// received returns the IDs of all metrics received, in order.
+func (rec *batchRecorder) received() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return slices.Concat(rec.batches...)
+}
+
+func accept([]string) int { return http.StatusOK }
+
+// pushGauges queues n gauges named m000, m001, ...
+func pushGauges(queue *MetricQueue, n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("m%03d", i)
+		value := float64(i)
+		queue.Push(Metrics{ID: ids[i], MType: "gauge", Value: &value})
+	}
+	return ids
+}
+
+func Test_worker_BatchLimits(t *testing.T) {
+	// Size of one queued gauge as sent; the names are unknown, so no metadata is attached
+	value := 0.0
+	gaugeSize := encodedSize(Metrics{ID: "m000", MType: "gauge", Value: &value})
+
+	tests := []struct {
+		name          string
+		limits        batchLimits
+		metrics       int
+		expectedSizes []int
+	}{
+		{
+			name:          "Count",
+			limits:        batchLimits{maxCount: 40, maxBytes: DefaultBatchMaxBytes, linger: time.Second},
+			metrics:       100,
+			expectedSizes: []int{40, 40, 20},
+		},
+		{
+			name:          "Bytes",
+			limits:        batchLimits{maxCount: 100, maxBytes: 2 + 3*gaugeSize + 2, linger: time.Second},
+			metrics:       10,
+			expectedSizes: []int{3, 3, 3, 1},
+		},
+		{
+			name:          "Metric larger than the byte limit",
+			limits:        batchLimits{maxCount: 100, maxBytes: 1, linger: time.Second},
+			metrics:       2,
+			expectedSizes: []int{1, 1},
+		},
+		{
+			name:          "Linger",
+			limits:        batchLimits{maxCount: 100, maxBytes: DefaultBatchMaxBytes, linger: 10 * time.Millisecond},
+			metrics:       1,
+			expectedSizes: []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec batchRecorder
+			server := httptest.NewServer(rec.handler(t, accept))
+			defer server.Close()
+
+			pool := newTestPool(server, tt.limits)
+			ids := pushGauges(pool.queue, tt.metrics)
+			pool.Start()
+			defer pool.Stop()
+
+			// The last batch is not full and is sent once the linger time has passed
+			require.Eventually(t, func() bool { return len(rec.received()) == tt.metrics }, 5*time.Second, 5*time.Millisecond)
+			assert.Equal(t, ids, rec.received())
+
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			sizes := make([]int, len(rec.batches))
+			for i, batch := range rec.batches {
+				sizes[i] = len(batch)
+				if len(batch) > 1 {
+					assert.LessOrEqual(t, rec.sizes[i], tt.limits.maxBytes)
+				}
+			}
+			assert.Equal(t, tt.expectedSizes, sizes)
+		})
+	}
+}
+
+func Test_sendBatch_SplitsRejectedBatch(t *testing.T) {
+	var rec batchRecorder
+	// The server applies a batch atomically and rejects every batch holding m005
+	server := httptest.NewServer(rec.handler(t, func(ids []string) int {
+		if slices.Contains(ids, "m005") {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	}))
+	defer server.Close()
+
+	pool := newTestPool(server, batchLimits{maxCount: 8})
+	pushGauges(pool.queue, 8)
+	var batch []Metrics
+	for !pool.queue.IsEmpty() {
+		batch = append(batch, pool.prepare(pool.queue.Pop()))
+	}
+	pool.sendBatch(0, batch)
+
+	// The rejected batch is halved until m005 is isolated
+	assert.Equal(t, [][]string{
+		{"m000", "m001", "m002", "m003", "m004", "m005", "m006", "m007"},
+		{"m000", "m001", "m002", "m003"},
+		{"m004", "m005", "m006", "m007"},
+		{"m004", "m005"},
+		{"m004"},
+		{"m005"},
+		{"m006", "m007"},
+	}, rec.batches)
+}
+
+func Test_sendBatch_SpoolsOnlyUndeliveredHalf(t *testing.T) {
+	oldDelays := retryDelays
+	retryDelays = []time.Duration{0}
+	defer func() { retryDelays = oldDelays }()
+
+	var rec batchRecorder
+	// The server rejects the full batch, accepts the first half and fails on the second
+	server := httptest.NewServer(rec.handler(t, func(ids []string) int {
+		switch {
+		case len(ids) == 4:
+			return http.StatusBadRequest
+		case ids[0] == "m000":
+			return http.StatusOK
+		default:
+			return http.StatusServiceUnavailable
+		}
+	}))
+	defer server.Close()
+
+	s, err := openSpool(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	defer s.close()
+	pool := newTestPool(server, batchLimits{maxCount: 4})
+	pool.spool = s
+	pushGauges(pool.queue, 4)
+	var batch []Metrics
+	for !pool.queue.IsEmpty() {
+		batch = append(batch, pool.prepare(pool.queue.Pop()))
+	}
+	pool.sendBatch(0, batch)
+
+	assert.Equal(t, 1, s.len())
+	spooled, _, ok, err := s.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	var ids []string
+	for _, m := range spooled.Metrics {
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []string{"m002", "m003"}, ids, "the delivered half is not spooled again")
+}
+
+func Test_replaySpool_ResumesPartialBatch(t *testing.T) {
+	oldDelays := retryDelays
+	retryDelays = []time.Duration{0}
+	defer func() { retryDelays = oldDelays }()
+
+	var mu sync.Mutex
+	up := false
+	var rec batchRecorder
+	server := httptest.NewServer(rec.handler(t, func(ids []string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case len(ids) == 4:
+			return http.StatusBadRequest
+		case ids[0] == "m000" || up:
+			return http.StatusOK
+		default:
+			return http.StatusServiceUnavailable
+		}
+	}))
+	defer server.Close()
+
+	s, err := openSpool(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	defer s.close()
+	pool := newTestPool(server, batchLimits{maxCount: 4})
+	pool.spool = s
+	ids := pushGauges(pool.queue, 4)
+	var batch []Metrics
+	for !pool.queue.IsEmpty() {
+		batch = append(batch, pool.prepare(pool.queue.Pop()))
+	}
+	require.NoError(t, s.append(startTime, batch))
+
+	var rest spoolRemainder
+	pool.replaySpool(0, &rest)
+	assert.Equal(t, 1, s.len())
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	pool.replaySpool(0, &rest)
+	assert.Equal(t, 0, s.len())
+	assert.Equal(t, [][]string{ids, ids[:2], ids[2:], ids[2:]}, rec.batches, "only the remainder is replayed")
+}
+
+func Test_flushQueue(t *testing.T) {
+	var rec batchRecorder
+	server := httptest.NewServer(rec.handler(t, accept))
+	defer server.Close()
+
+	pool := newTestPool(server, batchLimits{maxCount: 2, maxBytes: DefaultBatchMaxBytes, linger: time.Hour})
+	ids := pushGauges(pool.queue, 5)
+	pool.Start()
+	pool.Stop()
+	// Stopped workers may have sent some of the metrics already
+	pool.flushQueue()
+
+	assert.Equal(t, ids, rec.received())
+	assert.True(t, pool.queue.IsEmpty())
+	for _, batch := range rec.batches {
+		assert.LessOrEqual(t, len(batch), 2)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cgroupCollectorName is the name of the collector of the container resource metrics.
+	cgroupCollectorName = "cgroup"
+
+	// defaultCgroupRoot is where the cgroup file system is mounted.
+	defaultCgroupRoot = "/sys/fs/cgroup"
+
+	// defaultSelfCgroup lists the cgroups of the agent process.
+	defaultSelfCgroup = "/proc/self/cgroup"
+
+	// cgroupUnlimited is the smallest value cgroup v1 uses for "no limit"; the kernel
+	// reports the largest page-aligned int64 rather than a keyword.
+	cgroupUnlimited = 1 << 62
+)
+
+// cgroupSample is one reading of the cgroup files of the agent.
+type cgroupSample struct {
+	gauges        map[string]float64 // Memory and pids usage and limits that are set
+	hasCPU        bool               // Whether the CPU accounting files were found
+	cpuSeconds    float64            // CPU time used by the cgroup
+	periods       uint64             // CPU bandwidth enforcement periods that have elapsed
+	throttled     uint64             // Periods in which the cgroup was throttled
+	throttledTime float64            // Time the cgroup was throttled in seconds
+}
+
+// cgroupCollector reports the resources of the container the agent runs in, read
+// from the cgroup file system, which is detected as v1 or v2 on every run:
+//   - CgroupMemoryUsage, CgroupMemoryWorkingSet and CgroupMemoryLimit in bytes
+//   - CgroupCPUPercent, the CPU usage in percent of one core, and CgroupCPULimit in cores
+//   - CgroupCPUPeriods, CgroupCPUThrottledPeriods and CgroupCPUThrottledMicroseconds counters
+//   - CgroupPids and CgroupPidsLimit
+//
+// Limits are only reported if they are set.
+type cgroupCollector struct {
+	interval   time.Duration    // Default interval between two runs
+	root       string           // Mount point of the cgroup file system; a fixture tree in tests
+	selfCgroup string           // File listing the cgroups of the agent process
+	now        func() time.Time // Current time; replaced in tests
+
+	prev   *cgroupSample // Sample of the previous run
+	prevAt time.Time     // Time of the previous run
+}
+
+// newCgroupCollector creates the collector of the container resource metrics.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *cgroupCollector: Collector ready to be registered
+func newCgroupCollector(interval time.Duration) *cgroupCollector {
+	return &cgroupCollector{interval: interval, root: defaultCgroupRoot, selfCgroup: defaultSelfCgroup, now: time.Now}
+}
+
+// Name implements Collector.
+func (c *cgroupCollector) Name() string { return cgroupCollectorName }
+
+// Interval implements Collector.
+func (c *cgroupCollector) Interval() time.Duration { return c.interval }
+
+// available reports whether a cgroup file system is mounted, so that the collector
+// is enabled by default only where there is something to collect.
+//
+// Returns:
+//   - bool: true if the cgroup root is a directory
+func (c *cgroupCollector) available() bool {
+	info, err := os.Stat(c.root)
+	return err == nil && info.IsDir()
+}
+
+// Collect implements Collector. The CPU usage is computed from the CPU time used
+// since the previous run, so the first run does not report it, and the counters
+// start with an increment of 0.
+func (c *cgroupCollector) Collect(context.Context) ([]Metrics, error) {
+	var sample *cgroupSample
+	var err error
+	if _, statErr := os.Stat(filepath.Join(c.root, "cgroup.controllers")); statErr == nil {
+		sample, err = c.readV2()
+	} else {
+		sample, err = c.readV1()
+	}
+	if sample == nil {
+		return nil, err
+	}
+
+	out := gaugeMetrics(sample.gauges)
+	now := c.now()
+	prev, elapsed := c.prev, now.Sub(c.prevAt).Seconds()
+	c.prev, c.prevAt = sample, now
+	if !sample.hasCPU {
+		return out, err
+	}
+
+	var periods, throttled, throttledTime uint64
+	if prev != nil && prev.hasCPU {
+		periods, _ = counterIncrease(prev.periods, sample.periods)
+		throttled, _ = counterIncrease(prev.throttled, sample.throttled)
+		if sample.throttledTime >= prev.throttledTime {
+			throttledTime = uint64((sample.throttledTime - prev.throttledTime) * 1e6)
+		}
+		if elapsed > 0 && sample.cpuSeconds >= prev.cpuSeconds {
+			out = append(out, gauge("CgroupCPUPercent", 100*(sample.cpuSeconds-prev.cpuSeconds)/elapsed))
+		}
+	}
+	out = append(out,
+		counter("CgroupCPUPeriods", int64(periods)),
+		counter("CgroupCPUThrottledPeriods", int64(throttled)),
+		counter("CgroupCPUThrottledMicroseconds", int64(throttledTime)),
+	)
+	return out, err
+}
+
+// readV2 reads the files of the agent's cgroup in the unified (v2) hierarchy.
+//
+// Returns:
+//   - *cgroupSample: Values that could be read, or nil if the cgroup was not found
+//   - error: Errors of the files that could not be parsed
+func (c *cgroupCollector) readV2() (*cgroupSample, error) {
+	dir, err := c.cgroupDir("", c.root)
+	if err != nil {
+		return nil, err
+	}
+	r := cgroupReader{sample: &cgroupSample{gauges: make(map[string]float64)}}
+
+	if usage, ok := r.uint(filepath.Join(dir, "memory.current")); ok {
+		r.sample.gauges["CgroupMemoryUsage"] = float64(usage)
+		stat := r.keyed(filepath.Join(dir, "memory.stat"))
+		r.sample.gauges["CgroupMemoryWorkingSet"] = workingSet(usage, stat["inactive_file"])
+	}
+	if limit, ok := r.uint(filepath.Join(dir, "memory.max")); ok {
+		r.sample.gauges["CgroupMemoryLimit"] = float64(limit)
+	}
+	if pids, ok := r.uint(filepath.Join(dir, "pids.current")); ok {
+		r.sample.gauges["CgroupPids"] = float64(pids)
+	}
+	if limit, ok := r.uint(filepath.Join(dir, "pids.max")); ok {
+		r.sample.gauges["CgroupPidsLimit"] = float64(limit)
+	}
+
+	if stat := r.keyed(filepath.Join(dir, "cpu.stat")); stat != nil {
+		r.sample.hasCPU = true
+		r.sample.cpuSeconds = float64(stat["usage_usec"]) / 1e6
+		r.sample.periods = stat["nr_periods"]
+		r.sample.throttled = stat["nr_throttled"]
+		r.sample.throttledTime = float64(stat["throttled_usec"]) / 1e6
+	}
+	// cpu.max holds the quota and the period in microseconds, e.g. "50000 100000"
+	if fields := r.fields(filepath.Join(dir, "cpu.max")); len(fields) == 2 && fields[0] != "max" {
+		quota, err1 := strconv.ParseUint(fields[0], 10, 64)
+		period, err2 := strconv.ParseUint(fields[1], 10, 64)
+		if err1 != nil || err2 != nil || period == 0 {
+			r.errs = append(r.errs, fmt.Errorf("invalid %s: %q", filepath.Join(dir, "cpu.max"), strings.Join(fields, " ")))
+		} else {
+			r.sample.gauges["CgroupCPULimit"] = float64(quota) / float64(period)
+		}
+	}
+	return r.sample, errors.Join(r.errs...)
+}
+
+// readV1 reads the files of the agent's cgroups in the per-controller (v1)
+// hierarchies.
+//
+// Returns:
+//   - *cgroupSample: Values that could be read, or nil if no controller was found
+//   - error: Errors of the files that could not be parsed
+func (c *cgroupCollector) readV1() (*cgroupSample, error) {
+	r := cgroupReader{sample: &cgroupSample{gauges: make(map[string]float64)}}
+	found := false
+
+	if dir, err := c.controllerDir("memory"); err == nil {
+		found = true
+		if usage, ok := r.uint(filepath.Join(dir, "memory.usage_in_bytes")); ok {
+			r.sample.gauges["CgroupMemoryUsage"] = float64(usage)
+			stat := r.keyed(filepath.Join(dir, "memory.stat"))
+			r.sample.gauges["CgroupMemoryWorkingSet"] = workingSet(usage, stat["total_inactive_file"])
+		}
+		if limit, ok := r.uint(filepath.Join(dir, "memory.limit_in_bytes")); ok {
+			r.sample.gauges["CgroupMemoryLimit"] = float64(limit)
+		}
+	}
+	if dir, err := c.controllerDir("pids"); err == nil {
+		found = true
+		if pids, ok := r.uint(filepath.Join(dir, "pids.current")); ok {
+			r.sample.gauges["CgroupPids"] = float64(pids)
+		}
+		if limit, ok := r.uint(filepath.Join(dir, "pids.max")); ok {
+			r.sample.gauges["CgroupPidsLimit"] = float64(limit)
+		}
+	}
+	if dir, err := c.controllerDir("cpuacct"); err == nil {
+		found = true
+		// Nanoseconds of CPU time
+		if usage, ok := r.uint(filepath.Join(dir, "cpuacct.usage")); ok {
+			r.sample.hasCPU = true
+			r.sample.cpuSeconds = float64(usage) / 1e9
+		}
+	}
+	if dir, err := c.controllerDir("cpu"); err == nil {
+		found = true
+		if stat := r.keyed(filepath.Join(dir, "cpu.stat")); stat != nil {
+			r.sample.hasCPU = true
+			r.sample.periods = stat["nr_periods"]
+			r.sample.throttled = stat["nr_throttled"]
+			r.sample.throttledTime = float64(stat["throttled_time"]) / 1e9
+		}
+		// A quota of -1 means no limit
+		quota := r.fields(filepath.Join(dir, "cpu.cfs_quota_us"))
+		period, ok := r.uint(filepath.Join(dir, "cpu.cfs_period_us"))
+		if len(quota) == 1 && quota[0] != "-1" && ok && period > 0 {
+			if q, err := strconv.ParseUint(quota[0], 10, 64); err == nil {
+				r.sample.gauges["CgroupCPULimit"] = float64(q) / float64(period)
+			} else {
+				r.errs = append(r.errs, fmt.Errorf("invalid %s: %w", filepath.Join(dir, "cpu.cfs_quota_us"), err))
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no cgroup v1 or v2 hierarchy found at %s", c.root)
+	}
+	return r.sample, errors.Join(r.errs...)
+}
+
+// controllerDir returns the directory of the agent's cgroup in a v1 controller
+// hierarchy, which may be mounted together with other controllers, e.g. at
+// "cpu,cpuacct".
+//
+// Parameters:
+//   - controller: Controller name, e.g. "memory"
+//
+// Returns:
+//   - string: Directory of the cgroup
+//   - error: Error if the controller is not mounted
+func (c *cgroupCollector) controllerDir(controller string) (string, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		for _, name := range strings.Split(e.Name(), ",") {
+			if name == controller {
+				return c.cgroupDir(controller, filepath.Join(c.root, e.Name()))
+			}
+		}
+	}
+	return "", fmt.Errorf("cgroup controller %s: %w", controller, fs.ErrNotExist)
+}
+
+// cgroupDir returns the directory of the agent's cgroup in a hierarchy. The path
+// is taken from the agent's cgroup list; inside a container with its own cgroup
+// namespace that path does not exist below the mount point, which is then the
+// agent's cgroup itself.
+//
+// Parameters:
+//   - controller: v1 controller of the hierarchy, or "" for the v2 hierarchy
+//   - mount: Mount point of the hierarchy
+//
+// Returns:
+//   - string: Directory of the cgroup
+//   - error: Error if the mount point does not exist
+func (c *cgroupCollector) cgroupDir(controller, mount string) (string, error) {
+	if _, err := os.Stat(mount); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(c.selfCgroup)
+	if err != nil {
+		return mount, nil
+	}
+	// Lines look like "4:memory:/docker/abc" in v1 and "0::/system.slice/x" in v2
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		matches := controller == "" && parts[0] == "0" && parts[1] == ""
+		for _, name := range strings.Split(parts[1], ",") {
+			matches = matches || (controller != "" && name == controller)
+		}
+		if !matches {
+			continue
+		}
+		dir := filepath.Join(mount, filepath.FromSlash(parts[2]))
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+		break
+	}
+	return mount, nil
+}
+
+// workingSet returns the memory the cgroup cannot easily give back: its usage
+// without the inactive file cache, as reported by container runtimes.
+//
+// Parameters:
+//   - usage: Memory usage in bytes
+//   - inactiveFile: Inactive file cache in bytes
+//
+// Returns:
+//   - float64: Working set in bytes
+func workingSet(usage, inactiveFile uint64) float64 {
+	if inactiveFile > usage {
+		return 0
+	}
+	return float64(usage - inactiveFile)
+}
+
+// cgroupReader reads cgroup files, collecting parse errors. A missing file is not
+// an error, as the controller may not be enabled for the cgroup.
+type cgroupReader struct {
+	sample *cgroupSample // Sample being read
+	errs   []error       // Files that could not be read or parsed
+}
+
+// fields returns the whitespace-separated fields of a single-line file.
+//
+// Parameters:
+//   - path: File to read
+//
+// Returns:
+//   - []string: Fields, or nil if the file does not exist or cannot be read
+func (r *cgroupReader) fields(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			r.errs = append(r.errs, err)
+		}
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+// uint reads a file holding a single number.
+//
+// Parameters:
+//   - path: File to read
+//
+// Returns:
+//   - uint64: The number
+//   - bool: false if the file is missing or invalid, or holds "max" or the v1
+//     value for no limit
+func (r *cgroupReader) uint(path string) (uint64, bool) {
+	fields := r.fields(path)
+	if len(fields) == 0 || fields[0] == "max" {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("invalid %s: %w", path, err))
+		return 0, false
+	}
+	if v >= cgroupUnlimited {
+		return 0, false
+	}
+	return v, true
+}
+
+// keyed reads a file of "key value" lines such as memory.stat or cpu.stat.
+// Lines that do not hold a number are skipped.
+//
+// Parameters:
+//   - path: File to read
+//
+// Returns:
+//   - map[string]uint64: Values by key, or nil if the file is missing
+func (r *cgroupReader) keyed(path string) map[string]uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			r.errs = append(r.errs, err)
+		}
+		return nil
+	}
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values
+}
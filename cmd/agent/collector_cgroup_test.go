@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixtureCgroupCollector returns a cgroup collector reading a copy of a fixture
+// tree in testdata/cgroup, so that tests can change the files.
+func fixtureCgroupCollector(t *testing.T, fixture string, clock *fakeClock) (*cgroupCollector, string) {
+	dir := t.TempDir()
+	require.NoError(t, os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "cgroup", fixture))))
+	c := newCgroupCollector(time.Second)
+	c.root = filepath.Join(dir, "fs")
+	c.selfCgroup = filepath.Join(dir, "self")
+	c.now = clock.Now
+	return c, dir
+}
+
+func Test_cgroupCollector(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		expected map[string]float64
+	}{
+		{
+			name:    "v2",
+			fixture: "v2",
+			expected: map[string]float64{
+				"CgroupMemoryUsage":              104857600,
+				"CgroupMemoryWorkingSet":         100663296,
+				"CgroupMemoryLimit":              268435456,
+				"CgroupPids":                     12,
+				"CgroupCPULimit":                 1.5,
+				"CgroupCPUPeriods":               0,
+				"CgroupCPUThrottledPeriods":      0,
+				"CgroupCPUThrottledMicroseconds": 0,
+			},
+		},
+		{
+			// Without a memory limit, with a pids hierarchy in its own namespace
+			name:    "v1",
+			fixture: "v1",
+			expected: map[string]float64{
+				"CgroupMemoryUsage":              52428800,
+				"CgroupMemoryWorkingSet":         50331648,
+				"CgroupPids":                     3,
+				"CgroupPidsLimit":                1024,
+				"CgroupCPUPeriods":               0,
+				"CgroupCPUThrottledPeriods":      0,
+				"CgroupCPUThrottledMicroseconds": 0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := fixtureCgroupCollector(t, tt.fixture, newFakeClock())
+			assert.True(t, c.available())
+			ms, err := c.Collect(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, metricValues(t, ms))
+		})
+	}
+}
+
+func Test_cgroupCollector_CPU(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		files    map[string]string
+		expected map[string]float64
+	}{
+		{
+			name:    "v2",
+			fixture: "v2",
+			files: map[string]string{
+				"system.slice/agent.service/cpu.stat": "usage_usec 6000000\nnr_periods 120\nnr_throttled 15\nthrottled_usec 400000\n",
+			},
+			expected: map[string]float64{"CgroupCPUPercent": 50, "CgroupCPUPeriods": 20, "CgroupCPUThrottledPeriods": 5, "CgroupCPUThrottledMicroseconds": 150000},
+		},
+		{
+			name:    "v1",
+			fixture: "v1",
+			files: map[string]string{
+				"cpu,cpuacct/docker/abc/cpuacct.usage": "3000000000\n",
+				"cpu,cpuacct/docker/abc/cpu.stat":      "nr_periods 10\nnr_throttled 1\nthrottled_time 2000000\n",
+			},
+			expected: map[string]float64{"CgroupCPUPercent": 50, "CgroupCPUPeriods": 10, "CgroupCPUThrottledPeriods": 1, "CgroupCPUThrottledMicroseconds": 2000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			c, dir := fixtureCgroupCollector(t, tt.fixture, clock)
+			_, err := c.Collect(t.Context())
+			require.NoError(t, err)
+
+			for name, content := range tt.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "fs", name), []byte(content), 0o644))
+			}
+			clock.Advance(2 * time.Second)
+			ms, err := c.Collect(t.Context())
+			require.NoError(t, err)
+			values := metricValues(t, ms)
+			for name, expected := range tt.expected {
+				assert.InDelta(t, expected, values[name], 1e-9, name)
+			}
+		})
+	}
+}
+
+func Test_cgroupCollector_Errors(t *testing.T) {
+	// No cgroup file system at all
+	c := newCgroupCollector(time.Second)
+	c.root = filepath.Join(t.TempDir(), "missing")
+	assert.False(t, c.available())
+	_, err := c.Collect(t.Context())
+	assert.ErrorContains(t, err, "no cgroup v1 or v2 hierarchy found")
+
+	// A damaged file is reported along with the values that could be read
+	c, dir := fixtureCgroupCollector(t, "v2", newFakeClock())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "fs", "system.slice", "agent.service", "memory.max"), []byte("lots\n"), 0o644))
+	ms, err := c.Collect(t.Context())
+	assert.ErrorContains(t, err, "memory.max")
+	values := metricValues(t, ms)
+	assert.Equal(t, 104857600.0, values["CgroupMemoryUsage"])
+	assert.NotContains(t, values, "CgroupMemoryLimit")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// customSample is one value read from the output of a command of the exec
+// collector or from a file of the textfile collector.
+type customSample struct {
+	Name  string  `json:"name"`  // Metric name
+	MType string  `json:"type"`  // "gauge" or "counter"
+	Value float64 `json:"value"` // Current value of a gauge or total of a counter
+}
+
+// validate checks that a sample can be sent to the server.
+//
+// Returns:
+//   - error: Error if the name, type or value is invalid
+func (s customSample) validate() error {
+	if s.Name == "" {
+		return errors.New("empty metric name")
+	}
+	for _, r := range s.Name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' || r == ':') {
+			return fmt.Errorf("invalid metric name %q: only letters, digits and _-.: are allowed", s.Name)
+		}
+	}
+	if s.MType != "gauge" && s.MType != "counter" {
+		return fmt.Errorf("invalid type %q of metric %s: must be gauge or counter", s.MType, s.Name)
+	}
+	// JSON has no representation of NaN and infinities
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return fmt.Errorf("invalid value %v of metric %s", s.Value, s.Name)
+	}
+	if s.MType == "counter" && s.Value < 0 {
+		return fmt.Errorf("negative total %v of counter %s", s.Value, s.Name)
+	}
+	return nil
+}
+
+// parseCustomLines parses the "name type value" lines written by the commands of
+// the exec collector, e.g. "QueueDepth gauge 42". Blank lines and lines starting
+// with "#" are skipped.
+//
+// Parameters:
+//   - data: Output of the command
+//
+// Returns:
+//   - []customSample: Samples of the valid lines
+//   - error: Error listing the invalid lines
+func parseCustomLines(data []byte) ([]customSample, error) {
+	var samples []customSample
+	var errs []error
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			errs = append(errs, fmt.Errorf("line %d: expected \"name type value\", got %q", n, line))
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: invalid value %q", n, fields[2]))
+			continue
+		}
+		s := customSample{Name: fields[0], MType: fields[1], Value: value}
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return samples, errors.Join(errs...)
+}
+
+// parseCustomJSON parses a JSON array of samples, e.g.
+// [{"name": "QueueDepth", "type": "gauge", "value": 42}].
+//
+// Parameters:
+//   - data: JSON document
+//
+// Returns:
+//   - []customSample: Valid samples
+//   - error: Error if the document cannot be decoded or some samples are invalid
+func parseCustomJSON(data []byte) ([]customSample, error) {
+	var all []customSample
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	samples := all[:0]
+	var errs []error
+	for i, s := range all {
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("item %d: %w", i, err))
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, errors.Join(errs...)
+}
+
+// customMetrics turns the samples of custom collectors into metrics. Commands and
+// files report counters as running totals, like the system counters, and the
+// agent sends how much they grew since the previous run.
+type customMetrics struct {
+	prev map[string]float64 // Total of each counter at the previous run
+}
+
+// metrics converts the samples of one run. A counter is reported with an
+// increment of 0 the first time it is seen and when its total went down; its
+// fractional part is carried over to the next run. A name reported twice is
+// kept once.
+//
+// Parameters:
+//   - samples: Samples of the run
+//
+// Returns:
+//   - []Metrics: Gauges and counters
+//   - error: Error naming the duplicated metrics
+func (c *customMetrics) metrics(samples []customSample) ([]Metrics, error) {
+	prev := c.prev
+	c.prev = make(map[string]float64)
+	seen := make(map[string]bool, len(samples))
+	var errs []error
+	out := make([]Metrics, 0, len(samples))
+	for _, s := range samples {
+		if seen[s.Name] {
+			errs = append(errs, fmt.Errorf("metric %s reported more than once", s.Name))
+			continue
+		}
+		seen[s.Name] = true
+		if s.MType == "gauge" {
+			out = append(out, gauge(s.Name, s.Value))
+			continue
+		}
+		c.prev[s.Name] = s.Value
+		var delta int64
+		if before, ok := prev[s.Name]; ok && s.Value >= before {
+			delta = int64(math.Floor(s.Value) - math.Floor(before))
+		}
+		out = append(out, counter(s.Name, delta))
+	}
+	return out, errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// Names of the collectors of disk usage and disk IO metrics.
+const (
+	diskCollectorName   = "disk"
+	diskIOCollectorName = "diskio"
+)
+
+// diskCollector reports the size and usage of every mounted file system:
+// DiskTotal_<mount>, DiskFree_<mount> and DiskUsed_<mount> in bytes and
+// DiskUsedPercent_<mount>.
+type diskCollector struct {
+	interval   time.Duration                                                     // Default interval between two runs
+	partitions func(ctx context.Context, all bool) ([]disk.PartitionStat, error) // Lists the mounted file systems; replaced in tests
+	usage      func(ctx context.Context, path string) (*disk.UsageStat, error)   // Reads the usage of a file system; replaced in tests
+}
+
+// newDiskCollector creates the collector of the file system usage.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *diskCollector: Collector ready to be registered
+func newDiskCollector(interval time.Duration) *diskCollector {
+	return &diskCollector{interval: interval, partitions: disk.PartitionsWithContext, usage: disk.UsageWithContext}
+}
+
+// Name implements Collector.
+func (c *diskCollector) Name() string { return diskCollectorName }
+
+// Interval implements Collector.
+func (c *diskCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. Only physical file systems are reported, each
+// mount point once, and file systems of size zero are skipped.
+func (c *diskCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	partitions, err := c.partitions(ctx, false)
+	if err != nil {
+		return nil, fmt.Errorf("disk partitions: %w", err)
+	}
+
+	var out []Metrics
+	var errs []error
+	seen := make(map[string]bool, len(partitions))
+	for _, p := range partitions {
+		if seen[p.Mountpoint] {
+			continue
+		}
+		seen[p.Mountpoint] = true
+
+		usage, err := c.usage(ctx, p.Mountpoint)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("disk usage of %s: %w", p.Mountpoint, err))
+			continue
+		}
+		if usage.Total == 0 {
+			continue
+		}
+		mount := instanceName(p.Mountpoint)
+		out = append(out,
+			gauge("DiskTotal_"+mount, float64(usage.Total)),
+			gauge("DiskFree_"+mount, float64(usage.Free)),
+			gauge("DiskUsed_"+mount, float64(usage.Used)),
+			gauge("DiskUsedPercent_"+mount, usage.UsedPercent),
+		)
+	}
+	return out, errors.Join(errs...)
+}
+
+// diskIOCollector reports the IO rates of every block device, computed from the
+// system counters of two consecutive runs: DiskReadBytesPerSecond_<device>,
+// DiskWriteBytesPerSecond_<device>, DiskReadsPerSecond_<device> and
+// DiskWritesPerSecond_<device>.
+type diskIOCollector struct {
+	interval time.Duration                                                                      // Default interval between two runs
+	counters func(ctx context.Context, names ...string) (map[string]disk.IOCountersStat, error) // Reads the IO counters; replaced in tests
+	now      func() time.Time                                                                   // Current time; replaced in tests
+
+	prev   map[string]disk.IOCountersStat // Counters of the previous run by device
+	prevAt time.Time                      // Time of the previous run
+}
+
+// newDiskIOCollector creates the collector of the disk IO rates.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *diskIOCollector: Collector ready to be registered
+func newDiskIOCollector(interval time.Duration) *diskIOCollector {
+	return &diskIOCollector{interval: interval, counters: disk.IOCountersWithContext, now: time.Now}
+}
+
+// Name implements Collector.
+func (c *diskIOCollector) Name() string { return diskIOCollectorName }
+
+// Interval implements Collector.
+func (c *diskIOCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. The first run only takes the initial sample, and
+// a device whose counters went down since the previous run is skipped once.
+func (c *diskIOCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	cur, err := c.counters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("disk IO counters: %w", err)
+	}
+	now := c.now()
+	prev, elapsed := c.prev, now.Sub(c.prevAt).Seconds()
+	c.prev, c.prevAt = cur, now
+	if prev == nil || elapsed <= 0 {
+		return nil, nil
+	}
+
+	var out []Metrics
+	for _, name := range slices.Sorted(maps.Keys(cur)) {
+		before, ok := prev[name]
+		if !ok {
+			continue
+		}
+		after := cur[name]
+		readBytes, ok1 := counterIncrease(before.ReadBytes, after.ReadBytes)
+		writeBytes, ok2 := counterIncrease(before.WriteBytes, after.WriteBytes)
+		reads, ok3 := counterIncrease(before.ReadCount, after.ReadCount)
+		writes, ok4 := counterIncrease(before.WriteCount, after.WriteCount)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			continue
+		}
+		device := instanceName(name)
+		out = append(out,
+			gauge("DiskReadBytesPerSecond_"+device, float64(readBytes)/elapsed),
+			gauge("DiskWriteBytesPerSecond_"+device, float64(writeBytes)/elapsed),
+			gauge("DiskReadsPerSecond_"+device, float64(reads)/elapsed),
+			gauge("DiskWritesPerSecond_"+device, float64(writes)/elapsed),
+		)
+	}
+	return out, nil
+}
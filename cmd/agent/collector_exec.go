@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/config"
+)
+
+// execCollectorName is the name of the collector of the metrics written by commands.
+const execCollectorName = "exec"
+
+// execWaitDelay is how long a command that was killed or has exited may keep its
+// output open, e.g. through a child process, before the agent stops reading it.
+const execWaitDelay = time.Second
+
+// execCommand is a command run by the exec collector.
+type execCommand struct {
+	args    []string      // Program and its arguments
+	timeout time.Duration // Time after which the command is killed, 0 for the collector timeout
+}
+
+// execCollector runs the configured commands on every run and reports the metrics
+// they write to their standard output, one "name type value" line per metric, e.g.
+// "QueueDepth gauge 42" or "BackupsDone counter 17". Counters are running totals.
+// The commands are run directly, not through a shell, and concurrently.
+type execCollector struct {
+	interval time.Duration                                            // Default interval between two runs
+	commands []execCommand                                            // Commands to run
+	run      func(ctx context.Context, args []string) ([]byte, error) // Runs a command and returns its output; replaced in tests
+	custom   customMetrics                                            // Counter totals of the previous run
+}
+
+// newExecCollector creates the collector of the metrics written by commands.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//   - commands: Commands to run
+//
+// Returns:
+//   - *execCollector: Collector ready to be registered
+func newExecCollector(interval time.Duration, commands []execCommand) *execCollector {
+	return &execCollector{interval: interval, commands: commands, run: runCommand}
+}
+
+// Name implements Collector.
+func (c *execCollector) Name() string { return execCollectorName }
+
+// Interval implements Collector.
+func (c *execCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. The metrics of a command that fails are not
+// reported, but the lines it wrote before an invalid line are.
+func (c *execCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	samples := make([][]customSample, len(c.commands))
+	errs := make([]error, len(c.commands))
+	var wg sync.WaitGroup
+	for i, cmd := range c.commands {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCtx := ctx
+			if cmd.timeout > 0 {
+				var cancel context.CancelFunc
+				runCtx, cancel = context.WithTimeout(ctx, cmd.timeout)
+				defer cancel()
+			}
+			out, err := c.run(runCtx, cmd.args)
+			if err != nil {
+				if runCtx.Err() != nil {
+					err = fmt.Errorf("%w: %w", runCtx.Err(), err)
+				}
+				errs[i] = fmt.Errorf("command %s: %w", filepath.Base(cmd.args[0]), err)
+				return
+			}
+			samples[i], err = parseCustomLines(out)
+			if err != nil {
+				errs[i] = fmt.Errorf("output of command %s: %w", filepath.Base(cmd.args[0]), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	out, err := c.custom.metrics(joinSamples(samples))
+	return out, errors.Join(append(errs, err)...)
+}
+
+// joinSamples concatenates the samples of several sources in order.
+func joinSamples(sources [][]customSample) []customSample {
+	var all []customSample
+	for _, s := range sources {
+		all = append(all, s...)
+	}
+	return all
+}
+
+// runCommand runs a command and returns its standard output. If the command
+// fails, the error includes the end of its standard error.
+//
+// Parameters:
+//   - ctx: Context whose cancellation kills the command
+//   - args: Program and its arguments
+//
+// Returns:
+//   - []byte: Standard output
+//   - error: Error if the command could not be started or did not exit with status 0
+func runCommand(ctx context.Context, args []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = execWaitDelay
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			const maxStderr = 512
+			if len(msg) > maxStderr {
+				msg = "..." + msg[len(msg)-maxStderr:]
+			}
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// parseExecCommands builds the commands of the exec collector. The commands of
+// the -exec flag replace those of the configuration file.
+//
+// Parameters:
+//   - list: Commands separated by ";", each split at spaces, e.g.
+//     "/usr/local/bin/queue-depth.sh;/usr/local/bin/backups.sh --age"
+//   - settings: Commands of the configuration file, used if list is empty
+//
+// Returns:
+//   - []execCommand: Commands to run
+//   - error: Error if a configured command is empty or its timeout is invalid
+func parseExecCommands(list string, settings []config.ExecConfig) ([]execCommand, error) {
+	var commands []execCommand
+	if strings.TrimSpace(list) != "" {
+		for _, line := range strings.Split(list, ";") {
+			if args := strings.Fields(line); len(args) > 0 {
+				commands = append(commands, execCommand{args: args})
+			}
+		}
+		return commands, nil
+	}
+	for i, s := range settings {
+		if len(s.Command) == 0 || s.Command[0] == "" {
+			return nil, fmt.Errorf("exec command %d is empty", i)
+		}
+		cmd := execCommand{args: s.Command}
+		if s.Timeout != "" {
+			d, err := time.ParseDuration(s.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout of exec command %s: %w", s.Command[0], err)
+			}
+			if d <= 0 {
+				return nil, fmt.Errorf("timeout of exec command %s must be positive, got %v", s.Command[0], d)
+			}
+			cmd.timeout = d
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseCustomLines(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      []customSample
+		expectedError string
+	}{
+		{name: "Empty", input: ""},
+		{
+			name:  "Valid",
+			input: "# queue state\nQueueDepth gauge 42\n\n  BackupsDone   counter 17 \nTemperature gauge -3.5e1\n",
+			expected: []customSample{
+				{Name: "QueueDepth", MType: "gauge", Value: 42},
+				{Name: "BackupsDone", MType: "counter", Value: 17},
+				{Name: "Temperature", MType: "gauge", Value: -35},
+			},
+		},
+		{
+			name:          "Invalid lines are skipped",
+			input:         "QueueDepth 42\nA gauge 1\nB histogram 1\nC gauge many\nD counter -1\nE gauge NaN\nF/G gauge 1\n",
+			expected:      []customSample{{Name: "A", MType: "gauge", Value: 1}},
+			expectedError: "line 1: expected \"name type value\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, err := parseCustomLines([]byte(tt.input))
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.expectedError)
+				// Every invalid line is reported
+				assert.Len(t, strings.Split(err.Error(), "\n"), 6)
+			}
+			assert.Equal(t, tt.expected, samples)
+		})
+	}
+}
+
+func Test_customMetrics(t *testing.T) {
+	var c customMetrics
+	ms, err := c.metrics([]customSample{
+		{Name: "Depth", MType: "gauge", Value: 3},
+		{Name: "Done", MType: "counter", Value: 10.5},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Depth": 3, "Done": 0}, metricValues(t, ms), "a new counter starts at 0")
+
+	ms, err = c.metrics([]customSample{
+		{Name: "Done", MType: "counter", Value: 12.25},
+		{Name: "Done", MType: "gauge", Value: 1},
+	})
+	assert.ErrorContains(t, err, "metric Done reported more than once")
+	assert.Equal(t, map[string]float64{"Done": 2}, metricValues(t, ms))
+
+	ms, err = c.metrics([]customSample{{Name: "Done", MType: "counter", Value: 13.75}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Done": 1}, metricValues(t, ms), "fractions add up over runs")
+
+	ms, err = c.metrics([]customSample{{Name: "Done", MType: "counter", Value: 4}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Done": 0}, metricValues(t, ms), "a reset total adds nothing")
+}
+
+func Test_execCollector(t *testing.T) {
+	outputs := map[string]func(ctx context.Context) ([]byte, error){
+		"/opt/queue.sh": func(context.Context) ([]byte, error) {
+			return []byte("QueueDepth gauge 7\nJobsDone counter 100\n"), nil
+		},
+		"/opt/broken.sh": func(context.Context) ([]byte, error) {
+			return nil, errors.New("exit status 1: no such queue")
+		},
+		"/opt/slow.sh": func(ctx context.Context) ([]byte, error) {
+			<-ctx.Done()
+			return nil, errors.New("signal: killed")
+		},
+		"/opt/partial.sh": func(context.Context) ([]byte, error) {
+			return []byte("Backups gauge 3\nBackupAge gauge old\n"), nil
+		},
+	}
+	c := newExecCollector(time.Second, []execCommand{
+		{args: []string{"/opt/queue.sh", "--all"}},
+		{args: []string{"/opt/broken.sh"}},
+		{args: []string{"/opt/slow.sh"}, timeout: 10 * time.Millisecond},
+		{args: []string{"/opt/partial.sh"}},
+	})
+	c.run = func(ctx context.Context, args []string) ([]byte, error) {
+		return outputs[args[0]](ctx)
+	}
+
+	ms, err := c.Collect(t.Context())
+	assert.ErrorContains(t, err, "command broken.sh: exit status 1: no such queue")
+	assert.ErrorContains(t, err, "command slow.sh: context deadline exceeded")
+	assert.ErrorContains(t, err, "output of command partial.sh: line 2: invalid value \"old\"")
+	assert.Equal(t, map[string]float64{"QueueDepth": 7, "JobsDone": 0, "Backups": 3}, metricValues(t, ms))
+
+	outputs["/opt/queue.sh"] = func(context.Context) ([]byte, error) {
+		return []byte("QueueDepth gauge 5\nJobsDone counter 104\n"), nil
+	}
+	ms, _ = c.Collect(t.Context())
+	assert.Equal(t, map[string]float64{"QueueDepth": 5, "JobsDone": 4, "Backups": 3}, metricValues(t, ms))
+}
+
+func Test_runCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+
+	out, err := runCommand(t.Context(), []string{"sh", "-c", "echo QueueDepth gauge 1"})
+	require.NoError(t, err)
+	assert.Equal(t, "QueueDepth gauge 1\n", string(out))
+
+	_, err = runCommand(t.Context(), []string{"sh", "-c", "echo queue is gone >&2; exit 3"})
+	assert.ErrorContains(t, err, "exit status 3: queue is gone")
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = runCommand(ctx, []string{"sh", "-c", "sleep 10"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second, "the command is killed at the deadline")
+}
+
+func Test_parseExecCommands(t *testing.T) {
+	tests := []struct {
+		name          string
+		list          string
+		settings      []config.ExecConfig
+		expected      []execCommand
+		expectedError string
+	}{
+		{name: "None"},
+		{
+			name:     "Flag",
+			list:     " /opt/queue.sh --all ;; /opt/backups.sh",
+			settings: []config.ExecConfig{{Command: []string{"/opt/ignored.sh"}}},
+			expected: []execCommand{{args: []string{"/opt/queue.sh", "--all"}}, {args: []string{"/opt/backups.sh"}}},
+		},
+		{
+			name: "Config file",
+			settings: []config.ExecConfig{
+				{Command: []string{"/opt/queue.sh", "--queue", "high priority"}, Timeout: "5s"},
+				{Command: []string{"/opt/backups.sh"}},
+			},
+			expected: []execCommand{
+				{args: []string{"/opt/queue.sh", "--queue", "high priority"}, timeout: 5 * time.Second},
+				{args: []string{"/opt/backups.sh"}},
+			},
+		},
+		{name: "Empty command", settings: []config.ExecConfig{{Timeout: "5s"}}, expectedError: "exec command 0 is empty"},
+		{name: "Invalid timeout", settings: []config.ExecConfig{{Command: []string{"/opt/queue.sh"}, Timeout: "soon"}}, expectedError: "invalid timeout of exec command /opt/queue.sh"},
+		{name: "Zero timeout", settings: []config.ExecConfig{{Command: []string{"/opt/queue.sh"}, Timeout: "0s"}}, expectedError: "must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := parseExecCommands(tt.list, tt.settings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, commands)
+		})
+	}
+}
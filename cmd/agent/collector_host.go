@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// Names of the collectors of host load and swap metrics.
+const (
+	loadCollectorName = "load"
+	swapCollectorName = "swap"
+)
+
+// gauge returns a gauge metric.
+//
+// Parameters:
+//   - name: Metric name
+//   - value: Current value
+//
+// Returns:
+//   - Metrics: The gauge
+func gauge(name string, value float64) Metrics {
+	return Metrics{ID: name, MType: "gauge", Value: &value}
+}
+
+// counter returns a counter metric.
+//
+// Parameters:
+//   - name: Metric name
+//   - delta: Increment since the previous run
+//
+// Returns:
+//   - Metrics: The counter
+func counter(name string, delta int64) Metrics {
+	return Metrics{ID: name, MType: "counter", Delta: &delta}
+}
+
+// instanceName turns a mount point, device, interface or process name into the
+// suffix of a per-instance metric name: letters and digits are kept, any other
+// character becomes "_", and leading and trailing slashes are dropped. The root
+// mount point "/" becomes "root", e.g. "/var/lib" becomes "var_lib".
+//
+// Parameters:
+//   - name: Name of the instance as reported by the system
+//
+// Returns:
+//   - string: Suffix of the metric name
+func instanceName(name string) string {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return "root"
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// counterIncrease returns how much a cumulative system counter grew between two
+// samples.
+//
+// Parameters:
+//   - prev: Value of the previous sample
+//   - cur: Value of the current sample
+//
+// Returns:
+//   - uint64: Increase of the counter
+//   - bool: false if the counter went down, i.e. it was reset or wrapped around
+func counterIncrease(prev, cur uint64) (uint64, bool) {
+	if cur < prev {
+		return 0, false
+	}
+	return cur - prev, true
+}
+
+// loadCollector reports the system load averages over 1, 5 and 15 minutes.
+type loadCollector struct {
+	interval time.Duration                                    // Default interval between two runs
+	avg      func(ctx context.Context) (*load.AvgStat, error) // Reads the load averages; replaced in tests
+}
+
+// newLoadCollector creates the collector of the load averages.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *loadCollector: Collector ready to be registered
+func newLoadCollector(interval time.Duration) *loadCollector {
+	return &loadCollector{interval: interval, avg: load.AvgWithContext}
+}
+
+// Name implements Collector.
+func (c *loadCollector) Name() string { return loadCollectorName }
+
+// Interval implements Collector.
+func (c *loadCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector.
+func (c *loadCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	avg, err := c.avg(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load averages: %w", err)
+	}
+	return []Metrics{
+		gauge("LoadAverage1", avg.Load1),
+		gauge("LoadAverage5", avg.Load5),
+		gauge("LoadAverage15", avg.Load15),
+	}, nil
+}
+
+// swapCollector reports the size and usage of the swap space.
+type swapCollector struct {
+	interval time.Duration                                          // Default interval between two runs
+	swap     func(ctx context.Context) (*mem.SwapMemoryStat, error) // Reads the swap usage; replaced in tests
+}
+
+// newSwapCollector creates the collector of the swap usage.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *swapCollector: Collector ready to be registered
+func newSwapCollector(interval time.Duration) *swapCollector {
+	return &swapCollector{interval: interval, swap: mem.SwapMemoryWithContext}
+}
+
+// Name implements Collector.
+func (c *swapCollector) Name() string { return swapCollectorName }
+
+// Interval implements Collector.
+func (c *swapCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector.
+func (c *swapCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	swap, err := c.swap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("swap stats: %w", err)
+	}
+	return []Metrics{
+		gauge("SwapTotal", float64(swap.Total)),
+		gauge("SwapUsed", float64(swap.Used)),
+		gauge("SwapFree", float64(swap.Free)),
+		gauge("SwapUsedPercent", swap.UsedPercent),
+	}, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// metricValues returns the gauge values and counter increments of collected metrics by name.
+func metricValues(t *testing.T, ms []Metrics) map[string]float64 {
+	values := make(map[string]float64, len(ms))
+	for _, m := range ms {
+		require.NotContains(t, values, m.ID, "metric reported twice")
+		switch m.MType {
+		case "gauge":
+			values[m.ID] = *m.Value
+		case "counter":
+			values[m.ID] = float64(*m.Delta)
+		}
+	}
+	return values
+}
+
+// fakeClock is a clock advanced by the tests.
+type fakeClock struct{ now time.Time }
+
+func newFakeClock() *fakeClock { return &fakeClock{now: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)} }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func Test_instanceName(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "/", expected: "root"},
+		{input: "/var/lib/docker", expected: "var_lib_docker"},
+		{input: "/mnt/data/", expected: "mnt_data"},
+		{input: "C:", expected: "C_"},
+		{input: "eth0", expected: "eth0"},
+		{input: "br-1f2e.100", expected: "br_1f2e_100"},
+		{input: "nvme0n1", expected: "nvme0n1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.expected, instanceName(tt.input))
+		})
+	}
+}
+
+func Test_diskCollector(t *testing.T) {
+	c := newDiskCollector(time.Second)
+	c.partitions = func(_ context.Context, all bool) ([]disk.PartitionStat, error) {
+		assert.False(t, all, "only physical file systems are listed")
+		return []disk.PartitionStat{
+			{Device: "/dev/sda1", Mountpoint: "/"},
+			{Device: "/dev/sdb1", Mountpoint: "/var/lib"},
+			{Device: "/dev/sdb1", Mountpoint: "/var/lib"},
+			{Device: "/dev/sdc1", Mountpoint: "/mnt/broken"},
+			{Device: "none", Mountpoint: "/proc/empty"},
+		}, nil
+	}
+	c.usage = func(_ context.Context, path string) (*disk.UsageStat, error) {
+		switch path {
+		case "/":
+			return &disk.UsageStat{Total: 100, Free: 40, Used: 60, UsedPercent: 60}, nil
+		case "/var/lib":
+			return &disk.UsageStat{Total: 200, Free: 150, Used: 50, UsedPercent: 25}, nil
+		case "/mnt/broken":
+			return nil, errors.New("input/output error")
+		default:
+			return &disk.UsageStat{}, nil
+		}
+	}
+
+	ms, err := c.Collect(t.Context())
+	assert.ErrorContains(t, err, "disk usage of /mnt/broken: input/output error")
+	assert.Equal(t, map[string]float64{
+		"DiskTotal_root":          100,
+		"DiskFree_root":           40,
+		"DiskUsed_root":           60,
+		"DiskUsedPercent_root":    60,
+		"DiskTotal_var_lib":       200,
+		"DiskFree_var_lib":        150,
+		"DiskUsed_var_lib":        50,
+		"DiskUsedPercent_var_lib": 25,
+	}, metricValues(t, ms), "the other mounts are reported when one fails")
+
+	c.partitions = func(context.Context, bool) ([]disk.PartitionStat, error) { return nil, errors.New("no mtab") }
+	_, err = c.Collect(t.Context())
+	assert.ErrorContains(t, err, "disk partitions: no mtab")
+}
+
+func Test_diskIOCollector(t *testing.T) {
+	clock := newFakeClock()
+	samples := []map[string]disk.IOCountersStat{
+		{"sda": {ReadBytes: 1000, WriteBytes: 2000, ReadCount: 10, WriteCount: 20}},
+		{
+			"sda": {ReadBytes: 3000, WriteBytes: 6000, ReadCount: 14, WriteCount: 40},
+			"sdb": {ReadBytes: 10, WriteBytes: 10, ReadCount: 1, WriteCount: 1},
+		},
+		{
+			// The counters of sda were reset
+			"sda": {ReadBytes: 500, WriteBytes: 6000, ReadCount: 14, WriteCount: 40},
+			"sdb": {ReadBytes: 110, WriteBytes: 10, ReadCount: 2, WriteCount: 1},
+		},
+	}
+	c := newDiskIOCollector(time.Second)
+	c.now = clock.Now
+	c.counters = func(_ context.Context, names ...string) (map[string]disk.IOCountersStat, error) {
+		assert.Empty(t, names, "all devices are read")
+		sample := samples[0]
+		samples = samples[1:]
+		return sample, nil
+	}
+
+	ms, err := c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, ms, "the first run only takes a sample")
+
+	clock.Advance(2 * time.Second)
+	ms, err = c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"DiskReadBytesPerSecond_sda":  1000,
+		"DiskWriteBytesPerSecond_sda": 2000,
+		"DiskReadsPerSecond_sda":      2,
+		"DiskWritesPerSecond_sda":     10,
+	}, metricValues(t, ms), "a new device is reported from its second sample")
+
+	clock.Advance(4 * time.Second)
+	ms, err = c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"DiskReadBytesPerSecond_sdb":  25,
+		"DiskWriteBytesPerSecond_sdb": 0,
+		"DiskReadsPerSecond_sdb":      0.25,
+		"DiskWritesPerSecond_sdb":     0,
+	}, metricValues(t, ms))
+
+	c.counters = func(context.Context, ...string) (map[string]disk.IOCountersStat, error) {
+		return nil, errors.New("no diskstats")
+	}
+	_, err = c.Collect(t.Context())
+	assert.ErrorContains(t, err, "disk IO counters: no diskstats")
+}
+
+func Test_netCollector(t *testing.T) {
+	clock := newFakeClock()
+	samples := [][]net.IOCountersStat{
+		{{Name: "eth0", BytesSent: 1000, BytesRecv: 5000, Errin: 3, Dropout: 1}},
+		{
+			{Name: "eth0", BytesSent: 3000, BytesRecv: 9000, Errin: 5, Errout: 1, Dropin: 2, Dropout: 1},
+			{Name: "veth1a2b", BytesSent: 100, Errin: 7},
+		},
+		{
+			// eth0 was recreated
+			{Name: "eth0", BytesSent: 10, BytesRecv: 20},
+			{Name: "veth1a2b", BytesSent: 300, Errin: 8},
+		},
+	}
+	c := newNetCollector(time.Second)
+	c.now = clock.Now
+	c.counters = func(_ context.Context, pernic bool) ([]net.IOCountersStat, error) {
+		assert.True(t, pernic, "interfaces are reported separately")
+		sample := samples[0]
+		samples = samples[1:]
+		return sample, nil
+	}
+
+	ms, err := c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"NetErrorsIn_eth0":  0,
+		"NetErrorsOut_eth0": 0,
+		"NetDropsIn_eth0":   0,
+		"NetDropsOut_eth0":  0,
+	}, metricValues(t, ms), "the first run reports the counters without throughput")
+
+	clock.Advance(2 * time.Second)
+	ms, err = c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"NetErrorsIn_eth0":           2,
+		"NetErrorsOut_eth0":          1,
+		"NetDropsIn_eth0":            2,
+		"NetDropsOut_eth0":           0,
+		"NetBytesSentPerSecond_eth0": 1000,
+		"NetBytesRecvPerSecond_eth0": 2000,
+		"NetErrorsIn_veth1a2b":       0,
+		"NetErrorsOut_veth1a2b":      0,
+		"NetDropsIn_veth1a2b":        0,
+		"NetDropsOut_veth1a2b":       0,
+	}, metricValues(t, ms))
+
+	clock.Advance(time.Second)
+	ms, err = c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"NetErrorsIn_eth0":               0,
+		"NetErrorsOut_eth0":              0,
+		"NetDropsIn_eth0":                0,
+		"NetDropsOut_eth0":               0,
+		"NetErrorsIn_veth1a2b":           1,
+		"NetErrorsOut_veth1a2b":          0,
+		"NetDropsIn_veth1a2b":            0,
+		"NetDropsOut_veth1a2b":           0,
+		"NetBytesSentPerSecond_veth1a2b": 200,
+		"NetBytesRecvPerSecond_veth1a2b": 0,
+	}, metricValues(t, ms), "reset counters add nothing")
+}
+
+func Test_loadCollector(t *testing.T) {
+	c := newLoadCollector(time.Second)
+	c.avg = func(context.Context) (*load.AvgStat, error) {
+		return &load.AvgStat{Load1: 0.5, Load5: 1.25, Load15: 2}, nil
+	}
+	ms, err := c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"LoadAverage1": 0.5, "LoadAverage5": 1.25, "LoadAverage15": 2}, metricValues(t, ms))
+
+	c.avg = func(context.Context) (*load.AvgStat, error) { return nil, errors.New("not implemented yet") }
+	_, err = c.Collect(t.Context())
+	assert.ErrorContains(t, err, "load averages: not implemented yet")
+}
+
+func Test_swapCollector(t *testing.T) {
+	c := newSwapCollector(time.Second)
+	c.swap = func(context.Context) (*mem.SwapMemoryStat, error) {
+		return &mem.SwapMemoryStat{Total: 4096, Used: 1024, Free: 3072, UsedPercent: 25}, nil
+	}
+	ms, err := c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"SwapTotal": 4096, "SwapUsed": 1024, "SwapFree": 3072, "SwapUsedPercent": 25}, metricValues(t, ms))
+
+	c.swap = func(context.Context) (*mem.SwapMemoryStat, error) { return nil, errors.New("no meminfo") }
+	_, err = c.Collect(t.Context())
+	assert.ErrorContains(t, err, "swap stats: no meminfo")
+}
+
+func Test_metricMetadata_Families(t *testing.T) {
+	tests := []struct {
+		name                string
+		mtype               string
+		expectedDescription string
+		expectedUnit        string
+	}{
+		{name: "LoadAverage5", mtype: "gauge", expectedDescription: "System load average over the last 5 minutes", expectedUnit: "processes"},
+		{name: "DiskUsedPercent_var_lib", mtype: "gauge", expectedDescription: "Share of the file system mounted at var_lib in use", expectedUnit: "percent"},
+		{name: "DiskUsed_root", mtype: "gauge", expectedDescription: "Used space of the file system mounted at root", expectedUnit: "bytes"},
+		{name: "NetDropsIn_eth0", mtype: "counter", expectedDescription: "Incoming packets dropped by network interface eth0", expectedUnit: "packets"},
+		{name: "ProcessCPUPercent_nginx", mtype: "gauge", expectedDescription: "CPU usage of the nginx processes in percent of one core", expectedUnit: "percent"},
+		{name: "CollectorErrors_disk", mtype: "counter", expectedDescription: "Failed or timed out runs of the disk collector", expectedUnit: "runs"},
+		{name: "NetDropsIn_eth0", mtype: "gauge"},
+		{name: "DiskTotal_", mtype: "gauge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.mtype, func(t *testing.T) {
+			md := metricMetadata(tt.name, tt.mtype)
+			if tt.expectedDescription == "" {
+				assert.Nil(t, md)
+				return
+			}
+			require.NotNil(t, md)
+			assert.Equal(t, tt.name, md.ID)
+			assert.Equal(t, tt.expectedDescription, md.Description)
+			assert.Equal(t, tt.expectedUnit, md.Unit)
+		})
+	}
+}
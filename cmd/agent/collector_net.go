@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// netCollectorName is the name of the collector of the network interface metrics.
+const netCollectorName = "net"
+
+// netCollector reports the throughput and the errors of every network interface.
+// The throughput gauges NetBytesSentPerSecond_<interface> and
+// NetBytesRecvPerSecond_<interface> are computed from the system counters of two
+// consecutive runs; the errors and dropped packets are counters that grow by the
+// increase of the system counters: NetErrorsIn_<interface>, NetErrorsOut_<interface>,
+// NetDropsIn_<interface> and NetDropsOut_<interface>.
+type netCollector struct {
+	interval time.Duration                                                        // Default interval between two runs
+	counters func(ctx context.Context, pernic bool) ([]net.IOCountersStat, error) // Reads the interface counters; replaced in tests
+	now      func() time.Time                                                     // Current time; replaced in tests
+
+	prev   map[string]net.IOCountersStat // Counters of the previous run by interface
+	prevAt time.Time                     // Time of the previous run
+}
+
+// newNetCollector creates the collector of the network interface metrics.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *netCollector: Collector ready to be registered
+func newNetCollector(interval time.Duration) *netCollector {
+	return &netCollector{interval: interval, counters: net.IOCountersWithContext, now: time.Now}
+}
+
+// Name implements Collector.
+func (c *netCollector) Name() string { return netCollectorName }
+
+// Interval implements Collector.
+func (c *netCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. The first run reports the error counters of every
+// interface with an increment of 0 and no throughput. A system counter that went
+// down since the previous run, e.g. because the interface was recreated, adds
+// nothing and skips the throughput once.
+func (c *netCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	stats, err := c.counters(ctx, true)
+	if err != nil {
+		return nil, fmt.Errorf("network counters: %w", err)
+	}
+	now := c.now()
+	prev, elapsed := c.prev, now.Sub(c.prevAt).Seconds()
+	c.prev, c.prevAt = make(map[string]net.IOCountersStat, len(stats)), now
+
+	var out []Metrics
+	for _, cur := range stats {
+		c.prev[cur.Name] = cur
+		iface := instanceName(cur.Name)
+		before, seen := prev[cur.Name]
+
+		// A new interface starts its counters at 0
+		increase := func(prev, cur uint64) int64 {
+			if !seen {
+				return 0
+			}
+			inc, _ := counterIncrease(prev, cur)
+			return int64(inc)
+		}
+		out = append(out,
+			counter("NetErrorsIn_"+iface, increase(before.Errin, cur.Errin)),
+			counter("NetErrorsOut_"+iface, increase(before.Errout, cur.Errout)),
+			counter("NetDropsIn_"+iface, increase(before.Dropin, cur.Dropin)),
+			counter("NetDropsOut_"+iface, increase(before.Dropout, cur.Dropout)),
+		)
+
+		if !seen || elapsed <= 0 {
+			continue
+		}
+		sent, ok1 := counterIncrease(before.BytesSent, cur.BytesSent)
+		recv, ok2 := counterIncrease(before.BytesRecv, cur.BytesRecv)
+		if ok1 && ok2 {
+			out = append(out,
+				gauge("NetBytesSentPerSecond_"+iface, float64(sent)/elapsed),
+				gauge("NetBytesRecvPerSecond_"+iface, float64(recv)/elapsed),
+			)
+		}
+	}
+	return out, nil
+}
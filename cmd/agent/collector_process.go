@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// processCollectorName is the name of the collector of the per-process metrics.
+const processCollectorName = "process"
+
+// processInfo is what the process collector reads about one running process.
+type processInfo struct {
+	pid        int32   // Process ID
+	name       string  // Executable name
+	cpuSeconds float64 // User and system CPU time used since the process started
+	rss        uint64  // Resident set size in bytes
+	threads    int32   // Number of threads
+}
+
+// processCollector reports, for every configured process name, the processes
+// running under that name: ProcessCount_<name>, ProcessCPUPercent_<name>,
+// ProcessMemoryRSS_<name> in bytes and ProcessThreads_<name>, the last three summed
+// over the processes.
+type processCollector struct {
+	interval time.Duration                                                                   // Default interval between two runs
+	names    []string                                                                        // Process names to report
+	list     func(ctx context.Context, wanted func(name string) bool) ([]processInfo, error) // Reads the processes with a wanted name; replaced in tests
+	now      func() time.Time                                                                // Current time; replaced in tests
+
+	prevProcs map[int32]processInfo // Processes of the previous run by process ID
+	prevAt    time.Time             // Time of the previous run
+}
+
+// newProcessCollector creates the collector of the per-process metrics.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//   - names: Process names to report, e.g. from the -processes flag
+//
+// Returns:
+//   - *processCollector: Collector ready to be registered
+func newProcessCollector(interval time.Duration, names []string) *processCollector {
+	return &processCollector{interval: interval, names: names, list: listProcesses, now: time.Now}
+}
+
+// Name implements Collector.
+func (c *processCollector) Name() string { return processCollectorName }
+
+// Interval implements Collector.
+func (c *processCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. ProcessCount_<name> is reported even if no process
+// runs under the name. The CPU usage, in percent of one core, is computed from the
+// CPU time the processes of the previous run used since then, so the first run
+// does not report it.
+func (c *processCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	wanted := make(map[string]bool, len(c.names))
+	for _, name := range c.names {
+		wanted[name] = true
+	}
+	procs, err := c.list(ctx, func(name string) bool { return wanted[name] })
+	if err != nil {
+		return nil, fmt.Errorf("processes: %w", err)
+	}
+	now := c.now()
+	prev, elapsed := c.prevProcs, now.Sub(c.prevAt).Seconds()
+	c.prevProcs, c.prevAt = make(map[int32]processInfo, len(procs)), now
+
+	type totals struct {
+		count   int
+		cpu     float64
+		rss     uint64
+		threads int32
+	}
+	byName := make(map[string]*totals, len(c.names))
+	for _, name := range c.names {
+		byName[name] = &totals{}
+	}
+	for _, p := range procs {
+		t, ok := byName[p.name]
+		if !ok {
+			continue
+		}
+		c.prevProcs[p.pid] = p
+		t.count++
+		t.rss += p.rss
+		t.threads += p.threads
+		// A process ID reused by another process is not compared
+		if before, ok := prev[p.pid]; ok && before.name == p.name && p.cpuSeconds >= before.cpuSeconds {
+			t.cpu += p.cpuSeconds - before.cpuSeconds
+		}
+	}
+
+	var out []Metrics
+	for _, name := range c.names {
+		t, suffix := byName[name], instanceName(name)
+		out = append(out,
+			gauge("ProcessCount_"+suffix, float64(t.count)),
+			gauge("ProcessMemoryRSS_"+suffix, float64(t.rss)),
+			gauge("ProcessThreads_"+suffix, float64(t.threads)),
+		)
+		if prev != nil && elapsed > 0 {
+			out = append(out, gauge("ProcessCPUPercent_"+suffix, 100*t.cpu/elapsed))
+		}
+	}
+	return out, nil
+}
+
+// listProcesses reads the running processes with a wanted name using gopsutil.
+// Processes that exit while they are read are skipped.
+//
+// Parameters:
+//   - ctx: Context that cancels the listing
+//   - wanted: Reports whether a process name is of interest
+//
+// Returns:
+//   - []processInfo: The processes with a wanted name
+//   - error: Error if the processes cannot be listed
+func listProcesses(ctx context.Context, wanted func(name string) bool) ([]processInfo, error) {
+	procs, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []processInfo
+	for _, p := range procs {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+		name, err := p.NameWithContext(ctx)
+		if err != nil || !wanted(name) {
+			continue
+		}
+		info := processInfo{pid: p.Pid, name: name}
+		if times, err := p.TimesWithContext(ctx); err == nil {
+			info.cpuSeconds = times.User + times.System
+		}
+		if mem, err := p.MemoryInfoWithContext(ctx); err == nil {
+			info.rss = mem.RSS
+		}
+		if threads, err := p.NumThreadsWithContext(ctx); err == nil {
+			info.threads = threads
+		}
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+// parseProcessNames splits a comma-separated list of process names.
+//
+// Parameters:
+//   - list: Process names, e.g. "nginx, postgres"
+//
+// Returns:
+//   - []string: Names without surrounding spaces, empty names and duplicates
+func parseProcessNames(list string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_processCollector(t *testing.T) {
+	clock := newFakeClock()
+	samples := [][]processInfo{
+		{
+			{pid: 10, name: "nginx", cpuSeconds: 5, rss: 1000, threads: 1},
+			{pid: 11, name: "nginx", cpuSeconds: 1, rss: 2000, threads: 2},
+			{pid: 20, name: "bash", cpuSeconds: 100, rss: 9000, threads: 1},
+		},
+		{
+			{pid: 10, name: "nginx", cpuSeconds: 6, rss: 1500, threads: 1},
+			// Started since the previous run, its CPU time is not counted yet
+			{pid: 12, name: "nginx", cpuSeconds: 3, rss: 500, threads: 4},
+			{pid: 30, name: "postgres", cpuSeconds: 7, rss: 4000, threads: 1},
+		},
+	}
+	c := newProcessCollector(time.Second, []string{"nginx", "postgres", "redis-server"})
+	c.now = clock.Now
+	c.list = func(_ context.Context, wanted func(string) bool) ([]processInfo, error) {
+		assert.True(t, wanted("nginx"))
+		assert.False(t, wanted("bash"))
+		sample := samples[0]
+		samples = samples[1:]
+		return sample, nil
+	}
+
+	ms, err := c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"ProcessCount_nginx":            2,
+		"ProcessMemoryRSS_nginx":        3000,
+		"ProcessThreads_nginx":          3,
+		"ProcessCount_postgres":         0,
+		"ProcessMemoryRSS_postgres":     0,
+		"ProcessThreads_postgres":       0,
+		"ProcessCount_redis_server":     0,
+		"ProcessMemoryRSS_redis_server": 0,
+		"ProcessThreads_redis_server":   0,
+	}, metricValues(t, ms), "the first run reports no CPU usage")
+
+	clock.Advance(2 * time.Second)
+	ms, err = c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"ProcessCount_nginx":             2,
+		"ProcessMemoryRSS_nginx":         2000,
+		"ProcessThreads_nginx":           5,
+		"ProcessCPUPercent_nginx":        50,
+		"ProcessCount_postgres":          1,
+		"ProcessMemoryRSS_postgres":      4000,
+		"ProcessThreads_postgres":        1,
+		"ProcessCPUPercent_postgres":     0,
+		"ProcessCount_redis_server":      0,
+		"ProcessMemoryRSS_redis_server":  0,
+		"ProcessThreads_redis_server":    0,
+		"ProcessCPUPercent_redis_server": 0,
+	}, metricValues(t, ms))
+
+	c.list = func(context.Context, func(string) bool) ([]processInfo, error) {
+		return nil, errors.New("permission denied")
+	}
+	_, err = c.Collect(t.Context())
+	assert.ErrorContains(t, err, "processes: permission denied")
+}
+
+func Test_listProcesses(t *testing.T) {
+	procs, err := listProcesses(t.Context(), func(string) bool { return true })
+	require.NoError(t, err)
+	assert.NotEmpty(t, procs, "at least the test binary is running")
+}
+
+func Test_parseProcessNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{name: "Empty", input: ""},
+		{name: "One", input: "nginx", expected: []string{"nginx"}},
+		{name: "Several", input: " nginx ,postgres,,nginx ", expected: []string{"nginx", "postgres"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseProcessNames(tt.input))
+		})
+	}
+}
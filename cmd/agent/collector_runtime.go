@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+// runtimeCollectorName is the name of the collector of the Go runtime metrics.
+const runtimeCollectorName = "runtime"
+
+// memStatsSources maps the runtime.MemStats gauges the agent has always reported
+// to the runtime/metrics values whose sum they are. Reading runtime/metrics does not
+// stop the world like runtime.ReadMemStats. Lookups has no source and stays 0, as
+// it has been in MemStats since Go 1.16.
+var memStatsSources = map[string][]string{
+	"Alloc":        {"/memory/classes/heap/objects:bytes"},
+	"BuckHashSys":  {"/memory/classes/profiling/buckets:bytes"},
+	"Frees":        {"/gc/heap/frees:objects", "/gc/heap/tiny/allocs:objects"},
+	"GCSys":        {"/memory/classes/metadata/other:bytes"},
+	"HeapAlloc":    {"/memory/classes/heap/objects:bytes"},
+	"HeapIdle":     {"/memory/classes/heap/free:bytes", "/memory/classes/heap/released:bytes"},
+	"HeapInuse":    {"/memory/classes/heap/objects:bytes", "/memory/classes/heap/unused:bytes"},
+	"HeapObjects":  {"/gc/heap/objects:objects"},
+	"HeapReleased": {"/memory/classes/heap/released:bytes"},
+	"HeapSys":      {"/memory/classes/heap/objects:bytes", "/memory/classes/heap/unused:bytes", "/memory/classes/heap/free:bytes", "/memory/classes/heap/released:bytes"},
+	"Lookups":      {},
+	"MCacheInuse":  {"/memory/classes/metadata/mcache/inuse:bytes"},
+	"MCacheSys":    {"/memory/classes/metadata/mcache/inuse:bytes", "/memory/classes/metadata/mcache/free:bytes"},
+	"MSpanInuse":   {"/memory/classes/metadata/mspan/inuse:bytes"},
+	"MSpanSys":     {"/memory/classes/metadata/mspan/inuse:bytes", "/memory/classes/metadata/mspan/free:bytes"},
+	"Mallocs":      {"/gc/heap/allocs:objects", "/gc/heap/tiny/allocs:objects"},
+	"NextGC":       {"/gc/heap/goal:bytes"},
+	"NumForcedGC":  {"/gc/cycles/forced:gc-cycles"},
+	"NumGC":        {"/gc/cycles/total:gc-cycles"},
+	"OtherSys":     {"/memory/classes/other:bytes"},
+	"StackInuse":   {"/memory/classes/heap/stacks:bytes"},
+	"StackSys":     {"/memory/classes/heap/stacks:bytes", "/memory/classes/os-stacks:bytes"},
+	"Sys":          {"/memory/classes/total:bytes"},
+	"TotalAlloc":   {"/gc/heap/allocs:bytes"},
+}
+
+// runtimeGauges maps the gauges that have no MemStats equivalent to their
+// runtime/metrics value. Values the running Go version does not provide are not
+// reported.
+var runtimeGauges = map[string]string{
+	"Goroutines":     "/sched/goroutines:goroutines",
+	"GOMAXPROCS":     "/sched/gomaxprocs:threads",
+	"HeapLive":       "/gc/heap/live:bytes",
+	"MutexWaitTotal": "/sync/mutex/wait/total:seconds",
+	"CgoCalls":       "/cgo/go-to-c-calls:calls",
+}
+
+// Sources of GCCPUFraction, the share of the available CPU time used by the GC.
+const (
+	gcCPUSource    = "/cpu/classes/gc/total:cpu-seconds"
+	totalCPUSource = "/cpu/classes/total:cpu-seconds"
+)
+
+// runtimeHistograms maps the histograms reported by the agent to their
+// runtime/metrics distribution.
+var runtimeHistograms = map[string]string{
+	"SchedLatency": "/sched/latencies:seconds",
+	"GCPauses":     "/sched/pauses/total/gc:seconds",
+}
+
+// runtimeLatencyBounds are the upper bounds, in seconds, of the buckets of the
+// runtime histograms. The runtime uses far more buckets than the server accepts,
+// so its buckets are merged into these.
+var runtimeLatencyBounds = []float64{1e-6, 5e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 5e-2, 0.1, 0.5, 1}
+
+// runtimeCollector reports the Go runtime metrics of the agent process read from
+// runtime/metrics: the gauges named after the runtime.MemStats fields, goroutine,
+// thread and mutex gauges, the scheduler latency and GC pause histograms,
+// RandomValue and the PollCount counter.
+type runtimeCollector struct {
+	interval time.Duration       // Default interval between two runs
+	samples  []rtmetrics.Sample  // Reused samples of every runtime/metrics value read
+	index    map[string]int      // Position of each value in samples
+	gcStats  debug.GCStats       // Reused GC statistics for LastGC and PauseTotalNs
+	prev     map[string][]uint64 // Bucket counts of each runtime histogram at the previous run
+}
+
+// newRuntimeCollector creates the collector of the Go runtime metrics.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *runtimeCollector: Collector ready to be registered
+func newRuntimeCollector(interval time.Duration) *runtimeCollector {
+	c := &runtimeCollector{interval: interval, index: make(map[string]int), prev: make(map[string][]uint64)}
+	add := func(name string) {
+		if _, ok := c.index[name]; !ok {
+			c.index[name] = len(c.samples)
+			c.samples = append(c.samples, rtmetrics.Sample{Name: name})
+		}
+	}
+	for _, sources := range memStatsSources {
+		for _, name := range sources {
+			add(name)
+		}
+	}
+	for _, name := range runtimeGauges {
+		add(name)
+	}
+	for _, name := range runtimeHistograms {
+		add(name)
+	}
+	add(gcCPUSource)
+	add(totalCPUSource)
+	return c
+}
+
+// Name implements Collector.
+func (c *runtimeCollector) Name() string { return runtimeCollectorName }
+
+// Interval implements Collector.
+func (c *runtimeCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. Every run counts as one poll in PollCount. The
+// histograms hold the observations made since the previous run.
+func (c *runtimeCollector) Collect(context.Context) ([]Metrics, error) {
+	rtmetrics.Read(c.samples)
+	debug.ReadGCStats(&c.gcStats)
+
+	out := make([]Metrics, 0, len(memStatsSources)+len(runtimeGauges)+len(runtimeHistograms)+5)
+	for name, sources := range memStatsSources {
+		var total float64
+		for _, source := range sources {
+			v, _ := c.value(source)
+			total += v
+		}
+		out = append(out, gauge(name, total))
+	}
+	// The runtime updates the CPU time estimates at the end of each GC cycle
+	var gcCPUFraction float64
+	if totalCPU, _ := c.value(totalCPUSource); totalCPU > 0 {
+		gcCPU, _ := c.value(gcCPUSource)
+		gcCPUFraction = gcCPU / totalCPU
+	}
+	var lastGC float64
+	if !c.gcStats.LastGC.IsZero() {
+		lastGC = float64(c.gcStats.LastGC.UnixNano())
+	}
+	out = append(out,
+		gauge("GCCPUFraction", gcCPUFraction),
+		gauge("LastGC", lastGC),
+		gauge("PauseTotalNs", float64(c.gcStats.PauseTotal.Nanoseconds())),
+	)
+
+	for name, source := range runtimeGauges {
+		if v, ok := c.value(source); ok {
+			out = append(out, gauge(name, v))
+		}
+	}
+
+	for name, source := range runtimeHistograms {
+		s := c.samples[c.index[source]]
+		if s.Value.Kind() != rtmetrics.KindFloat64Histogram {
+			continue
+		}
+		rh := s.Value.Float64Histogram()
+		prev := c.prev[source]
+		if h, ok := rebucketHistogram(rh.Buckets, prev, rh.Counts, runtimeLatencyBounds); ok {
+			out = append(out, Metrics{ID: name, MType: "histogram", Histogram: &h})
+		}
+		// The runtime may reuse the counts on the next read
+		c.prev[source] = append(prev[:0], rh.Counts...)
+	}
+
+	// Add a random value for testing/demonstration purposes
+	out = append(out, gauge("RandomValue", rand.Float64()))
+	return append(out, counter("PollCount", 1)), nil
+}
+
+// value returns a runtime/metrics value read by the last Collect.
+//
+// Parameters:
+//   - name: runtime/metrics name of the value
+//
+// Returns:
+//   - float64: The value
+//   - bool: false if the running Go version does not provide it
+func (c *runtimeCollector) value(name string) (float64, bool) {
+	v := c.samples[c.index[name]].Value
+	switch v.Kind() {
+	case rtmetrics.KindUint64:
+		return float64(v.Uint64()), true
+	case rtmetrics.KindFloat64:
+		return v.Float64(), true
+	default:
+		return 0, false
+	}
+}
+
+// rebucketHistogram turns the increase of a cumulative runtime/metrics histogram
+// into a histogram with the given bounds. A runtime bucket is counted in the
+// first bucket whose bound is not below the runtime bucket's upper end, so an
+// observation may be counted one bucket higher than its value. The sum is
+// estimated from the middle of each runtime bucket.
+//
+// Parameters:
+//   - buckets: Boundaries of the runtime buckets; bucket i holds the values in
+//     [buckets[i], buckets[i+1])
+//   - prev: Counts of the runtime buckets at the previous read, or nil
+//   - cur: Counts of the runtime buckets now
+//   - bounds: Strictly ascending upper bounds of the resulting buckets
+//
+// Returns:
+//   - client.Histogram: Observations made since the previous read
+//   - bool: false if there were none
+func rebucketHistogram(buckets []float64, prev, cur []uint64, bounds []float64) (client.Histogram, bool) {
+	if len(prev) != len(cur) {
+		prev = nil
+	}
+	h := client.Histogram{Bounds: slices.Clone(bounds), Counts: make([]int64, len(bounds)+1)}
+	for i, n := range cur {
+		if prev != nil {
+			n, _ = counterIncrease(prev[i], n)
+		}
+		if n == 0 {
+			continue
+		}
+		lo, hi := buckets[i], buckets[i+1]
+		h.Counts[sort.SearchFloat64s(bounds, hi)] += int64(n)
+		h.Count += int64(n)
+
+		var mid float64
+		switch {
+		case math.IsInf(lo, -1) && math.IsInf(hi, 1):
+		case math.IsInf(lo, -1):
+			mid = hi
+		case math.IsInf(hi, 1):
+			mid = lo
+		default:
+			mid = (lo + hi) / 2
+		}
+		h.Sum += mid * float64(n)
+	}
+	return h, h.Count > 0
+}
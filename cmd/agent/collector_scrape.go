@@ -0,0 +1,582 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/config"
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+// scrapeCollectorName is the name of the collector of the metrics scraped from
+// Prometheus endpoints.
+const scrapeCollectorName = "scrape"
+
+// Label modes of a scrape target.
+const (
+	// scrapeLabelsFlatten appends the label values to the metric name,
+	// e.g. http_requests_total_200_get; this is the default
+	scrapeLabelsFlatten = "flatten"
+
+	// scrapeLabelsPreserve keeps the labels in the metric name,
+	// e.g. http_requests_total{code="200",method="get"}
+	scrapeLabelsPreserve = "preserve"
+)
+
+// Limits of a scrape.
+const (
+	// maxScrapeBytes is the largest exposition read from a target
+	maxScrapeBytes = 16 << 20
+
+	// maxSummaryQuantiles is the largest number of quantiles the server accepts in a summary
+	maxSummaryQuantiles = 32
+
+	// defaultScrapeMaxSeries is the largest number of series reported per target
+	// when the target sets no max_series
+	defaultScrapeMaxSeries = 1000
+)
+
+// Name prefixes of the metrics describing the scrapes, followed by the target name.
+const (
+	scrapeUpPrefix       = "ScrapeUp_"
+	scrapeDurationPrefix = "ScrapeDurationSeconds_"
+	scrapeSamplesPrefix  = "ScrapeSamples_"
+)
+
+// labelValueEscaper escapes a label value like the Prometheus text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promHistogramState is the cumulative state of a scraped histogram at the
+// previous scrape.
+type promHistogramState struct {
+	bounds []float64 // Upper bounds of the buckets without +Inf
+	counts []float64 // Observations per bucket since the target started, with the overflow bucket
+	sum    float64   // Sum of the observations since the target started
+}
+
+// promSummaryState is the cumulative state of a scraped summary at the previous
+// scrape.
+type promSummaryState struct {
+	count float64 // Observations since the target started
+	sum   float64 // Sum of the observations since the target started
+}
+
+// scrapeTarget is a Prometheus endpoint scraped by the scrape collector, with the
+// state needed to turn its running totals into increments.
+type scrapeTarget struct {
+	name      string           // Name of the target in the ScrapeUp_, ScrapeDurationSeconds_ and ScrapeSamples_ metrics
+	url       string           // URL of the exposition, e.g. http://localhost:9100/metrics
+	timeout   time.Duration    // Time after which a scrape fails, 0 for the collector timeout
+	preserve  bool             // Whether labels are kept in the metric name instead of flattened
+	prefix    string           // Prefix of the names of the scraped metrics
+	keep      []*regexp.Regexp // Metric families to keep; all if empty
+	drop      []*regexp.Regexp // Metric families to drop, applied after keep
+	maxSeries int              // Largest number of series reported per scrape, without the metrics describing the scrape
+
+	custom     customMetrics                 // Counter totals of the previous scrape
+	histograms map[string]promHistogramState // Histograms of the previous scrape by metric name
+	summaries  map[string]promSummaryState   // Summaries of the previous scrape by metric name
+}
+
+// scrapeCollector scrapes Prometheus endpoints in the text exposition format and
+// reports their metrics. Gauges and untyped metrics become gauges. Counters,
+// histograms and summaries hold running totals in Prometheus, so the collector
+// sends what was added since the previous scrape, like the other collectors of
+// cumulative values: counters start at 0, and histograms and summaries are
+// reported from the second scrape on. Every target is also described by
+// ScrapeUp_<target>, ScrapeDurationSeconds_<target> and ScrapeSamples_<target>.
+// A target reports at most its max_series series per scrape, so that a large
+// exposition cannot flood the report queue.
+type scrapeCollector struct {
+	interval time.Duration    // Default interval between two runs
+	targets  []*scrapeTarget  // Endpoints to scrape
+	client   *http.Client     // Client of the scrapes
+	now      func() time.Time // Current time; replaced in tests
+}
+
+// newScrapeCollector creates the collector of the metrics of Prometheus endpoints.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//   - targets: Endpoints to scrape
+//
+// Returns:
+//   - *scrapeCollector: Collector ready to be registered
+func newScrapeCollector(interval time.Duration, targets []*scrapeTarget) *scrapeCollector {
+	return &scrapeCollector{interval: interval, targets: targets, client: &http.Client{}, now: time.Now}
+}
+
+// Name implements Collector.
+func (c *scrapeCollector) Name() string { return scrapeCollectorName }
+
+// Interval implements Collector.
+func (c *scrapeCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. The targets are scraped concurrently. A target
+// that cannot be scraped is reported with ScrapeUp_<target> 0; the valid samples
+// of an exposition with errors are reported.
+func (c *scrapeCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	results := make([][]Metrics, len(c.targets))
+	errs := make([]error, len(c.targets))
+	var wg sync.WaitGroup
+	for i, t := range c.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.scrape(ctx, t)
+		}()
+	}
+	wg.Wait()
+
+	// Targets may expose metrics with the same name, and a flattened name may
+	// clash with another metric of the same target
+	seen := make(map[string]bool)
+	var out []Metrics
+	for i, ms := range results {
+		for _, m := range ms {
+			if seen[m.ID] {
+				errs = append(errs, fmt.Errorf("target %s: metric %s is reported twice", c.targets[i].name, m.ID))
+				continue
+			}
+			seen[m.ID] = true
+			out = append(out, m)
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+// scrape scrapes one target and converts its samples.
+//
+// Parameters:
+//   - ctx: Context of the collector run
+//   - t: Target to scrape
+//
+// Returns:
+//   - []Metrics: Metrics of the target followed by the metrics describing the scrape;
+//     ScrapeSamples_<target> counts the series before the max_series limit
+//   - error: Error if the target could not be scraped, some samples are invalid or
+//     the target exceeds its series limit
+func (c *scrapeCollector) scrape(ctx context.Context, t *scrapeTarget) ([]Metrics, error) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	start := c.now()
+	body, err := c.fetch(ctx, t.url)
+	duration := gauge(scrapeDurationPrefix+t.name, c.now().Sub(start).Seconds())
+	if err != nil {
+		return []Metrics{gauge(scrapeUpPrefix+t.name, 0), duration}, fmt.Errorf("target %s: %w", t.name, err)
+	}
+
+	samples, parseErr := parsePromExposition(body)
+	out, convertErr := t.convert(samples)
+	series := len(out)
+	var limitErr error
+	if series > t.maxSeries {
+		out = out[:t.maxSeries]
+		limitErr = fmt.Errorf("%d series exceed the limit of %d, the first %d are reported", series, t.maxSeries, t.maxSeries)
+	}
+	out = append(out, gauge(scrapeUpPrefix+t.name, 1), duration, gauge(scrapeSamplesPrefix+t.name, float64(series)))
+	if err := errors.Join(parseErr, convertErr, limitErr); err != nil {
+		return out, fmt.Errorf("target %s: %w", t.name, err)
+	}
+	return out, nil
+}
+
+// fetch reads the exposition of a target.
+//
+// Parameters:
+//   - ctx: Context whose cancellation aborts the request
+//   - target: URL of the exposition
+//
+// Returns:
+//   - []byte: Body of the response
+//   - error: Error if the request failed, the status is not 200 OK or the body is too large
+func (c *scrapeCollector) fetch(ctx context.Context, target string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=1,*/*;q=0.1")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxScrapeBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxScrapeBytes {
+		return nil, fmt.Errorf("exposition larger than %d bytes", maxScrapeBytes)
+	}
+	return body, nil
+}
+
+// wanted reports whether the metrics of a family pass the keep and drop filters.
+//
+// Parameters:
+//   - family: Name of the metric family
+//
+// Returns:
+//   - bool: true if the family is kept
+func (t *scrapeTarget) wanted(family string) bool {
+	matches := func(res []*regexp.Regexp) bool {
+		return slices.ContainsFunc(res, func(re *regexp.Regexp) bool { return re.MatchString(family) })
+	}
+	return (len(t.keep) == 0 || matches(t.keep)) && !matches(t.drop)
+}
+
+// metricName builds the name of a scraped metric from its Prometheus name and
+// labels, according to the label mode of the target.
+//
+// Parameters:
+//   - name: Prometheus name of the metric
+//   - labels: Labels of the sample
+//   - skip: Label that is not part of the name, e.g. "le" of a histogram bucket
+//
+// Returns:
+//   - string: Metric name
+func (t *scrapeTarget) metricName(name string, labels []promLabel, skip string) string {
+	name = t.prefix + name
+	kept := make([]promLabel, 0, len(labels))
+	for _, l := range labels {
+		if l.name != skip {
+			kept = append(kept, l)
+		}
+	}
+	if !t.preserve {
+		return flattenLabels(name, kept)
+	}
+	if len(kept) == 0 {
+		return name
+	}
+	slices.SortStableFunc(kept, func(a, b promLabel) int { return strings.Compare(a.name, b.name) })
+	pairs := make([]string, len(kept))
+	for i, l := range kept {
+		pairs[i] = l.name + `="` + labelValueEscaper.Replace(l.value) + `"`
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// promHistogram collects the samples of one scraped histogram.
+type promHistogram struct {
+	name     string              // Metric name
+	line     int                 // Line of the first sample, for error messages
+	buckets  map[float64]float64 // Cumulative count by upper bound, including +Inf
+	sum      float64             // Value of the _sum sample
+	count    float64             // Value of the _count sample
+	hasCount bool                // Whether the _count sample was seen
+}
+
+// promSummary collects the samples of one scraped summary.
+type promSummary struct {
+	name      string            // Metric name
+	line      int               // Line of the first sample, for error messages
+	quantiles []client.Quantile // Quantiles in the order of the exposition
+	sum       float64           // Value of the _sum sample
+	count     float64           // Value of the _count sample
+}
+
+// convert turns the samples of a scrape into metrics and updates the state of the
+// target. Gauges with a NaN or infinite value are skipped.
+//
+// Parameters:
+//   - samples: Samples of the exposition
+//
+// Returns:
+//   - []Metrics: Gauges, counters, histograms and summaries
+//   - error: Error listing the samples that could not be converted
+func (t *scrapeTarget) convert(samples []promSample) ([]Metrics, error) {
+	var values []customSample
+	var histograms []*promHistogram
+	var summaries []*promSummary
+	byName := make(map[string]any)
+	var errs []error
+	for _, s := range samples {
+		if !t.wanted(s.family) {
+			continue
+		}
+		switch s.mtype {
+		case "gauge", "untyped":
+			if !math.IsNaN(s.value) && !math.IsInf(s.value, 0) {
+				values = append(values, customSample{Name: t.metricName(s.name, s.labels, ""), MType: "gauge", Value: s.value})
+			}
+		case "counter":
+			if math.IsNaN(s.value) || math.IsInf(s.value, 0) || s.value < 0 {
+				errs = append(errs, fmt.Errorf("line %d: invalid total %v of counter %s", s.line, s.value, s.name))
+				continue
+			}
+			values = append(values, customSample{Name: t.metricName(s.name, s.labels, ""), MType: "counter", Value: s.value})
+		case "histogram":
+			name := t.metricName(s.family, s.labels, "le")
+			h, ok := byName[name].(*promHistogram)
+			if !ok {
+				h = &promHistogram{name: name, line: s.line, buckets: make(map[float64]float64)}
+				byName[name] = h
+				histograms = append(histograms, h)
+			}
+			switch s.name {
+			case s.family + "_bucket":
+				le, _ := s.label("le")
+				bound, err := strconv.ParseFloat(le, 64)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("line %d: invalid bucket bound %q of histogram %s", s.line, le, s.family))
+					continue
+				}
+				h.buckets[bound] = s.value
+			case s.family + "_sum":
+				h.sum = s.value
+			case s.family + "_count":
+				h.count, h.hasCount = s.value, true
+			}
+		case "summary":
+			name := t.metricName(s.family, s.labels, "quantile")
+			sm, ok := byName[name].(*promSummary)
+			if !ok {
+				sm = &promSummary{name: name, line: s.line}
+				byName[name] = sm
+				summaries = append(summaries, sm)
+			}
+			switch s.name {
+			case s.family:
+				q, _ := s.label("quantile")
+				rank, err := strconv.ParseFloat(q, 64)
+				if err != nil || rank < 0 || rank > 1 {
+					errs = append(errs, fmt.Errorf("line %d: invalid quantile %q of summary %s", s.line, q, s.family))
+					continue
+				}
+				// Prometheus exposes NaN quantiles until there are observations
+				if !math.IsNaN(s.value) && !math.IsInf(s.value, 0) {
+					sm.quantiles = append(sm.quantiles, client.Quantile{Quantile: rank, Value: s.value})
+				}
+			case s.family + "_sum":
+				sm.sum = s.value
+			case s.family + "_count":
+				sm.count = s.value
+			}
+		}
+	}
+
+	out, err := t.custom.metrics(values)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	prevHistograms := t.histograms
+	t.histograms = make(map[string]promHistogramState, len(histograms))
+	for _, h := range histograms {
+		state, err := h.state()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: histogram %s: %w", h.line, h.name, err))
+			continue
+		}
+		t.histograms[h.name] = state
+		if delta, ok := histogramIncrease(prevHistograms[h.name], state); ok {
+			out = append(out, Metrics{ID: h.name, MType: "histogram", Histogram: &delta})
+		}
+	}
+
+	prevSummaries := t.summaries
+	t.summaries = make(map[string]promSummaryState, len(summaries))
+	for _, sm := range summaries {
+		if len(sm.quantiles) > maxSummaryQuantiles {
+			errs = append(errs, fmt.Errorf("line %d: summary %s has more than %d quantiles", sm.line, sm.name, maxSummaryQuantiles))
+			continue
+		}
+		if math.IsNaN(sm.count) || math.IsInf(sm.count, 0) || sm.count < 0 || math.IsNaN(sm.sum) || math.IsInf(sm.sum, 0) {
+			errs = append(errs, fmt.Errorf("line %d: summary %s has an invalid count or sum", sm.line, sm.name))
+			continue
+		}
+		state := promSummaryState{count: sm.count, sum: sm.sum}
+		t.summaries[sm.name] = state
+		prev, ok := prevSummaries[sm.name]
+		if !ok || state.count < prev.count {
+			continue
+		}
+		slices.SortStableFunc(sm.quantiles, func(a, b client.Quantile) int { return cmp.Compare(a.Quantile, b.Quantile) })
+		sm.quantiles = slices.CompactFunc(sm.quantiles, func(a, b client.Quantile) bool { return a.Quantile == b.Quantile })
+		out = append(out, Metrics{ID: sm.name, MType: "summary", Summary: &client.Summary{
+			Count:     int64(math.Round(state.count - prev.count)),
+			Sum:       state.sum - prev.sum,
+			Quantiles: sm.quantiles,
+		}})
+	}
+	return out, errors.Join(errs...)
+}
+
+// state checks the buckets of a scraped histogram and turns its cumulative bucket
+// counts into counts per bucket.
+//
+// Returns:
+//   - promHistogramState: Observations since the target started
+//   - error: Error if the buckets are inconsistent or too many
+func (h *promHistogram) state() (promHistogramState, error) {
+	inf, ok := h.buckets[math.Inf(1)]
+	if !ok {
+		if !h.hasCount {
+			return promHistogramState{}, errors.New("neither a +Inf bucket nor a count")
+		}
+		inf = h.count
+	}
+	var bounds []float64
+	for b := range h.buckets {
+		if !math.IsInf(b, 0) && !math.IsNaN(b) {
+			bounds = append(bounds, b)
+		}
+	}
+	slices.Sort(bounds)
+	if len(bounds) > maxLatencyBuckets {
+		return promHistogramState{}, fmt.Errorf("%d buckets, at most %d are supported", len(bounds), maxLatencyBuckets)
+	}
+	if math.IsNaN(h.sum) || math.IsInf(h.sum, 0) {
+		return promHistogramState{}, errors.New("invalid sum")
+	}
+	counts := make([]float64, len(bounds)+1)
+	var below float64
+	for i, b := range bounds {
+		cum := h.buckets[b]
+		counts[i] = cum - below
+		below = cum
+	}
+	counts[len(bounds)] = inf - below
+	for _, n := range counts {
+		if n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+			return promHistogramState{}, errors.New("bucket counts are not cumulative")
+		}
+	}
+	return promHistogramState{bounds: bounds, counts: counts, sum: h.sum}, nil
+}
+
+// histogramIncrease returns the observations a scraped histogram gained since the
+// previous scrape.
+//
+// Parameters:
+//   - prev: State at the previous scrape, or the zero state
+//   - cur: State now
+//
+// Returns:
+//   - client.Histogram: New observations
+//   - bool: false if there are none, the histogram is new, its buckets changed or
+//     it was reset
+func histogramIncrease(prev, cur promHistogramState) (client.Histogram, bool) {
+	if prev.counts == nil || !slices.Equal(prev.bounds, cur.bounds) {
+		return client.Histogram{}, false
+	}
+	h := client.Histogram{Bounds: slices.Clone(cur.bounds), Counts: make([]int64, len(cur.counts)), Sum: cur.sum - prev.sum}
+	for i, n := range cur.counts {
+		if n < prev.counts[i] {
+			return client.Histogram{}, false
+		}
+		h.Counts[i] = int64(math.Round(n - prev.counts[i]))
+		h.Count += h.Counts[i]
+	}
+	return h, h.Count > 0
+}
+
+// parseScrapeTargets builds the targets of the scrape collector. The URLs of the
+// -scrape flag replace the targets of the configuration file.
+//
+// Parameters:
+//   - list: Comma-separated URLs, e.g. "http://localhost:9100/metrics"
+//   - settings: Targets of the configuration file, used if list is empty
+//
+// Returns:
+//   - []*scrapeTarget: Targets to scrape
+//   - error: Error if a target is invalid or two targets have the same name
+func parseScrapeTargets(list string, settings []config.ScrapeConfig) ([]*scrapeTarget, error) {
+	if strings.TrimSpace(list) != "" {
+		settings = nil
+		for _, u := range strings.Split(list, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				settings = append(settings, config.ScrapeConfig{URL: u})
+			}
+		}
+	}
+
+	var targets []*scrapeTarget
+	names := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		u, err := url.Parse(s.URL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid scrape URL %q: an http or https URL is expected", s.URL)
+		}
+		t := &scrapeTarget{name: s.Name, url: s.URL, prefix: s.Prefix, maxSeries: defaultScrapeMaxSeries}
+		if t.name == "" {
+			t.name = instanceName(u.Host)
+		}
+		if names[t.name] {
+			return nil, fmt.Errorf("scrape target name %q is used twice, set distinct names", t.name)
+		}
+		names[t.name] = true
+
+		switch s.LabelMode {
+		case "", scrapeLabelsFlatten:
+		case scrapeLabelsPreserve:
+			t.preserve = true
+		default:
+			return nil, fmt.Errorf("invalid label mode %q of scrape target %s: must be %s or %s", s.LabelMode, t.name, scrapeLabelsFlatten, scrapeLabelsPreserve)
+		}
+		if s.Timeout != "" {
+			d, err := time.ParseDuration(s.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout of scrape target %s: %w", t.name, err)
+			}
+			if d <= 0 {
+				return nil, fmt.Errorf("timeout of scrape target %s must be positive, got %v", t.name, d)
+			}
+			t.timeout = d
+		}
+		if s.MaxSeries < 0 {
+			return nil, fmt.Errorf("max series of scrape target %s must not be negative, got %d", t.name, s.MaxSeries)
+		}
+		if s.MaxSeries > 0 {
+			t.maxSeries = s.MaxSeries
+		}
+		if t.keep, err = compileFilters(s.Keep); err != nil {
+			return nil, fmt.Errorf("invalid keep filter of scrape target %s: %w", t.name, err)
+		}
+		if t.drop, err = compileFilters(s.Drop); err != nil {
+			return nil, fmt.Errorf("invalid drop filter of scrape target %s: %w", t.name, err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// compileFilters compiles metric family filters. Like Prometheus relabeling
+// regular expressions, a filter must match the whole name.
+//
+// Parameters:
+//   - patterns: Regular expressions, e.g. "go_.*"
+//
+// Returns:
+//   - []*regexp.Regexp: Anchored expressions
+//   - error: Error if a pattern is invalid
+func compileFilters(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
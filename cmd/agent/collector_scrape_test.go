@@ -0,0 +1,313 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/config"
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exposition serves a Prometheus exposition that tests can replace.
+type exposition struct{ body atomic.Value }
+
+func (e *exposition) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(e.body.Load().(string)))
+}
+
+// metricsByID returns collected metrics by name.
+func metricsByID(ms []Metrics) map[string]Metrics {
+	byID := make(map[string]Metrics, len(ms))
+	for _, m := range ms {
+		byID[m.ID] = m
+	}
+	return byID
+}
+
+const firstExposition = `# HELP http_requests_total Requests handled.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1027
+http_requests_total{code="500",method="get"} 3
+# TYPE go_goroutines gauge
+go_goroutines 12
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.5"} NaN
+go_gc_duration_seconds_sum 0
+go_gc_duration_seconds_count 0
+# TYPE request_seconds histogram
+request_seconds_bucket{path="/api",le="0.1"} 5
+request_seconds_bucket{path="/api",le="0.5"} 8
+request_seconds_bucket{path="/api",le="+Inf"} 9
+request_seconds_sum{path="/api"} 2.5
+request_seconds_count{path="/api"} 9
+process_open_fds 7
+`
+
+const secondExposition = `# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1030
+http_requests_total{code="500",method="get"} 3
+# TYPE go_goroutines gauge
+go_goroutines 15
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="1"} 0.004
+go_gc_duration_seconds{quantile="0.5"} 0.001
+go_gc_duration_seconds_sum 0.008
+go_gc_duration_seconds_count 4
+# TYPE request_seconds histogram
+request_seconds_bucket{path="/api",le="0.1"} 6
+request_seconds_bucket{path="/api",le="0.5"} 10
+request_seconds_bucket{path="/api",le="+Inf"} 12
+request_seconds_sum{path="/api"} 4
+request_seconds_count{path="/api"} 12
+process_open_fds 8
+`
+
+func Test_scrapeCollector(t *testing.T) {
+	api := &exposition{}
+	api.body.Store(firstExposition)
+	apiServer := httptest.NewServer(api)
+	defer apiServer.Close()
+
+	var accept atomic.Value
+	jobs := &exposition{}
+	jobs.body.Store("# TYPE jobs_queued gauge\njobs_queued{queue=\"mail\"} 4\n")
+	jobsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept.Store(r.Header.Get("Accept"))
+		jobs.ServeHTTP(w, r)
+	}))
+	defer jobsServer.Close()
+
+	brokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "exporter crashed", http.StatusInternalServerError)
+	}))
+	defer brokenServer.Close()
+
+	targets, err := parseScrapeTargets("", []config.ScrapeConfig{
+		{Name: "api", URL: apiServer.URL + "/metrics", Drop: []string{"process_.*"}},
+		{Name: "jobs", URL: jobsServer.URL + "/metrics", LabelMode: scrapeLabelsPreserve, Prefix: "jobs:"},
+		{Name: "broken", URL: brokenServer.URL + "/metrics"},
+	})
+	require.NoError(t, err)
+	c := newScrapeCollector(time.Second, targets)
+
+	ms, err := c.Collect(t.Context())
+	assert.ErrorContains(t, err, "target broken: unexpected status 500 Internal Server Error")
+	assert.Contains(t, accept.Load(), "text/plain;version=0.0.4")
+	values := metricValues(t, ms)
+	assert.Equal(t, map[string]float64{
+		"http_requests_total_200_get":    0,
+		"http_requests_total_500_get":    0,
+		"go_goroutines":                  12,
+		`jobs:jobs_queued{queue="mail"}`: 4,
+		"ScrapeUp_api":                   1,
+		"ScrapeDurationSeconds_api":      values["ScrapeDurationSeconds_api"],
+		"ScrapeSamples_api":              3,
+		"ScrapeUp_jobs":                  1,
+		"ScrapeDurationSeconds_jobs":     values["ScrapeDurationSeconds_jobs"],
+		"ScrapeSamples_jobs":             1,
+		"ScrapeUp_broken":                0,
+		"ScrapeDurationSeconds_broken":   values["ScrapeDurationSeconds_broken"],
+	}, values, "histograms and summaries are reported from the second scrape")
+
+	api.body.Store(secondExposition)
+	ms, _ = c.Collect(t.Context())
+	byID := metricsByID(ms)
+	values = metricValues(t, ms)
+	assert.Equal(t, 3.0, values["http_requests_total_200_get"])
+	assert.Equal(t, 0.0, values["http_requests_total_500_get"])
+	assert.Equal(t, 15.0, values["go_goroutines"])
+	assert.Equal(t, 5.0, values["ScrapeSamples_api"])
+
+	require.Contains(t, byID, "request_seconds_api")
+	assert.Equal(t, client.Histogram{Bounds: []float64{0.1, 0.5}, Counts: []int64{1, 1, 1}, Count: 3, Sum: 1.5}, *byID["request_seconds_api"].Histogram)
+	require.Contains(t, byID, "go_gc_duration_seconds")
+	assert.Equal(t, client.Summary{
+		Count:     4,
+		Sum:       0.008,
+		Quantiles: []client.Quantile{{Quantile: 0.5, Value: 0.001}, {Quantile: 1, Value: 0.004}},
+	}, *byID["go_gc_duration_seconds"].Summary)
+
+	// The application restarted: reset totals add nothing
+	api.body.Store(firstExposition)
+	ms, _ = c.Collect(t.Context())
+	byID = metricsByID(ms)
+	assert.Equal(t, 0.0, metricValues(t, ms)["http_requests_total_200_get"])
+	assert.NotContains(t, byID, "request_seconds_api")
+	assert.NotContains(t, byID, "go_gc_duration_seconds")
+}
+
+func Test_scrapeCollector_Timeout(t *testing.T) {
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slowServer.Close()
+	fast := &exposition{}
+	fast.body.Store("up_since 1\n")
+	fastServer := httptest.NewServer(fast)
+	defer fastServer.Close()
+
+	targets, err := parseScrapeTargets("", []config.ScrapeConfig{
+		{Name: "slow", URL: slowServer.URL, Timeout: "50ms"},
+		{Name: "fast", URL: fastServer.URL, Timeout: "5s"},
+	})
+	require.NoError(t, err)
+	c := newScrapeCollector(time.Second, targets)
+
+	start := time.Now()
+	ms, err := c.Collect(t.Context())
+	assert.Less(t, time.Since(start), 3*time.Second, "the slow target does not hold up the run")
+	assert.ErrorContains(t, err, "target slow:")
+	assert.ErrorContains(t, err, "context deadline exceeded")
+	values := metricValues(t, ms)
+	assert.Equal(t, 0.0, values["ScrapeUp_slow"])
+	assert.Equal(t, 1.0, values["ScrapeUp_fast"])
+	assert.Equal(t, 1.0, values["up_since"])
+}
+
+func Test_scrapeCollector_MaxSeries(t *testing.T) {
+	big := &exposition{}
+	big.body.Store("# TYPE a gauge\na 1\n# TYPE b gauge\nb 2\n# TYPE c gauge\nc 3\n")
+	server := httptest.NewServer(big)
+	defer server.Close()
+
+	targets, err := parseScrapeTargets("", []config.ScrapeConfig{{Name: "big", URL: server.URL, MaxSeries: 2}})
+	require.NoError(t, err)
+	c := newScrapeCollector(time.Second, targets)
+
+	ms, err := c.Collect(t.Context())
+	assert.ErrorContains(t, err, "target big: 3 series exceed the limit of 2")
+	values := metricValues(t, ms)
+	assert.Equal(t, map[string]float64{
+		"a":                         1,
+		"b":                         2,
+		"ScrapeUp_big":              1,
+		"ScrapeDurationSeconds_big": values["ScrapeDurationSeconds_big"],
+		"ScrapeSamples_big":         3,
+	}, values)
+
+	targets, err = parseScrapeTargets(server.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultScrapeMaxSeries, targets[0].maxSeries, "targets of the flag use the default limit")
+}
+
+func Test_scrapeTarget_metricName(t *testing.T) {
+	labels := []promLabel{{name: "path", value: `/a "b"`}, {name: "code", value: "200"}, {name: "le", value: "0.5"}}
+	tests := []struct {
+		name     string
+		target   scrapeTarget
+		skip     string
+		expected string
+	}{
+		{name: "Flatten", target: scrapeTarget{}, skip: "le", expected: "requests_a__b__200"},
+		{name: "Preserve", target: scrapeTarget{preserve: true, prefix: "api_"}, skip: "le", expected: `api_requests{code="200",path="/a \"b\""}`},
+		{name: "Preserve all", target: scrapeTarget{preserve: true}, expected: `requests{code="200",le="0.5",path="/a \"b\""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.target.metricName("requests", labels, tt.skip))
+		})
+	}
+	assert.Equal(t, "requests", (&scrapeTarget{preserve: true}).metricName("requests", nil, ""))
+}
+
+func Test_scrapeTarget_wanted(t *testing.T) {
+	targets, err := parseScrapeTargets("", []config.ScrapeConfig{{
+		URL:  "http://localhost:9100/metrics",
+		Keep: []string{"go_.*", "http_requests_total"},
+		Drop: []string{"go_memstats_.*"},
+	}})
+	require.NoError(t, err)
+	target := targets[0]
+	assert.True(t, target.wanted("go_goroutines"))
+	assert.True(t, target.wanted("http_requests_total"))
+	assert.False(t, target.wanted("http_requests_total_created"), "filters match the whole name")
+	assert.False(t, target.wanted("go_memstats_alloc_bytes"))
+	assert.False(t, target.wanted("process_open_fds"))
+}
+
+func Test_parseScrapeTargets(t *testing.T) {
+	tests := []struct {
+		name          string
+		list          string
+		settings      []config.ScrapeConfig
+		expectedNames []string
+		expectedError string
+	}{
+		{name: "None"},
+		{
+			name:          "Flag",
+			list:          "http://localhost:9100/metrics, https://db.internal:9187/metrics",
+			settings:      []config.ScrapeConfig{{URL: "http://ignored:1/metrics"}},
+			expectedNames: []string{"localhost_9100", "db_internal_9187"},
+		},
+		{
+			name:          "Config file",
+			settings:      []config.ScrapeConfig{{Name: "node", URL: "http://localhost:9100/metrics", Timeout: "2s", LabelMode: "preserve"}},
+			expectedNames: []string{"node"},
+		},
+		{name: "Same name", list: "http://localhost:9100/metrics,http://localhost:9100/other", expectedError: `name "localhost_9100" is used twice`},
+		{name: "Invalid URL", list: "localhost:9100", expectedError: "invalid scrape URL"},
+		{name: "Invalid label mode", settings: []config.ScrapeConfig{{URL: "http://a/metrics", LabelMode: "drop"}}, expectedError: "invalid label mode"},
+		{name: "Invalid timeout", settings: []config.ScrapeConfig{{URL: "http://a/metrics", Timeout: "-1s"}}, expectedError: "must be positive"},
+		{name: "Invalid max series", settings: []config.ScrapeConfig{{URL: "http://a/metrics", MaxSeries: -1}}, expectedError: "must not be negative"},
+		{name: "Invalid filter", settings: []config.ScrapeConfig{{URL: "http://a/metrics", Keep: []string{"go_("}}}, expectedError: "invalid keep filter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, err := parseScrapeTargets(tt.list, tt.settings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			var names []string
+			for _, target := range targets {
+				names = append(names, target.name)
+			}
+			assert.Equal(t, tt.expectedNames, names)
+		})
+	}
+}
+
+func Test_promHistogram_state(t *testing.T) {
+	tests := []struct {
+		name          string
+		histogram     promHistogram
+		expected      promHistogramState
+		expectedError string
+	}{
+		{
+			name:      "Count without +Inf bucket",
+			histogram: promHistogram{buckets: map[float64]float64{1: 2, 2: 5}, sum: 6, count: 6, hasCount: true},
+			expected:  promHistogramState{bounds: []float64{1, 2}, counts: []float64{2, 3, 1}, sum: 6},
+		},
+		{
+			name:          "No total",
+			histogram:     promHistogram{buckets: map[float64]float64{1: 2}},
+			expectedError: "neither a +Inf bucket nor a count",
+		},
+		{
+			name:          "Not cumulative",
+			histogram:     promHistogram{buckets: map[float64]float64{1: 5, 2: 3, math.Inf(1): 6}},
+			expectedError: "not cumulative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := tt.histogram.state()
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, state)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// systemCollectorName is the name of the collector of the host memory and CPU metrics.
+const systemCollectorName = "system"
+
+// systemCollector reports the memory of the host and the utilization of each CPU core.
+type systemCollector struct {
+	interval time.Duration      // Default interval between two runs
+	ms       map[string]float64 // Reused map of the collected values
+}
+
+// newSystemCollector creates the collector of the host memory and CPU metrics.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//
+// Returns:
+//   - *systemCollector: Collector ready to be registered
+func newSystemCollector(interval time.Duration) *systemCollector {
+	return &systemCollector{interval: interval, ms: make(map[string]float64, 5)}
+}
+
+// Name implements Collector.
+func (c *systemCollector) Name() string { return systemCollectorName }
+
+// Interval implements Collector.
+func (c *systemCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector.
+func (c *systemCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	clear(c.ms)
+	err := CollectSystemMetrics(ctx, c.ms)
+	return gaugeMetrics(c.ms), err
+}
+
+// CollectSystemMetrics gathers system-level metrics using the gopsutil library
+// and populates the provided map with:
+//   - Memory statistics (TotalMemory, FreeMemory)
+//   - CPU utilization per core (CPUutilization1, CPUutilization2, etc.)
+//
+// Parameters:
+//   - ctx: Context that cancels the collection, including the one-second CPU sample
+//   - ms: A map that will be populated with system metric names as keys and float64 values
+//
+// Returns:
+//   - error: Errors of the subsystems that failed; the map holds the results of the others
+func CollectSystemMetrics(ctx context.Context, ms map[string]float64) error {
+	var errs []error
+
+	// Collect virtual memory statistics
+	vmStat, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("memory stats: %w", err))
+	} else {
+		ms["TotalMemory"] = float64(vmStat.Total)
+		ms["FreeMemory"] = float64(vmStat.Free)
+	}
+
+	// Collect CPU utilization percentages per core
+	// Parameters: duration to sample (1 second), true = per-cpu percentages
+	cpuPercentages, err := cpu.PercentWithContext(ctx, time.Second, true)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("CPU stats: %w", err))
+	} else {
+		// Add each CPU core's utilization as a separate metric
+		for i, percent := range cpuPercentages {
+			ms[fmt.Sprintf("%s%d", cpuUtilizationPrefix, i+1)] = percent
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gaugeMetrics converts collected values into gauges.
+//
+// Parameters:
+//   - values: Gauge names and values
+//
+// Returns:
+//   - []Metrics: One gauge per value
+func gaugeMetrics(values map[string]float64) []Metrics {
+	out := make([]Metrics, 0, len(values))
+	for name, value := range values {
+		out = append(out, Metrics{ID: name, MType: "gauge", Value: &value})
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// textfileCollectorName is the name of the collector of the metrics written to files.
+const textfileCollectorName = "textfile"
+
+// textfileCollector reports the metrics written to the *.prom and *.json files of
+// a directory, e.g. by cron jobs. The *.prom files use the Prometheus text format;
+// the *.json files hold an array of {"name", "type", "value"} objects. Counters are
+// running totals. Other files are ignored, so a file can be written under a
+// temporary name and renamed once complete.
+type textfileCollector struct {
+	interval time.Duration // Default interval between two runs
+	dir      string        // Directory of the files
+	custom   customMetrics // Counter totals of the previous run
+}
+
+// newTextfileCollector creates the collector of the metrics written to files.
+//
+// Parameters:
+//   - interval: Default interval between two runs, usually the poll interval
+//   - dir: Directory of the files, e.g. from the -textfile-dir flag
+//
+// Returns:
+//   - *textfileCollector: Collector ready to be registered
+func newTextfileCollector(interval time.Duration, dir string) *textfileCollector {
+	return &textfileCollector{interval: interval, dir: dir}
+}
+
+// Name implements Collector.
+func (c *textfileCollector) Name() string { return textfileCollectorName }
+
+// Interval implements Collector.
+func (c *textfileCollector) Interval() time.Duration { return c.interval }
+
+// Collect implements Collector. The files are read in name order; the valid
+// metrics of a file with errors are reported.
+func (c *textfileCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("textfile directory: %w", err)
+	}
+	var samples []customSample
+	var errs []error
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || ext != ".prom" && ext != ".json" {
+			continue
+		}
+		path := filepath.Join(c.dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var fileSamples []customSample
+		if ext == ".prom" {
+			fileSamples, err = parsePromText(data)
+		} else {
+			fileSamples, err = parseCustomJSON(data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+		samples = append(samples, fileSamples...)
+	}
+	out, err := c.custom.metrics(samples)
+	return out, errors.Join(append(errs, err)...)
+}
+
+// parsePromText parses metrics in the Prometheus text exposition format. Gauges,
+// counters and untyped metrics, reported as gauges, are kept; the samples of
+// histograms and summaries are skipped. The label values of a sample are
+// appended to its name like the instance of the agent's per-instance metrics,
+// e.g. http_requests_total{code="200",method="get"} becomes
+// http_requests_total_200_get.
+//
+// Parameters:
+//   - data: Content of the file
+//
+// Returns:
+//   - []customSample: Samples of the valid lines
+//   - error: Error listing the invalid lines
+func parsePromText(data []byte) ([]customSample, error) {
+	parsed, err := parsePromExposition(data)
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	samples := make([]customSample, 0, len(parsed))
+	for _, p := range parsed {
+		var mtype string
+		switch p.mtype {
+		case "gauge", "untyped":
+			mtype = "gauge"
+		case "counter":
+			mtype = "counter"
+		default:
+			continue
+		}
+		s := customSample{Name: flattenLabels(p.name, p.labels), MType: mtype, Value: p.value}
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", p.line, err))
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, errors.Join(errs...)
+}
+
+// flattenLabels appends the non-empty label values of a sample to its name.
+//
+// Parameters:
+//   - name: Metric name
+//   - labels: Labels of the sample
+//
+// Returns:
+//   - string: Name followed by the values, e.g. "http_requests_total_200_get"
+func flattenLabels(name string, labels []promLabel) string {
+	for _, l := range labels {
+		if l.value != "" {
+			name += "_" + instanceName(l.value)
+		}
+	}
+	return name
+}
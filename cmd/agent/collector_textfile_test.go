@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_textfileCollector(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "textfile"))))
+	c := newTextfileCollector(time.Second, dir)
+
+	ms, err := c.Collect(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"backup_last_success_timestamp_seconds": 1767323045,
+		"backup_runs_total_ok":                  0,
+		"backup_runs_total_failed":              0,
+		"backup_size_bytes":                     1.5e9,
+		"QueueDepth_orders":                     17,
+		"QueueProcessed_orders":                 0,
+	}, metricValues(t, ms), "histograms and other files are skipped")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "queues.json"), []byte(`[
+		{"name": "QueueDepth_orders", "type": "gauge", "value": 3},
+		{"name": "QueueProcessed_orders", "type": "counter", "value": 1014},
+		{"name": "QueueLag", "type": "summary", "value": 1}
+	]`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"name":`), 0o644))
+	ms, err = c.Collect(t.Context())
+	assert.ErrorContains(t, err, "broken.json: unexpected end of JSON input")
+	assert.ErrorContains(t, err, `queues.json: item 2: invalid type "summary" of metric QueueLag`)
+	values := metricValues(t, ms)
+	assert.Equal(t, 3.0, values["QueueDepth_orders"])
+	assert.Equal(t, 14.0, values["QueueProcessed_orders"])
+	assert.Equal(t, 0.0, values["backup_runs_total_ok"])
+
+	c.dir = filepath.Join(dir, "missing")
+	_, err = c.Collect(t.Context())
+	assert.ErrorContains(t, err, "textfile directory")
+}
+
+func Test_parsePromText(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      []customSample
+		expectedError string
+	}{
+		{
+			name:     "Untyped",
+			input:    "temperature 21.5\n",
+			expected: []customSample{{Name: "temperature", MType: "gauge", Value: 21.5}},
+		},
+		{
+			name:  "Labels",
+			input: "# TYPE requests_total counter\nrequests_total{code=\"200\", method=\"get\",} 10\nrequests_total{path=\"/api/v1\",empty=\"\"} 2\nrequests_total{q=\"a \\\"b\\\" }\"} 1\n",
+			expected: []customSample{
+				{Name: "requests_total_200_get", MType: "counter", Value: 10},
+				{Name: "requests_total_api_v1", MType: "counter", Value: 2},
+				{Name: "requests_total_a__b___", MType: "counter", Value: 1},
+			},
+		},
+		{
+			name:  "Summary",
+			input: "# TYPE rpc_seconds summary\nrpc_seconds{quantile=\"0.5\"} 0.1\nrpc_seconds_sum 10\nrpc_seconds_count 100\nrpc_count 5\n",
+			expected: []customSample{
+				{Name: "rpc_count", MType: "gauge", Value: 5},
+			},
+		},
+		{
+			name:          "Invalid",
+			input:         "a{code=\"200\" 1\nb{code=200} 1\nc\nd one\ne +Inf\nf 1 2 3\ng 2\n",
+			expected:      []customSample{{Name: "g", MType: "gauge", Value: 2}},
+			expectedError: "line 1: malformed labels",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, err := parsePromText([]byte(tt.input))
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.expectedError)
+			}
+			assert.Equal(t, tt.expected, samples)
+		})
+	}
+}
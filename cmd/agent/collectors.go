@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/config"
+)
+
+// collectorErrorsPrefix is the name prefix of the counters of failed collector runs,
+// followed by the collector name.
+const collectorErrorsPrefix = "CollectorErrors_"
+
+// Collector gathers a set of metrics on its own schedule.
+type Collector interface {
+	// Name identifies the collector in the configuration, in logs and in the name of
+	// its error counter.
+	Name() string
+
+	// Interval is how often the collector runs unless the configuration overrides it.
+	Interval() time.Duration
+
+	// Collect gathers the metrics: gauges with their value and counters with their
+	// increment since the previous call. If some metrics cannot be gathered, it returns
+	// the others together with an error. It must return once ctx is done.
+	Collect(ctx context.Context) ([]Metrics, error)
+}
+
+// registeredCollector is a collector known to the registry.
+type registeredCollector struct {
+	collector Collector // The collector
+	enabled   bool      // Whether it runs unless the configuration says otherwise
+}
+
+// collectorRegistry holds the collectors the agent can run and selects the ones
+// enabled by the configuration.
+type collectorRegistry struct {
+	entries []registeredCollector // Collectors in registration order
+}
+
+// register adds a collector to the registry.
+//
+// Parameters:
+//   - c: Collector to add
+//   - enabled: Whether the collector runs unless the configuration disables it
+//
+// Returns:
+//   - error: Error if a collector with the same name is already registered
+func (r *collectorRegistry) register(c Collector, enabled bool) error {
+	if r.lookup(c.Name()) != nil {
+		return fmt.Errorf("collector %q is already registered", c.Name())
+	}
+	r.entries = append(r.entries, registeredCollector{collector: c, enabled: enabled})
+	return nil
+}
+
+// lookup returns the registered collector with a name.
+//
+// Parameters:
+//   - name: Collector name
+//
+// Returns:
+//   - *registeredCollector: The collector, or nil if there is none with this name
+func (r *collectorRegistry) lookup(name string) *registeredCollector {
+	for i := range r.entries {
+		if r.entries[i].collector.Name() == name {
+			return &r.entries[i]
+		}
+	}
+	return nil
+}
+
+// names returns the names of the registered collectors.
+func (r *collectorRegistry) names() []string {
+	names := make([]string, len(r.entries))
+	for i, e := range r.entries {
+		names[i] = e.collector.Name()
+	}
+	return names
+}
+
+// scheduledCollector is an enabled collector with its effective schedule.
+type scheduledCollector struct {
+	collector Collector     // The collector
+	interval  time.Duration // Time between two runs
+	timeout   time.Duration // Time after which a run counts as failed
+}
+
+// configure selects the collectors to run and their schedules.
+//
+// The settings of the configuration file are applied first, then the selection,
+// which takes precedence: a comma-separated list of collector names, where a name
+// enables the collector and a name prefixed with "-" disables it, e.g. "-system".
+// Without an interval setting a collector runs at its own interval; without a
+// timeout setting a run may take up to the interval.
+//
+// Parameters:
+//   - selection: Collectors to enable or disable, e.g. from the -collectors flag
+//   - settings: Collector settings of the configuration file by collector name
+//
+// Returns:
+//   - []scheduledCollector: Enabled collectors in registration order
+//   - error: Error if a collector name is unknown or a setting is invalid
+func (r *collectorRegistry) configure(selection string, settings map[string]config.CollectorConfig) ([]scheduledCollector, error) {
+	enabled := make(map[string]bool, len(r.entries))
+	for _, e := range r.entries {
+		enabled[e.collector.Name()] = e.enabled
+	}
+	for name, cfg := range settings {
+		if r.lookup(name) == nil {
+			return nil, fmt.Errorf("unknown collector %q, known collectors: %s", name, strings.Join(r.names(), ", "))
+		}
+		if cfg.Enabled != nil {
+			enabled[name] = *cfg.Enabled
+		}
+	}
+	for _, field := range strings.Split(selection, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, disable := strings.CutPrefix(field, "-")
+		if r.lookup(name) == nil {
+			return nil, fmt.Errorf("unknown collector %q, known collectors: %s", name, strings.Join(r.names(), ", "))
+		}
+		enabled[name] = !disable
+	}
+
+	var scheduled []scheduledCollector
+	for _, e := range r.entries {
+		name := e.collector.Name()
+		if !enabled[name] {
+			continue
+		}
+		sc := scheduledCollector{collector: e.collector, interval: e.collector.Interval()}
+		cfg := settings[name]
+		if cfg.Interval != "" {
+			d, err := time.ParseDuration(cfg.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval of collector %q: %w", name, err)
+			}
+			sc.interval = d
+		}
+		sc.timeout = sc.interval
+		if cfg.Timeout != "" {
+			d, err := time.ParseDuration(cfg.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout of collector %q: %w", name, err)
+			}
+			sc.timeout = d
+		}
+		if sc.interval <= 0 || sc.timeout <= 0 {
+			return nil, fmt.Errorf("interval and timeout of collector %q must be positive, got %v and %v", name, sc.interval, sc.timeout)
+		}
+		scheduled = append(scheduled, sc)
+	}
+	return scheduled, nil
+}
+
+// collectResult is the outcome of one Collect call.
+type collectResult struct {
+	metrics []Metrics // Gathered metrics
+	err     error     // Error of the metrics that could not be gathered
+}
+
+// runCollectors runs every collector on its own schedule until ctx is done,
+// recording the gathered metrics in the store.
+//
+// Parameters:
+//   - ctx: Context whose cancellation stops the collectors
+//   - wg: WaitGroup to add the collector goroutines to
+//   - scheduled: Collectors to run
+//   - store: Store of the latest values
+func runCollectors(ctx context.Context, wg *sync.WaitGroup, scheduled []scheduledCollector, store *metricStore) {
+	for _, sc := range scheduled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.run(ctx, store)
+		}()
+	}
+}
+
+// run runs the collector right away and then at its interval until ctx is done.
+// Failed runs are counted in the collector's error counter; a run that does not
+// finish within the timeout counts as failed, and the collector is skipped until
+// it returns.
+//
+// Parameters:
+//   - ctx: Context whose cancellation stops the collector
+//   - store: Store of the latest values
+func (sc scheduledCollector) run(ctx context.Context, store *metricStore) {
+	errorsName := collectorErrorsPrefix + sc.collector.Name()
+	// Report the counter from the start, not only after the first failure
+	store.addCounter(errorsName, 0)
+
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+
+	// Result of a run that overran its timeout
+	var overrun <-chan collectResult
+	for {
+		if overrun != nil {
+			select {
+			case <-overrun:
+				overrun = nil
+			default:
+				log.Printf("Collector %s: Skipping run, the previous one has not finished\n", sc.collector.Name())
+				store.addCounter(errorsName, 1)
+			}
+		}
+		if overrun == nil {
+			overrun = sc.collect(ctx, store, errorsName)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect runs the collector once and records its metrics.
+//
+// Parameters:
+//   - ctx: Context whose cancellation stops the collector
+//   - store: Store of the latest values
+//   - errorsName: Name of the collector's error counter
+//
+// Returns:
+//   - <-chan collectResult: Channel the result arrives on if the run did not finish
+//     within the timeout, otherwise nil
+func (sc scheduledCollector) collect(ctx context.Context, store *metricStore, errorsName string) <-chan collectResult {
+	runCtx, cancel := context.WithTimeout(ctx, sc.timeout)
+	defer cancel()
+
+	done := make(chan collectResult, 1)
+	go func() {
+		ms, err := sc.collector.Collect(runCtx)
+		done <- collectResult{metrics: ms, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		store.record(res.metrics)
+		if res.err != nil && ctx.Err() == nil {
+			if errors.Is(res.err, context.DeadlineExceeded) {
+				log.Printf("Collector %s: Timed out after %v: %v\n", sc.collector.Name(), sc.timeout, res.err)
+			} else {
+				log.Printf("Collector %s: %v\n", sc.collector.Name(), res.err)
+			}
+			store.addCounter(errorsName, 1)
+		}
+		return nil
+	case <-runCtx.Done():
+		if ctx.Err() == nil {
+			log.Printf("Collector %s: Timed out after %v\n", sc.collector.Name(), sc.timeout)
+			store.addCounter(errorsName, 1)
+		}
+		return done
+	}
+}
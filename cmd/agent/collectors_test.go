@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/config"
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+// fakeCollector is a Collector running a function.
+type fakeCollector struct {
+	name     string
+	interval time.Duration
+	collect  func(ctx context.Context) ([]Metrics, error)
+}
+
+func (c *fakeCollector) Name() string            { return c.name }
+func (c *fakeCollector) Interval() time.Duration { return c.interval }
+func (c *fakeCollector) Collect(ctx context.Context) ([]Metrics, error) {
+	return c.collect(ctx)
+}
+
+func newFakeCollector(name string, interval time.Duration) *fakeCollector {
+	return &fakeCollector{name: name, interval: interval, collect: func(context.Context) ([]Metrics, error) { return nil, nil }}
+}
+
+func Test_collectorRegistry_configure(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		name              string
+		selection         string
+		settings          map[string]config.CollectorConfig
+		expectedCollected []string
+		expectedInterval  time.Duration
+		expectedTimeout   time.Duration
+		expectedError     string
+	}{
+		{
+			name:              "Defaults",
+			expectedCollected: []string{"runtime", "system"},
+			expectedInterval:  2 * time.Second,
+			expectedTimeout:   2 * time.Second,
+		},
+		{
+			name:              "Disabled by flag",
+			selection:         "-system",
+			expectedCollected: []string{"runtime"},
+			expectedInterval:  2 * time.Second,
+			expectedTimeout:   2 * time.Second,
+		},
+		{
+			name:              "Enabled by flag",
+			selection:         " disk , -system",
+			expectedCollected: []string{"runtime", "disk"},
+			expectedInterval:  2 * time.Second,
+			expectedTimeout:   2 * time.Second,
+		},
+		{
+			name:              "Config file",
+			settings:          map[string]config.CollectorConfig{"runtime": {Interval: "10s", Timeout: "1s"}, "system": {Enabled: &no}, "disk": {Enabled: &yes}},
+			expectedCollected: []string{"runtime", "disk"},
+			expectedInterval:  10 * time.Second,
+			expectedTimeout:   time.Second,
+		},
+		{
+			name:              "Flag overrides config file",
+			selection:         "system",
+			settings:          map[string]config.CollectorConfig{"runtime": {Interval: "5s"}, "system": {Enabled: &no}},
+			expectedCollected: []string{"runtime", "system"},
+			expectedInterval:  5 * time.Second,
+			expectedTimeout:   5 * time.Second,
+		},
+		{
+			name:          "Unknown collector in flag",
+			selection:     "-gpu",
+			expectedError: `unknown collector "gpu", known collectors: runtime, system, disk`,
+		},
+		{
+			name:          "Unknown collector in config file",
+			settings:      map[string]config.CollectorConfig{"gpu": {Enabled: &yes}},
+			expectedError: `unknown collector "gpu"`,
+		},
+		{
+			name:          "Invalid interval",
+			settings:      map[string]config.CollectorConfig{"runtime": {Interval: "often"}},
+			expectedError: `invalid interval of collector "runtime"`,
+		},
+		{
+			name:          "Negative timeout",
+			settings:      map[string]config.CollectorConfig{"runtime": {Timeout: "-1s"}},
+			expectedError: `interval and timeout of collector "runtime" must be positive`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := &collectorRegistry{}
+			require.NoError(t, registry.register(newFakeCollector("runtime", 2*time.Second), true))
+			require.NoError(t, registry.register(newFakeCollector("system", 2*time.Second), true))
+			require.NoError(t, registry.register(newFakeCollector("disk", 2*time.Second), false))
+
+			scheduled, err := registry.configure(tt.selection, tt.settings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			names := make([]string, len(scheduled))
+			for i, sc := range scheduled {
+				names[i] = sc.collector.Name()
+			}
+			assert.Equal(t, tt.expectedCollected, names)
+			assert.Equal(t, tt.expectedInterval, scheduled[0].interval)
+			assert.Equal(t, tt.expectedTimeout, scheduled[0].timeout)
+		})
+	}
+}
+
+func Test_collectorRegistry_registerTwice(t *testing.T) {
+	registry := &collectorRegistry{}
+	require.NoError(t, registry.register(newFakeCollector("runtime", time.Second), true))
+	assert.ErrorContains(t, registry.register(newFakeCollector("runtime", time.Second), true), `collector "runtime" is already registered`)
+}
+
+// counterTotal returns the total of a counter in the store.
+func counterTotal(store *metricStore, name string) (int64, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	total, ok := store.counters[name]
+	return total, ok
+}
+
+func Test_runCollectors(t *testing.T) {
+	const interval = 10 * time.Millisecond
+
+	ok := newFakeCollector("ok", interval)
+	ok.collect = func(context.Context) ([]Metrics, error) {
+		value, poll := 1.5, int64(1)
+		return []Metrics{{ID: "Up", MType: "gauge", Value: &value}, {ID: "Runs", MType: "counter", Delta: &poll}}, nil
+	}
+	partial := newFakeCollector("partial", interval)
+	partial.collect = func(context.Context) ([]Metrics, error) {
+		value := 2.0
+		return []Metrics{{ID: "Half", MType: "gauge", Value: &value}}, errors.New("other half failed")
+	}
+	slow := newFakeCollector("slow", interval)
+	slow.collect = func(ctx context.Context) ([]Metrics, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	// Ignores its context and blocks until released
+	release := make(chan struct{})
+	var calls atomic.Int32
+	stuck := newFakeCollector("stuck", interval)
+	stuck.collect = func(context.Context) ([]Metrics, error) {
+		calls.Add(1)
+		<-release
+		return nil, nil
+	}
+
+	store := newMetricStore()
+	ctx, cancel := context.WithCancel(t.Context())
+	var wg sync.WaitGroup
+	runCollectors(ctx, &wg, []scheduledCollector{
+		{collector: ok, interval: interval, timeout: time.Second},
+		{collector: partial, interval: interval, timeout: time.Second},
+		{collector: slow, interval: interval, timeout: 5 * time.Millisecond},
+		{collector: stuck, interval: interval, timeout: 5 * time.Millisecond},
+	}, store)
+
+	require.Eventually(t, func() bool {
+		runs, _ := counterTotal(store, "Runs")
+		slowErrors, _ := counterTotal(store, "CollectorErrors_slow")
+		stuckErrors, _ := counterTotal(store, "CollectorErrors_stuck")
+		return runs >= 3 && slowErrors >= 3 && stuckErrors >= 3
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	wg.Wait()
+	close(release)
+
+	// The stuck collector is not called again while its first run is pending
+	assert.Equal(t, int32(1), calls.Load())
+
+	okErrors, found := counterTotal(store, "CollectorErrors_ok")
+	assert.True(t, found, "the error counter is reported from the start")
+	assert.Zero(t, okErrors)
+	partialErrors, _ := counterTotal(store, "CollectorErrors_partial")
+	assert.Positive(t, partialErrors)
+
+	snapshot := store.snapshot()
+	gauges := map[string]float64{}
+	for _, m := range snapshot {
+		if m.MType == "gauge" {
+			gauges[m.ID] = *m.Value
+		}
+	}
+	assert.Equal(t, map[string]float64{"Up": 1.5, "Half": 2}, gauges, "metrics of failed runs are kept")
+}
+
+func Test_runtimeCollector(t *testing.T) {
+	c := newRuntimeCollector(2 * time.Second)
+	assert.Equal(t, "runtime", c.Name())
+	assert.Equal(t, 2*time.Second, c.Interval())
+
+	collect := func() map[string]Metrics {
+		ms, err := c.Collect(t.Context())
+		require.NoError(t, err)
+		byName := map[string]Metrics{}
+		for _, m := range ms {
+			_, dup := byName[m.ID]
+			require.False(t, dup, "%s reported twice", m.ID)
+			byName[m.ID] = m
+		}
+		return byName
+	}
+	byName := collect()
+
+	// Every MemStats gauge is still reported
+	for _, name := range []string{
+		"Alloc", "BuckHashSys", "Frees", "GCCPUFraction", "GCSys", "HeapAlloc", "HeapIdle", "HeapInuse",
+		"HeapObjects", "HeapReleased", "HeapSys", "LastGC", "Lookups", "MCacheInuse", "MCacheSys",
+		"MSpanInuse", "MSpanSys", "Mallocs", "NextGC", "NumForcedGC", "NumGC", "OtherSys",
+		"PauseTotalNs", "StackInuse", "StackSys", "Sys", "TotalAlloc", "RandomValue",
+	} {
+		m, ok := byName[name]
+		if assert.True(t, ok, "%s is reported", name) {
+			assert.Equal(t, "gauge", m.MType, name)
+			assert.NotNil(t, metricMetadata(name, "gauge"), "%s has metadata", name)
+		}
+	}
+	assert.Positive(t, *byName["Alloc"].Value)
+	assert.Equal(t, *byName["Alloc"].Value, *byName["HeapAlloc"].Value)
+	assert.GreaterOrEqual(t, *byName["Sys"].Value, *byName["HeapSys"].Value)
+	assert.GreaterOrEqual(t, *byName["Mallocs"].Value, *byName["Frees"].Value)
+	assert.Positive(t, *byName["Goroutines"].Value)
+	assert.NotNil(t, metricMetadata("Goroutines", "gauge"))
+	assert.Equal(t, int64(1), *byName["PollCount"].Delta, "every run counts as one poll")
+
+	// Histograms hold the observations since the previous run
+	numGC := *byName["NumGC"].Value
+	runtime.GC()
+	byName = collect()
+	assert.Equal(t, numGC+1, *byName["NumGC"].Value)
+	assert.Positive(t, *byName["LastGC"].Value)
+	pauses, ok := byName["GCPauses"]
+	require.True(t, ok, "the pauses of the forced GC are reported")
+	assert.Equal(t, "histogram", pauses.MType)
+	assert.Equal(t, runtimeLatencyBounds, pauses.Histogram.Bounds)
+	assert.Len(t, pauses.Histogram.Counts, len(runtimeLatencyBounds)+1)
+	assert.Positive(t, pauses.Histogram.Count)
+	assert.Less(t, pauses.Histogram.Count, int64(10), "earlier pauses are not reported again")
+	assert.NotNil(t, metricMetadata("GCPauses", "histogram"))
+}
+
+func Test_rebucketHistogram(t *testing.T) {
+	inf := math.Inf(1)
+	buckets := []float64{math.Inf(-1), 0, 1e-6, 2e-6, 1e-3, 2, inf}
+	bounds := []float64{1e-6, 1e-3, 1}
+
+	tests := []struct {
+		name     string
+		prev     []uint64
+		cur      []uint64
+		expected client.Histogram
+		ok       bool
+	}{
+		{
+			name:     "First read",
+			cur:      []uint64{0, 2, 1, 3, 1, 1},
+			expected: client.Histogram{Bounds: bounds, Counts: []int64{2, 4, 0, 2}, Count: 8, Sum: 2*0.5e-6 + 1.5e-6 + 3*(1e-6+0.5e-3) + (1e-3+2)/2 + 2},
+			ok:       true,
+		},
+		{
+			name:     "Increase",
+			prev:     []uint64{0, 2, 1, 3, 1, 1},
+			cur:      []uint64{0, 2, 1, 5, 1, 1},
+			expected: client.Histogram{Bounds: bounds, Counts: []int64{0, 2, 0, 0}, Count: 2, Sum: 2 * (1e-6 + 0.5e-3)},
+			ok:       true,
+		},
+		{
+			name: "Nothing new",
+			prev: []uint64{0, 2, 1, 3, 1, 1},
+			cur:  []uint64{0, 2, 1, 3, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, ok := rebucketHistogram(buckets, tt.prev, tt.cur, bounds)
+			assert.Equal(t, tt.ok, ok)
+			if !tt.ok {
+				return
+			}
+			assert.Equal(t, tt.expected.Bounds, h.Bounds)
+			assert.Equal(t, tt.expected.Counts, h.Counts)
+			assert.Equal(t, tt.expected.Count, h.Count)
+			assert.InDelta(t, tt.expected.Sum, h.Sum, 1e-12)
+		})
+	}
+}
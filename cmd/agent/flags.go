@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/SergeyDolin/metrics-and-alerting/internal/config"
@@ -52,11 +53,93 @@ var (
 	// Default value: empty string (no encryption)
 	cryptoKey = flag.String("crypto-key", "", "path to public key file for encryption")
 
+	// token is the bearer token sent in the Authorization header of every request.
+	// Can be set via command-line flag "-token" or environment variable "TOKEN".
+	// Default value: empty string (no authentication)
+	token = flag.String("token", "", "bearer token for server authentication")
+
+	// sourceID identifies this agent to the server, which tracks cumulative counters per source.
+	// Can be set via command-line flag "-source-id" or environment variable "SOURCE_ID".
+	// Default value: the host name
+	sourceID = flag.String("source-id", "", "identifier of this agent for cumulative counters (default: host name)")
+
+	// latencyBuckets lists the upper bounds, in seconds, of the buckets of the
+	// ReportLatency histogram reported by the agent.
+	// Can be set via command-line flag "-latency-buckets" or environment variable "LATENCY_BUCKETS".
+	// Default value: defaultLatencyBuckets
+	latencyBuckets = flag.String("latency-buckets", defaultLatencyBuckets, "comma-separated upper bounds in seconds of the report latency histogram buckets")
+
+	// batchMaxCount limits the number of metrics sent in one /updates request.
+	// Can be set via command-line flag "-batch-max-count" or environment variable "BATCH_MAX_COUNT".
+	// Default value: DefaultBatchMaxCount
+	batchMaxCount = flag.Int("batch-max-count", DefaultBatchMaxCount, "maximum number of metrics per batch")
+
+	// batchMaxBytes limits the size of the uncompressed JSON body of one /updates request.
+	// Can be set via command-line flag "-batch-max-bytes" or environment variable "BATCH_MAX_BYTES".
+	// Default value: DefaultBatchMaxBytes
+	batchMaxBytes = flag.Int("batch-max-bytes", DefaultBatchMaxBytes, "maximum uncompressed size in bytes of a batch")
+
+	// batchLinger defines how long a worker waits for more metrics before it sends a batch that is not full.
+	// Can be set via command-line flag "-batch-linger" or environment variable "BATCH_LINGER".
+	// Default value: DefaultBatchLinger
+	batchLinger = flag.Duration("batch-linger", DefaultBatchLinger, "time to wait for more metrics before sending a batch")
+
+	// spoolDir specifies the directory where batches are kept while the server cannot be reached.
+	// Can be set via command-line flag "-spool-dir" or environment variable "SPOOL_DIR".
+	// Default value: empty string (no spool, undeliverable batches are dropped)
+	spoolDir = flag.String("spool-dir", "", "directory for batches kept while the server is unreachable (disabled if empty)")
+
+	// spoolMaxBytes caps the size of the spool; the oldest batches are evicted first.
+	// Can be set via command-line flag "-spool-max-bytes" or environment variable "SPOOL_MAX_BYTES".
+	// Default value: DefaultSpoolMaxBytes
+	spoolMaxBytes = flag.Int64("spool-max-bytes", DefaultSpoolMaxBytes, "size cap in bytes of the spool directory")
+
+	// collectorSelection enables and disables collectors: a comma-separated list of
+	// collector names, where a name prefixed with "-" disables the collector.
+	// Can be set via command-line flag "-collectors" or environment variable "COLLECTORS".
+	// Default value: empty string (the collectors enabled by default and in the config file)
+	collectorSelection = flag.String("collectors", "", `collectors to enable, or to disable with a "-" prefix, e.g. "-system"`)
+
+	// processNames lists the names of the processes the process collector reports,
+	// separated by commas. The process collector is enabled if the list is not empty.
+	// Can be set via command-line flag "-processes" or environment variable "PROCESSES".
+	// Default value: empty string (no process metrics)
+	processNames = flag.String("processes", "", `comma-separated names of processes to report, e.g. "nginx,postgres"`)
+
+	// execList lists the commands run by the exec collector, separated by ";"; each
+	// command is split at spaces and run without a shell. The exec collector is
+	// enabled if there are commands to run.
+	// Can be set via command-line flag "-exec" or environment variable "EXEC".
+	// Default value: empty string (the commands of the config file, if any)
+	execList = flag.String("exec", "", `commands writing "name type value" lines, separated by ";", e.g. "/usr/local/bin/queue-depth.sh"`)
+
+	// textfileDir specifies the directory of the *.prom and *.json files read by the
+	// textfile collector, which is enabled if the directory is set.
+	// Can be set via command-line flag "-textfile-dir" or environment variable "TEXTFILE_DIR".
+	// Default value: empty string (no textfile metrics)
+	textfileDir = flag.String("textfile-dir", "", "directory of *.prom and *.json metric files (disabled if empty)")
+
+	// scrapeList lists the URLs of the Prometheus endpoints scraped by the scrape
+	// collector, separated by commas. The scrape collector is enabled if there are
+	// endpoints to scrape.
+	// Can be set via command-line flag "-scrape" or environment variable "SCRAPE".
+	// Default value: empty string (the targets of the config file, if any)
+	scrapeList = flag.String("scrape", "", `comma-separated URLs of Prometheus endpoints to scrape, e.g. "http://localhost:9100/metrics"`)
+
 	// configPath specifies the path to the configuration file
 	// Can be set via command-line flag "-c" or "-config" or environment variable "CONFIG".
 	// Default value: empty string (no config file)
 	configPath = flag.String("c", "", "path to config file")
 	_          = flag.String("config", "", "path to config file (alternative flag)")
+
+	// collectorSettings holds the collector settings of the config file by collector name.
+	collectorSettings map[string]config.CollectorConfig
+
+	// execSettings holds the exec collector commands of the config file.
+	execSettings []config.ExecConfig
+
+	// scrapeSettings holds the scrape collector targets of the config file.
+	scrapeSettings []config.ScrapeConfig
 )
 
 // parseArgs processes command-line arguments and environment variables to configure the agent.
@@ -70,11 +153,25 @@ var (
 //   - KEY: Overrides the HMAC secret key (overrides -k flag)
 //   - RATE_LIMIT: Overrides the rate limit (overrides -l flag)
 //   - CRYPTO_KEY: Overrides the path to the public key file (overrides -crypto-key flag)
+//   - TOKEN: Overrides the bearer token (overrides -token flag)
+//   - SOURCE_ID: Overrides the source identifier (overrides -source-id flag)
+//   - LATENCY_BUCKETS: Overrides the report latency buckets (overrides -latency-buckets flag)
+//   - BATCH_MAX_COUNT: Overrides the maximum number of metrics per batch (overrides -batch-max-count flag)
+//   - BATCH_MAX_BYTES: Overrides the maximum size of a batch (overrides -batch-max-bytes flag)
+//   - BATCH_LINGER: Overrides the batch linger time, e.g. "100ms" (overrides -batch-linger flag)
+//   - SPOOL_DIR: Overrides the spool directory (overrides -spool-dir flag)
+//   - SPOOL_MAX_BYTES: Overrides the spool size cap (overrides -spool-max-bytes flag)
+//   - COLLECTORS: Overrides the enabled and disabled collectors (overrides -collectors flag)
+//   - PROCESSES: Overrides the names of the reported processes (overrides -processes flag)
+//   - EXEC: Overrides the commands of the exec collector (overrides -exec flag)
+//   - TEXTFILE_DIR: Overrides the directory of the textfile collector (overrides -textfile-dir flag)
+//   - SCRAPE: Overrides the endpoints of the scrape collector (overrides -scrape flag)
 //
 // The function logs warnings when:
 //   - Environment variables are not set (informational)
-//   - Integer environment variables (POLL_INTERVAL, REPORT_INTERVAL, RATE_LIMIT)
-//     contain invalid values that cannot be parsed
+//   - Integer environment variables (POLL_INTERVAL, REPORT_INTERVAL, RATE_LIMIT,
+//     BATCH_MAX_COUNT, BATCH_MAX_BYTES, SPOOL_MAX_BYTES) or BATCH_LINGER contain invalid
+//     values that cannot be parsed
 //
 // This function should be called early in the program initialization,
 // typically right after the main() function starts.
@@ -136,6 +233,103 @@ func parseArgs() {
 		log.Printf("%s not set\n", cryptoKeyOs)
 	}
 
+	// Override bearer token from environment variable if provided
+	if tokenOs, ok := os.LookupEnv("TOKEN"); ok {
+		*token = tokenOs
+	} else {
+		log.Printf("%s not set\n", tokenOs)
+	}
+
+	// Override source identifier from environment variable if provided
+	if sourceIDOs, ok := os.LookupEnv("SOURCE_ID"); ok {
+		*sourceID = sourceIDOs
+	} else {
+		log.Printf("%s not set\n", sourceIDOs)
+	}
+
+	// Override report latency buckets from environment variable if provided
+	if bucketsOs, ok := os.LookupEnv("LATENCY_BUCKETS"); ok {
+		*latencyBuckets = bucketsOs
+	} else {
+		log.Printf("%s not set\n", bucketsOs)
+	}
+
+	// Override batch limits from environment variables if provided and valid
+	if countOs, ok := os.LookupEnv("BATCH_MAX_COUNT"); ok {
+		if count, err := strconv.Atoi(countOs); err == nil {
+			*batchMaxCount = count
+		} else {
+			log.Printf("Invalid BATCH_MAX_COUNT value '%s': %v", countOs, err)
+		}
+	} else {
+		log.Printf("%s not set\n", countOs)
+	}
+	if bytesOs, ok := os.LookupEnv("BATCH_MAX_BYTES"); ok {
+		if size, err := strconv.Atoi(bytesOs); err == nil {
+			*batchMaxBytes = size
+		} else {
+			log.Printf("Invalid BATCH_MAX_BYTES value '%s': %v", bytesOs, err)
+		}
+	} else {
+		log.Printf("%s not set\n", bytesOs)
+	}
+	if lingerOs, ok := os.LookupEnv("BATCH_LINGER"); ok {
+		if linger, err := time.ParseDuration(lingerOs); err == nil {
+			*batchLinger = linger
+		} else {
+			log.Printf("Invalid BATCH_LINGER value '%s': %v", lingerOs, err)
+		}
+	} else {
+		log.Printf("%s not set\n", lingerOs)
+	}
+
+	// Override spool settings from environment variables if provided and valid
+	if spoolDirOs, ok := os.LookupEnv("SPOOL_DIR"); ok {
+		*spoolDir = spoolDirOs
+	} else {
+		log.Printf("%s not set\n", spoolDirOs)
+	}
+	if spoolBytesOs, ok := os.LookupEnv("SPOOL_MAX_BYTES"); ok {
+		if size, err := strconv.ParseInt(spoolBytesOs, 10, 64); err == nil {
+			*spoolMaxBytes = size
+		} else {
+			log.Printf("Invalid SPOOL_MAX_BYTES value '%s': %v", spoolBytesOs, err)
+		}
+	} else {
+		log.Printf("%s not set\n", spoolBytesOs)
+	}
+
+	// Override collector selection from environment variable if provided
+	if collectorsOs, ok := os.LookupEnv("COLLECTORS"); ok {
+		*collectorSelection = collectorsOs
+	} else {
+		log.Printf("%s not set\n", collectorsOs)
+	}
+
+	// Override reported process names from environment variable if provided
+	if processesOs, ok := os.LookupEnv("PROCESSES"); ok {
+		*processNames = processesOs
+	} else {
+		log.Printf("%s not set\n", processesOs)
+	}
+
+	// Override custom metric sources from environment variables if provided
+	if execOs, ok := os.LookupEnv("EXEC"); ok {
+		*execList = execOs
+	} else {
+		log.Printf("%s not set\n", execOs)
+	}
+	if textfileDirOs, ok := os.LookupEnv("TEXTFILE_DIR"); ok {
+		*textfileDir = textfileDirOs
+	} else {
+		log.Printf("%s not set\n", textfileDirOs)
+	}
+	if scrapeOs, ok := os.LookupEnv("SCRAPE"); ok {
+		*scrapeList = scrapeOs
+	} else {
+		log.Printf("%s not set\n", scrapeOs)
+	}
+
 	// Load configuration from file if provided
 	configFilePath := *configPath
 	if envConfigPath := os.Getenv("CONFIG"); envConfigPath != "" {
@@ -164,8 +358,34 @@ func parseArgs() {
 			if *cryptoKey == "" {
 				*cryptoKey = agentConfig.CryptoKey
 			}
+			if *token == "" {
+				*token = agentConfig.Token
+			}
+			if *sourceID == "" {
+				*sourceID = agentConfig.SourceID
+			}
+			if *processNames == "" {
+				*processNames = strings.Join(agentConfig.Processes, ",")
+			}
+			if *textfileDir == "" {
+				*textfileDir = agentConfig.TextfileDir
+			}
+			// The -exec commands and -scrape URLs replace those of the config file
+			execSettings = agentConfig.Exec
+			scrapeSettings = agentConfig.Scrape
+			// The -collectors selection is applied on top of these settings
+			collectorSettings = agentConfig.Collectors
 		} else {
 			log.Printf("Failed to load config file: %v", err)
 		}
 	}
+
+	// Fall back to the host name, which is stable across agent restarts
+	if *sourceID == "" {
+		if host, err := os.Hostname(); err == nil {
+			*sourceID = host
+		} else {
+			log.Printf("Cannot determine host name for the source identifier: %v", err)
+		}
+	}
 }
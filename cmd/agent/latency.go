@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+const (
+	// reportLatencyName is the name of the histogram of the agent's report request latencies.
+	reportLatencyName = "ReportLatency"
+
+	// defaultLatencyBuckets are the default upper bounds, in seconds, of the report latency histogram.
+	defaultLatencyBuckets = "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5"
+
+	// maxLatencyBuckets is the largest number of bounds the server accepts in a histogram.
+	maxLatencyBuckets = 64
+)
+
+// parseLatencyBuckets parses a comma-separated list of histogram bucket upper bounds.
+//
+// Parameters:
+//   - s: Bounds in seconds, e.g. "0.1,0.5,1"
+//
+// Returns:
+//   - []float64: Parsed bounds
+//   - error: Error if a bound does not parse, is not finite, the bounds are not strictly
+//     ascending or there are more than maxLatencyBuckets
+func parseLatencyBuckets(s string) ([]float64, error) {
+	var bounds []float64
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		b, err := strconv.ParseFloat(field, 64)
+		if err != nil || math.IsInf(b, 0) || math.IsNaN(b) {
+			return nil, fmt.Errorf("invalid latency bucket %q", field)
+		}
+		if len(bounds) > 0 && b <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("latency buckets must be strictly ascending, got %v after %v", b, bounds[len(bounds)-1])
+		}
+		bounds = append(bounds, b)
+	}
+	if len(bounds) > maxLatencyBuckets {
+		return nil, fmt.Errorf("at most %d latency buckets are allowed, got %d", maxLatencyBuckets, len(bounds))
+	}
+	return bounds, nil
+}
+
+// latencyHistogram records the latencies of report requests between two reports.
+// It is safe for concurrent use by the workers.
+type latencyHistogram struct {
+	mu     sync.Mutex // Guards the fields below
+	bounds []float64  // Upper bounds of the buckets in seconds
+	counts []int64    // Observations per bucket, the last one for values above all bounds
+	count  int64      // Total number of observations
+	sum    float64    // Sum of the observations in seconds
+}
+
+// newLatencyHistogram creates an empty latency histogram.
+//
+// Parameters:
+//   - bounds: Strictly ascending bucket upper bounds in seconds
+//
+// Returns:
+//   - *latencyHistogram: Histogram ready to record observations
+func newLatencyHistogram(bounds []float64) *latencyHistogram {
+	return &latencyHistogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// observe records the latency of one request.
+//
+// Parameters:
+//   - d: Duration of the request
+func (h *latencyHistogram) observe(d time.Duration) {
+	v := d.Seconds()
+	// A bucket counts the values less than or equal to its bound
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// take returns the observations recorded since the last take and starts over.
+//
+// Returns:
+//   - client.Histogram: Recorded observations
+//   - bool: false if nothing was recorded
+func (h *latencyHistogram) take() (client.Histogram, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return client.Histogram{}, false
+	}
+	out := client.Histogram{Bounds: slices.Clone(h.bounds), Counts: h.counts, Count: h.count, Sum: h.sum}
+	h.counts = make([]int64, len(h.bounds)+1)
+	h.count, h.sum = 0, 0
+	return out, true
+}
+
+// restore adds observations returned by take back, so that they are reported
+// again after a failed send.
+//
+// Parameters:
+//   - taken: Observations returned by take
+func (h *latencyHistogram) restore(taken client.Histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !slices.Equal(taken.Bounds, h.bounds) {
+		return
+	}
+	for i, c := range taken.Counts {
+		h.counts[i] += c
+	}
+	h.count += taken.Count
+	h.sum += taken.Sum
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -41,11 +43,15 @@ func printBuildInfo() {
 //  1. Starts a pprof profiling server for debugging and performance analysis
 //  2. Parses configuration from command-line flags and environment variables
 //  3. Initializes a metric queue and worker pool for concurrent metric processing
-//  4. Runs a metric collection loop that gathers runtime and system metrics
-//  5. Handles graceful shutdown on SIGINT and SIGTERM signals
+//  4. Runs the enabled collectors, such as the runtime, system, disk, network,
+//     process and cgroup ones, the exec and textfile collectors of custom metrics
+//     and the scrape collector of Prometheus endpoints, on their own schedules
+//  5. Runs a reporting loop that queues the latest values every report interval
+//  6. Handles graceful shutdown on SIGINT and SIGTERM signals
 //
 // The agent continues running until it receives a termination signal,
-// at which point it ensures all queued metrics are processed before exiting.
+// at which point it reports the latest values once more and ensures all
+// queued metrics are sent before exiting.
 func main() {
 	// Initialize structured logger for the application
 	logger, err := zap.NewDevelopment()
@@ -63,72 +69,116 @@ func main() {
 		log.Infoln(http.ListenAndServe("localhost:8081", nil))
 	}()
 
-	// Initialize HTTP client for sending metrics to the server
-	client := http.Client{}
-
 	// Parse configuration from flags and environment variables
 	parseArgs()
 
-	// Create a buffered queue for metrics with capacity of 100 items
-	// This queue acts as a buffer between metric collection and sending
-	queue := NewMetricQueue(100)
-
-	// Create and start a worker pool for concurrent metric processing
-	// The pool size is determined by the rateLimit configuration
-	pool := NewWorkerPool(*rateLimit, queue, &client, *sAddr)
-	pool.Start()
-
-	// Start metric collection goroutine
-	// This loop runs continuously, collecting metrics at the specified poll interval
-	go func() {
-		// Convert poll interval from seconds to time.Duration
-		pollInterval := time.Duration(*pInterval) * time.Second
-
-		// Initialize counter for PollCount metric
-		counter := int64(0)
+	// Determine the address reported in X-Real-IP for the server's trusted subnet check
+	if ip, err := outboundIP(*sAddr); err != nil {
+		log.Warnf("X-Real-IP will not be sent: %v", err)
+	} else {
+		localIP = ip
+	}
 
-		// Pre-allocate maps for metrics to reduce allocations during collection
-		runtimeMetrics := make(map[string]float64, 30) // Runtime metrics like MemStats
-		systemMetrics := make(map[string]float64, 5)   // System metrics like CPU, memory
+	// Create the client that sends the reports with the keys and token of the configuration
+	sender, err := newSender(&http.Client{}, *sAddr)
+	if err != nil {
+		log.Fatalf("Cannot create metrics client: %v", err)
+	}
 
-		// Infinite collection loop
-		for {
-			// Wait for the next poll interval
-			time.Sleep(pollInterval)
+	// Create a buffered queue between reporting and sending that holds a batch per
+	// worker. A report larger than the queue waits for the workers instead of
+	// dropping metrics
+	queue := NewMetricQueue(*batchMaxCount * max(*rateLimit, 1))
 
-			// Collect Go runtime metrics (MemStats, etc.)
-			CollectRuntimeMetrics(runtimeMetrics)
+	// Record the latency of report requests in the configured buckets
+	bounds, err := parseLatencyBuckets(*latencyBuckets)
+	if err != nil {
+		log.Fatalf("Invalid latency buckets: %v", err)
+	}
+	latency := newLatencyHistogram(bounds)
 
-			// Collect system-level metrics (CPU, memory usage, etc.)
-			CollectSystemMetrics(systemMetrics)
+	// Create and start a worker pool for concurrent metric processing
+	// The pool size is determined by the rateLimit configuration; each worker
+	// sends the queued metrics in batches through /updates
+	limits := batchLimits{maxCount: *batchMaxCount, maxBytes: *batchMaxBytes, linger: *batchLinger}
+	pool := NewWorkerPool(*rateLimit, queue, sender, limits)
+	pool.latency = latency
+
+	// Keep the batches the server cannot take on disk, including those left by an
+	// earlier run, and replay them in order once the server is reachable
+	if *spoolDir != "" {
+		sp, err := openSpool(*spoolDir, *spoolMaxBytes)
+		if err != nil {
+			log.Fatalf("Cannot open spool: %v", err)
+		}
+		defer sp.close()
+		pool.spool = sp
+	}
+	pool.Start()
 
-			// Increment PollCount counter for each collection cycle
-			counter++
+	// Polling and reporting run at their own intervals: every collector run updates
+	// the latest values in the store, and every report queues a snapshot of them
+	pollInterval := time.Duration(*pInterval) * time.Second
+	reportInterval := time.Duration(*rInterval) * time.Second
+	if pollInterval <= 0 || reportInterval <= 0 {
+		log.Fatalf("Poll and report intervals must be positive, got %v and %v", pollInterval, reportInterval)
+	}
+	store := newMetricStore()
+	ctx, stop := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	// Run every enabled collector on its own schedule. The process, exec, textfile
+	// and scrape collectors are enabled once there is something to report, and the
+	// cgroup collector where a cgroup file system is mounted
+	processes := parseProcessNames(*processNames)
+	commands, err := parseExecCommands(*execList, execSettings)
+	if err != nil {
+		log.Fatalf("Invalid exec collector configuration: %v", err)
+	}
+	targets, err := parseScrapeTargets(*scrapeList, scrapeSettings)
+	if err != nil {
+		log.Fatalf("Invalid scrape collector configuration: %v", err)
+	}
+	cgroup := newCgroupCollector(pollInterval)
+	registry := &collectorRegistry{}
+	for _, rc := range []registeredCollector{
+		{collector: newRuntimeCollector(pollInterval), enabled: true},
+		{collector: newSystemCollector(pollInterval), enabled: true},
+		{collector: newDiskCollector(pollInterval), enabled: true},
+		{collector: newDiskIOCollector(pollInterval), enabled: true},
+		{collector: newNetCollector(pollInterval), enabled: true},
+		{collector: newLoadCollector(pollInterval), enabled: true},
+		{collector: newSwapCollector(pollInterval), enabled: true},
+		{collector: newProcessCollector(pollInterval, processes), enabled: len(processes) > 0},
+		{collector: cgroup, enabled: cgroup.available()},
+		{collector: newExecCollector(pollInterval, commands), enabled: len(commands) > 0},
+		{collector: newTextfileCollector(pollInterval, *textfileDir), enabled: *textfileDir != ""},
+		{collector: newScrapeCollector(pollInterval, targets), enabled: len(targets) > 0},
+	} {
+		if err := registry.register(rc.collector, rc.enabled); err != nil {
+			log.Fatalf("Cannot register collector: %v", err)
+		}
+	}
+	scheduled, err := registry.configure(*collectorSelection, collectorSettings)
+	if err != nil {
+		log.Fatalf("Invalid collector configuration: %v", err)
+	}
+	runCollectors(ctx, &wg, scheduled, store)
 
-			// Queue all runtime gauge metrics for sending
-			for name, value := range runtimeMetrics {
-				queue.Push(Metrics{
-					ID:    name,
-					MType: "gauge",
-					Value: &value,
-				})
-			}
+	// Start reporting goroutine
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(reportInterval)
+		defer ticker.Stop()
 
-			// Queue all system gauge metrics for sending
-			for name, value := range systemMetrics {
-				queue.Push(Metrics{
-					ID:    name,
-					MType: "gauge",
-					Value: &value,
-				})
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report(queue, store, latency)
 			}
-
-			// Queue the PollCount counter metric
-			queue.Push(Metrics{
-				ID:    "PollCount",
-				MType: "counter",
-				Delta: &counter,
-			})
 		}
 	}()
 
@@ -140,21 +190,19 @@ func main() {
 
 	// Block until a signal is received
 	<-sigChan
-	log.Infoln("Shutdown signal received, waiting for workers to finish.")
+	log.Infoln("Shutdown signal received, sending the final report.")
 
-	// Stop the worker pool - no new metrics will be processed
-	pool.Stop()
+	// Stop polling and reporting, then report the latest values one last time
+	stop()
+	wg.Wait()
+	report(queue, store, latency)
 
-	// Allow time for in-flight requests to complete
-	time.Sleep(time.Duration(*pInterval) * time.Second)
+	// Stop the worker pool; the workers send the batches they have collected
+	pool.Stop()
 
-	// Process any remaining metrics in the queue synchronously
-	// This ensures no metrics are lost during shutdown
-	for !queue.IsEmpty() {
-		metric := queue.Pop()
-		// Send each remaining metric directly (bypassing the worker pool)
-		sendMetricJSON(&client, metric.ID, metric.MType, *sAddr, metric.Value, metric.Delta)
-	}
+	// Send any remaining metrics in the queue in batches, or spool them if the server
+	// cannot be reached. This ensures no metrics are lost during shutdown
+	pool.flushQueue()
 
 	// Log completion and exit
 	log.Infoln("Agent shutdown complete.")
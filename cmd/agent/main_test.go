@@ -1,101 +1,40 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func Test_sendMetric(t *testing.T) {
-	// sendMetric не имеет тела → не использует подпись → тест без изменений
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, http.MethodPost, r.Method)
-		assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
-
-		path := r.URL.Path
-		assert.True(t, strings.HasPrefix(path, "/update/"))
-
-		parts := strings.Split(strings.TrimPrefix(path, "/update/"), "/")
-		assert.Len(t, parts, 3)
-
-		metricType, metricName, metricValue := parts[0], parts[1], parts[2]
-		assert.NotEmpty(t, metricType)
-		assert.NotEmpty(t, metricName)
-		assert.NotEmpty(t, metricValue)
-
-		w.WriteHeader(http.StatusOK)
-	}))
-	defer server.Close()
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	serverAddr := strings.TrimPrefix(server.URL, "http://")
-
-	tests := []struct {
-		name       string
-		metricName string
-		typeMetric string
-		value      string
-		serverAddr string
-		wantErr    bool
-	}{
-		{
-			name:       "Valid gauge metric",
-			metricName: "Alloc",
-			typeMetric: "gauge",
-			value:      "12345.678",
-			serverAddr: serverAddr,
-			wantErr:    false,
-		},
-		{
-			name:       "Valid counter metric",
-			metricName: "PollCount",
-			typeMetric: "counter",
-			value:      "5",
-			serverAddr: serverAddr,
-			wantErr:    false,
-		},
-		{
-			name:       "Invalid server address",
-			metricName: "Alloc",
-			typeMetric: "gauge",
-			value:      "1.0",
-			serverAddr: "localhost:12345",
-			wantErr:    true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			err := sendMetric(client, tt.metricName, tt.typeMetric, tt.value, tt.serverAddr)
-			if tt.wantErr {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
-		})
-	}
+// newTestSender creates the client of the agent for a test server.
+func newTestSender(t testing.TB, serverAddr string) *client.Client {
+	sender, err := newSender(&http.Client{Timeout: 5 * time.Second}, serverAddr)
+	require.NoError(t, err)
+	return sender
 }
 
-func Test_sendMetricJSON(t *testing.T) {
+func Test_sendBatchJSONFrom(t *testing.T) {
 	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
 		gz, err := gzip.NewReader(r.Body)
 		assert.NoError(t, err)
 		defer gz.Close()
 		body, _ := io.ReadAll(gz)
-		var m Metrics
-		assert.NoError(t, json.Unmarshal(body, &m))
+		var batch []Metrics
+		assert.NoError(t, json.Unmarshal(body, &batch))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(m)
+		json.NewEncoder(w).Encode(batch)
 	}))
 	defer okServer.Close()
 
@@ -104,52 +43,36 @@ func Test_sendMetricJSON(t *testing.T) {
 	}))
 	defer errServer.Close()
 
-	client := &http.Client{Timeout: 5 * time.Second}
 	okAddr := strings.TrimPrefix(okServer.URL, "http://")
 	errAddr := strings.TrimPrefix(errServer.URL, "http://")
 
 	tests := []struct {
 		name        string
-		metricName  string
-		metricType  string
-		value       *float64
-		delta       *int64
+		metric      Metrics
 		serverAddr  string
 		expectError bool
 	}{
 		{
 			name:        "Valid gauge metric",
-			metricName:  "Temperature",
-			metricType:  "gauge",
-			value:       func() *float64 { v := 25.5; return &v }(),
-			delta:       nil,
+			metric:      Metrics{ID: "Temperature", MType: "gauge", Value: func() *float64 { v := 25.5; return &v }()},
 			serverAddr:  okAddr,
 			expectError: false,
 		},
 		{
 			name:        "Valid counter metric",
-			metricName:  "PollCount",
-			metricType:  "counter",
-			value:       nil,
-			delta:       func() *int64 { v := int64(10); return &v }(),
+			metric:      Metrics{ID: "PollCount", MType: "counter", Delta: func() *int64 { v := int64(10); return &v }()},
 			serverAddr:  okAddr,
 			expectError: false,
 		},
 		{
 			name:        "Server returns error",
-			metricName:  "RandomValue",
-			metricType:  "gauge",
-			value:       func() *float64 { v := 0.123; return &v }(),
-			delta:       nil,
+			metric:      Metrics{ID: "RandomValue", MType: "gauge", Value: func() *float64 { v := 0.123; return &v }()},
 			serverAddr:  errAddr,
 			expectError: true,
 		},
 		{
 			name:        "Invalid server address",
-			metricName:  "Alloc",
-			metricType:  "gauge",
-			value:       func() *float64 { v := 12345.0; return &v }(),
-			delta:       nil,
+			metric:      Metrics{ID: "Alloc", MType: "gauge", Value: func() *float64 { v := 12345.0; return &v }()},
 			serverAddr:  "localhost:12345",
 			expectError: true,
 		},
@@ -157,7 +80,7 @@ func Test_sendMetricJSON(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := sendMetricJSON(client, tt.metricName, tt.metricType, tt.serverAddr, tt.value, tt.delta)
+			err := sendBatchJSONFrom(newTestSender(t, tt.serverAddr), []Metrics{tt.metric}, startTime)
 			if tt.expectError {
 				assert.Error(t, err)
 			} else {
@@ -167,45 +90,7 @@ func Test_sendMetricJSON(t *testing.T) {
 	}
 }
 
-func Test_sendMetricJSON_GzipCompression(t *testing.T) {
-	var receivedBody []byte
-	var contentEncoding string
-
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		contentEncoding = r.Header.Get("Content-Encoding")
-		receivedBody, _ = io.ReadAll(r.Body)
-		w.WriteHeader(http.StatusOK)
-	}))
-	defer server.Close()
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	serverAddr := strings.TrimPrefix(server.URL, "http://")
-
-	metricName := "TestGauge"
-	metricType := "gauge"
-	value := 42.0
-
-	err := sendMetricJSON(client, metricName, metricType, serverAddr, &value, nil)
-	assert.NoError(t, err)
-
-	assert.Equal(t, "gzip", contentEncoding)
-
-	gz, err := gzip.NewReader(bytes.NewReader(receivedBody))
-	assert.NoError(t, err)
-	defer gz.Close()
-
-	decompressed, err := io.ReadAll(gz)
-	assert.NoError(t, err)
-
-	var metric Metrics
-	err = json.Unmarshal(decompressed, &metric)
-	assert.NoError(t, err)
-	assert.Equal(t, metricName, metric.ID)
-	assert.Equal(t, metricType, metric.MType)
-	assert.Equal(t, value, *metric.Value)
-}
-
-func Test_sendBatchJSON_Success(t *testing.T) {
+func Test_sendBatchJSONFrom_Success(t *testing.T) {
 	var receivedMetrics []Metrics
 	var contentEncoding string
 
@@ -231,7 +116,6 @@ func Test_sendBatchJSON_Success(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := &http.Client{Timeout: 5 * time.Second}
 	serverAddr := strings.TrimPrefix(server.URL, "http://")
 
 	batch := []Metrics{
@@ -239,7 +123,7 @@ func Test_sendBatchJSON_Success(t *testing.T) {
 		{ID: "Counter1", MType: "counter", Delta: func(v int64) *int64 { return &v }(2)},
 	}
 
-	err := sendBatchJSON(client, batch, serverAddr)
+	err := sendBatchJSONFrom(newTestSender(t, serverAddr), batch, startTime)
 	assert.NoError(t, err)
 	assert.Equal(t, "gzip", contentEncoding)
 	assert.Len(t, receivedMetrics, 2)
@@ -258,7 +142,7 @@ func Test_sendBatchJSON_Success(t *testing.T) {
 	assert.True(t, gotCounter)
 }
 
-func Test_sendBatchJSON_EmptyBatch(t *testing.T) {
+func Test_sendBatchJSONFrom_EmptyBatch(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
@@ -266,11 +150,194 @@ func Test_sendBatchJSON_EmptyBatch(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := &http.Client{Timeout: 5 * time.Second}
 	serverAddr := strings.TrimPrefix(server.URL, "http://")
 
 	// Пустой срез
-	err := sendBatchJSON(client, []Metrics{}, serverAddr)
+	err := sendBatchJSONFrom(newTestSender(t, serverAddr), []Metrics{}, startTime)
 	assert.NoError(t, err)
 	assert.False(t, called, "Server should not be called for empty batch")
 }
+
+func Test_sendBatchJSONFrom_RealIPHeader(t *testing.T) {
+	var realIP string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realIP = r.Header.Get("X-Real-IP")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverAddr := strings.TrimPrefix(server.URL, "http://")
+	ip, err := outboundIP(serverAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+
+	localIP = ip
+	defer func() { localIP = "" }()
+
+	err = sendBatchJSONFrom(newTestSender(t, serverAddr), gaugeBatch("TestGauge", 1), startTime)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", realIP)
+}
+
+func Test_sendBatchJSONFrom_CumulativeWithSourceHeaders(t *testing.T) {
+	var headers http.Header
+	var received []Metrics
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		received = decodeBatch(t, r)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	oldSourceID := *sourceID
+	*sourceID = "agent-1"
+	defer func() { *sourceID = oldSourceID }()
+
+	total := int64(42)
+	metric := Metrics{ID: "PollCount", MType: "counter", Delta: &total, Temporality: "cumulative"}
+	err := sendBatchJSONFrom(newTestSender(t, strings.TrimPrefix(server.URL, "http://")), []Metrics{metric}, startTime)
+	assert.NoError(t, err)
+
+	require.Len(t, received, 1)
+	assert.Equal(t, "cumulative", received[0].Temporality)
+	assert.Equal(t, int64(42), *received[0].Delta)
+	assert.Equal(t, "agent-1", headers.Get("X-Source-ID"))
+
+	// The start time identifies this run of the agent; a restart sends a new one
+	start, err := time.Parse(time.RFC3339Nano, headers.Get("X-Source-Start"))
+	assert.NoError(t, err)
+	assert.True(t, start.Equal(startTime), "X-Source-Start = %v, want %v", start, startTime)
+}
+
+func Test_sendBatch_SendsMetadataUntilAccepted(t *testing.T) {
+	status := http.StatusBadRequest
+	var received []Metrics
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, decodeBatch(t, r)...)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	pool := newTestPool(server, batchLimits{maxCount: 1})
+	send := func(name string) {
+		value := 1.0
+		pool.sendBatch(0, []Metrics{pool.prepare(Metrics{ID: name, MType: "gauge", Value: &value})})
+	}
+
+	// Rejected samples keep their metadata for the next attempt
+	send("Alloc")
+	status = http.StatusOK
+	send("Alloc")
+	send("Alloc")
+	send("CPUutilization2")
+	send("Custom")
+
+	if assert.Len(t, received, 5) {
+		for _, m := range received[:2] {
+			if assert.NotNil(t, m.Meta) {
+				assert.Equal(t, "Alloc", m.Meta.ID)
+				assert.Equal(t, "bytes", m.Meta.Unit)
+			}
+		}
+		assert.Nil(t, received[2].Meta)
+		if assert.NotNil(t, received[3].Meta) {
+			assert.Equal(t, "Utilization of CPU core 2", received[3].Meta.Description)
+			assert.Equal(t, "percent", received[3].Meta.Unit)
+		}
+		assert.Nil(t, received[4].Meta)
+	}
+}
+
+func manyBuckets(n int) string {
+	bounds := make([]string, n)
+	for i := range bounds {
+		bounds[i] = strconv.Itoa(i + 1)
+	}
+	return strings.Join(bounds, ",")
+}
+
+func Test_parseLatencyBuckets(t *testing.T) {
+	tests := []struct {
+		name           string
+		input          string
+		expectedBounds []float64
+		expectedError  string
+	}{
+		{name: "Default", input: defaultLatencyBuckets, expectedBounds: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}},
+		{name: "Spaces", input: " 0.1, 1 ,", expectedBounds: []float64{0.1, 1}},
+		{name: "Empty", input: ""},
+		{name: "Not a number", input: "0.1,fast", expectedError: `invalid latency bucket "fast"`},
+		{name: "Infinite", input: "+Inf", expectedError: "invalid latency bucket"},
+		{name: "Descending", input: "1,0.5", expectedError: "strictly ascending"},
+		{name: "Too many", input: manyBuckets(65), expectedError: "at most 64 latency buckets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bounds, err := parseLatencyBuckets(tt.input)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedBounds, bounds)
+		})
+	}
+}
+
+func Test_sendBatch_ReportLatency(t *testing.T) {
+	status := http.StatusOK
+	var received []Metrics
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, decodeBatch(t, r)...)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	pool := newTestPool(server, batchLimits{maxCount: 1})
+	pool.latency = newLatencyHistogram([]float64{60})
+	send := func(m Metrics) {
+		pool.sendBatch(0, []Metrics{pool.prepare(m)})
+	}
+	value := 1.0
+	send(Metrics{ID: "Alloc", MType: "gauge", Value: &value})
+	send(Metrics{ID: "Alloc", MType: "gauge", Value: &value})
+
+	// Both requests were observed, every one well below a minute
+	h, ok := pool.latency.take()
+	require.True(t, ok)
+	assert.Equal(t, []float64{60}, h.Bounds)
+	assert.Equal(t, []int64{2, 0}, h.Counts)
+	assert.Equal(t, int64(2), h.Count)
+	_, ok = pool.latency.take()
+	assert.False(t, ok, "take must start over")
+
+	// A rejected histogram is put back, together with the latency of its own request
+	status = http.StatusBadRequest
+	send(Metrics{ID: reportLatencyName, MType: "histogram", Histogram: &h})
+	retried, ok := pool.latency.take()
+	require.True(t, ok)
+	assert.Equal(t, int64(3), retried.Count)
+
+	status = http.StatusOK
+	send(Metrics{ID: reportLatencyName, MType: "histogram", Histogram: &retried})
+	if assert.Len(t, received, 4) {
+		sent := received[3]
+		assert.Equal(t, "histogram", sent.MType)
+		assert.Nil(t, sent.Value)
+		assert.Nil(t, sent.Delta)
+		if assert.NotNil(t, sent.Histogram) {
+			assert.Equal(t, int64(3), sent.Histogram.Count)
+		}
+		if assert.NotNil(t, sent.Meta) {
+			assert.Equal(t, "seconds", sent.Meta.Unit)
+		}
+	}
+	// Only the last request remains for the next report
+	h, ok = pool.latency.take()
+	require.True(t, ok)
+	assert.Equal(t, int64(1), h.Count)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+// cpuUtilizationPrefix is the name prefix of the per-core CPU utilization gauges.
+const cpuUtilizationPrefix = "CPUutilization"
+
+// metricDescriptions maps the names of the metrics collected by the agent to their
+// description and unit. The agent sends them alongside the first sample of each metric.
+var metricDescriptions = map[string]client.Metadata{
+	"Alloc":                          {MType: "gauge", Description: "Bytes of allocated heap objects", Unit: "bytes"},
+	"BuckHashSys":                    {MType: "gauge", Description: "Bytes of memory in profiling bucket hash tables", Unit: "bytes"},
+	"Frees":                          {MType: "gauge", Description: "Cumulative count of heap objects freed", Unit: "objects"},
+	"GCCPUFraction":                  {MType: "gauge", Description: "Fraction of CPU time used by the GC since the program started", Unit: "ratio"},
+	"GCSys":                          {MType: "gauge", Description: "Bytes of memory in garbage collection metadata", Unit: "bytes"},
+	"HeapAlloc":                      {MType: "gauge", Description: "Bytes of allocated heap objects", Unit: "bytes"},
+	"HeapIdle":                       {MType: "gauge", Description: "Bytes in idle (unused) heap spans", Unit: "bytes"},
+	"HeapInuse":                      {MType: "gauge", Description: "Bytes in in-use heap spans", Unit: "bytes"},
+	"HeapObjects":                    {MType: "gauge", Description: "Number of allocated heap objects", Unit: "objects"},
+	"HeapReleased":                   {MType: "gauge", Description: "Bytes of physical memory returned to the OS", Unit: "bytes"},
+	"HeapSys":                        {MType: "gauge", Description: "Bytes of heap memory obtained from the OS", Unit: "bytes"},
+	"LastGC":                         {MType: "gauge", Description: "Time the last garbage collection finished", Unit: "nanoseconds since the Unix epoch"},
+	"Lookups":                        {MType: "gauge", Description: "Number of pointer lookups performed by the runtime", Unit: "lookups"},
+	"MCacheInuse":                    {MType: "gauge", Description: "Bytes of allocated mcache structures", Unit: "bytes"},
+	"MCacheSys":                      {MType: "gauge", Description: "Bytes of memory obtained from the OS for mcache structures", Unit: "bytes"},
+	"MSpanInuse":                     {MType: "gauge", Description: "Bytes of allocated mspan structures", Unit: "bytes"},
+	"MSpanSys":                       {MType: "gauge", Description: "Bytes of memory obtained from the OS for mspan structures", Unit: "bytes"},
+	"Mallocs":                        {MType: "gauge", Description: "Cumulative count of heap objects allocated", Unit: "objects"},
+	"NextGC":                         {MType: "gauge", Description: "Target heap size of the next GC cycle", Unit: "bytes"},
+	"NumForcedGC":                    {MType: "gauge", Description: "Number of GC cycles forced by calling runtime.GC", Unit: "cycles"},
+	"NumGC":                          {MType: "gauge", Description: "Number of completed GC cycles", Unit: "cycles"},
+	"OtherSys":                       {MType: "gauge", Description: "Bytes of memory in miscellaneous off-heap runtime allocations", Unit: "bytes"},
+	"PauseTotalNs":                   {MType: "gauge", Description: "Cumulative time spent in GC stop-the-world pauses", Unit: "nanoseconds"},
+	"StackInuse":                     {MType: "gauge", Description: "Bytes in stack spans", Unit: "bytes"},
+	"StackSys":                       {MType: "gauge", Description: "Bytes of stack memory obtained from the OS", Unit: "bytes"},
+	"Sys":                            {MType: "gauge", Description: "Total bytes of memory obtained from the OS", Unit: "bytes"},
+	"TotalAlloc":                     {MType: "gauge", Description: "Cumulative bytes allocated for heap objects", Unit: "bytes"},
+	"Goroutines":                     {MType: "gauge", Description: "Number of live goroutines", Unit: "goroutines"},
+	"GOMAXPROCS":                     {MType: "gauge", Description: "Number of OS threads that can execute Go code at once", Unit: "threads"},
+	"HeapLive":                       {MType: "gauge", Description: "Bytes of heap objects marked live by the last GC cycle", Unit: "bytes"},
+	"MutexWaitTotal":                 {MType: "gauge", Description: "Cumulative time goroutines spent blocked on sync.Mutex and sync.RWMutex", Unit: "seconds"},
+	"CgoCalls":                       {MType: "gauge", Description: "Cumulative count of calls from Go to C", Unit: "calls"},
+	"SchedLatency":                   {MType: "histogram", Description: "Time goroutines spent runnable before running", Unit: "seconds"},
+	"GCPauses":                       {MType: "histogram", Description: "Stop-the-world pauses of the garbage collector", Unit: "seconds"},
+	"RandomValue":                    {MType: "gauge", Description: "Random value in [0, 1) refreshed on every poll"},
+	"TotalMemory":                    {MType: "gauge", Description: "Total amount of physical memory", Unit: "bytes"},
+	"FreeMemory":                     {MType: "gauge", Description: "Amount of physical memory not in use", Unit: "bytes"},
+	"LoadAverage1":                   {MType: "gauge", Description: "System load average over the last minute", Unit: "processes"},
+	"LoadAverage5":                   {MType: "gauge", Description: "System load average over the last 5 minutes", Unit: "processes"},
+	"LoadAverage15":                  {MType: "gauge", Description: "System load average over the last 15 minutes", Unit: "processes"},
+	"SwapTotal":                      {MType: "gauge", Description: "Total amount of swap space", Unit: "bytes"},
+	"SwapUsed":                       {MType: "gauge", Description: "Amount of swap space in use", Unit: "bytes"},
+	"SwapFree":                       {MType: "gauge", Description: "Amount of swap space not in use", Unit: "bytes"},
+	"SwapUsedPercent":                {MType: "gauge", Description: "Share of the swap space in use", Unit: "percent"},
+	"CgroupMemoryUsage":              {MType: "gauge", Description: "Memory used by the agent's container", Unit: "bytes"},
+	"CgroupMemoryWorkingSet":         {MType: "gauge", Description: "Memory used by the agent's container without the inactive file cache", Unit: "bytes"},
+	"CgroupMemoryLimit":              {MType: "gauge", Description: "Memory limit of the agent's container", Unit: "bytes"},
+	"CgroupCPUPercent":               {MType: "gauge", Description: "CPU usage of the agent's container in percent of one core", Unit: "percent"},
+	"CgroupCPULimit":                 {MType: "gauge", Description: "CPU quota of the agent's container", Unit: "cores"},
+	"CgroupCPUPeriods":               {MType: "counter", Description: "CPU bandwidth periods of the agent's container", Unit: "periods"},
+	"CgroupCPUThrottledPeriods":      {MType: "counter", Description: "CPU bandwidth periods in which the agent's container was throttled", Unit: "periods"},
+	"CgroupCPUThrottledMicroseconds": {MType: "counter", Description: "Time the agent's container was throttled", Unit: "microseconds"},
+	"CgroupPids":                     {MType: "gauge", Description: "Number of processes and threads in the agent's container", Unit: "tasks"},
+	"CgroupPidsLimit":                {MType: "gauge", Description: "Limit of processes and threads in the agent's container", Unit: "tasks"},
+	"PollCount":                      {MType: "counter", Description: "Number of polls performed by the agent", Unit: "polls"},
+	"ReportLatency":                  {MType: "histogram", Description: "Latency of the agent's report requests", Unit: "seconds"},
+}
+
+// metricFamily describes the metrics whose names consist of a common prefix and an
+// instance, such as a CPU core, a mount point or a collector name.
+type metricFamily struct {
+	prefix      string // Name prefix preceding the instance
+	mtype       string // Metric type
+	description string // Description with a %s verb for the instance
+	unit        string // Unit of the values
+}
+
+// metricFamilies lists the per-instance metrics collected by the agent.
+var metricFamilies = []metricFamily{
+	{prefix: cpuUtilizationPrefix, mtype: "gauge", description: "Utilization of CPU core %s", unit: "percent"},
+	{prefix: collectorErrorsPrefix, mtype: "counter", description: "Failed or timed out runs of the %s collector", unit: "runs"},
+	{prefix: "DiskTotal_", mtype: "gauge", description: "Total size of the file system mounted at %s", unit: "bytes"},
+	{prefix: "DiskFree_", mtype: "gauge", description: "Free space of the file system mounted at %s", unit: "bytes"},
+	{prefix: "DiskUsed_", mtype: "gauge", description: "Used space of the file system mounted at %s", unit: "bytes"},
+	{prefix: "DiskUsedPercent_", mtype: "gauge", description: "Share of the file system mounted at %s in use", unit: "percent"},
+	{prefix: "DiskReadBytesPerSecond_", mtype: "gauge", description: "Bytes read from disk %s per second", unit: "bytes/s"},
+	{prefix: "DiskWriteBytesPerSecond_", mtype: "gauge", description: "Bytes written to disk %s per second", unit: "bytes/s"},
+	{prefix: "DiskReadsPerSecond_", mtype: "gauge", description: "Read operations completed by disk %s per second", unit: "operations/s"},
+	{prefix: "DiskWritesPerSecond_", mtype: "gauge", description: "Write operations completed by disk %s per second", unit: "operations/s"},
+	{prefix: "NetBytesSentPerSecond_", mtype: "gauge", description: "Bytes sent through network interface %s per second", unit: "bytes/s"},
+	{prefix: "NetBytesRecvPerSecond_", mtype: "gauge", description: "Bytes received through network interface %s per second", unit: "bytes/s"},
+	{prefix: "NetErrorsIn_", mtype: "counter", description: "Receive errors of network interface %s", unit: "packets"},
+	{prefix: "NetErrorsOut_", mtype: "counter", description: "Transmit errors of network interface %s", unit: "packets"},
+	{prefix: "NetDropsIn_", mtype: "counter", description: "Incoming packets dropped by network interface %s", unit: "packets"},
+	{prefix: "NetDropsOut_", mtype: "counter", description: "Outgoing packets dropped by network interface %s", unit: "packets"},
+	{prefix: "ProcessCount_", mtype: "gauge", description: "Number of running %s processes", unit: "processes"},
+	{prefix: "ProcessCPUPercent_", mtype: "gauge", description: "CPU usage of the %s processes in percent of one core", unit: "percent"},
+	{prefix: "ProcessMemoryRSS_", mtype: "gauge", description: "Resident memory of the %s processes", unit: "bytes"},
+	{prefix: "ProcessThreads_", mtype: "gauge", description: "Number of threads of the %s processes", unit: "threads"},
+	{prefix: scrapeUpPrefix, mtype: "gauge", description: "Whether the last scrape of target %s succeeded", unit: "boolean"},
+	{prefix: scrapeDurationPrefix, mtype: "gauge", description: "Duration of the last scrape of target %s", unit: "seconds"},
+	{prefix: scrapeSamplesPrefix, mtype: "gauge", description: "Metrics reported from the last scrape of target %s", unit: "metrics"},
+}
+
+// metricMetadata returns the metadata the agent sends for a metric.
+//
+// Parameters:
+//   - name: Metric name as collected
+//   - mtype: Metric type as collected
+//
+// Returns:
+//   - *client.Metadata: Metadata of the metric, or nil if none is known for its name and type
+func metricMetadata(name, mtype string) *client.Metadata {
+	md, ok := metricDescriptions[name]
+	for _, f := range metricFamilies {
+		if ok {
+			break
+		}
+		if instance, found := strings.CutPrefix(name, f.prefix); found && instance != "" {
+			md, ok = client.Metadata{MType: f.mtype, Description: fmt.Sprintf(f.description, instance), Unit: f.unit}, true
+		}
+	}
+	if !ok || md.MType != mtype {
+		return nil
+	}
+	md.ID = name
+	return &md
+}
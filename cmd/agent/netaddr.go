@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// localIP is the address of the network interface used to reach the server.
+// It is sent in the X-Real-IP header so that the server can check it against its trusted subnet.
+// Empty when the address could not be determined.
+var localIP string
+
+// outboundIP returns the local address of the interface the system would use to reach the server.
+// It opens a UDP socket towards the server, which selects a route without sending any packets.
+//
+// Parameters:
+//   - serverAddr: Server address in "host:port" format
+//
+// Returns:
+//   - string: Local IP address
+//   - error: An error if the server address cannot be resolved or no route exists
+func outboundIP(serverAddr string) (string, error) {
+	conn, err := net.Dial("udp", serverAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine outbound address: %w", err)
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return "", fmt.Errorf("unexpected local address type %T", conn.LocalAddr())
+	}
+	return addr.IP.String(), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// promLabel is a label of a sample in the Prometheus text format.
+type promLabel struct {
+	name  string // Label name
+	value string // Label value, unescaped
+}
+
+// promSample is a sample line in the Prometheus text format, e.g.
+// http_requests_total{code="200"} 1027.
+type promSample struct {
+	line   int         // Line number, for error messages
+	family string      // Name of the metric family, e.g. "rpc_seconds" for "rpc_seconds_sum"
+	mtype  string      // Type declared for the family: "counter", "gauge", "histogram", "summary" or "untyped"
+	name   string      // Name of the sample
+	labels []promLabel // Labels in the order of the line
+	value  float64     // Value, which may be NaN or infinite
+}
+
+// label returns the value of a label of the sample.
+//
+// Parameters:
+//   - name: Label name
+//
+// Returns:
+//   - string: Label value
+//   - bool: false if the sample has no such label
+func (s promSample) label(name string) (string, bool) {
+	for _, l := range s.labels {
+		if l.name == name {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+// parsePromExposition parses metrics in the Prometheus text exposition format.
+// Only the "# TYPE" comments are interpreted; samples of families without one
+// are untyped. Timestamps are ignored.
+//
+// Parameters:
+//   - data: Exposition, e.g. the body of a /metrics response
+//
+// Returns:
+//   - []promSample: Samples of the valid lines in order
+//   - error: Error listing the invalid lines
+func parsePromExposition(data []byte) ([]promSample, error) {
+	types := make(map[string]string)
+	var samples []promSample
+	var errs []error
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// Label values of some exporters make for long lines
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if comment, ok := strings.CutPrefix(line, "#"); ok {
+			if fields := strings.Fields(comment); len(fields) == 3 && fields[0] == "TYPE" {
+				types[fields[1]] = fields[2]
+			}
+			continue
+		}
+		name, rest := line, ""
+		if i := strings.IndexAny(line, "{ \t"); i >= 0 {
+			name, rest = line[:i], line[i:]
+		}
+		var labels []promLabel
+		if strings.HasPrefix(rest, "{") {
+			var err error
+			if labels, rest, err = parsePromLabels(rest); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+				continue
+			}
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 || len(fields) > 2 {
+			errs = append(errs, fmt.Errorf("line %d: expected a value and an optional timestamp, got %q", n, rest))
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: invalid value %q", n, fields[0]))
+			continue
+		}
+		family, mtype := promFamily(types, name)
+		samples = append(samples, promSample{line: n, family: family, mtype: mtype, name: name, labels: labels, value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return samples, errors.Join(errs...)
+}
+
+// promFamily returns the metric family a sample belongs to and its declared type.
+// The _bucket, _sum and _count samples belong to the histogram or summary named
+// without the suffix.
+//
+// Parameters:
+//   - types: Types declared by the "# TYPE" comments by family name
+//   - name: Name of the sample
+//
+// Returns:
+//   - string: Name of the family
+//   - string: Type of the family, "untyped" if it was not declared
+func promFamily(types map[string]string, name string) (string, string) {
+	if t, ok := types[name]; ok {
+		return name, t
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if family, ok := strings.CutSuffix(name, suffix); ok {
+			if t := types[family]; t == "histogram" || t == "summary" && suffix != "_bucket" {
+				return family, t
+			}
+		}
+	}
+	return name, "untyped"
+}
+
+// parsePromLabels parses the label set at the start of a sample line, e.g.
+// {code="200",method="get"}.
+//
+// Parameters:
+//   - s: Rest of the line, starting with "{"
+//
+// Returns:
+//   - []promLabel: Labels in order
+//   - string: Rest of the line after "}"
+//   - error: Error if the label set is malformed
+func parsePromLabels(s string) ([]promLabel, string, error) {
+	var labels []promLabel
+	s = s[1:]
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if rest, ok := strings.CutPrefix(s, "}"); ok {
+			return labels, rest, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return nil, "", fmt.Errorf("malformed labels %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+2:]
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s):
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(s[i])
+				}
+			case s[i] == '"':
+				s, closed = s[i+1:], true
+			default:
+				value.WriteByte(s[i])
+			}
+			if closed {
+				break
+			}
+		}
+		if !closed {
+			return nil, "", errors.New("unterminated label value")
+		}
+		labels = append(labels, promLabel{name: name, value: value.String()})
+		s = strings.TrimLeft(s, " \t")
+		s = strings.TrimPrefix(s, ",")
+	}
+}
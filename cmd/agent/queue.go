@@ -1,34 +1,26 @@
 package main
 
 import (
-	"log"
 	"sync"
+
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
 )
 
 // Metrics represents a single metric that can be sent to the monitoring server.
-// It follows the JSON format expected by the server API and uses pointers for
-// optional fields to distinguish between zero values and omitted fields.
+// It is the wire type of the client SDK, so that the agent sends exactly what
+// applications using pkg/client send.
 //
-// The struct supports two types of metrics:
+// The agent uses four types of metrics:
 //   - gauge: A floating-point value that can go up and down (e.g., CPU usage, memory usage)
-//   - counter: A monotonically increasing integer value (e.g., request count, poll count)
+//   - counter: The running total since the agent started, sent with
+//     client.TemporalityCumulative (e.g., poll count)
+//   - histogram: Bucketed observations since the previous report (e.g., report latency)
+//   - summary: Count and sum of the observations since the previous report with the
+//     latest quantiles (e.g., scraped Prometheus summaries)
 //
-// generate:reset
-type Metrics struct {
-	// ID is the unique identifier/name of the metric (e.g., "Alloc", "PollCount", "CPUUtilization")
-	ID string `json:"id"`
-
-	// MType specifies the metric type - either "gauge" or "counter"
-	MType string `json:"type"`
-
-	// Delta is used for counter metrics and represents the change in value.
-	// It's a pointer to distinguish between a zero value and no value being provided.
-	Delta *int64 `json:"delta,omitempty"`
-
-	// Value is used for gauge metrics and represents the current value.
-	// It's a pointer to distinguish between a zero value and no value being provided.
-	Value *float64 `json:"value,omitempty"`
-}
+// Meta carries the description and unit of the metric. The agent sends it with the
+// first successfully delivered sample of each metric and omits it afterwards.
+type Metrics = client.Metric
 
 // MetricQueue provides a thread-safe, buffered queue for metrics with a simple
 // producer-consumer pattern. It allows metrics collectors (producers) to push
@@ -50,15 +42,13 @@ type MetricQueue struct {
 // NewMetricQueue creates and initializes a new MetricQueue with the specified buffer size.
 //
 // Parameters:
-//   - size: The maximum number of metrics that can be queued before blocking/dropping
+//   - size: The maximum number of metrics that can be queued before Push blocks (at least 1)
 //
 // Returns:
 //   - *MetricQueue: A pointer to the initialized queue ready for use
 func NewMetricQueue(size int) *MetricQueue {
 	return &MetricQueue{
-		// Create a buffered channel with capacity of 100 (size parameter is ignored)
-		// FIXME: The size parameter is passed but hardcoded to 100 - consider using size
-		queue: make(chan Metrics, 100),
+		queue: make(chan Metrics, max(size, 1)),
 		pool: sync.Pool{
 			New: func() interface{} {
 				return &Metrics{}
@@ -67,23 +57,15 @@ func NewMetricQueue(size int) *MetricQueue {
 	}
 }
 
-// Push adds a metric to the queue for processing. If the queue is full,
-// the metric is dropped and a warning is logged to prevent blocking the
-// collection goroutine.
-//
-// This is a non-blocking operation that uses a select statement with a default
-// case to handle full queue scenarios gracefully.
+// Push adds a metric to the queue for processing. If the queue is full, it
+// blocks until a worker has taken a metric, so that a report with more metrics
+// than the queue holds is delivered in full. Histograms and summaries are taken
+// from the store before they are queued, so dropping them would lose them.
 //
 // Parameters:
 //   - metric: The Metrics object to be queued for processing
 func (mq *MetricQueue) Push(metric Metrics) {
-	select {
-	case mq.queue <- metric:
-		// Successfully added to queue
-	default:
-		// Queue is full - log warning and drop the metric
-		log.Printf("Queue full, dropping metric %s\n", metric.ID)
-	}
+	mq.queue <- metric
 }
 
 // Pop retrieves and removes a metric from the queue for processing.
@@ -3,22 +3,6 @@
 
 package main
 
-// Reset resets the Metrics struct to its zero state.
-func (s *Metrics) Reset() {
-	if s == nil {
-		return
-	}
-
-	s.ID = ""
-	s.MType = ""
-	if s.Delta != nil {
-		*s.Delta = 0
-	}
-	if s.Value != nil {
-		*s.Value = 0
-	}
-}
-
 // Reset resets the MetricQueue struct to its zero state.
 func (s *MetricQueue) Reset() {
 	if s == nil {
@@ -34,16 +18,6 @@ func (s *MetricQueue) Reset() {
 	}
 }
 
-// Reset resets the httpError struct to its zero state.
-func (s *httpError) Reset() {
-	if s == nil {
-		return
-	}
-
-	s.statusCode = 0
-	s.msg = ""
-}
-
 // Reset resets the WorkerPool struct to its zero state.
 func (s *WorkerPool) Reset() {
 	if s == nil {
@@ -58,20 +32,40 @@ func (s *WorkerPool) Reset() {
 			// TODO: manually reset pointer field queue
 		}
 	}
-	if s.client != nil {
-		if resetter, ok := interface{}(s.client).(interface{ Reset() }); ok {
+	if s.sender != nil {
+		if resetter, ok := interface{}(s.sender).(interface{ Reset() }); ok {
 			resetter.Reset()
 		} else {
-			// TODO: manually reset pointer field client
+			// TODO: manually reset pointer field sender
 		}
 	}
-	s.serverAddr = ""
 	// Reset field wg of external type sync.WaitGroup
 	if resetter, ok := interface{}(&s.wg).(interface{ Reset() }); ok {
 		resetter.Reset()
 	} else {
 		// TODO: manually reset external field wg
 	}
+	// Reset field metaSent of external type sync.Map
+	if resetter, ok := interface{}(&s.metaSent).(interface{ Reset() }); ok {
+		resetter.Reset()
+	} else {
+		// TODO: manually reset external field metaSent
+	}
+	if s.latency != nil {
+		if resetter, ok := interface{}(s.latency).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field latency
+		}
+	}
+	s.limits = batchLimits{}
+	if s.spool != nil {
+		if resetter, ok := interface{}(s.spool).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field spool
+		}
+	}
 	// Reset field ctx of external type context.Context
 	if resetter, ok := interface{}(&s.ctx).(interface{ Reset() }); ok {
 		resetter.Reset()
@@ -0,0 +1,8 @@
+package main
+
+import "time"
+
+// startTime is when the agent process started. It is sent in X-Source-Start so that
+// the server can tell a restarted agent, whose cumulative counters start over, from
+// one whose counters went backwards.
+var startTime = time.Now()
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSpoolMaxBytes is the default size cap of the spool directory.
+	DefaultSpoolMaxBytes = 64 << 20
+
+	// spoolSegments is the number of segments the size cap is divided into. When the
+	// cap is reached, the oldest segment is evicted as a whole.
+	spoolSegments = 8
+
+	// spoolSegmentExt is the file name extension of spool segments, whose names are
+	// their zero-padded sequence numbers.
+	spoolSegmentExt = ".seg"
+
+	// spoolCursorFile stores the segment and offset of the next record to replay.
+	spoolCursorFile = "cursor"
+
+	// spoolHeaderSize is the size of a record header: the payload length and its
+	// CRC-32C checksum, both big-endian uint32.
+	spoolHeaderSize = 8
+)
+
+// spoolReplayInterval is how often the spool is replayed while the server is unreachable.
+var spoolReplayInterval = 5 * time.Second
+
+var (
+	// errSpoolRecordTooLarge is returned when a single batch exceeds the spool size cap.
+	errSpoolRecordTooLarge = errors.New("batch exceeds the spool size cap")
+
+	// errSpoolCorrupt is returned when a record does not match its checksum.
+	errSpoolCorrupt = errors.New("corrupt spool record")
+
+	// spoolCRCTable is the CRC-32C table of the record checksums.
+	spoolCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// spoolRecord is one batch kept in the spool.
+type spoolRecord struct {
+	Start   time.Time `json:"start"`   // Start time of the agent run that collected the metrics
+	Metrics []Metrics `json:"metrics"` // Prepared metrics of the batch
+}
+
+// spoolSegment describes one segment file of the spool.
+type spoolSegment struct {
+	id      uint64 // Sequence number, increasing from the oldest to the newest segment
+	size    int64  // Size of the valid records in bytes
+	records int    // Number of valid records
+}
+
+// spoolPosition identifies a record returned by peek, so that commit can tell
+// whether it is still the next record to replay.
+type spoolPosition struct {
+	segment uint64 // Segment of the record
+	offset  int64  // Offset of the record
+	next    int64  // Offset of the following record
+}
+
+// spool is a disk-backed FIFO of batches the server could not take. Batches are
+// appended as checksummed records to segment files in a directory and replayed
+// oldest first; the position of the next record to replay is kept in a cursor
+// file, so the spool survives agent restarts without replaying a batch twice.
+// When the spool exceeds its size cap, the oldest segments are evicted.
+// It is safe for concurrent use.
+type spool struct {
+	mu           sync.Mutex     // Guards the fields below
+	dir          string         // Directory of the segment files
+	maxBytes     int64          // Size cap of all segments
+	segmentBytes int64          // Size after which a new segment is started
+	segments     []spoolSegment // Segments from the oldest to the newest; records are appended to the last one
+	size         int64          // Total size of the segments
+	pending      int            // Number of records not yet replayed
+	readOffset   int64          // Offset of the next record to replay in the first segment
+	readRecords  int            // Number of records of the first segment already replayed
+	nextID       uint64         // Sequence number of the next new segment
+	tail         *os.File       // Last segment opened for appending, nil until the next append
+}
+
+// openSpool opens the spool in a directory, creating the directory if needed.
+// Records that do not match their checksums, such as one torn by a crash during
+// a write, are truncated together with everything after them in their segment.
+//
+// Parameters:
+//   - dir: Spool directory
+//   - maxBytes: Size cap of the spool
+//
+// Returns:
+//   - *spool: Spool with the batches left by earlier runs of the agent
+//   - error: Error if the directory or a segment cannot be read, or maxBytes is not positive
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("spool size cap must be positive, got %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: max(maxBytes/spoolSegments, 1),
+		nextID:       1,
+	}
+	cursorID, cursorOffset, err := s.readCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), spoolSegmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if id, err := strconv.ParseUint(name, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		s.nextID = max(s.nextID, id+1)
+		if id < cursorID {
+			// Replayed completely before the agent stopped
+			if err := os.Remove(s.segmentPath(id)); err != nil {
+				return nil, fmt.Errorf("failed to remove replayed spool segment: %w", err)
+			}
+			continue
+		}
+
+		upTo := int64(0)
+		if id == cursorID {
+			upTo = cursorOffset
+		}
+		seg, replayed, err := s.scanSegment(id, upTo)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.segments) == 0 && replayed > 0 {
+			// Count the records before the cursor
+			if s.readOffset, s.readRecords, err = s.countRecords(id, replayed); err != nil {
+				return nil, err
+			}
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+		s.pending += seg.records
+	}
+	s.pending -= s.readRecords
+	return s, nil
+}
+
+// segmentPath returns the path of a segment file.
+func (s *spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentExt))
+}
+
+// readCursor reads the position of the next record to replay.
+//
+// Returns:
+//   - uint64: Segment of the next record, 0 if there is no cursor
+//   - int64: Offset of the next record in the segment
+//   - error: Error if the cursor file cannot be read or parsed
+func (s *spool) readCursor() (uint64, int64, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spool cursor: %w", err)
+	}
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &offset); err != nil {
+		return 0, 0, fmt.Errorf("invalid spool cursor %q: %w", data, err)
+	}
+	return id, offset, nil
+}
+
+// saveCursor persists the position of the next record to replay. The file is
+// replaced atomically, so a crash leaves either the old or the new position.
+// Callers must hold s.mu.
+//
+// Returns:
+//   - error: Error if the cursor file cannot be written
+func (s *spool) saveCursor() error {
+	path := filepath.Join(s.dir, spoolCursorFile)
+	if len(s.segments) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove spool cursor: %w", err)
+		}
+		return nil
+	}
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d\n", s.segments[0].id, s.readOffset)
+	if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+		return fmt.Errorf("failed to write spool cursor: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace spool cursor: %w", err)
+	}
+	return nil
+}
+
+// scanSegment validates the records of a segment and truncates the segment after
+// the last valid one.
+//
+// Parameters:
+//   - id: Segment to scan
+//   - cursor: Offset of the next record to replay if this is the cursor's segment, otherwise 0
+//
+// Returns:
+//   - spoolSegment: Size and number of the valid records
+//   - int64: Offset of the next record to replay, cursor moved back to the end of the valid records if needed
+//   - error: Error if the segment cannot be read or truncated
+func (s *spool) scanSegment(id uint64, cursor int64) (spoolSegment, int64, error) {
+	size, records, err := s.countRecords(id, -1)
+	if err != nil {
+		return spoolSegment{}, 0, err
+	}
+
+	path := s.segmentPath(id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return spoolSegment{}, 0, fmt.Errorf("failed to read spool segment: %w", err)
+	}
+	if info.Size() > size {
+		log.Printf("Spool segment %s is corrupt after offset %d, dropping %d byte(s)\n", path, size, info.Size()-size)
+		if err := os.Truncate(path, size); err != nil {
+			return spoolSegment{}, 0, fmt.Errorf("failed to truncate spool segment: %w", err)
+		}
+	}
+	return spoolSegment{id: id, size: size, records: records}, min(cursor, size), nil
+}
+
+// countRecords reads the valid records at the start of a segment.
+//
+// Parameters:
+//   - id: Segment to read
+//   - upTo: Offset to stop at, or -1 to read the whole segment
+//
+// Returns:
+//   - int64: Offset after the last valid record read
+//   - int: Number of valid records read
+//   - error: Error if the segment cannot be opened or read
+func (s *spool) countRecords(id uint64, upTo int64) (int64, int, error) {
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spool segment: %w", err)
+	}
+
+	var offset int64
+	records := 0
+	for upTo < 0 || offset < upTo {
+		n, err := readSpoolRecord(f, info.Size(), offset, nil)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errSpoolCorrupt) {
+			break
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read spool segment: %w", err)
+		}
+		offset += n
+		records++
+	}
+	return offset, records, nil
+}
+
+// readSpoolRecord reads and validates the record at an offset of a segment.
+//
+// Parameters:
+//   - r: Segment file
+//   - size: Size of the segment
+//   - offset: Offset of the record
+//   - rec: Record to decode the payload into, or nil to only validate it
+//
+// Returns:
+//   - int64: Size of the record including its header
+//   - error: io.EOF at the end of the segment, io.ErrUnexpectedEOF for a torn record,
+//     errSpoolCorrupt if the payload does not match its checksum or does not decode
+func readSpoolRecord(r io.ReaderAt, size, offset int64, rec *spoolRecord) (int64, error) {
+	if offset >= size {
+		return 0, io.EOF
+	}
+	var header [spoolHeaderSize]byte
+	if n, err := r.ReadAt(header[:], offset); err != nil {
+		if errors.Is(err, io.EOF) && n < len(header) {
+			// A partial header is a torn write
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+spoolHeaderSize+length > size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+spoolHeaderSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if crc32.Checksum(payload, spoolCRCTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, errSpoolCorrupt
+	}
+	if rec != nil {
+		if err := json.Unmarshal(payload, rec); err != nil {
+			return 0, fmt.Errorf("%w: %v", errSpoolCorrupt, err)
+		}
+	}
+	return spoolHeaderSize + length, nil
+}
+
+// append adds a batch to the end of the spool and evicts the oldest segments if
+// the spool exceeds its size cap. The record is synced to disk before it returns.
+//
+// Parameters:
+//   - start: Start time of the agent run that collected the metrics
+//   - batch: Prepared metrics of the batch
+//
+// Returns:
+//   - error: errSpoolRecordTooLarge if the batch alone exceeds the size cap, or an
+//     error if it cannot be encoded or written
+func (s *spool) append(start time.Time, batch []Metrics) error {
+	payload, err := json.Marshal(spoolRecord{Start: start, Metrics: batch})
+	if err != nil {
+		return fmt.Errorf("failed to encode batch: %w", err)
+	}
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, spoolCRCTable))
+	copy(record[spoolHeaderSize:], payload)
+	size := int64(len(record))
+	if size > s.maxBytes {
+		return errSpoolRecordTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n := len(s.segments); n == 0 || (s.segments[n-1].size > 0 && s.segments[n-1].size+size > s.segmentBytes) {
+		if err := s.closeTail(); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, spoolSegment{id: s.nextID})
+		s.nextID++
+		if len(s.segments) == 1 {
+			s.readOffset, s.readRecords = 0, 0
+		}
+	}
+	last := &s.segments[len(s.segments)-1]
+	if s.tail == nil {
+		f, err := os.OpenFile(s.segmentPath(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open spool segment: %w", err)
+		}
+		s.tail = f
+	}
+	if _, err := s.tail.Write(record); err != nil {
+		// Drop the partial record so that the segment stays readable
+		s.tail.Truncate(last.size)
+		return fmt.Errorf("failed to write spool segment: %w", err)
+	}
+	if err := s.tail.Sync(); err != nil {
+		s.tail.Truncate(last.size)
+		return fmt.Errorf("failed to sync spool segment: %w", err)
+	}
+	last.size += size
+	last.records++
+	s.size += size
+	s.pending++
+
+	return s.evict()
+}
+
+// evict removes the oldest segments until the spool fits into its size cap.
+// Callers must hold s.mu.
+//
+// Returns:
+//   - error: Error if a segment cannot be removed
+func (s *spool) evict() error {
+	for s.size > s.maxBytes && len(s.segments) > 1 {
+		head := s.segments[0]
+		dropped := head.records - s.readRecords
+		if err := os.Remove(s.segmentPath(head.id)); err != nil {
+			return fmt.Errorf("failed to evict spool segment: %w", err)
+		}
+		s.segments = s.segments[1:]
+		s.size -= head.size
+		s.pending -= dropped
+		s.readOffset, s.readRecords = 0, 0
+		log.Printf("Spool is full, dropped %d oldest batch(es)\n", dropped)
+	}
+	return s.saveCursor()
+}
+
+// closeTail closes the segment opened for appending. Callers must hold s.mu.
+func (s *spool) closeTail() error {
+	if s.tail == nil {
+		return nil
+	}
+	err := s.tail.Close()
+	s.tail = nil
+	if err != nil {
+		return fmt.Errorf("failed to close spool segment: %w", err)
+	}
+	return nil
+}
+
+// peek returns the oldest batch not yet replayed without removing it. A corrupt
+// record is skipped together with the rest of its segment.
+//
+// Returns:
+//   - spoolRecord: Oldest batch
+//   - spoolPosition: Position of the batch to pass to commit
+//   - bool: false if the spool is empty
+//   - error: Error if a segment cannot be read or removed
+func (s *spool) peek() (spoolRecord, spoolPosition, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.segments) > 0 {
+		head := s.segments[0]
+		if s.readOffset < head.size {
+			f, err := os.Open(s.segmentPath(head.id))
+			if err != nil {
+				return spoolRecord{}, spoolPosition{}, false, fmt.Errorf("failed to open spool segment: %w", err)
+			}
+			var rec spoolRecord
+			n, err := readSpoolRecord(f, head.size, s.readOffset, &rec)
+			f.Close()
+			if err == nil {
+				return rec, spoolPosition{segment: head.id, offset: s.readOffset, next: s.readOffset + n}, true, nil
+			}
+			log.Printf("Skipping the rest of spool segment %d: %v\n", head.id, err)
+			s.pending -= head.records - s.readRecords
+			s.readOffset, s.readRecords = head.size, head.records
+		}
+
+		// The first segment is replayed completely
+		if err := s.dropHead(); err != nil {
+			return spoolRecord{}, spoolPosition{}, false, err
+		}
+	}
+	return spoolRecord{}, spoolPosition{}, false, nil
+}
+
+// commit removes a batch returned by peek once it has been replayed. It does
+// nothing if the batch was evicted in the meantime.
+//
+// Parameters:
+//   - pos: Position returned by peek
+//
+// Returns:
+//   - error: Error if the cursor cannot be saved or a segment cannot be removed
+func (s *spool) commit(pos spoolPosition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[0].id != pos.segment || s.readOffset != pos.offset {
+		return nil
+	}
+	s.readOffset = pos.next
+	s.readRecords++
+	s.pending--
+	if s.readOffset >= s.segments[0].size {
+		return s.dropHead()
+	}
+	return s.saveCursor()
+}
+
+// dropHead removes the first segment after it has been replayed completely.
+// Callers must hold s.mu.
+//
+// Returns:
+//   - error: Error if the segment cannot be removed or the cursor cannot be saved
+func (s *spool) dropHead() error {
+	if len(s.segments) == 1 {
+		// The segment being appended to is replayed too: start over with a new one
+		if err := s.closeTail(); err != nil {
+			return err
+		}
+	}
+	head := s.segments[0]
+	if err := os.Remove(s.segmentPath(head.id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove replayed spool segment: %w", err)
+	}
+	s.segments = s.segments[1:]
+	s.size -= head.size
+	s.readOffset, s.readRecords = 0, 0
+	return s.saveCursor()
+}
+
+// len returns the number of batches not yet replayed.
+func (s *spool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// close closes the segment opened for appending. The spool must not be used afterwards.
+//
+// Returns:
+//   - error: Error if the segment cannot be closed
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeTail()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gaugeBatch returns a batch of one gauge.
+func gaugeBatch(id string, value float64) []Metrics {
+	return []Metrics{{ID: id, MType: "gauge", Value: &value}}
+}
+
+// drainSpool replays the whole spool and returns the IDs of the first metric of every batch.
+func drainSpool(t *testing.T, s *spool) []string {
+	var ids []string
+	for {
+		rec, pos, ok, err := s.peek()
+		require.NoError(t, err)
+		if !ok {
+			return ids
+		}
+		ids = append(ids, rec.Metrics[0].ID)
+		require.NoError(t, s.commit(pos))
+	}
+}
+
+// segmentFiles returns the segment files in a spool directory.
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	require.NoError(t, err)
+	return files
+}
+
+func Test_spool_ReplaysInOrderAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	s, err := openSpool(dir, 1<<20)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, s.append(start, gaugeBatch(id, 1)))
+	}
+	rec, pos, ok, err := s.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "a", rec.Metrics[0].ID)
+	assert.True(t, start.Equal(rec.Start))
+	require.NoError(t, s.commit(pos))
+	require.NoError(t, s.close())
+
+	// The replayed batch is not sent again after a restart
+	s, err = openSpool(dir, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.len())
+	require.NoError(t, s.append(start, gaugeBatch("d", 1)))
+	assert.Equal(t, []string{"b", "c", "d"}, drainSpool(t, s))
+	assert.Equal(t, 0, s.len())
+	assert.Empty(t, segmentFiles(t, dir), "replayed segments are removed")
+
+	// The spool starts over once it is empty
+	require.NoError(t, s.append(start, gaugeBatch("e", 1)))
+	require.NoError(t, s.close())
+	s, err = openSpool(dir, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"e"}, drainSpool(t, s))
+}
+
+func Test_spool_EvictsOldestSegments(t *testing.T) {
+	dir := t.TempDir()
+	record := int64(spoolHeaderSize + len(`{"start":"0001-01-01T00:00:00Z","metrics":[{"id":"m00","type":"gauge","value":1}]}`))
+
+	// Room for 16 records in 8 segments of 2 records
+	s, err := openSpool(dir, 16*record)
+	require.NoError(t, err)
+	for i := range 20 {
+		require.NoError(t, s.append(time.Time{}, gaugeBatch(fmt.Sprintf("m%02d", i), 1)))
+	}
+
+	assert.LessOrEqual(t, s.size, s.maxBytes)
+	assert.Len(t, segmentFiles(t, dir), 8)
+	assert.Equal(t, 16, s.len())
+	ids := drainSpool(t, s)
+	assert.Equal(t, []string{"m04", "m05", "m06", "m07", "m08", "m09", "m10", "m11", "m12", "m13", "m14", "m15", "m16", "m17", "m18", "m19"}, ids)
+
+	// A batch that does not fit at all is refused
+	err = s.append(time.Time{}, gaugeBatch(string(make([]byte, 16*record)), 1))
+	assert.ErrorIs(t, err, errSpoolRecordTooLarge)
+}
+
+func Test_spool_CommitAfterEviction(t *testing.T) {
+	record := int64(spoolHeaderSize + len(`{"start":"0001-01-01T00:00:00Z","metrics":[{"id":"m00","type":"gauge","value":1}]}`))
+	s, err := openSpool(t.TempDir(), 8*record)
+	require.NoError(t, err)
+	require.NoError(t, s.append(time.Time{}, gaugeBatch("m00", 1)))
+
+	_, pos, ok, err := s.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	// The batch being replayed is evicted in the meantime
+	for i := 1; i <= 9; i++ {
+		require.NoError(t, s.append(time.Time{}, gaugeBatch(fmt.Sprintf("m%02d", i), 1)))
+	}
+	require.NoError(t, s.commit(pos))
+	assert.Equal(t, []string{"m02", "m03", "m04", "m05", "m06", "m07", "m08", "m09"}, drainSpool(t, s))
+}
+
+func Test_spool_Checksums(t *testing.T) {
+	tests := []struct {
+		name        string
+		damage      func(t *testing.T, path string, first int64)
+		expectedIDs []string
+	}{
+		{
+			name: "Corrupt payload",
+			damage: func(t *testing.T, path string, first int64) {
+				f, err := os.OpenFile(path, os.O_WRONLY, 0)
+				require.NoError(t, err)
+				defer f.Close()
+				_, err = f.WriteAt([]byte("X"), first+spoolHeaderSize+2)
+				require.NoError(t, err)
+			},
+			expectedIDs: []string{"a", "d"},
+		},
+		{
+			name: "Torn header",
+			damage: func(t *testing.T, path string, _ int64) {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				require.NoError(t, err)
+				defer f.Close()
+				_, err = f.Write([]byte{0, 0, 1})
+				require.NoError(t, err)
+			},
+			expectedIDs: []string{"a", "b", "c", "d"},
+		},
+		{
+			name: "Torn payload",
+			damage: func(t *testing.T, path string, _ int64) {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				require.NoError(t, err)
+				defer f.Close()
+				_, err = f.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{'})
+				require.NoError(t, err)
+			},
+			expectedIDs: []string{"a", "b", "c", "d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := openSpool(dir, 1<<20)
+			require.NoError(t, err)
+			require.NoError(t, s.append(time.Time{}, gaugeBatch("a", 1)))
+			first := s.size
+			require.NoError(t, s.append(time.Time{}, gaugeBatch("b", 1)))
+			require.NoError(t, s.append(time.Time{}, gaugeBatch("c", 1)))
+			require.NoError(t, s.close())
+
+			files := segmentFiles(t, dir)
+			require.Len(t, files, 1)
+			tt.damage(t, files[0], first)
+
+			// The damaged records are dropped and the segment stays usable
+			s, err = openSpool(dir, 1<<20)
+			require.NoError(t, err)
+			require.NoError(t, s.append(time.Time{}, gaugeBatch("d", 1)))
+			assert.Equal(t, tt.expectedIDs, drainSpool(t, s))
+		})
+	}
+}
+
+func Test_WorkerPool_SpoolsWhileServerIsDown(t *testing.T) {
+	oldDelays, oldInterval, oldSourceID := retryDelays, spoolReplayInterval, *sourceID
+	retryDelays, spoolReplayInterval, *sourceID = []time.Duration{0}, 10*time.Millisecond, "agent-1"
+	defer func() { retryDelays, spoolReplayInterval, *sourceID = oldDelays, oldInterval, oldSourceID }()
+
+	var mu sync.Mutex
+	up := false
+	var received []string
+	var starts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		for _, m := range decodeBatch(t, r) {
+			received = append(received, m.ID)
+			starts = append(starts, r.Header.Get("X-Source-Start"))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// A batch left by an earlier run of the agent
+	dir := t.TempDir()
+	s, err := openSpool(dir, 1<<20)
+	require.NoError(t, err)
+	earlier := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, s.append(earlier, gaugeBatch("m0", 1)))
+	require.NoError(t, s.close())
+
+	s, err = openSpool(dir, 1<<20)
+	require.NoError(t, err)
+	defer s.close()
+	pool := newTestPool(server, batchLimits{maxCount: 100})
+	pool.spool = s
+
+	// Nothing is lost while the server is down
+	pool.sendBatch(0, gaugeBatch("m1", 1))
+	pool.sendBatch(0, gaugeBatch("m2", 1))
+	assert.Equal(t, 3, s.len())
+
+	pool.Start()
+	defer pool.Stop()
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	require.Eventually(t, func() bool { return s.len() == 0 }, 5*time.Second, 5*time.Millisecond)
+
+	// Live batches are sent directly again once the spool is empty
+	pool.sendBatch(0, gaugeBatch("m3", 1))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"m0", "m1", "m2", "m3"}, received)
+	assert.Equal(t, earlier.Format(time.RFC3339Nano), starts[0], "spooled batches keep the start time of their run")
+	assert.Equal(t, startTime.UTC().Format(time.RFC3339Nano), starts[1])
+	assert.Empty(t, segmentFiles(t, dir))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+// metricStore keeps the latest polled values until they are reported. Polling
+// and reporting run at their own intervals, so several polls may update a value
+// before a report sends it. It is safe for concurrent use.
+type metricStore struct {
+	mu         sync.Mutex                  // Guards the maps below
+	gauges     map[string]float64          // Latest value of every gauge; a later poll overwrites an earlier one
+	counters   map[string]int64            // Sum of all increments of every counter since the agent started
+	histograms map[string]client.Histogram // Observations of every histogram since the previous report
+	summaries  map[string]client.Summary   // Observations of every summary since the previous report
+}
+
+// newMetricStore creates an empty metric store.
+//
+// Returns:
+//   - *metricStore: Store ready to record polled values
+func newMetricStore() *metricStore {
+	return &metricStore{
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+		histograms: make(map[string]client.Histogram),
+		summaries:  make(map[string]client.Summary),
+	}
+}
+
+// addCounter adds an increment to a counter.
+//
+// Parameters:
+//   - name: Counter name
+//   - delta: Increment
+func (s *metricStore) addCounter(name string, delta int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[name] += delta
+}
+
+// record stores metrics gathered by a collector: gauges replace their previous
+// value, counter increments are added to their totals and histogram and summary
+// observations are added to those not reported yet.
+//
+// Parameters:
+//   - ms: Gauges with their value, counters with their increment and histograms
+//     and summaries with their new observations
+func (s *metricStore) record(ms []Metrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range ms {
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			s.gauges[m.ID] = *m.Value
+		case m.MType == "counter" && m.Delta != nil:
+			s.counters[m.ID] += *m.Delta
+		case m.MType == "histogram" && m.Histogram != nil:
+			s.histograms[m.ID] = mergeHistograms(s.histograms[m.ID], *m.Histogram)
+		case m.MType == "summary" && m.Summary != nil:
+			s.summaries[m.ID] = mergeSummaries(s.summaries[m.ID], *m.Summary)
+		}
+	}
+}
+
+// mergeHistograms adds the observations of a histogram to earlier ones. Histograms
+// with other bounds cannot be merged, so the earlier observations are replaced.
+//
+// Parameters:
+//   - cur: Earlier observations, or the zero histogram
+//   - add: New observations
+//
+// Returns:
+//   - client.Histogram: Merged observations
+func mergeHistograms(cur, add client.Histogram) client.Histogram {
+	if cur.Count == 0 || !slices.Equal(cur.Bounds, add.Bounds) || len(cur.Counts) != len(add.Counts) {
+		return client.Histogram{Bounds: slices.Clone(add.Bounds), Counts: slices.Clone(add.Counts), Count: add.Count, Sum: add.Sum}
+	}
+	for i, n := range add.Counts {
+		cur.Counts[i] += n
+	}
+	cur.Count += add.Count
+	cur.Sum += add.Sum
+	return cur
+}
+
+// mergeSummaries adds the observations of a summary to earlier ones. Quantiles
+// cannot be merged, so the newer ones are kept.
+//
+// Parameters:
+//   - cur: Earlier observations, or the zero summary
+//   - add: New observations
+//
+// Returns:
+//   - client.Summary: Merged observations
+func mergeSummaries(cur, add client.Summary) client.Summary {
+	return client.Summary{Count: cur.Count + add.Count, Sum: cur.Sum + add.Sum, Quantiles: slices.Clone(add.Quantiles)}
+}
+
+// snapshot returns the metrics to report, sorted by type and name. Counters are
+// reported as their running total with cumulative temporality, so the server
+// counts every increment once even if a report is lost or sent twice.
+//
+// Returns:
+//   - []Metrics: Gauges followed by counters
+func (s *metricStore) snapshot() []Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Metrics, 0, len(s.gauges)+len(s.counters))
+	for _, name := range slices.Sorted(maps.Keys(s.gauges)) {
+		value := s.gauges[name]
+		out = append(out, Metrics{ID: name, MType: "gauge", Value: &value})
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.counters)) {
+		total := s.counters[name]
+		out = append(out, Metrics{ID: name, MType: "counter", Delta: &total, Temporality: client.TemporalityCumulative})
+	}
+	return out
+}
+
+// takeHistograms returns the histogram observations recorded since the previous
+// call and starts over. Unlike counters, histograms are sent as increments, so
+// observations in a report that cannot be delivered are lost unless it is spooled.
+//
+// Returns:
+//   - []Metrics: Histograms sorted by name
+func (s *metricStore) takeHistograms() []Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Metrics, 0, len(s.histograms))
+	for _, name := range slices.Sorted(maps.Keys(s.histograms)) {
+		h := s.histograms[name]
+		out = append(out, Metrics{ID: name, MType: "histogram", Histogram: &h})
+	}
+	clear(s.histograms)
+	return out
+}
+
+// takeSummaries returns the summary observations recorded since the previous call
+// and starts over. Like histograms, summaries are sent as increments.
+//
+// Returns:
+//   - []Metrics: Summaries sorted by name
+func (s *metricStore) takeSummaries() []Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Metrics, 0, len(s.summaries))
+	for _, name := range slices.Sorted(maps.Keys(s.summaries)) {
+		sm := s.summaries[name]
+		out = append(out, Metrics{ID: name, MType: "summary", Summary: &sm})
+	}
+	clear(s.summaries)
+	return out
+}
+
+// report queues a snapshot of the store for sending, followed by the histogram
+// and summary observations and the report latencies observed since the previous
+// report. It blocks while the queue is full, until the workers have taken the
+// whole report.
+//
+// Parameters:
+//   - queue: Queue drained by the worker pool
+//   - store: Latest polled values
+//   - latency: Report latency histogram, or nil
+func report(queue *MetricQueue, store *metricStore, latency *latencyHistogram) {
+	for _, m := range store.snapshot() {
+		queue.Push(m)
+	}
+	for _, m := range store.takeHistograms() {
+		queue.Push(m)
+	}
+	for _, m := range store.takeSummaries() {
+		queue.Push(m)
+	}
+
+	// A failed send puts the latencies back for the next report
+	if latency == nil {
+		return
+	}
+	if h, ok := latency.take(); ok {
+		queue.Push(Metrics{
+			ID:        reportLatencyName,
+			MType:     "histogram",
+			Histogram: &h,
+		})
+	}
+}
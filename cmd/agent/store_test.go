@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
+)
+
+func Test_metricStore(t *testing.T) {
+	store := newMetricStore()
+	assert.Empty(t, store.snapshot())
+
+	// Three polls before the first report
+	poll := int64(1)
+	store.record(append(gaugeMetrics(map[string]float64{"Alloc": 1, "HeapAlloc": 5}), Metrics{ID: "PollCount", MType: "counter", Delta: &poll}))
+	store.record(append(gaugeMetrics(map[string]float64{"Alloc": 2}), Metrics{ID: "PollCount", MType: "counter", Delta: &poll}))
+	store.record(append(gaugeMetrics(map[string]float64{"Alloc": 3}), Metrics{ID: "PollCount", MType: "counter", Delta: &poll}))
+
+	snapshot := store.snapshot()
+	require.Len(t, snapshot, 3)
+	assert.Equal(t, "Alloc", snapshot[0].ID)
+	assert.Equal(t, 3.0, *snapshot[0].Value, "gauges keep the latest value")
+	assert.Equal(t, "HeapAlloc", snapshot[1].ID)
+	assert.Equal(t, 5.0, *snapshot[1].Value)
+	assert.Equal(t, "PollCount", snapshot[2].ID)
+	assert.Equal(t, "counter", snapshot[2].MType)
+	assert.Equal(t, int64(3), *snapshot[2].Delta, "counters sum the increments")
+	assert.Equal(t, client.TemporalityCumulative, snapshot[2].Temporality)
+
+	// Counters keep the running total across reports
+	store.addCounter("PollCount", 2)
+	snapshot = store.snapshot()
+	assert.Equal(t, int64(5), *snapshot[2].Delta)
+
+	// The snapshot is not affected by later polls
+	store.record(gaugeMetrics(map[string]float64{"Alloc": 4}))
+	assert.Equal(t, 3.0, *snapshot[0].Value)
+}
+
+func Test_metricStore_Histograms(t *testing.T) {
+	store := newMetricStore()
+	histogram := func(bounds []float64, counts ...int64) Metrics {
+		h := client.Histogram{Bounds: bounds, Counts: counts}
+		for _, n := range counts {
+			h.Count += n
+			h.Sum += float64(n)
+		}
+		return Metrics{ID: "GCPauses", MType: "histogram", Histogram: &h}
+	}
+
+	// Observations of several polls are added up until they are reported
+	first := histogram([]float64{1, 2}, 1, 0, 2)
+	store.record([]Metrics{first})
+	store.record([]Metrics{histogram([]float64{1, 2}, 0, 4, 1)})
+	assert.Equal(t, []int64{1, 0, 2}, first.Histogram.Counts, "recorded histograms are not modified")
+
+	taken := store.takeHistograms()
+	require.Len(t, taken, 1)
+	assert.Equal(t, client.Histogram{Bounds: []float64{1, 2}, Counts: []int64{1, 4, 3}, Count: 8, Sum: 8}, *taken[0].Histogram)
+	assert.Empty(t, store.takeHistograms(), "reported observations are not reported again")
+
+	// Histograms with other bounds replace the earlier observations
+	store.record([]Metrics{histogram([]float64{1, 2}, 1, 1, 1)})
+	store.record([]Metrics{histogram([]float64{5}, 2, 0)})
+	taken = store.takeHistograms()
+	require.Len(t, taken, 1)
+	assert.Equal(t, client.Histogram{Bounds: []float64{5}, Counts: []int64{2, 0}, Count: 2, Sum: 2}, *taken[0].Histogram)
+	assert.Empty(t, store.snapshot(), "histograms are not part of the snapshot")
+}
+
+func Test_metricStore_Summaries(t *testing.T) {
+	store := newMetricStore()
+	summary := func(count int64, sum float64, p50 float64) Metrics {
+		return Metrics{ID: "rpc_seconds", MType: "summary", Summary: &client.Summary{
+			Count: count, Sum: sum, Quantiles: []client.Quantile{{Quantile: 0.5, Value: p50}},
+		}}
+	}
+
+	// Counts and sums are added up, the latest quantiles are kept
+	store.record([]Metrics{summary(3, 1.5, 0.4)})
+	store.record([]Metrics{summary(2, 0.5, 0.3)})
+	taken := store.takeSummaries()
+	require.Len(t, taken, 1)
+	assert.Equal(t, client.Summary{Count: 5, Sum: 2, Quantiles: []client.Quantile{{Quantile: 0.5, Value: 0.3}}}, *taken[0].Summary)
+	assert.Empty(t, store.takeSummaries(), "reported observations are not reported again")
+	assert.Empty(t, store.snapshot(), "summaries are not part of the snapshot")
+}
+
+func Test_report(t *testing.T) {
+	store := newMetricStore()
+	store.record(gaugeMetrics(map[string]float64{"Alloc": 1}))
+	store.addCounter("PollCount", 1)
+	store.record([]Metrics{{ID: "GCPauses", MType: "histogram", Histogram: &client.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5}}})
+	latency := newLatencyHistogram([]float64{1})
+	latency.observe(10 * time.Millisecond)
+
+	queue := NewMetricQueue(10)
+	report(queue, store, latency)
+
+	var ids []string
+	for !queue.IsEmpty() {
+		ids = append(ids, queue.Pop().ID)
+	}
+	assert.Equal(t, []string{"Alloc", "PollCount", "GCPauses", reportLatencyName}, ids)
+
+	// Nothing was observed since, so only the values are reported again
+	report(queue, store, latency)
+	ids = nil
+	for !queue.IsEmpty() {
+		ids = append(ids, queue.Pop().ID)
+	}
+	assert.Equal(t, []string{"Alloc", "PollCount"}, ids)
+}
+
+func Test_report_MoreSeriesThanQueue(t *testing.T) {
+	var rec batchRecorder
+	server := httptest.NewServer(rec.handler(t, accept))
+	defer server.Close()
+
+	// Far more series than the queue holds, and histograms taken from the store
+	store := newMetricStore()
+	values := make(map[string]float64)
+	for i := range 250 {
+		values[fmt.Sprintf("g%03d", i)] = float64(i)
+	}
+	store.record(gaugeMetrics(values))
+	for i := range 30 {
+		store.record([]Metrics{{ID: fmt.Sprintf("h%03d", i), MType: "histogram", Histogram: &client.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5}}})
+	}
+
+	pool := newTestPool(server, batchLimits{maxCount: 20, maxBytes: DefaultBatchMaxBytes, linger: 10 * time.Millisecond})
+	pool.queue = NewMetricQueue(20)
+	pool.Start()
+	defer pool.Stop()
+
+	report(pool.queue, store, nil)
+	require.Eventually(t, func() bool { return len(rec.received()) == 280 }, 5*time.Second, 5*time.Millisecond)
+	received := rec.received()
+	assert.Contains(t, received, "g249")
+	assert.Contains(t, received, "h029")
+}
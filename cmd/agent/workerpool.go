@@ -2,16 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"math/rand"
-	"net/http"
-	"runtime"
 	"sync"
-	"time"
 
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/SergeyDolin/metrics-and-alerting/pkg/client"
 )
 
 // WorkerPool manages a pool of worker goroutines that process and send metrics
@@ -20,45 +13,55 @@ import (
 //
 // generate:reset
 type WorkerPool struct {
-	workers    int                // Number of concurrent worker goroutines
-	queue      *MetricQueue       // Shared queue containing metrics to be processed
-	client     *http.Client       // HTTP client for sending requests
-	serverAddr string             // Address of the monitoring server
-	wg         sync.WaitGroup     // WaitGroup for tracking worker goroutines
-	ctx        context.Context    // Context for signaling shutdown
-	cancel     context.CancelFunc // Function to cancel the context
+	workers  int                // Number of concurrent worker goroutines
+	queue    *MetricQueue       // Shared queue containing metrics to be processed
+	sender   *client.Client     // Client sending the batches to the monitoring server
+	wg       sync.WaitGroup     // WaitGroup for tracking worker goroutines
+	metaSent sync.Map           // Names of metrics whose metadata the server has accepted
+	latency  *latencyHistogram  // Records the latency of every send attempt (nil disables it)
+	limits   batchLimits        // Bounds of the batches sent through /updates
+	spool    *spool             // Keeps the batches the server cannot take until it is back (nil disables it)
+	ctx      context.Context    // Context for signaling shutdown
+	cancel   context.CancelFunc // Function to cancel the context
 }
 
 // NewWorkerPool creates and initializes a new WorkerPool with the specified parameters.
 //
 // Parameters:
-//   - workers: Number of concurrent worker goroutines to start
+//   - workers: Number of concurrent worker goroutines to start (at least 1, since
+//     MetricQueue.Push waits for the workers)
 //   - queue: Pointer to the MetricQueue containing pending metrics
-//   - client: HTTP client for making requests to the server
-//   - serverAddr: Address of the monitoring server in "host:port" format
+//   - sender: Client sending the batches to the monitoring server, see newSender
+//   - limits: Bounds of the batches the workers send; a count below 1 sends every metric alone
 //
 // Returns:
 //   - *WorkerPool: A configured worker pool ready to be started
-func NewWorkerPool(workers int, queue *MetricQueue, client *http.Client, serverAddr string) *WorkerPool {
+func NewWorkerPool(workers int, queue *MetricQueue, sender *client.Client, limits batchLimits) *WorkerPool {
 	ctx, cancel := context.WithCancel(context.Background())
+	limits.maxCount = max(limits.maxCount, 1)
 	return &WorkerPool{
-		workers:    workers,
-		queue:      queue,
-		client:     client,
-		serverAddr: serverAddr,
-		ctx:        ctx,
-		cancel:     cancel,
+		workers: max(workers, 1),
+		queue:   queue,
+		sender:  sender,
+		limits:  limits,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
 // Start launches the specified number of worker goroutines.
 // Each worker runs concurrently and processes metrics from the queue
-// until Stop() is called or the context is cancelled.
+// until Stop() is called or the context is cancelled. If a spool is
+// configured, one more goroutine replays it.
 func (wp *WorkerPool) Start() {
 	for i := 0; i < wp.workers; i++ {
 		wp.wg.Add(1)
 		go wp.worker(i)
 	}
+	if wp.spool != nil {
+		wp.wg.Add(1)
+		go wp.replay(wp.workers)
+	}
 }
 
 // Stop signals all workers to shut down gracefully and waits for them to finish.
@@ -70,7 +73,7 @@ func (wp *WorkerPool) Stop() {
 }
 
 // worker is the main processing loop for individual worker goroutines.
-// It continuously retrieves metrics from the queue and processes them
+// It continuously drains metrics from the queue into batches and sends them
 // until shutdown is signaled via context cancellation or the queue is closed.
 //
 // Parameters:
@@ -78,134 +81,26 @@ func (wp *WorkerPool) Stop() {
 func (wp *WorkerPool) worker(id int) {
 	defer wp.wg.Done()
 
+	// Metric that did not fit into the previous batch
+	var next *Metrics
 	for {
-		select {
-		case <-wp.ctx.Done():
-			// Shutdown signal received - exit gracefully
-			return
-		case metric, ok := <-wp.queue.queue:
-			if !ok {
-				// Queue channel was closed - exit
+		if next == nil {
+			select {
+			case <-wp.ctx.Done():
+				// Shutdown signal received - exit gracefully
 				return
+			case metric, ok := <-wp.queue.queue:
+				if !ok {
+					// Queue channel was closed - exit
+					return
+				}
+				next = &metric
 			}
-			// Process the retrieved metric
-			wp.processMetric(id, &metric)
 		}
-	}
-}
 
-// processMetric handles the sending of a single metric to the server.
-// It uses the retryWithBackoff function to handle transient failures
-// and returns the metric object to the pool after processing.
-//
-// Parameters:
-//   - id: Worker ID for logging purposes
-//   - metric: Pointer to the Metrics object to be sent
-func (wp *WorkerPool) processMetric(id int, metric *Metrics) {
-	// Return the metric to the pool after processing to reduce allocations
-	defer wp.queue.pool.Put(metric)
-
-	// Attempt to send the metric with retry logic for transient failures
-	err := retryWithBackoff(func() error {
-		// Different handling based on metric type (gauge vs counter)
-		if metric.MType == "gauge" {
-			return sendMetricJSON(wp.client, metric.ID, metric.MType, wp.serverAddr, metric.Value, nil)
-		} else {
-			return sendMetricJSON(wp.client, metric.ID, metric.MType, wp.serverAddr, nil, metric.Delta)
-		}
-	})
-
-	// Log any failures after all retry attempts
-	if err != nil {
-		log.Printf("Worker %d: Failed to send metric %s: %v\n", id, metric.ID, err)
-	}
-}
-
-// CollectRuntimeMetrics gathers Go runtime memory statistics and populates
-// the provided map with various metrics from runtime.MemStats.
-//
-// The function collects:
-//   - All fields from runtime.MemStats (Alloc, HeapAlloc, GC stats, etc.)
-//   - A random value (RandomValue) for testing/demonstration purposes
-//
-// Parameters:
-//   - ms: A map that will be populated with metric names as keys and float64 values
-//
-// Note: The map should be pre-allocated for better performance
-func CollectRuntimeMetrics(ms map[string]float64) {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	// Map of metric names to extractor functions
-	// Each function extracts a specific field from MemStats and converts it to float64
-	fieldMap := map[string]func(*runtime.MemStats) float64{
-		"Alloc":         func(m *runtime.MemStats) float64 { return float64(m.Alloc) },
-		"BuckHashSys":   func(m *runtime.MemStats) float64 { return float64(m.BuckHashSys) },
-		"Frees":         func(m *runtime.MemStats) float64 { return float64(m.Frees) },
-		"GCCPUFraction": func(m *runtime.MemStats) float64 { return float64(m.GCCPUFraction) },
-		"GCSys":         func(m *runtime.MemStats) float64 { return float64(m.GCSys) },
-		"HeapAlloc":     func(m *runtime.MemStats) float64 { return float64(m.HeapAlloc) },
-		"HeapIdle":      func(m *runtime.MemStats) float64 { return float64(m.HeapIdle) },
-		"HeapObjects":   func(m *runtime.MemStats) float64 { return float64(m.HeapObjects) },
-		"HeapReleased":  func(m *runtime.MemStats) float64 { return float64(m.HeapReleased) },
-		"HeapSys":       func(m *runtime.MemStats) float64 { return float64(m.HeapSys) },
-		"LastGC":        func(m *runtime.MemStats) float64 { return float64(m.LastGC) },
-		"Lookups":       func(m *runtime.MemStats) float64 { return float64(m.Lookups) },
-		"MCacheInuse":   func(m *runtime.MemStats) float64 { return float64(m.MCacheInuse) },
-		"MCacheSys":     func(m *runtime.MemStats) float64 { return float64(m.MCacheSys) },
-		"MSpanSys":      func(m *runtime.MemStats) float64 { return float64(m.MSpanSys) },
-		"Mallocs":       func(m *runtime.MemStats) float64 { return float64(m.Mallocs) },
-		"NextGC":        func(m *runtime.MemStats) float64 { return float64(m.NextGC) },
-		"NumForcedGC":   func(m *runtime.MemStats) float64 { return float64(m.NumForcedGC) },
-		"NumGC":         func(m *runtime.MemStats) float64 { return float64(m.NumGC) },
-		"OtherSys":      func(m *runtime.MemStats) float64 { return float64(m.OtherSys) },
-		"PauseTotalNs":  func(m *runtime.MemStats) float64 { return float64(m.PauseTotalNs) },
-		"StackInuse":    func(m *runtime.MemStats) float64 { return float64(m.StackInuse) },
-		"Sys":           func(m *runtime.MemStats) float64 { return float64(m.Sys) },
-		"TotalAlloc":    func(m *runtime.MemStats) float64 { return float64(m.TotalAlloc) },
-		"HeapInuse":     func(m *runtime.MemStats) float64 { return float64(m.HeapInuse) },
-		"MSpanInuse":    func(m *runtime.MemStats) float64 { return float64(m.MSpanInuse) },
-		"StackSys":      func(m *runtime.MemStats) float64 { return float64(m.StackSys) },
-	}
-
-	// Apply each extractor function to populate the metrics map
-	for name, metric := range fieldMap {
-		ms[name] = metric(&m)
-	}
-
-	// Add a random value for testing/demonstration purposes
-	ms["RandomValue"] = rand.Float64()
-}
-
-// CollectSystemMetrics gathers system-level metrics using the gopsutil library
-// and populates the provided map with:
-//   - Memory statistics (TotalMemory, FreeMemory)
-//   - CPU utilization per core (CPUutilization1, CPUutilization2, etc.)
-//
-// Parameters:
-//   - ms: A map that will be populated with system metric names as keys and float64 values
-//
-// The function handles errors gracefully by logging them and continuing,
-// allowing partial results to be collected even if some subsystems fail.
-func CollectSystemMetrics(ms map[string]float64) {
-	// Collect virtual memory statistics
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		log.Printf("Error getting memory stats: %v\n", err)
-	} else {
-		ms["TotalMemory"] = float64(vmStat.Total)
-		ms["FreeMemory"] = float64(vmStat.Free)
-	}
-
-	// Collect CPU utilization percentages per core
-	// Parameters: duration to sample (1 second), true = per-cpu percentages
-	cpuPercentages, err := cpu.Percent(time.Second, true)
-	if err != nil {
-		log.Printf("Error getting CPU stats: %v\n", err)
-	} else {
-		// Add each CPU core's utilization as a separate metric
-		for i, percent := range cpuPercentages {
-			ms[fmt.Sprintf("CPUutilization%d", i+1)] = percent
-		}
+		// Collect and send a batch starting with the retrieved metric
+		var batch []Metrics
+		batch, next = wp.nextBatch(*next)
+		wp.sendBatch(id, batch)
 	}
 }
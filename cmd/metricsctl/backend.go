@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// backendUsage describes the accepted backend specifications for flag help texts.
+const backendUsage = `storage backend: "file:<path>", "bolt:<path>" or a postgres:// DSN`
+
+// backend is an opened storage backend together with the function releasing it.
+type backend struct {
+	store storage.Storage // Storage of the selected tenant
+	close func() error    // Releases files and connections
+	save  func() error    // Persists buffered state after an import (can be nil)
+	name  string          // Backend for messages; never contains credentials
+}
+
+// openBackend opens the storage backend described by spec.
+//
+// Supported specifications:
+//   - file:<path>: FileStorage with the snapshot at path (as the server's -f)
+//   - bolt:<path>: BoltStorage with the database file at path (as the server's -bolt-path)
+//   - postgres://... or postgresql://...: DBStorage; migrations are read from ./migrations
+//
+// Parameters:
+//   - ctx: Context for connecting to the database
+//   - spec: Backend specification
+//   - tenant: Tenant whose series are read or written (storage.DefaultTenant for none)
+//
+// Returns:
+//   - *backend: Opened backend; call close when done
+//   - error: Error if the specification is invalid or the backend cannot be opened
+func openBackend(ctx context.Context, spec, tenant string) (*backend, error) {
+	if !storage.ValidTenantID(tenant) {
+		return nil, fmt.Errorf("invalid tenant %q", tenant)
+	}
+
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		path := strings.TrimPrefix(spec, "file:")
+		if path == "" {
+			return nil, fmt.Errorf("backend %q: missing path", spec)
+		}
+		fs, err := storage.NewFileStorage(storage.TenantFilePath(path, tenant))
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", spec, err)
+		}
+		// A snapshot keeps the imported data in the file the server restores from
+		return &backend{store: fs, close: fs.Close, save: fs.Save, name: spec}, nil
+
+	case strings.HasPrefix(spec, "bolt:"):
+		path := strings.TrimPrefix(spec, "bolt:")
+		if path == "" {
+			return nil, fmt.Errorf("backend %q: missing path", spec)
+		}
+		bs, err := storage.NewBoltStorage(path)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", spec, err)
+		}
+		if tenant == storage.DefaultTenant {
+			return &backend{store: bs, close: bs.Close, name: spec}, nil
+		}
+		ts, err := storage.NewTenantBoltStorage(bs, tenant)
+		if err != nil {
+			bs.Close()
+			return nil, fmt.Errorf("open %s: %w", spec, err)
+		}
+		return &backend{store: ts, close: bs.Close, name: spec}, nil
+
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		db, err := storage.NewDBStorage(ctx, spec)
+		if err != nil {
+			return nil, fmt.Errorf("open database: %w", err)
+		}
+		// Never print the DSN, it may contain a password
+		if tenant == storage.DefaultTenant {
+			return &backend{store: db, close: db.Close, name: "postgres"}, nil
+		}
+		ts, err := storage.NewTenantDBStorage(ctx, db, tenant)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("open database: %w", err)
+		}
+		return &backend{store: ts, close: db.Close, name: "postgres"}, nil
+	}
+
+	return nil, fmt.Errorf("unknown backend %q (want %s)", spec, backendUsage)
+}
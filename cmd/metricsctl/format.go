@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// Export and import formats.
+const (
+	formatJSON   = "json"   // JSON array of metrics, the same layout as the legacy file snapshot
+	formatNDJSON = "ndjson" // One JSON metric per line
+	formatCSV    = "csv"    // Header "id,type,value", one metric per row; gauges and counters only
+)
+
+// csvHeader is the header row of the CSV format.
+var csvHeader = []string{"id", "type", "value"}
+
+// validFormat reports whether format is a supported export/import format.
+//
+// Parameters:
+//   - format: Format name
+//
+// Returns:
+//   - bool: true if the format is supported
+func validFormat(format string) bool {
+	return format == formatJSON || format == formatNDJSON || format == formatCSV
+}
+
+// typeOrder orders the metric types in exports: gauges, counters, histograms, summaries.
+var typeOrder = map[string]int{"gauge": 0, "counter": 1, "histogram": 2, "summary": 3}
+
+// sortMetrics orders metrics by type and name so that exports are reproducible.
+//
+// Parameters:
+//   - list: Metrics to sort in place
+func sortMetrics(list []metrics.Metrics) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].MType != list[j].MType {
+			return typeOrder[list[i].MType] < typeOrder[list[j].MType]
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// writeMetrics encodes metrics in the given format.
+//
+// Parameters:
+//   - w: Destination
+//   - format: formatJSON, formatNDJSON or formatCSV
+//   - list: Metrics to write
+//
+// Returns:
+//   - error: Any error encoding or writing
+func writeMetrics(w io.Writer, format string, list []metrics.Metrics) error {
+	switch format {
+	case formatJSON:
+		if list == nil {
+			list = []metrics.Metrics{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+
+	case formatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, m := range list {
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, m := range list {
+			var value string
+			switch {
+			case m.MType == "gauge" && m.Value != nil:
+				value = strconv.FormatFloat(*m.Value, 'g', -1, 64)
+			case m.MType == "counter" && m.Delta != nil:
+				value = strconv.FormatInt(*m.Delta, 10)
+			case m.MType == "histogram" || m.MType == "summary":
+				return fmt.Errorf("%s %s has no single value for CSV, use json or ndjson", m.MType, m.ID)
+			default:
+				return fmt.Errorf("metric %s of type %q has no value", m.ID, m.MType)
+			}
+			if err := cw.Write([]string{m.ID, m.MType, value}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// readMetrics decodes metrics in the given format and validates them.
+//
+// Parameters:
+//   - r: Source
+//   - format: formatJSON, formatNDJSON or formatCSV
+//
+// Returns:
+//   - []metrics.Metrics: Decoded metrics in input order
+//   - error: Error naming the offending record if the input is malformed
+func readMetrics(r io.Reader, format string) ([]metrics.Metrics, error) {
+	var list []metrics.Metrics
+
+	switch format {
+	case formatJSON:
+		if err := json.NewDecoder(r).Decode(&list); err != nil {
+			return nil, fmt.Errorf("decode JSON: %w", err)
+		}
+		for i, m := range list {
+			if err := checkMetric(m); err != nil {
+				return nil, fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+
+	case formatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var m metrics.Metrics
+			if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if err := checkMetric(m); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			list = append(list, m)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+	case formatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		header, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read CSV header: %w", err)
+		}
+		for i, name := range csvHeader {
+			if header[i] != name {
+				return nil, fmt.Errorf("CSV header must be %q, got %q", csvHeader, header)
+			}
+		}
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("read CSV: %w", err)
+			}
+			line, _ := cr.FieldPos(0)
+			m, err := parseCSVRecord(record)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			list = append(list, m)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	return list, nil
+}
+
+// parseCSVRecord converts a CSV row into a metric.
+//
+// Parameters:
+//   - record: Fields id, type and value
+//
+// Returns:
+//   - metrics.Metrics: Parsed metric
+//   - error: Error if the type is unknown or the value does not parse
+func parseCSVRecord(record []string) (metrics.Metrics, error) {
+	m := metrics.Metrics{ID: record[0], MType: record[1]}
+	switch m.MType {
+	case "gauge":
+		v, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return m, fmt.Errorf("gauge %s: invalid value %q", m.ID, record[2])
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("counter %s: invalid value %q", m.ID, record[2])
+		}
+		m.Delta = &d
+	}
+	return m, checkMetric(m)
+}
+
+// checkMetric validates a decoded metric.
+//
+// Parameters:
+//   - m: Metric to validate
+//
+// Returns:
+//   - error: Error if the name is empty, the type is unknown or the value is missing or invalid
+func checkMetric(m metrics.Metrics) error {
+	switch {
+	case m.ID == "":
+		return errors.New("missing id")
+	case m.MType == "gauge" && m.Value == nil:
+		return fmt.Errorf("gauge %s: missing value", m.ID)
+	case m.MType == "counter" && m.Delta == nil:
+		return fmt.Errorf("counter %s: missing delta", m.ID)
+	case m.MType == "histogram" && m.Histogram == nil:
+		return fmt.Errorf("histogram %s: missing histogram", m.ID)
+	case m.MType == "summary" && m.Summary == nil:
+		return fmt.Errorf("summary %s: missing summary", m.ID)
+	case m.MType == "histogram":
+		if err := storage.ValidateHistogram(*m.Histogram); err != nil {
+			return fmt.Errorf("histogram %s: %w", m.ID, err)
+		}
+	case m.MType == "summary":
+		if err := storage.ValidateSummary(*m.Summary); err != nil {
+			return fmt.Errorf("summary %s: %w", m.ID, err)
+		}
+	case m.MType != "gauge" && m.MType != "counter":
+		return fmt.Errorf("%s: unknown type %q", m.ID, m.MType)
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// Conflict policies for series that already exist in the target backend.
+const (
+	conflictOverwrite = "overwrite" // Replace the existing value
+	conflictSkip      = "skip"      // Keep the existing value
+	conflictSum       = "sum"       // Add imported counters and distributions to existing ones; gauges are overwritten
+)
+
+// Import actions reported for every imported series.
+const (
+	actionCreate    = "create"
+	actionOverwrite = "overwrite"
+	actionSum       = "sum"
+	actionSkip      = "skip"
+)
+
+// validConflict reports whether policy is a supported conflict policy.
+//
+// Parameters:
+//   - policy: Policy name
+//
+// Returns:
+//   - bool: true if the policy is supported
+func validConflict(policy string) bool {
+	return policy == conflictOverwrite || policy == conflictSkip || policy == conflictSum
+}
+
+// importStep is the outcome planned for one imported metric.
+type importStep struct {
+	Action string // actionCreate, actionOverwrite, actionSum or actionSkip
+	MType  string // Metric type
+	ID     string // Metric name
+	Old    string // Value in the target before the import (empty if missing)
+	New    string // Value in the target after the import
+}
+
+// String formats the step for the import log.
+func (s importStep) String() string {
+	switch s.Action {
+	case actionCreate:
+		return fmt.Sprintf("%-9s %s %s = %s", s.Action, s.MType, s.ID, s.New)
+	case actionSkip:
+		return fmt.Sprintf("%-9s %s %s (keeping %s)", s.Action, s.MType, s.ID, s.Old)
+	default:
+		return fmt.Sprintf("%-9s %s %s: %s -> %s", s.Action, s.MType, s.ID, s.Old, s.New)
+	}
+}
+
+// importPlan is the result of planning an import.
+type importPlan struct {
+	Steps []importStep      // One step per imported metric, in input order
+	Batch []metrics.Metrics // Batch turning the current target state into the planned one
+}
+
+// count returns the number of steps with the given action.
+//
+// Parameters:
+//   - action: Action to count
+//
+// Returns:
+//   - int: Number of steps
+func (p *importPlan) count(action string) int {
+	n := 0
+	for _, s := range p.Steps {
+		if s.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// planImport decides what happens to every imported metric and builds the batch
+// that applies the result. Metrics are processed in order, so a series imported
+// twice conflicts with its own first occurrence.
+//
+// The batch sets gauges to their final value and increments counters by the
+// difference between their final and current value, so that it can be applied
+// atomically with Storage.UpdateBatch. The target must not be written by anyone
+// else between reading its state and applying the batch.
+//
+// Histograms and summaries can only be merged, never replaced: an existing one is
+// skipped or summed, and the overwrite policy fails for them.
+//
+// Parameters:
+//   - current: All series currently in the target
+//   - incoming: Metrics to import
+//   - policy: Conflict policy for series that already exist
+//
+// Returns:
+//   - *importPlan: Planned steps and batch
+//   - error: Error wrapping storage.ErrCounterOverflow if a summed counter does not fit into
+//     int64, storage.ErrBucketMismatch if a summed histogram has other buckets, or an error
+//     if an existing histogram or summary would be overwritten
+func planImport(current, incoming []metrics.Metrics, policy string) (*importPlan, error) {
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
+	histograms := make(map[string]metrics.Histogram)
+	summaries := make(map[string]metrics.Summary)
+	for _, m := range current {
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			gauges[m.ID] = *m.Value
+		case m.MType == "counter" && m.Delta != nil:
+			counters[m.ID] = *m.Delta
+		case m.MType == "histogram" && m.Histogram != nil:
+			histograms[m.ID] = *m.Histogram
+		case m.MType == "summary" && m.Summary != nil:
+			summaries[m.ID] = *m.Summary
+		}
+	}
+	origCounters := make(map[string]int64, len(counters))
+	for k, v := range counters {
+		origCounters[k] = v
+	}
+
+	plan := &importPlan{}
+	touchedGauges := make(map[string]bool)
+	touchedCounters := make(map[string]bool)
+	// Observations to add per distribution, merged in input order
+	histogramDeltas := make(map[string]metrics.Histogram)
+	summaryDeltas := make(map[string]metrics.Summary)
+
+	for _, m := range incoming {
+		step := importStep{MType: m.MType, ID: m.ID}
+		switch m.MType {
+		case "gauge":
+			old, exists := gauges[m.ID]
+			if exists {
+				step.Old = formatGauge(old)
+			}
+			switch {
+			case !exists:
+				step.Action = actionCreate
+			case policy == conflictSkip:
+				step.Action = actionSkip
+			default:
+				// Summing gauges has no meaning; the imported value wins
+				step.Action = actionOverwrite
+			}
+			if step.Action != actionSkip {
+				gauges[m.ID] = *m.Value
+				touchedGauges[m.ID] = true
+			}
+			step.New = formatGauge(gauges[m.ID])
+
+		case "counter":
+			old, exists := counters[m.ID]
+			if exists {
+				step.Old = strconv.FormatInt(old, 10)
+			}
+			switch {
+			case !exists:
+				step.Action = actionCreate
+				counters[m.ID] = *m.Delta
+			case policy == conflictSkip:
+				step.Action = actionSkip
+			case policy == conflictSum:
+				step.Action = actionSum
+				sum, err := storage.AddCounter(old, *m.Delta)
+				if err != nil {
+					return nil, fmt.Errorf("sum counter %s: %w", m.ID, err)
+				}
+				counters[m.ID] = sum
+			default:
+				step.Action = actionOverwrite
+				counters[m.ID] = *m.Delta
+			}
+			if step.Action != actionSkip {
+				touchedCounters[m.ID] = true
+			}
+			step.New = strconv.FormatInt(counters[m.ID], 10)
+
+		case "histogram":
+			old, exists := histograms[m.ID]
+			if exists {
+				step.Old = formatDistribution(old.Count, old.Sum)
+			}
+			switch {
+			case !exists:
+				step.Action = actionCreate
+			case policy == conflictSkip:
+				step.Action = actionSkip
+			case policy == conflictSum:
+				step.Action = actionSum
+			default:
+				return nil, fmt.Errorf("histogram %s: existing histograms cannot be overwritten, use -conflict skip or sum", m.ID)
+			}
+			if step.Action != actionSkip {
+				next, err := mergeImported(histograms, m.ID, *m.Histogram, storage.MergeHistogram)
+				if err == nil {
+					_, err = mergeImported(histogramDeltas, m.ID, *m.Histogram, storage.MergeHistogram)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("sum histogram %s: %w", m.ID, err)
+				}
+				old = next
+			}
+			step.New = formatDistribution(old.Count, old.Sum)
+
+		case "summary":
+			old, exists := summaries[m.ID]
+			if exists {
+				step.Old = formatDistribution(old.Count, old.Sum)
+			}
+			switch {
+			case !exists:
+				step.Action = actionCreate
+			case policy == conflictSkip:
+				step.Action = actionSkip
+			case policy == conflictSum:
+				step.Action = actionSum
+			default:
+				return nil, fmt.Errorf("summary %s: existing summaries cannot be overwritten, use -conflict skip or sum", m.ID)
+			}
+			if step.Action != actionSkip {
+				next, err := mergeImported(summaries, m.ID, *m.Summary, storage.MergeSummary)
+				if err == nil {
+					_, err = mergeImported(summaryDeltas, m.ID, *m.Summary, storage.MergeSummary)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("sum summary %s: %w", m.ID, err)
+				}
+				old = next
+			}
+			step.New = formatDistribution(old.Count, old.Sum)
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	for name := range touchedGauges {
+		v := gauges[name]
+		plan.Batch = append(plan.Batch, metrics.Metrics{ID: name, MType: "gauge", Value: &v})
+	}
+	for name := range touchedCounters {
+		orig, existed := origCounters[name]
+		final := counters[name]
+		delta := final - orig
+		if (orig > 0 && delta > final) || (orig < 0 && delta < final) {
+			// The step from the current to the final value does not fit into one increment
+			return nil, fmt.Errorf("counter %s: %w: cannot change %d to %d", name, storage.ErrCounterOverflow, orig, final)
+		}
+		if existed && delta == 0 {
+			continue
+		}
+		plan.Batch = append(plan.Batch, metrics.Metrics{ID: name, MType: "counter", Delta: &delta})
+	}
+	for name, h := range histogramDeltas {
+		plan.Batch = append(plan.Batch, metrics.Metrics{ID: name, MType: "histogram", Histogram: &h})
+	}
+	for name, sm := range summaryDeltas {
+		plan.Batch = append(plan.Batch, metrics.Metrics{ID: name, MType: "summary", Summary: &sm})
+	}
+	sortMetrics(plan.Batch)
+	return plan, nil
+}
+
+// mergeImported merges an imported distribution into the one tracked for its name,
+// or starts tracking it.
+//
+// Parameters:
+//   - m: Distributions by name, updated on success
+//   - name: Metric name
+//   - v: Imported distribution
+//   - merge: storage.MergeHistogram or storage.MergeSummary
+//
+// Returns:
+//   - T: The merged distribution
+//   - error: Any error of merge
+func mergeImported[T any](m map[string]T, name string, v T, merge func(cur, delta T) (T, error)) (T, error) {
+	cur, ok := m[name]
+	if !ok {
+		m[name] = v
+		return v, nil
+	}
+	next, err := merge(cur, v)
+	if err != nil {
+		return cur, err
+	}
+	m[name] = next
+	return next, nil
+}
+
+// formatDistribution formats the count and sum of a histogram or summary for the import log.
+func formatDistribution(count int64, sum float64) string {
+	return fmt.Sprintf("count=%d sum=%s", count, formatGauge(sum))
+}
+
+// formatGauge formats a gauge value for the import log.
+func formatGauge(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// importMetrics imports metrics into a backend.
+//
+// Parameters:
+//   - ctx: Context for the storage operations
+//   - target: Backend to import into
+//   - incoming: Metrics to import
+//   - policy: Conflict policy
+//   - dryRun: Only report what would change
+//   - verbose: Report every series, not only the summary
+//   - log: Destination of the report
+//
+// Returns:
+//   - error: Any error reading the target or applying the batch
+func importMetrics(ctx context.Context, target *backend, incoming []metrics.Metrics, policy string, dryRun, verbose bool, log io.Writer) error {
+	current, err := target.store.GetAll()
+	if err != nil {
+		return fmt.Errorf("read %s: %w", target.name, err)
+	}
+	plan, err := planImport(current, incoming, policy)
+	if err != nil {
+		return err
+	}
+
+	if verbose || dryRun {
+		for _, step := range plan.Steps {
+			fmt.Fprintln(log, step)
+		}
+	}
+
+	summary := fmt.Sprintf("%d created, %d overwritten, %d summed, %d skipped",
+		plan.count(actionCreate), plan.count(actionOverwrite), plan.count(actionSum), plan.count(actionSkip))
+	if dryRun {
+		fmt.Fprintf(log, "Dry run, nothing written to %s: %s\n", target.name, summary)
+		return nil
+	}
+
+	if len(plan.Batch) > 0 {
+		if err := target.store.UpdateBatch(ctx, plan.Batch); err != nil {
+			return fmt.Errorf("write %s: %w", target.name, err)
+		}
+		if target.save != nil {
+			if err := target.save(); err != nil {
+				return fmt.Errorf("save %s: %w", target.name, err)
+			}
+		}
+	}
+	fmt.Fprintf(log, "Imported into %s: %s\n", target.name, summary)
+	return nil
+}
+
+// exportMetrics reads all metrics of a backend in a reproducible order.
+//
+// Parameters:
+//   - source: Backend to export
+//
+// Returns:
+//   - []metrics.Metrics: All series sorted by type and name
+//   - error: Any error reading the backend
+func exportMetrics(source *backend) ([]metrics.Metrics, error) {
+	list, err := source.store.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", source.name, err)
+	}
+	sortMetrics(list)
+	return list, nil
+}
+
+// migrateMetadata copies the registered metadata of the source into the target.
+// Metadata already registered identically in the target is not written again.
+//
+// Parameters:
+//   - ctx: Context for the storage operations
+//   - source: Backend to read metadata from
+//   - target: Backend to register metadata in
+//   - dryRun: Only report what would change
+//   - log: Destination of the report
+//
+// Returns:
+//   - error: Any error reading the source or registering metadata in the target, e.g.
+//     storage.ErrTypeConflict if the target stores a series of another type
+func migrateMetadata(ctx context.Context, source, target *backend, dryRun bool, log io.Writer) error {
+	all, err := source.store.AllMetadata()
+	if err != nil {
+		return fmt.Errorf("read metadata of %s: %w", source.name, err)
+	}
+	var changed []metrics.Metadata
+	for _, md := range all {
+		if cur, ok := target.store.GetMetadata(md.ID); !ok || cur != md {
+			changed = append(changed, md)
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(log, "Dry run, nothing written to %s: %d metadata to copy\n", target.name, len(changed))
+		return nil
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	for _, md := range changed {
+		if err := target.store.SetMetadata(ctx, md); err != nil {
+			return fmt.Errorf("write metadata of %s to %s: %w", md.ID, target.name, err)
+		}
+	}
+	if target.save != nil {
+		if err := target.save(); err != nil {
+			return fmt.Errorf("save %s: %w", target.name, err)
+		}
+	}
+	fmt.Fprintf(log, "Copied %d metadata into %s\n", len(changed), target.name)
+	return nil
+}
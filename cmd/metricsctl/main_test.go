@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+func gauge(id string, v float64) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func counter(id string, d int64) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+// seriesOf returns all series of a storage keyed by "type/name".
+func seriesOf(t *testing.T, s storage.Storage) map[string]string {
+	t.Helper()
+	all, err := s.GetAll()
+	require.NoError(t, err)
+	out := make(map[string]string)
+	for _, m := range all {
+		if m.MType == "gauge" {
+			out["gauge/"+m.ID] = formatGauge(*m.Value)
+		} else {
+			out["counter/"+m.ID] = strconv.FormatInt(*m.Delta, 10)
+		}
+	}
+	return out
+}
+
+func Test_formats_RoundTrip(t *testing.T) {
+	list := []metrics.Metrics{gauge("Alloc", 42.5), gauge("Tiny", 1e-300), counter("PollCount", 10), counter("Neg", -3)}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: formatCSV,
+			expected: "id,type,value\n" +
+				"Alloc,gauge,42.5\nTiny,gauge,1e-300\nPollCount,counter,10\nNeg,counter,-3\n",
+		},
+		{
+			format: formatNDJSON,
+			expected: `{"id":"Alloc","type":"gauge","value":42.5}` + "\n" +
+				`{"id":"Tiny","type":"gauge","value":1e-300}` + "\n" +
+				`{"id":"PollCount","type":"counter","delta":10}` + "\n" +
+				`{"id":"Neg","type":"counter","delta":-3}` + "\n",
+		},
+		{format: formatJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, writeMetrics(&buf, tt.format, list))
+			if tt.expected != "" {
+				assert.Equal(t, tt.expected, buf.String())
+			}
+
+			got, err := readMetrics(&buf, tt.format)
+			require.NoError(t, err)
+			assert.Equal(t, list, got)
+		})
+	}
+}
+
+func Test_readMetrics_Errors(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		input         string
+		expectedError string
+	}{
+		{name: "JSON missing value", format: formatJSON, input: `[{"id":"a","type":"gauge"}]`, expectedError: "item 0: gauge a: missing value"},
+		{name: "JSON unknown type", format: formatJSON, input: `[{"id":"a","type":"rate","value":1}]`, expectedError: `unknown type "rate"`},
+		{name: "JSON malformed", format: formatJSON, input: `{`, expectedError: "decode JSON"},
+		{name: "NDJSON missing id", format: formatNDJSON, input: `{"id":"a","type":"counter","delta":1}` + "\n" + `{"type":"counter","delta":1}`, expectedError: "line 2: missing id"},
+		{name: "CSV bad header", format: formatCSV, input: "name,kind,value\n", expectedError: "CSV header"},
+		{name: "CSV bad counter", format: formatCSV, input: "id,type,value\na,counter,1.5\n", expectedError: `line 2: counter a: invalid value "1.5"`},
+		{name: "CSV wrong field count", format: formatCSV, input: "id,type,value\na,gauge\n", expectedError: "wrong number of fields"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readMetrics(strings.NewReader(tt.input), tt.format)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expectedError)
+		})
+	}
+}
+
+func Test_planImport_ConflictPolicies(t *testing.T) {
+	current := []metrics.Metrics{gauge("temp", 1), counter("hits", 10), counter("same", 5)}
+	incoming := []metrics.Metrics{gauge("temp", 2), counter("hits", 3), counter("same", 5), gauge("new", 7), counter("fresh", 0)}
+
+	tests := []struct {
+		policy          string
+		expectedActions []string
+		expectedBatch   []metrics.Metrics
+	}{
+		{
+			policy:          conflictOverwrite,
+			expectedActions: []string{actionOverwrite, actionOverwrite, actionOverwrite, actionCreate, actionCreate},
+			// hits goes from 10 to 3; same is unchanged and left out
+			expectedBatch: []metrics.Metrics{gauge("new", 7), gauge("temp", 2), counter("fresh", 0), counter("hits", -7)},
+		},
+		{
+			policy:          conflictSkip,
+			expectedActions: []string{actionSkip, actionSkip, actionSkip, actionCreate, actionCreate},
+			expectedBatch:   []metrics.Metrics{gauge("new", 7), counter("fresh", 0)},
+		},
+		{
+			policy:          conflictSum,
+			expectedActions: []string{actionOverwrite, actionSum, actionSum, actionCreate, actionCreate},
+			expectedBatch:   []metrics.Metrics{gauge("new", 7), gauge("temp", 2), counter("fresh", 0), counter("hits", 3), counter("same", 5)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			plan, err := planImport(current, incoming, tt.policy)
+			require.NoError(t, err)
+			var actions []string
+			for _, s := range plan.Steps {
+				actions = append(actions, s.Action)
+			}
+			assert.Equal(t, tt.expectedActions, actions)
+			assert.Equal(t, tt.expectedBatch, plan.Batch)
+		})
+	}
+}
+
+func Test_planImport_DuplicateSeries(t *testing.T) {
+	plan, err := planImport(nil, []metrics.Metrics{counter("hits", 2), counter("hits", 3)}, conflictSum)
+	require.NoError(t, err)
+
+	require.Len(t, plan.Steps, 2)
+	assert.Equal(t, actionCreate, plan.Steps[0].Action)
+	assert.Equal(t, actionSum, plan.Steps[1].Action)
+	assert.Equal(t, "5", plan.Steps[1].New)
+	assert.Equal(t, []metrics.Metrics{counter("hits", 5)}, plan.Batch)
+}
+
+func Test_planImport_CounterOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  []metrics.Metrics
+		incoming []metrics.Metrics
+		policy   string
+	}{
+		{name: "Sum", current: []metrics.Metrics{counter("hits", math.MaxInt64)}, incoming: []metrics.Metrics{counter("hits", 1)}, policy: conflictSum},
+		{name: "Duplicate series", incoming: []metrics.Metrics{counter("hits", math.MinInt64), counter("hits", -1)}, policy: conflictSum},
+		{name: "Overwrite too far", current: []metrics.Metrics{counter("hits", math.MinInt64)}, incoming: []metrics.Metrics{counter("hits", 1)}, policy: conflictOverwrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := planImport(tt.current, tt.incoming, tt.policy)
+			assert.ErrorIs(t, err, storage.ErrCounterOverflow)
+		})
+	}
+}
+
+func Test_planImport_Distributions(t *testing.T) {
+	latency := func(counts ...int64) metrics.Metrics {
+		h := metrics.Histogram{Bounds: []float64{0.1}, Counts: counts}
+		for _, c := range counts {
+			h.Count += c
+		}
+		return metrics.Metrics{ID: "latency", MType: "histogram", Histogram: &h}
+	}
+	size := func(count int64, sum float64) metrics.Metrics {
+		return metrics.Metrics{ID: "size", MType: "summary", Summary: &metrics.Summary{Count: count, Sum: sum}}
+	}
+	current := []metrics.Metrics{latency(1, 1), size(2, 8)}
+
+	plan, err := planImport(current, []metrics.Metrics{latency(1, 0), latency(0, 3), size(1, 2)}, conflictSum)
+	require.NoError(t, err)
+	require.Len(t, plan.Steps, 3)
+	assert.Equal(t, "sum       histogram latency: count=3 sum=0 -> count=6 sum=0", plan.Steps[1].String())
+	assert.Equal(t, "sum       summary size: count=2 sum=8 -> count=3 sum=10", plan.Steps[2].String())
+	// Imported observations are merged into one batch item per series
+	assert.Equal(t, []metrics.Metrics{latency(1, 3), size(1, 2)}, plan.Batch)
+
+	plan, err = planImport(current, []metrics.Metrics{latency(1, 0), size(1, 2)}, conflictSkip)
+	require.NoError(t, err)
+	assert.Empty(t, plan.Batch)
+
+	_, err = planImport(current, []metrics.Metrics{latency(1, 0)}, conflictOverwrite)
+	assert.ErrorContains(t, err, "cannot be overwritten")
+
+	rebucketed := metrics.Metrics{ID: "latency", MType: "histogram", Histogram: &metrics.Histogram{Bounds: []float64{1}, Counts: []int64{0, 0}}}
+	_, err = planImport(current, []metrics.Metrics{rebucketed}, conflictSum)
+	assert.ErrorIs(t, err, storage.ErrBucketMismatch)
+
+	var buf bytes.Buffer
+	assert.ErrorContains(t, writeMetrics(&buf, formatCSV, current), "histogram latency has no single value for CSV")
+}
+
+func Test_run_ExportImportMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "metrics.json")
+	boltPath := filepath.Join(dir, "metrics.db")
+	csvPath := filepath.Join(dir, "export.csv")
+
+	// Source: the file backend as written by the server
+	src, err := storage.NewFileStorage(filePath)
+	require.NoError(t, err)
+	require.NoError(t, src.UpdateBatch(ctx, []metrics.Metrics{gauge("Alloc", 42.5), counter("PollCount", 10)}))
+	require.NoError(t, src.SetMetadata(ctx, metrics.Metadata{ID: "Alloc", MType: "gauge", Unit: "bytes"}))
+	require.NoError(t, src.Close())
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, run(ctx, []string{"export", "-from", "file:" + filePath, "-o", csvPath}, nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "Exported 2 metrics")
+
+	// Target already has a series that conflicts
+	dst, err := storage.NewBoltStorage(boltPath)
+	require.NoError(t, err)
+	require.NoError(t, dst.UpdateCounter(ctx, "PollCount", 5))
+	require.NoError(t, dst.Close())
+
+	openBolt := func() *storage.BoltStorage {
+		s, err := storage.NewBoltStorage(boltPath)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	// Dry run reports but does not write
+	stderr.Reset()
+	require.NoError(t, run(ctx, []string{"import", "-to", "bolt:" + boltPath, "-i", csvPath, "-conflict", "sum", "-dry-run"}, nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "sum       counter PollCount: 5 -> 15")
+	assert.Contains(t, stderr.String(), "Dry run, nothing written to bolt:"+boltPath+": 1 created, 0 overwritten, 1 summed, 0 skipped")
+	s := openBolt()
+	assert.Equal(t, map[string]string{"counter/PollCount": "5"}, seriesOf(t, s))
+	s.Close()
+
+	stderr.Reset()
+	require.NoError(t, run(ctx, []string{"import", "-to", "bolt:" + boltPath, "-i", csvPath, "-conflict", "sum"}, nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "1 created, 0 overwritten, 1 summed, 0 skipped")
+	s = openBolt()
+	assert.Equal(t, map[string]string{"gauge/Alloc": "42.5", "counter/PollCount": "15"}, seriesOf(t, s))
+	s.Close()
+
+	// Migrate back into a fresh file backend of another tenant, from standard output to input
+	stdout.Reset()
+	require.NoError(t, run(ctx, []string{"export", "-from", "bolt:" + boltPath, "-format", "ndjson"}, nil, &stdout, &stderr))
+	stderr.Reset()
+	require.NoError(t, run(ctx, []string{"import", "-to", "file:" + filePath, "-tenant", "team-a", "-format", "ndjson"}, &stdout, &bytes.Buffer{}, &stderr))
+	assert.Contains(t, stderr.String(), "2 created")
+
+	stderr.Reset()
+	require.NoError(t, run(ctx, []string{"migrate", "-from", "file:" + filePath, "-to", "bolt:" + boltPath, "-conflict", "overwrite"}, nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "0 created, 2 overwritten")
+	assert.Contains(t, stderr.String(), "Copied 1 metadata into bolt:"+boltPath)
+	s = openBolt()
+	assert.Equal(t, map[string]string{"gauge/Alloc": "42.5", "counter/PollCount": "10"}, seriesOf(t, s))
+	md, ok := s.GetMetadata("Alloc")
+	assert.True(t, ok)
+	assert.Equal(t, "bytes", md.Unit)
+	s.Close()
+
+	// The imported tenant was snapshotted to its own file
+	ts, err := storage.NewFileStorage(storage.TenantFilePath(filePath, "team-a"))
+	require.NoError(t, err)
+	defer ts.Close()
+	assert.Equal(t, map[string]string{"gauge/Alloc": "42.5", "counter/PollCount": "15"}, seriesOf(t, ts))
+}
+
+func Test_run_Usage(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError error
+		expectedText  string
+	}{
+		{name: "No command", args: nil, expectedError: errUsage, expectedText: "Usage: metricsctl"},
+		{name: "Unknown command", args: []string{"backup"}, expectedError: errUsage, expectedText: `unknown command "backup"`},
+		{name: "Help", args: []string{"help"}, expectedError: flag.ErrHelp},
+		{name: "Export without source", args: []string{"export"}, expectedError: errUsage, expectedText: "-from is required"},
+		{name: "Unknown flag", args: []string{"import", "-force"}, expectedError: errUsage},
+		{name: "Extra arguments", args: []string{"migrate", "-from", "file:a", "-to", "file:b", "extra"}, expectedError: errUsage, expectedText: "unexpected arguments: extra"},
+		{name: "Unknown backend", args: []string{"export", "-from", "mysql://db"}, expectedText: ""},
+		{name: "Unknown conflict policy", args: []string{"import", "-to", "bolt:" + filepath.Join(dir, "x.db"), "-conflict", "max"}},
+		{name: "Same backend", args: []string{"migrate", "-from", "file:a", "-to", "file:a"}},
+		{name: "Invalid tenant", args: []string{"export", "-from", "bolt:" + filepath.Join(dir, "y.db"), "-tenant", "../etc"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			err := run(context.Background(), tt.args, strings.NewReader(""), &bytes.Buffer{}, &stderr)
+			require.Error(t, err)
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+			}
+			assert.Contains(t, stderr.String(), tt.expectedText)
+		})
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
 )
 
 // AuditEvent represents an audit log entry containing information about
@@ -16,9 +19,13 @@ import (
 //
 // generate:reset
 type AuditEvent struct {
-	Timestamp int64    `json:"ts"`         // Unix timestamp when the event occurred
-	Metrics   []string `json:"metrics"`    // Names of metrics that were accessed
-	IPAddress string   `json:"ip_address"` // IP address of the client that accessed the metrics
+	Timestamp int64    `json:"ts"`                // Unix timestamp when the event occurred
+	Metrics   []string `json:"metrics"`           // Names of metrics that were accessed
+	IPAddress string   `json:"ip_address"`        // IP address of the client that accessed the metrics
+	Action    string   `json:"action,omitempty"`  // Kind of event (e.g., "auth_failure"); empty for regular access
+	Subject   string   `json:"subject,omitempty"` // Name of the API token that made the request, if any
+	Reason    string   `json:"reason,omitempty"`  // Human-readable reason for a failure event
+	Tenant    string   `json:"tenant,omitempty"`  // Tenant whose metrics were accessed (empty for the default tenant)
 }
 
 // Observer defines the interface for components that want to receive
@@ -168,6 +175,68 @@ func (fw *FileWriterObserver) Close() error {
 	return nil
 }
 
+// TenantFileWriterObserver implements the Observer interface by writing
+// audit events to a separate file per tenant, so that each tenant gets its own
+// audit stream. Events of tenant "team-a" are appended to "<dir>/team-a.log";
+// events of the default tenant go to "<dir>/default.log". No other tenant can
+// share that file because storage.ValidTenantID rejects the name "default".
+//
+// generate:reset
+type TenantFileWriterObserver struct {
+	dir     string                         // Directory holding per-tenant audit files
+	writers map[string]*FileWriterObserver // File writer per tenant
+	mutex   sync.Mutex                     // Protects writers
+}
+
+// NewTenantFileWriterObserver creates an observer that writes per-tenant audit files
+// into the given directory. The directory is created on first write if needed.
+//
+// Parameters:
+//   - dir: Directory for per-tenant audit files
+//
+// Returns:
+//   - *TenantFileWriterObserver: A configured per-tenant file writer observer
+func NewTenantFileWriterObserver(dir string) *TenantFileWriterObserver {
+	return &TenantFileWriterObserver{
+		dir:     dir,
+		writers: make(map[string]*FileWriterObserver),
+	}
+}
+
+// Notify appends the event to the audit file of the event's tenant.
+//
+// Parameters:
+//   - event: The audit event to write
+//
+// Returns:
+//   - error: nil if successful, otherwise an error describing what went wrong
+func (tw *TenantFileWriterObserver) Notify(event AuditEvent) error {
+	name := event.Tenant
+	if name == storage.DefaultTenant {
+		name = storage.ReservedTenant
+	}
+
+	tw.mutex.Lock()
+	writer, ok := tw.writers[name]
+	if !ok {
+		if err := os.MkdirAll(tw.dir, 0755); err != nil {
+			tw.mutex.Unlock()
+			return fmt.Errorf("failed to create tenant audit directory: %w", err)
+		}
+		writer = NewFileWriterObserver(filepath.Join(tw.dir, name+".log"))
+		tw.writers[name] = writer
+	}
+	tw.mutex.Unlock()
+
+	return writer.Notify(event)
+}
+
+// Close implements the Observer interface for TenantFileWriterObserver.
+// Files are closed after each write, so no cleanup is needed.
+func (tw *TenantFileWriterObserver) Close() error {
+	return nil
+}
+
 // HTTPSenderObserver implements the Observer interface by sending
 // audit events to a remote HTTP endpoint. This enables centralized
 // audit logging across multiple services.
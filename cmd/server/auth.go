@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/auth"
+)
+
+// authContextKey is the type of the context key under which the authenticated token is stored.
+type authContextKey struct{}
+
+// auditActionAuthFailure marks audit events produced by rejected authentication or authorization.
+const auditActionAuthFailure = "auth_failure"
+
+// tokenFromContext returns the authenticated API token attached to the request context.
+//
+// Parameters:
+//   - ctx: Request context
+//
+// Returns:
+//   - *auth.Token: The token, or nil if authentication is disabled
+func tokenFromContext(ctx context.Context) *auth.Token {
+	t, _ := ctx.Value(authContextKey{}).(*auth.Token)
+	return t
+}
+
+// bearerToken extracts the bearer token from the Authorization header.
+//
+// Parameters:
+//   - req: HTTP request object
+//
+// Returns:
+//   - string: The token, or an empty string if the header is missing or malformed
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// auditAuthFailure publishes an audit event describing a rejected request.
+//
+// Parameters:
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
+//   - req: The rejected HTTP request
+//   - subject: Name of the token that made the request (empty if unknown)
+//   - reason: Why the request was rejected
+//   - metricNames: Names of the metrics the request tried to access, if known
+func auditAuthFailure(auditPublisher *Publisher, req *http.Request, subject, reason string, metricNames ...string) {
+	if auditPublisher == nil {
+		return
+	}
+	if metricNames == nil {
+		metricNames = []string{}
+	}
+	auditPublisher.Notify(AuditEvent{
+		Timestamp: time.Now().Unix(),
+		Metrics:   metricNames,
+		IPAddress: getRealIP(req),
+		Tenant:    requestTenant(req),
+		Action:    auditActionAuthFailure,
+		Subject:   subject,
+		Reason:    reason,
+	})
+}
+
+// authMiddleware authenticates requests by bearer token and checks that the token's
+// role permits access to the route. The authenticated token is stored in the request
+// context so that handlers can enforce its metric-name scope with authorizeMetrics.
+//
+// When tokens is nil, authentication is disabled and all requests pass through.
+//
+// Responses:
+//   - 401 Unauthorized: the token is missing or unknown
+//   - 403 Forbidden: the token's role does not allow the route
+//   - 500 Internal Server Error: the token store failed
+//
+// Every rejected request is reported to the audit publisher.
+//
+// Parameters:
+//   - tokens: Token store used to look up bearer tokens (nil disables authentication)
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
+//   - role: Role required by the routes behind this middleware
+//
+// Returns:
+//   - func(http.Handler) http.Handler: Middleware function
+func authMiddleware(tokens auth.TokenStore, auditPublisher *Publisher, role auth.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if tokens == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret := bearerToken(r)
+			if secret == "" {
+				auditAuthFailure(auditPublisher, r, "", "missing bearer token")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			token, err := tokens.Lookup(r.Context(), auth.HashToken(secret))
+			if errors.Is(err, auth.ErrTokenNotFound) {
+				auditAuthFailure(auditPublisher, r, "", "invalid bearer token")
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Invalid bearer token", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				auditAuthFailure(auditPublisher, r, "", fmt.Sprintf("token lookup failed: %v", err))
+				http.Error(w, "Failed to verify token", http.StatusInternalServerError)
+				return
+			}
+
+			if !token.Allows(role) {
+				auditAuthFailure(auditPublisher, r, token.Name, fmt.Sprintf("role %s is not allowed, %s required", token.Role, role))
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), authContextKey{}, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authorizeMetrics checks that every metric name is inside the scope of the request's token.
+// If a name is out of scope, it reports the failure to the audit publisher and returns false;
+// the caller is responsible for writing 403 Forbidden in its own response format.
+// When authentication is disabled it always returns true.
+//
+// Parameters:
+//   - req: HTTP request carrying the authenticated token
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
+//   - names: Metric names the request is about to access
+//
+// Returns:
+//   - bool: true if the request may proceed
+func authorizeMetrics(req *http.Request, auditPublisher *Publisher, names ...string) bool {
+	token := tokenFromContext(req.Context())
+	if token == nil {
+		return true
+	}
+
+	for _, name := range names {
+		if !token.InScope(name) {
+			auditAuthFailure(auditPublisher, req, token.Name, fmt.Sprintf("metric %s is outside of scope %q", name, token.Scope), names...)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/auth"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+func newAuthRouter(t *testing.T, store storage.Storage, publisher *Publisher) http.Handler {
+	t.Helper()
+	tokens, err := auth.NewMemoryTokenStore([]auth.Token{
+		{Name: "reader", Hash: auth.HashToken("reader-secret"), Role: auth.RoleReader},
+		{Name: "writer", Hash: auth.HashToken("writer-secret"), Role: auth.RoleWriter},
+		{Name: "scoped", Hash: auth.HashToken("scoped-secret"), Role: auth.RoleWriter, Scope: "app_"},
+		{Name: "admin", Hash: auth.HashToken("admin-secret"), Role: auth.RoleAdmin},
+	})
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokens, publisher, auth.RoleReader))
+		r.Get("/value/{type}/{name}", getHandler(store, publisher))
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokens, publisher, auth.RoleWriter))
+		r.Post("/update", updateJSONHandler(context.Background(), store, nil, func() {}, publisher))
+		r.Post("/updates", updatesBatchHandler(context.Background(), store, nil, func() {}, publisher))
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokens, publisher, auth.RoleAdmin))
+		r.Delete("/value/{type}/{name}", deleteHandler(context.Background(), store, func() {}, publisher))
+	})
+	return router
+}
+
+func Test_authMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		body           string
+		token          string
+		expectedStatus int
+	}{
+		{
+			name:           "Missing token",
+			method:         http.MethodPost,
+			url:            "/update",
+			body:           `{"id":"Alloc","type":"gauge","value":1}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Unknown token",
+			method:         http.MethodPost,
+			url:            "/update",
+			body:           `{"id":"Alloc","type":"gauge","value":1}`,
+			token:          "wrong",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Reader cannot write",
+			method:         http.MethodPost,
+			url:            "/update",
+			body:           `{"id":"Alloc","type":"gauge","value":1}`,
+			token:          "reader-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Writer can write",
+			method:         http.MethodPost,
+			url:            "/update",
+			body:           `{"id":"Alloc","type":"gauge","value":1}`,
+			token:          "writer-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Writer cannot read",
+			method:         http.MethodGet,
+			url:            "/value/gauge/Existing",
+			token:          "writer-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Reader can read",
+			method:         http.MethodGet,
+			url:            "/value/gauge/Existing",
+			token:          "reader-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Scoped token inside scope",
+			method:         http.MethodPost,
+			url:            "/update",
+			body:           `{"id":"app_requests","type":"counter","delta":1}`,
+			token:          "scoped-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Scoped token outside scope",
+			method:         http.MethodPost,
+			url:            "/update",
+			body:           `{"id":"Alloc","type":"gauge","value":1}`,
+			token:          "scoped-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Scoped token batch with foreign metric",
+			method:         http.MethodPost,
+			url:            "/updates",
+			body:           `[{"id":"app_x","type":"gauge","value":1},{"id":"Alloc","type":"gauge","value":1}]`,
+			token:          "scoped-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Writer cannot delete",
+			method:         http.MethodDelete,
+			url:            "/value/gauge/Existing",
+			token:          "writer-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Admin can delete",
+			method:         http.MethodDelete,
+			url:            "/value/gauge/Existing",
+			token:          "admin-secret",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemStorage()
+			store.UpdateGauge(t.Context(), "Existing", 1.5)
+			router := newAuthRouter(t, store, nil)
+
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+		})
+	}
+}
+
+func Test_authMiddleware_AuditsFailures(t *testing.T) {
+	tmpFile := tempFile(t)
+	publisher := NewPublisher([]Observer{NewFileWriterObserver(tmpFile)})
+	defer publisher.Close()
+
+	store := storage.NewMemStorage()
+	router := newAuthRouter(t, store, publisher)
+
+	// Unknown token
+	req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"id":"Alloc","type":"gauge","value":1}`))
+	req.Header.Set("Authorization", "Bearer nope")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Out-of-scope metric
+	req = httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"id":"Alloc","type":"gauge","value":1}`))
+	req.Header.Set("Authorization", "Bearer scoped-secret")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"action":"auth_failure"`)
+	assert.Contains(t, lines[0], "invalid bearer token")
+	assert.Contains(t, lines[1], `"subject":"scoped"`)
+	assert.Contains(t, lines[1], "Alloc")
+
+	_, exists := store.GetGauge("Alloc")
+	assert.False(t, exists, "rejected update must not be stored")
+}
+
+// failingTokenStore is a token store whose lookups always fail.
+type failingTokenStore struct{}
+
+func (failingTokenStore) Lookup(context.Context, string) (*auth.Token, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingTokenStore) Close() error { return nil }
+
+func Test_authMiddleware_AuditsStoreErrors(t *testing.T) {
+	tmpFile := tempFile(t)
+	publisher := NewPublisher([]Observer{NewFileWriterObserver(tmpFile)})
+	defer publisher.Close()
+
+	router := chi.NewRouter()
+	router.Use(authMiddleware(failingTokenStore{}, publisher, auth.RoleWriter))
+	router.Post("/update", func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"id":"Alloc","type":"gauge","value":1}`))
+	req.Header.Set("Authorization", "Bearer writer-secret")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	data, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"action":"auth_failure"`)
+	assert.Contains(t, string(data), "token lookup failed: connection refused")
+}
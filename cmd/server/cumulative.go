@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+const (
+	// sourceHeader is the request header identifying the sender of cumulative counters.
+	sourceHeader = "X-Source-ID"
+
+	// sourceStartHeader is the optional request header with the RFC 3339 start time of
+	// the sending process. A changed start time tells the server the sender restarted.
+	sourceStartHeader = "X-Source-Start"
+
+	// maxSourceIDLength limits the length of the X-Source-ID header.
+	maxSourceIDLength = 256
+)
+
+// errInvalidSource is returned when the source headers of a request are malformed.
+var errInvalidSource = errors.New("invalid source headers")
+
+// errCumulativeDisabled is returned for cumulative counters sent to a server without
+// a tracker, i.e. one that may share its database with other replicas.
+var errCumulativeDisabled = errors.New("cumulative counters are disabled")
+
+// requestSource builds the source of cumulative counters from the request headers.
+//
+// Parameters:
+//   - req: HTTP request object
+//
+// Returns:
+//   - storage.Source: Tenant, X-Source-ID and X-Source-Start of the request
+//   - error: errInvalidSource if a header is malformed
+func requestSource(req *http.Request) (storage.Source, error) {
+	src := storage.Source{Tenant: requestTenant(req), ID: req.Header.Get(sourceHeader)}
+	if len(src.ID) > maxSourceIDLength {
+		return src, fmt.Errorf("%w: %s longer than %d bytes", errInvalidSource, sourceHeader, maxSourceIDLength)
+	}
+	if v := req.Header.Get(sourceStartHeader); v != "" {
+		start, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return src, fmt.Errorf("%w: %s: %v", errInvalidSource, sourceStartHeader, err)
+		}
+		src.Start = start
+	}
+	return src, nil
+}
+
+// writeBatch stores a batch of metrics from a request. Cumulative counters are
+// converted into increments by the tracker, per source of the request.
+//
+// Parameters:
+//   - ctx: Context for the storage operation
+//   - req: HTTP request carrying the source headers
+//   - store: Storage of the request's tenant
+//   - tracker: Tracker of cumulative counters (nil rejects them)
+//   - batch: Validated metrics to store
+//
+// Returns:
+//   - error: errCumulativeDisabled, errInvalidSource, storage.ErrMissingSource,
+//     or any error of the storage
+func writeBatch(ctx context.Context, req *http.Request, store storage.Storage, tracker *storage.CumulativeTracker, batch []metrics.Metrics) error {
+	if tracker == nil {
+		for _, m := range batch {
+			if m.Temporality == metrics.TemporalityCumulative {
+				return errCumulativeDisabled
+			}
+		}
+		return store.UpdateBatch(ctx, batch)
+	}
+	src, err := requestSource(req)
+	if err != nil {
+		return err
+	}
+	return tracker.UpdateBatch(ctx, store, src, batch)
+}
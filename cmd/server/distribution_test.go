@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+func newDistributionRouter(store storage.Storage) *chi.Mux {
+	router := newMetadataRouter(store)
+	router.Post("/update/{type}/{name}/{value}", postHandler(context.Background(), store, func() {}, nil))
+	router.Get("/value/{type}/{name}", getHandler(store, nil))
+	router.Delete("/value/{type}/{name}", deleteHandler(context.Background(), store, func() {}, nil))
+	return router
+}
+
+func Test_distributionUpdates(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+		expectedCounts []int64
+	}{
+		{
+			name:           "Histogram merged",
+			method:         http.MethodPost,
+			path:           "/update",
+			body:           `{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1,0,1],"count":2,"sum":2.05}}`,
+			expectedStatus: http.StatusOK,
+			expectedCounts: []int64{3, 1, 1},
+		},
+		{
+			name:           "Histogram batch merged in order",
+			method:         http.MethodPost,
+			path:           "/updates",
+			body:           `[{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1,0,0],"count":1,"sum":0.05}},{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[0,0,1],"count":1,"sum":2}}]`,
+			expectedStatus: http.StatusOK,
+			expectedCounts: []int64{3, 1, 1},
+		},
+		{
+			name:           "Other buckets",
+			method:         http.MethodPost,
+			path:           "/update",
+			body:           `{"id":"latency","type":"histogram","histogram":{"bounds":[0.5],"counts":[1,0],"count":1,"sum":0.2}}`,
+			expectedStatus: http.StatusConflict,
+			expectedBody:   "Histogram buckets differ from the stored histogram",
+		},
+		{
+			name:           "Other buckets in batch",
+			method:         http.MethodPost,
+			path:           "/updates",
+			body:           `[{"id":"x","type":"gauge","value":1},{"id":"latency","type":"histogram","histogram":{"bounds":[0.5],"counts":[1,0],"count":1,"sum":0.2}}]`,
+			expectedStatus: http.StatusConflict,
+			expectedBody:   `"index":1,"id":"latency","type":"histogram"`,
+		},
+		{
+			name:           "Missing histogram",
+			method:         http.MethodPost,
+			path:           "/update",
+			body:           `{"id":"latency","type":"histogram","value":1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "Missing 'histogram' for histogram metric latency",
+		},
+		{
+			name:           "Counts do not match bounds",
+			method:         http.MethodPost,
+			path:           "/update",
+			body:           `{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1],"count":1,"sum":0}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "histogram needs 3 counts for 2 bounds, got 1",
+		},
+		{
+			name:           "Cumulative histogram",
+			method:         http.MethodPost,
+			path:           "/update",
+			body:           `{"id":"latency","type":"histogram","temporality":"cumulative","histogram":{"bounds":[],"counts":[1],"count":1,"sum":0}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "Only counters can be cumulative",
+		},
+		{
+			name:           "Summary",
+			method:         http.MethodPost,
+			path:           "/update",
+			body:           `{"id":"size","type":"summary","summary":{"count":2,"sum":10,"quantiles":[{"quantile":0.5,"value":4}]}}`,
+			expectedStatus: http.StatusOK,
+			expectedCounts: []int64{2, 1, 0},
+		},
+		{
+			name:           "Plain URL",
+			method:         http.MethodPost,
+			path:           "/update/histogram/latency/1",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "only accepted as JSON",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemStorage()
+			require.NoError(t, store.UpdateHistogram(t.Context(), "latency", metrics.Histogram{Bounds: []float64{0.1, 1}, Counts: []int64{2, 1, 0}, Count: 3, Sum: 0.75}))
+
+			rr := serve(t, newDistributionRouter(store), tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tt.expectedBody)
+
+			h, ok := store.GetHistogram("latency")
+			require.True(t, ok)
+			if tt.expectedCounts == nil {
+				assert.Equal(t, []int64{2, 1, 0}, h.Counts, "rejected update must not change the histogram")
+				return
+			}
+			assert.Equal(t, tt.expectedCounts, h.Counts)
+		})
+	}
+}
+
+func Test_distributionQueries(t *testing.T) {
+	store := storage.NewMemStorage()
+	require.NoError(t, store.UpdateHistogram(t.Context(), "latency", metrics.Histogram{Bounds: []float64{0.1, 1}, Counts: []int64{2, 1, 1}, Count: 4, Sum: 2.5}))
+	require.NoError(t, store.UpdateSummary(t.Context(), "size", metrics.Summary{Count: 3, Sum: 12, Quantiles: []metrics.Quantile{{Quantile: 0.5, Value: 4}, {Quantile: 0.99, Value: 7}}}))
+	router := newDistributionRouter(store)
+
+	rr := serve(t, router, http.MethodPost, "/value", `{"id":"latency","type":"histogram"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp metrics.Metrics
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Histogram)
+	assert.Equal(t, metrics.Histogram{Bounds: []float64{0.1, 1}, Counts: []int64{2, 1, 1}, Count: 4, Sum: 2.5}, *resp.Histogram)
+
+	rr = serve(t, router, http.MethodGet, "/value/summary/size", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"count":3,"sum":12,"quantiles":[{"quantile":0.5,"value":4},{"quantile":0.99,"value":7}]}`, rr.Body.String())
+
+	rr = serve(t, router, http.MethodGet, "/", "")
+	assert.Contains(t, rr.Body.String(), "<strong>latency</strong>: count=4 sum=2.5 (histogram)")
+
+	rr = serve(t, router, http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `# TYPE latency histogram
+latency_bucket{le="0.1"} 2
+latency_bucket{le="1"} 3
+latency_bucket{le="+Inf"} 4
+latency_sum 2.5
+latency_count 4
+# TYPE size summary
+size{quantile="0.5"} 4
+size{quantile="0.99"} 7
+size_sum 12
+size_count 3
+`, rr.Body.String())
+
+	rr = serve(t, router, http.MethodDelete, "/value/histogram/latency", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve(t, router, http.MethodGet, "/value/histogram/latency", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func Test_prometheusHandler_DistributionNames(t *testing.T) {
+	store := storage.NewMemStorage()
+	require.NoError(t, store.UpdateHistogram(t.Context(), "rtt", metrics.Histogram{Counts: []int64{1}, Count: 1, Sum: 0.5}))
+	// Taken by a series of the histogram, so the gauge is skipped
+	require.NoError(t, store.UpdateGauge(t.Context(), "rtt_count", 9))
+
+	rr := serve(t, newMetadataRouter(store), http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `# TYPE rtt histogram
+rtt_bucket{le="+Inf"} 1
+rtt_sum 0.5
+rtt_count 1
+`, rr.Body.String())
+}
@@ -91,7 +91,7 @@ func Example_updateJSONHandler() {
 	// Setup: Create a test server with in-memory storage
 	store := storage.NewMemStorage()
 	router := chi.NewRouter()
-	router.Post("/update", updateJSONHandler(context.Background(), store, func() {}, nil))
+	router.Post("/update", updateJSONHandler(context.Background(), store, nil, func() {}, nil))
 
 	ts := httptest.NewServer(router)
 	defer ts.Close()
@@ -135,7 +135,7 @@ func Example_updatesBatchHandler() {
 	// Setup: Create a test server with in-memory storage
 	store := storage.NewMemStorage()
 	router := chi.NewRouter()
-	router.Post("/updates", updatesBatchHandler(context.Background(), store, func() {}, nil))
+	router.Post("/updates", updatesBatchHandler(context.Background(), store, nil, func() {}, nil))
 
 	ts := httptest.NewServer(router)
 	defer ts.Close()
@@ -296,7 +296,7 @@ func Example_workflow() {
 	router := chi.NewRouter()
 
 	// Register handlers
-	router.Post("/update", updateJSONHandler(context.Background(), store, func() {}, nil))
+	router.Post("/update", updateJSONHandler(context.Background(), store, nil, func() {}, nil))
 	router.Post("/value", valueJSONHandler(store, nil))
 
 	ts := httptest.NewServer(router)
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
-	"net"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -20,7 +22,7 @@ import (
 	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
 )
 
-// MetricType represents the type of metric (gauge or counter).
+// MetricType represents the type of metric (gauge, counter, histogram or summary).
 type MetricType string
 
 const (
@@ -31,6 +33,14 @@ const (
 	// MetricTypeCounter represents a counter metric type that stores integer values.
 	// Counter metrics are monotonically increasing (e.g., request count, poll count)
 	MetricTypeCounter MetricType = "counter"
+
+	// MetricTypeHistogram represents a histogram metric type that stores bucketed observations.
+	// Reports carry the observations since the previous report and are merged by the server
+	MetricTypeHistogram MetricType = "histogram"
+
+	// MetricTypeSummary represents a summary metric type that stores the count and sum of
+	// observations together with the quantiles of the latest report
+	MetricTypeSummary MetricType = "summary"
 )
 
 // writeJSONError writes an error response in JSON format.
@@ -46,8 +56,174 @@ func writeJSONError(w http.ResponseWriter, code int, message string) {
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
 
-// indexHandler returns an HTTP handler that displays all metrics (gauge and counter) as HTML.
-// The format is a list of metric names with their values.
+// storageErrorStatus maps a storage write error to an HTTP status code.
+// Invalid metrics, missing or malformed source headers and cumulative counters
+// sent to a server that does not accept them are reported as 400 Bad Request,
+// exceeding the tenant's series quota as 403 Forbidden, a conflict with the
+// registered metric type or with the buckets of a stored histogram as 409 Conflict
+// and a counter overflow as 422 Unprocessable Entity; any other failure is an
+// internal server error.
+//
+// Parameters:
+//   - err: Error returned by the storage
+//
+// Returns:
+//   - int: HTTP status code
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrInvalidMetric),
+		errors.Is(err, storage.ErrMissingSource),
+		errors.Is(err, errInvalidSource),
+		errors.Is(err, errCumulativeDisabled):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, storage.ErrTypeConflict),
+		errors.Is(err, storage.ErrBucketMismatch):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrCounterOverflow):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// storageErrorMessage returns the client-facing message for a storage write error.
+//
+// Parameters:
+//   - err: Error returned by the storage
+//   - fallback: Message used for errors that are not reported to the client in detail
+//
+// Returns:
+//   - string: Error message
+func storageErrorMessage(err error, fallback string) string {
+	switch {
+	case errors.Is(err, storage.ErrInvalidMetric), errors.Is(err, errInvalidSource):
+		// Caused by the request, so the details are safe to return
+		return err.Error()
+	case errors.Is(err, storage.ErrMissingSource):
+		return "Cumulative counters require the " + sourceHeader + " header"
+	case errors.Is(err, errCumulativeDisabled):
+		return "Cumulative counters are disabled on this server; send increments instead"
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return "Series quota exceeded"
+	case errors.Is(err, storage.ErrTypeConflict):
+		return "Metric type conflicts with its registered type"
+	case errors.Is(err, storage.ErrBucketMismatch):
+		return "Histogram buckets differ from the stored histogram"
+	case errors.Is(err, storage.ErrCounterOverflow):
+		return "Counter overflow"
+	}
+	return fallback
+}
+
+// batchFailure describes a rejected item of a batch update in the error response.
+type batchFailure struct {
+	Index int    `json:"index"` // Position of the item in the request array
+	ID    string `json:"id"`    // Metric name
+	MType string `json:"type"`  // Metric type
+	Error string `json:"error"` // Why the item was rejected
+}
+
+// writeBatchError writes a JSON error response listing the failed items of a batch.
+//
+// Parameters:
+//   - w: HTTP response writer
+//   - code: HTTP status code to return
+//   - failed: Items that were rejected
+func writeBatchError(w http.ResponseWriter, code int, failed []batchFailure) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error  string         `json:"error"`
+		Failed []batchFailure `json:"failed"`
+	}{
+		Error:  fmt.Sprintf("Batch rejected: %d item(s) failed", len(failed)),
+		Failed: failed,
+	})
+}
+
+// writeStorageError writes the JSON error response for a rejected write. A *storage.BatchError
+// lists every failed item; other errors are reported with a single message.
+//
+// Parameters:
+//   - w: HTTP response writer
+//   - err: Error returned by storage.ValidateBatch or the storage
+//   - fallback: Message used for errors that are not reported to the client in detail
+func writeStorageError(w http.ResponseWriter, err error, fallback string) {
+	var batchErr *storage.BatchError
+	if !errors.As(err, &batchErr) {
+		writeJSONError(w, storageErrorStatus(err), storageErrorMessage(err, fallback))
+		return
+	}
+	failed := make([]batchFailure, len(batchErr.Items))
+	for i, item := range batchErr.Items {
+		failed[i] = batchFailure{Index: item.Index, ID: item.ID, MType: item.MType, Error: storageErrorMessage(item.Err, "Storage error")}
+	}
+	writeBatchError(w, storageErrorStatus(err), failed)
+}
+
+// updateMetricError checks the type, the value fields and the temporality of a metric
+// sent to /update. Clients match on these messages, so they are kept as they are;
+// /updates reports the wording of storage.ValidateBatch per failed item instead.
+//
+// Parameters:
+//   - m: Metric from the request, with an ID
+//
+// Returns:
+//   - string: Error message for the client, or an empty string if the checks pass
+func updateMetricError(m metrics.Metrics) string {
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return "Missing 'value' for gauge metric"
+		}
+		if m.Delta != nil {
+			return "Unexpected 'delta' for gauge metric"
+		}
+	case "counter":
+		if m.Delta == nil {
+			return "Missing 'delta' for counter metric"
+		}
+		if m.Value != nil {
+			return "Unexpected 'value' for counter metric"
+		}
+	case "histogram":
+		if m.Histogram == nil {
+			return fmt.Sprintf("Missing 'histogram' for histogram metric %s", m.ID)
+		}
+		if m.Value != nil || m.Delta != nil || m.Summary != nil {
+			return fmt.Sprintf("Unexpected value fields for histogram metric %s", m.ID)
+		}
+	case "summary":
+		if m.Summary == nil {
+			return fmt.Sprintf("Missing 'summary' for summary metric %s", m.ID)
+		}
+		if m.Value != nil || m.Delta != nil || m.Histogram != nil {
+			return fmt.Sprintf("Unexpected value fields for summary metric %s", m.ID)
+		}
+	default:
+		return "Unknown metric type"
+	}
+
+	switch m.Temporality {
+	case "", metrics.TemporalityDelta:
+	case metrics.TemporalityCumulative:
+		if m.MType != "counter" {
+			return fmt.Sprintf("Only counters can be cumulative, got %s metric %s", m.MType, m.ID)
+		}
+		if *m.Delta < 0 {
+			return fmt.Sprintf("Cumulative value of counter %s must not be negative", m.ID)
+		}
+	default:
+		return fmt.Sprintf("Unknown temporality %q for metric %s", m.Temporality, m.ID)
+	}
+	return ""
+}
+
+// indexHandler returns an HTTP handler that displays all metrics as HTML.
+// The format is a list of metric names with their values, followed by the unit and
+// description of metrics with registered metadata. Histograms and summaries are
+// shown with the count and sum of their observations.
 // Supports only GET requests; returns 405 Method Not Allowed for other methods.
 //
 // Parameters:
@@ -57,6 +233,7 @@ func writeJSONError(w http.ResponseWriter, code int, message string) {
 //   - http.HandlerFunc: Handler function for the index endpoint
 func indexHandler(store storage.Storage) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
 		if req.Method != http.MethodGet {
 			http.Error(res, "Only GET request allowed!", http.StatusMethodNotAllowed)
 			return
@@ -70,31 +247,51 @@ func indexHandler(store storage.Storage) func(http.ResponseWriter, *http.Request
 		res.Header().Set("Content-Type", "text/html; charset=utf-8")
 
 		// Build HTML response with all metrics
-		html := `<!DOCTYPE html>
+		page := `<!DOCTYPE html>
 <html lang="en">
 <head><meta charset="UTF-8"><title>Metrics</title></head>
 <body><h1>Metrics</h1><ul>`
+		token := tokenFromContext(req.Context())
 		for _, m := range metrics {
-			switch m.MType {
-			case "gauge":
-				if m.Value != nil {
-					html += fmt.Sprintf("<li><strong>%s</strong>: %v (gauge)</li>", m.ID, *m.Value)
+			// Hide metrics outside of the token scope instead of failing the whole page
+			if token != nil && !token.InScope(m.ID) {
+				continue
+			}
+			var value interface{}
+			switch {
+			case m.MType == "gauge" && m.Value != nil:
+				value = *m.Value
+			case m.MType == "counter" && m.Delta != nil:
+				value = *m.Delta
+			case m.MType == "histogram" && m.Histogram != nil:
+				value = fmt.Sprintf("count=%d sum=%v", m.Histogram.Count, m.Histogram.Sum)
+			case m.MType == "summary" && m.Summary != nil:
+				value = fmt.Sprintf("count=%d sum=%v", m.Summary.Count, m.Summary.Sum)
+			default:
+				continue
+			}
+			// Metadata is free text from clients, so it is escaped
+			var unit, description string
+			if md, ok := store.GetMetadata(m.ID); ok {
+				if md.Unit != "" {
+					unit = " " + html.EscapeString(md.Unit)
 				}
-			case "counter":
-				if m.Delta != nil {
-					html += fmt.Sprintf("<li><strong>%s</strong>: %v (counter)</li>", m.ID, *m.Delta)
+				if md.Description != "" {
+					description = " &ndash; " + html.EscapeString(md.Description)
 				}
 			}
+			page += fmt.Sprintf("<li><strong>%s</strong>: %v%s (%s)%s</li>", html.EscapeString(m.ID), value, unit, m.MType, description)
 		}
-		html += `</ul></body></html>`
-		io.WriteString(res, html)
+		page += `</ul></body></html>`
+		io.WriteString(res, page)
 	}
 }
 
 // getHandler returns an HTTP handler for retrieving the value of a specific metric by type and name.
 // URL pattern: /value/{type}/{name}
 // Supports only GET requests; returns 404 if the metric is not found or if the type is invalid.
-// Valid types: "gauge" or "counter" (case-insensitive).
+// Valid types: "gauge", "counter", "histogram" or "summary" (case-insensitive).
+// Histograms and summaries are returned as JSON objects.
 //
 // Parameters:
 //   - store: Storage interface for retrieving metrics
@@ -104,6 +301,7 @@ func indexHandler(store storage.Storage) func(http.ResponseWriter, *http.Request
 //   - http.HandlerFunc: Handler function for the value endpoint
 func getHandler(store storage.Storage, auditPublisher *Publisher) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
 		if req.Method != http.MethodGet {
 			http.Error(res, "Only GET request allowed!", http.StatusMethodNotAllowed)
 			return
@@ -112,6 +310,11 @@ func getHandler(store storage.Storage, auditPublisher *Publisher) func(http.Resp
 		metricType := strings.ToLower(chi.URLParam(req, "type"))
 		metricName := chi.URLParam(req, "name")
 
+		if !authorizeMetrics(req, auditPublisher, metricName) {
+			http.Error(res, "Metric is outside of token scope", http.StatusForbidden)
+			return
+		}
+
 		switch metricType {
 		case "gauge":
 			if value, exists := store.GetGauge(metricName); exists {
@@ -122,6 +325,7 @@ func getHandler(store storage.Storage, auditPublisher *Publisher) func(http.Resp
 						Timestamp: time.Now().Unix(),
 						Metrics:   []string{metricName},
 						IPAddress: ipAddress,
+						Tenant:    requestTenant(req),
 					}
 					auditPublisher.Notify(event)
 				}
@@ -140,6 +344,7 @@ func getHandler(store storage.Storage, auditPublisher *Publisher) func(http.Resp
 						Timestamp: time.Now().Unix(),
 						Metrics:   []string{metricName},
 						IPAddress: ipAddress,
+						Tenant:    requestTenant(req),
 					}
 					auditPublisher.Notify(event)
 				}
@@ -149,6 +354,35 @@ func getHandler(store storage.Storage, auditPublisher *Publisher) func(http.Resp
 			http.Error(res, "Unknown metric name", http.StatusNotFound)
 			return
 
+		case "histogram", "summary":
+			var (
+				value  interface{}
+				exists bool
+			)
+			if metricType == "histogram" {
+				value, exists = store.GetHistogram(metricName)
+			} else {
+				value, exists = store.GetSummary(metricName)
+			}
+			if !exists {
+				http.Error(res, "Unknown metric name", http.StatusNotFound)
+				return
+			}
+			// Log audit event if publisher is configured
+			if auditPublisher != nil {
+				ipAddress := getRealIP(req)
+				event := AuditEvent{
+					Timestamp: time.Now().Unix(),
+					Metrics:   []string{metricName},
+					IPAddress: ipAddress,
+					Tenant:    requestTenant(req),
+				}
+				auditPublisher.Notify(event)
+			}
+			res.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(res).Encode(value)
+			return
+
 		default:
 			http.Error(res, "Unknown metric type", http.StatusNotFound)
 			return
@@ -161,6 +395,8 @@ func getHandler(store storage.Storage, auditPublisher *Publisher) func(http.Resp
 // Supports only POST requests; validates the value type based on the metric type:
 // - gauge: requires float64
 // - counter: requires int64
+// Histograms and summaries have no single value and are rejected with 400; they are
+// only accepted as JSON.
 // On success, returns 200 OK; on errors, returns appropriate HTTP error codes.
 //
 // Parameters:
@@ -172,6 +408,7 @@ func getHandler(store storage.Storage, auditPublisher *Publisher) func(http.Resp
 //   - http.HandlerFunc: Handler function for the update endpoint
 func postHandler(ctx context.Context, store storage.Storage, saveFunc func(), auditPublisher *Publisher) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
 		if req.Method != http.MethodPost {
 			http.Error(res, "Only POST request allowed!", http.StatusMethodNotAllowed)
 			return
@@ -181,6 +418,11 @@ func postHandler(ctx context.Context, store storage.Storage, saveFunc func(), au
 		name := chi.URLParam(req, "name")
 		valueStr := chi.URLParam(req, "value")
 
+		if !authorizeMetrics(req, auditPublisher, name) {
+			http.Error(res, "Metric is outside of token scope", http.StatusForbidden)
+			return
+		}
+
 		var err error
 		switch metricType {
 		case "gauge":
@@ -190,7 +432,7 @@ func postHandler(ctx context.Context, store storage.Storage, saveFunc func(), au
 				return
 			}
 			if err = store.UpdateGauge(ctx, name, v); err != nil {
-				http.Error(res, "Failed to update metric", http.StatusInternalServerError)
+				http.Error(res, storageErrorMessage(err, "Failed to update metric"), storageErrorStatus(err))
 				return
 			}
 
@@ -201,10 +443,14 @@ func postHandler(ctx context.Context, store storage.Storage, saveFunc func(), au
 				return
 			}
 			if err = store.UpdateCounter(ctx, name, d); err != nil {
-				http.Error(res, "Failed to update metric", http.StatusInternalServerError)
+				http.Error(res, storageErrorMessage(err, "Failed to update metric"), storageErrorStatus(err))
 				return
 			}
 
+		case "histogram", "summary":
+			http.Error(res, "Histograms and summaries are only accepted as JSON", http.StatusBadRequest)
+			return
+
 		default:
 			http.Error(res, "Unknown metric type", http.StatusBadRequest)
 			return
@@ -217,6 +463,7 @@ func postHandler(ctx context.Context, store storage.Storage, saveFunc func(), au
 				Timestamp: time.Now().Unix(),
 				Metrics:   []string{name},
 				IPAddress: ipAddress,
+				Tenant:    requestTenant(req),
 			}
 			auditPublisher.Notify(event)
 		}
@@ -229,19 +476,31 @@ func postHandler(ctx context.Context, store storage.Storage, saveFunc func(), au
 // updateJSONHandler handles updating metrics via JSON payload.
 // Accepts a JSON object representing a metric with its type, name, and value.
 // Validates the metric type and value format before updating the storage.
+// A counter with temporality "cumulative" carries the running total of the source
+// named in the X-Source-ID header; the tracker stores the increment since its last sample.
+// Metadata sent in the "meta" field is checked before and registered after the sample
+// is stored, so a rejected request changes nothing, and samples whose type conflicts with the registered type are rejected with 409.
+// Histograms and summaries are merged into the stored ones; a histogram whose bounds
+// differ from the stored histogram is rejected with 409.
 // Returns the updated metric in the response body along with appropriate HTTP status codes.
 //
 // Parameters:
 //   - store: Storage interface for updating metrics
+//   - tracker: Tracker of cumulative counters (nil rejects them with 400)
 //   - saveFunc: Function to persist metrics to disk/database
 //   - auditPublisher: Optional publisher for audit logging (can be nil)
 //
 // Returns:
 //   - http.HandlerFunc: Handler function for the JSON update endpoint
-func updateJSONHandler(ctx context.Context, store storage.Storage, saveFunc func(), auditPublisher *Publisher) http.HandlerFunc {
+func updateJSONHandler(ctx context.Context, store storage.Storage, tracker *storage.CumulativeTracker, saveFunc func(), auditPublisher *Publisher) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
 		var m metrics.Metrics
 		if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+			if isBodyTooLarge(err) {
+				writeJSONError(res, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
 			writeJSONError(res, http.StatusBadRequest, "Invalid JSON")
 			return
 		}
@@ -251,39 +510,70 @@ func updateJSONHandler(ctx context.Context, store storage.Storage, saveFunc func
 			return
 		}
 
+		if !authorizeMetrics(req, auditPublisher, m.ID) {
+			writeJSONError(res, http.StatusForbidden, "Metric is outside of token scope")
+			return
+		}
+
+		if msg := updateMetricError(m); msg != "" {
+			writeJSONError(res, http.StatusBadRequest, msg)
+			return
+		}
+
+		// The remaining checks are those of the items of a batch
+		if err := storage.ValidateBatch([]metrics.Metrics{m}); err != nil {
+			var batchErr *storage.BatchError
+			if errors.As(err, &batchErr) {
+				err = batchErr.Items[0].Err
+			}
+			writeJSONError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Check inline metadata now and register it once the sample is stored
+		md, err := checkMetadata(store, m)
+		if err != nil {
+			writeJSONError(res, storageErrorStatus(err), storageErrorMessage(err, "Storage error"))
+			return
+		}
+
 		// Validate and process based on metric type
 		switch m.MType {
 		case "gauge":
-			if m.Value == nil {
-				writeJSONError(res, http.StatusBadRequest, "Missing 'value' for gauge metric")
-				return
-			}
-			if m.Delta != nil {
-				writeJSONError(res, http.StatusBadRequest, "Unexpected 'delta' for gauge metric")
-				return
-			}
 			if err := store.UpdateGauge(ctx, m.ID, *m.Value); err != nil {
-				writeJSONError(res, http.StatusInternalServerError, "Storage error")
+				writeJSONError(res, storageErrorStatus(err), storageErrorMessage(err, "Storage error"))
 				return
 			}
 
 		case "counter":
-			if m.Delta == nil {
-				writeJSONError(res, http.StatusBadRequest, "Missing 'delta' for counter metric")
+			if m.Temporality == metrics.TemporalityCumulative {
+				sample := m
+				sample.Meta = nil
+				err = writeBatch(ctx, req, store, tracker, []metrics.Metrics{sample})
+			} else {
+				err = store.UpdateCounter(ctx, m.ID, *m.Delta)
+			}
+			if err != nil {
+				writeJSONError(res, storageErrorStatus(err), storageErrorMessage(err, "Storage error"))
 				return
 			}
-			if m.Value != nil {
-				writeJSONError(res, http.StatusBadRequest, "Unexpected 'value' for counter metric")
+
+		case "histogram", "summary":
+			if m.MType == "histogram" {
+				err = store.UpdateHistogram(ctx, m.ID, *m.Histogram)
+			} else {
+				err = store.UpdateSummary(ctx, m.ID, *m.Summary)
+			}
+			if err != nil {
+				writeJSONError(res, storageErrorStatus(err), storageErrorMessage(err, "Storage error"))
 				return
 			}
-			if err := store.UpdateCounter(ctx, m.ID, *m.Delta); err != nil {
-				writeJSONError(res, http.StatusInternalServerError, "Storage error")
+		}
+		if md != nil {
+			if err := registerMetadata(ctx, store, *md); err != nil {
+				writeJSONError(res, storageErrorStatus(err), storageErrorMessage(err, "Storage error"))
 				return
 			}
-
-		default:
-			writeJSONError(res, http.StatusBadRequest, "Unknown metric type")
-			return
 		}
 
 		// Log audit event if publisher is configured
@@ -293,6 +583,7 @@ func updateJSONHandler(ctx context.Context, store storage.Storage, saveFunc func
 				Timestamp: time.Now().Unix(),
 				Metrics:   []string{m.ID},
 				IPAddress: ipAddress,
+				Tenant:    requestTenant(req),
 			}
 			auditPublisher.Notify(event)
 		}
@@ -311,7 +602,8 @@ func updateJSONHandler(ctx context.Context, store storage.Storage, saveFunc func
 }
 
 // valueJSONHandler handles retrieving metric values via JSON payload.
-// Accepts a JSON object with metric ID and type, returns the current value.
+// Accepts a JSON object with metric ID and type, returns the current value
+// and, in the "meta" field, the registered metadata of the metric.
 // Returns 404 if the metric is not found.
 //
 // Parameters:
@@ -322,8 +614,13 @@ func updateJSONHandler(ctx context.Context, store storage.Storage, saveFunc func
 //   - http.HandlerFunc: Handler function for the JSON value endpoint
 func valueJSONHandler(store storage.Storage, auditPublisher *Publisher) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
 		var r metrics.Metrics
 		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			if isBodyTooLarge(err) {
+				writeJSONError(res, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
 			writeJSONError(res, http.StatusBadRequest, "Invalid JSON")
 			return
 		}
@@ -333,6 +630,11 @@ func valueJSONHandler(store storage.Storage, auditPublisher *Publisher) http.Han
 			return
 		}
 
+		if !authorizeMetrics(req, auditPublisher, r.ID) {
+			writeJSONError(res, http.StatusForbidden, "Metric is outside of token scope")
+			return
+		}
+
 		var resp metrics.Metrics
 		found := false
 
@@ -348,6 +650,16 @@ func valueJSONHandler(store storage.Storage, auditPublisher *Publisher) http.Han
 				resp = metrics.Metrics{ID: r.ID, MType: "counter", Delta: &d}
 				found = true
 			}
+		case "histogram":
+			if h, ok := store.GetHistogram(r.ID); ok {
+				resp = metrics.Metrics{ID: r.ID, MType: "histogram", Histogram: &h}
+				found = true
+			}
+		case "summary":
+			if sm, ok := store.GetSummary(r.ID); ok {
+				resp = metrics.Metrics{ID: r.ID, MType: "summary", Summary: &sm}
+				found = true
+			}
 		default:
 			writeJSONError(res, http.StatusBadRequest, "Unknown metric type")
 			return
@@ -357,6 +669,9 @@ func valueJSONHandler(store storage.Storage, auditPublisher *Publisher) http.Han
 			writeJSONError(res, http.StatusNotFound, "Metric not found")
 			return
 		}
+		if md, ok := store.GetMetadata(r.ID); ok {
+			resp.Meta = &md
+		}
 
 		// Add HMAC signature if key is configured
 		responseBody, _ := json.Marshal(resp)
@@ -372,6 +687,7 @@ func valueJSONHandler(store storage.Storage, auditPublisher *Publisher) http.Han
 				Timestamp: time.Now().Unix(),
 				Metrics:   []string{r.ID},
 				IPAddress: ipAddress,
+				Tenant:    requestTenant(req),
 			}
 			auditPublisher.Notify(event)
 		}
@@ -406,20 +722,37 @@ func pingSQLHandler(store storage.Storage) http.HandlerFunc {
 }
 
 // updatesBatchHandler handles batch updates of multiple metrics in a single request.
-// Accepts a JSON array of metrics and updates all of them atomically.
+// Accepts a JSON array of metrics and updates all of them atomically with Storage.UpdateBatch:
+// if any item is rejected, nothing is stored and the response lists every failed item.
+// Batches longer than flagMaxBatchSize are rejected with 413.
 // Returns the updated batch in the response body.
 //
+// Error response example:
+//
+//	{"error":"Batch rejected: 1 item(s) failed","failed":[{"index":1,"id":"Alloc","type":"gauge","error":"invalid metric: missing value for gauge"}]}
+//
+// Cumulative counters are converted into increments per source as in updateJSONHandler.
+// Inline metadata is registered after the batch is stored. Items whose type conflicts
+// with the registered type or whose histogram buckets differ from the stored ones are
+// rejected with 409, a counter that would overflow int64 with 422.
+//
 // Parameters:
 //   - store: Storage interface for updating metrics
+//   - tracker: Tracker of cumulative counters (nil rejects them with 400)
 //   - saveFunc: Function to persist metrics to disk/database
 //   - auditPublisher: Optional publisher for audit logging (can be nil)
 //
 // Returns:
 //   - http.HandlerFunc: Handler function for the batch update endpoint
-func updatesBatchHandler(ctx context.Context, store storage.Storage, saveFunc func(), auditPublisher *Publisher) http.HandlerFunc {
+func updatesBatchHandler(ctx context.Context, store storage.Storage, tracker *storage.CumulativeTracker, saveFunc func(), auditPublisher *Publisher) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
 		var batch []metrics.Metrics
 		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			if isBodyTooLarge(err) {
+				writeJSONError(res, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
 			writeJSONError(res, http.StatusBadRequest, "Invalid JSON")
 			return
 		}
@@ -429,63 +762,48 @@ func updatesBatchHandler(ctx context.Context, store storage.Storage, saveFunc fu
 			return
 		}
 
-		// Validate each metric in the batch
-		for _, m := range batch {
-			if m.ID == "" {
-				writeJSONError(res, http.StatusBadRequest, "Missing metric ID in batch")
-				return
-			}
-			switch m.MType {
-			case "gauge":
-				if m.Value == nil {
-					writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("Missing 'value' for gauge metric %s", m.ID))
-					return
-				}
-				if m.Delta != nil {
-					writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("Unexpected 'delta' for gauge metric %s", m.ID))
-					return
-				}
-			case "counter":
-				if m.Delta == nil {
-					writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("Missing 'delta' for counter metric %s", m.ID))
-					return
-				}
-				if m.Value != nil {
-					writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("Unexpected 'value' for counter metric %s", m.ID))
-					return
-				}
-			default:
-				writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("Unknown metric type for %s", m.ID))
-				return
-			}
+		if flagMaxBatchSize > 0 && len(batch) > flagMaxBatchSize {
+			writeJSONError(res, http.StatusRequestEntityTooLarge, fmt.Sprintf("Batch of %d metrics exceeds the limit of %d", len(batch), flagMaxBatchSize))
+			return
 		}
 
-		// Update all metrics
-		for _, m := range batch {
-			var err error
-			switch m.MType {
-			case "gauge":
-				err = store.UpdateGauge(ctx, m.ID, *m.Value)
-			case "counter":
-				err = store.UpdateCounter(ctx, m.ID, *m.Delta)
-			}
-			if err != nil {
-				writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("Storage error during batch update %s", m.ID))
-				return
-			}
+		// Validate each metric in the batch, collecting every invalid item
+		if err := storage.ValidateBatch(batch); err != nil {
+			writeStorageError(res, err, "Invalid batch")
+			return
+		}
+
+		// Check that the token may write every metric in the batch
+		names := make([]string, len(batch))
+		for i, m := range batch {
+			names[i] = m.ID
+		}
+		if !authorizeMetrics(req, auditPublisher, names...) {
+			writeJSONError(res, http.StatusForbidden, "Batch contains metrics outside of token scope")
+			return
+		}
+
+		// Check inline metadata, apply the whole batch atomically, then register the metadata
+		samples, pending, err := checkInlineMetadata(store, batch)
+		if err == nil {
+			err = writeBatch(ctx, req, store, tracker, samples)
+		}
+		if err == nil {
+			err = registerMetadata(ctx, store, pending...)
+		}
+		if err != nil {
+			writeStorageError(res, err, "Storage error during batch update")
+			return
 		}
 
 		// Log batch audit event if publisher is configured
 		if auditPublisher != nil {
 			ipAddress := getRealIP(req)
-			metricNames := make([]string, len(batch))
-			for i, m := range batch {
-				metricNames[i] = m.ID
-			}
 			event := AuditEvent{
 				Timestamp: time.Now().Unix(),
-				Metrics:   metricNames,
+				Metrics:   names,
 				IPAddress: ipAddress,
+				Tenant:    requestTenant(req),
 			}
 			auditPublisher.Notify(event)
 		}
@@ -503,35 +821,134 @@ func updatesBatchHandler(ctx context.Context, store storage.Storage, saveFunc fu
 	}
 }
 
-// getRealIP extracts the real client IP address from the request headers.
-// It checks in order:
-//  1. X-Forwarded-For header (taking the first IP in case of a list)
-//  2. X-Real-IP header
-//  3. RemoteAddr as fallback
-//
-// This is useful when the server is behind a reverse proxy.
+// deleteHandler returns an HTTP handler that removes a metric.
+// URL pattern: DELETE /value/{type}/{name}
+// Returns 200 OK if the metric was removed and 404 if it does not exist or the type is invalid.
 //
 // Parameters:
-//   - req: HTTP request object
+//   - store: Storage interface for removing metrics
+//   - saveFunc: Function to persist metrics to disk/database
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
 //
 // Returns:
-//   - string: The client's IP address
-func getRealIP(req *http.Request) string {
-	// Check X-Forwarded-For header
-	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
-		// Take the first IP in case there are multiple
-		ips := strings.Split(forwarded, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+//   - http.HandlerFunc: Handler function for the delete endpoint
+func deleteHandler(ctx context.Context, store storage.Storage, saveFunc func(), auditPublisher *Publisher) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
+		metricType := strings.ToLower(chi.URLParam(req, "type"))
+		metricName := chi.URLParam(req, "name")
+
+		if !authorizeMetrics(req, auditPublisher, metricName) {
+			http.Error(res, "Metric is outside of token scope", http.StatusForbidden)
+			return
 		}
+
+		var (
+			deleted bool
+			err     error
+		)
+		switch metricType {
+		case "gauge":
+			deleted, err = store.DeleteGauge(ctx, metricName)
+		case "counter":
+			deleted, err = store.DeleteCounter(ctx, metricName)
+		case "histogram":
+			deleted, err = store.DeleteHistogram(ctx, metricName)
+		case "summary":
+			deleted, err = store.DeleteSummary(ctx, metricName)
+		default:
+			http.Error(res, "Unknown metric type", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(res, "Failed to delete metric", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(res, "Unknown metric name", http.StatusNotFound)
+			return
+		}
+
+		// Log audit event if publisher is configured
+		if auditPublisher != nil {
+			event := AuditEvent{
+				Timestamp: time.Now().Unix(),
+				Metrics:   []string{metricName},
+				IPAddress: getRealIP(req),
+				Tenant:    requestTenant(req),
+				Action:    "delete",
+			}
+			if token := tokenFromContext(req.Context()); token != nil {
+				event.Subject = token.Name
+			}
+			auditPublisher.Notify(event)
+		}
+
+		saveFunc()
+		res.WriteHeader(http.StatusOK)
 	}
+}
 
-	// Check X-Real-IP header
-	if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
-		return realIP
+// configHandler returns an HTTP handler that reports the effective server configuration
+// as JSON. Secrets (HMAC key, crypto key path, database DSN) are never included;
+// only whether they are configured.
+//
+// Returns:
+//   - http.HandlerFunc: Handler function for the config endpoint
+func configHandler() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		cfg := map[string]interface{}{
+			"address":           flagRunAddr,
+			"store_interval":    flagStoreInterval.String(),
+			"store_file":        flagFileStoragePath,
+			"restore":           flagRestore,
+			"storage":           flagStorage,
+			"bolt_path":         flagBoltPath,
+			"wal_sync_interval": flagWALSyncInterval.String(),
+			"wal_snapshot_size": flagWALSnapshotSize,
+			"database_enabled":  flagSQL != "",
+			"db_max_conns":      flagDBMaxConns,
+			"db_min_conns":      flagDBMinConns,
+			"db_query_timeout":  flagDBQueryTimeout.String(),
+			"db_single_replica": flagDBSingleReplica,
+			"signing_enabled":   flagKey != "",
+			"crypto_enabled":    flagCryptoKey != "",
+			"audit_file":        flagAuditFile,
+			"audit_url":         flagAuditURL,
+			"auth_file":         flagAuthFile,
+			"auth_db":           flagAuthDB,
+			"multi_tenant":      flagMultiTenant,
+			"tenant_quota":      flagTenantQuota,
+			"tenants":           flagTenants,
+			"max_tenants":       flagMaxTenants,
+			"audit_tenant_dir":  flagAuditTenantDir,
+			"trusted_subnet":    flagTrustedSubnet,
+			"trusted_proxies":   flagTrustedProxies,
+			"max_body_size":     flagMaxBodySize,
+			"max_batch_size":    flagMaxBatchSize,
+			"rate_limit":        flagRateLimit,
+			"rate_burst":        flagRateBurst,
+		}
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(cfg); err != nil {
+			log.Printf("Failed to encode config: %v\n", err)
+		}
 	}
+}
 
-	// Fallback to RemoteAddr
-	host, _, _ := net.SplitHostPort(req.RemoteAddr)
-	return host
+// getRealIP returns the client IP address of the request.
+// The address is resolved by realIPMiddleware, which honours the X-Real-IP and
+// X-Forwarded-For headers only from trusted proxies. Requests that did not pass
+// through the middleware fall back to RemoteAddr; proxy headers are never trusted blindly.
+//
+// Parameters:
+//   - req: HTTP request object
+//
+// Returns:
+//   - string: The client's IP address
+func getRealIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(req)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/ratelimit"
+)
+
+// isBodyTooLarge reports whether the error was caused by reading past the request body limit.
+//
+// Parameters:
+//   - err: Error returned while reading or decoding the request body
+//
+// Returns:
+//   - bool: true if the body exceeded the limit set by bodyLimitMiddleware
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// bodyLimitMiddleware limits the size of request bodies. Requests whose declared
+// Content-Length exceeds the limit are rejected immediately; otherwise the body is wrapped
+// so that reading past the limit fails and handlers can answer with 413.
+//
+// It must run after gzipMiddleware so that the limit also applies to the decompressed body.
+// When maxBytes is not positive, bodies are not limited.
+//
+// Responses:
+//   - 413 Request Entity Too Large: the declared body size exceeds the limit
+//
+// Parameters:
+//   - maxBytes: Maximum body size in bytes
+//
+// Returns:
+//   - func(http.Handler) http.Handler: Middleware function
+func bodyLimitMiddleware(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if maxBytes <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ipRateLimitMiddleware applies a token-bucket rate limit per client IP address to every request.
+//
+// It must run after realIPMiddleware to see the client IP, and before gzipMiddleware and
+// hashVerificationMiddleware so that throttled clients are rejected before their bodies
+// are decompressed, verified, decrypted or authenticated. When limiter is nil,
+// requests are not limited.
+//
+// Responses:
+//   - 429 Too Many Requests: the client IP exhausted its bucket; Retry-After holds
+//     the number of seconds until the next request is allowed
+//
+// Parameters:
+//   - limiter: Token-bucket limiter shared by all routes (nil disables rate limiting)
+//
+// Returns:
+//   - func(http.Handler) http.Handler: Middleware function
+func ipRateLimitMiddleware(limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allowRequest(w, limiter, "ip:"+getRealIP(r)) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tokenRateLimitMiddleware additionally applies a token-bucket rate limit per API token
+// to authenticated requests. Requests without a token pass unchanged; they are limited
+// by ipRateLimitMiddleware alone.
+//
+// It must run after authMiddleware to see the token. When limiter is nil,
+// requests are not limited.
+//
+// Responses:
+//   - 429 Too Many Requests: the token exhausted its bucket; Retry-After holds
+//     the number of seconds until the next request is allowed
+//
+// Parameters:
+//   - limiter: Token-bucket limiter shared by all routes (nil disables rate limiting)
+//
+// Returns:
+//   - func(http.Handler) http.Handler: Middleware function
+func tokenRateLimitMiddleware(limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token := tokenFromContext(r.Context()); token != nil && !allowRequest(w, limiter, "token:"+token.Name) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowRequest consumes a token from the key's bucket and answers with 429 if it is empty.
+//
+// Parameters:
+//   - w: HTTP response writer for the rejection
+//   - limiter: Token-bucket limiter
+//   - key: Client identifier
+//
+// Returns:
+//   - bool: true if the request may proceed, false if it was rejected
+func allowRequest(w http.ResponseWriter, limiter *ratelimit.Limiter, key string) bool {
+	ok, retryAfter := limiter.Allow(key)
+	if ok {
+		return true
+	}
+	// Retry-After is in whole seconds; round up so that the retry is not rejected again
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/auth"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/ratelimit"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// batchBody builds a JSON batch of n gauge updates.
+func batchBody(n int) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"id":"g%d","type":"gauge","value":1}`, i)
+	}
+	return "[" + strings.Join(items, ",") + "]"
+}
+
+func Test_requestSizeLimits(t *testing.T) {
+	oldBatch := flagMaxBatchSize
+	flagMaxBatchSize = 5
+	defer func() { flagMaxBatchSize = oldBatch }()
+
+	store := storage.NewMemStorage()
+	router := chi.NewRouter()
+	router.Use(gzipMiddleware)
+	router.Use(bodyLimitMiddleware(512))
+	router.Post("/update", updateJSONHandler(context.Background(), store, nil, func() {}, nil))
+	router.Post("/updates", updatesBatchHandler(context.Background(), store, nil, func() {}, nil))
+
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(s))
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name           string
+		url            string
+		body           []byte
+		gzip           bool
+		expectedStatus int
+	}{
+		{name: "Small update", url: "/update", body: []byte(`{"id":"a","type":"gauge","value":1}`), expectedStatus: http.StatusOK},
+		{name: "Batch within limits", url: "/updates", body: []byte(batchBody(5)), expectedStatus: http.StatusOK},
+		{name: "Batch too long", url: "/updates", body: []byte(batchBody(6)), expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "Body too large", url: "/updates", body: []byte(batchBody(40)), expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "Gzipped body too large after decompression", url: "/update", body: gzipped(`{"id":"` + strings.Repeat("a", 4096) + `","type":"gauge","value":1}`), gzip: true, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.url, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+		})
+	}
+}
+
+func Test_rateLimitMiddleware(t *testing.T) {
+	tokens, err := auth.NewMemoryTokenStore([]auth.Token{
+		{Name: "first", Hash: auth.HashToken("first-secret"), Role: auth.RoleWriter},
+		{Name: "second", Hash: auth.HashToken("second-secret"), Role: auth.RoleWriter},
+	})
+	require.NoError(t, err)
+
+	limiter := ratelimit.New(0.5, 2)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	router := chi.NewRouter()
+	router.Use(ipRateLimitMiddleware(limiter))
+	router.Use(gzipMiddleware)
+	router.Group(func(r chi.Router) {
+		r.Get("/public", ok)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokens, nil, auth.RoleWriter))
+		r.Use(tokenRateLimitMiddleware(limiter))
+		r.Post("/private", ok)
+	})
+
+	send := func(method, url, remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Burst of two requests per IP, then 429 with Retry-After
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/public", "192.0.2.1:1000", "").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/public", "192.0.2.1:1001", "").Code)
+	rr := send(http.MethodGet, "/public", "192.0.2.1:1002", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, retryAfter)
+
+	// Other IPs have their own bucket
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/public", "192.0.2.2:1000", "").Code)
+
+	// A throttled IP is rejected before its body is decompressed, even with a valid token
+	req := httptest.NewRequest(http.MethodPost, "/private", strings.NewReader("not gzip"))
+	req.RemoteAddr = "192.0.2.1:1003"
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer first-secret")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// Authenticated clients are additionally limited per token across IPs
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/private", "192.0.2.3:1000", "first-secret").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/private", "192.0.2.4:1000", "first-secret").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send(http.MethodPost, "/private", "192.0.2.5:1000", "first-secret").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/private", "192.0.2.5:1000", "second-secret").Code)
+}
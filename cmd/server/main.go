@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/SergeyDolin/metrics-and-alerting/internal/auth"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/leader"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/ratelimit"
 	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
 	"github.com/go-chi/chi"
 
@@ -53,19 +58,41 @@ func printBuildInfo() {
 //   - POST /value - Retrieve a metric value via JSON
 //   - POST /update/{type}/{name}/{value} - Update a metric via URL parameters (legacy)
 //   - GET /value/{type}/{name} - Retrieve a metric value via URL parameters (legacy)
+//   - DELETE /value/{type}/{name} - Remove a metric (admin)
+//   - GET /config - Effective configuration without secrets (admin)
 //
 // The server also supports:
 //   - Gzip compression middleware
 //   - HMAC signature verification when a key is configured
+//   - Client IP restriction to a trusted subnet, honouring proxy headers only from trusted proxies
+//   - Request body and batch size limits (413) and per-client rate limiting (429 with Retry-After)
+//   - Bearer token authentication with reader/writer/admin roles when a token store is configured
+//   - Tenant isolation with per-tenant series quotas and audit files when multi-tenancy is enabled
 //   - Request logging
 //   - Audit logging to file or HTTP endpoint when configured
 //   - Periodic or synchronous metric persistence to disk
+//   - Cache coherence between server instances sharing a database (LISTEN/NOTIFY)
+//   - Leader election, so that periodic saving runs on one instance only
 func main() {
 	// Print build information on startup for debugging and traceability
 	printBuildInfo()
 	// Parse configuration from command-line flags and environment variables
 	parseFlags()
 
+	// Create a context that will be canceled when a shutdown signal is received
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	run(ctx)
+}
+
+// run starts the server configured by the flags and serves requests until ctx is
+// canceled. It then shuts the server down gracefully and returns, so that the
+// deferred cleanup closes the storage, syncing the write-ahead log of file storage.
+//
+// Parameters:
+//   - ctx: Context whose cancellation shuts the server down
+func run(ctx context.Context) {
 	// Initialize structured logger for the application
 	logger, err := zap.NewDevelopment()
 	if err != nil {
@@ -81,38 +108,102 @@ func main() {
 	var store storage.Storage
 	var saveSync func()
 
+	// Per-tenant storage registry, nil unless multi-tenancy is enabled
+	var registry *storage.TenantRegistry
+
+	// Singleton background jobs run only on the elected leader;
+	// without a shared database this instance always leads
+	var elector leader.Elector = leader.NewLocal(nil)
+	var jobs []leader.Job
+
 	// Configure storage backend based on flags
-	if flagSQL != "" {
+	backend := flagStorage
+	if backend == "" {
+		backend = "file"
+		if flagSQL != "" {
+			backend = "postgres"
+		}
+	}
+
+	switch backend {
+	case "postgres":
+		if flagSQL == "" {
+			sugar.Fatal("Postgres storage requires DATABASE_DSN to be set")
+		}
 		// PostgreSQL database storage
 		sugar.Infof("Initializing PostgreSQL storage with DSN: %s", flagSQL)
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		dbStorage, err := storage.NewDBStorage(ctx, flagSQL)
+		dbStorage, err := storage.NewPooledDBStorage(ctx, flagSQL, storage.PoolConfig{
+			MaxConns:          int32(flagDBMaxConns),
+			MinConns:          int32(flagDBMinConns),
+			MaxConnLifetime:   flagDBConnLifetime,
+			MaxConnIdleTime:   flagDBConnIdleTime,
+			HealthCheckPeriod: flagDBHealthCheckPeriod,
+			ConnectTimeout:    flagDBConnectTimeout,
+			QueryTimeout:      flagDBQueryTimeout,
+		})
 		if err != nil {
 			sugar.Fatalf("Failed to open DB connection: %v", err)
 		}
 		store = dbStorage
-		// Ensure database connection is properly closed on exit
+
+		// Apply writes of other server instances sharing the database to the cache
+		listenCtx, stopListening := context.WithCancel(context.Background())
+		go dbStorage.Listen(listenCtx, func(err error) {
+			sugar.Warnf("Change notifications: %v", err)
+		})
+
+		// Ensure the connection pool is properly closed on exit
 		defer func() {
-			cleanupCtx := context.Background()
-			if err := dbStorage.SaveAll(cleanupCtx); err != nil {
-				sugar.Errorf("Failed to save metrics on exit: %v", err)
-			}
+			stopListening()
 			dbStorage.Close()
 		}()
 
+		// Replicas sharing the database elect the leader with an advisory lock.
+		// Writes are synchronous, so there is nothing to save on exit.
+		elector = leader.NewPostgres(dbStorage.Pool(), leader.DefaultLockKey)
+
+		// Every tenant gets a storage scoped to its rows, sharing the connection pool
+		if flagMultiTenant {
+			registry = storage.NewTenantRegistry(store, func(ctx context.Context, tenant string) (storage.Storage, error) {
+				return storage.NewTenantDBStorage(ctx, dbStorage, tenant)
+			}, flagTenantQuota, flagMaxTenants)
+		}
+
 		// Database storage persists immediately, no sync function needed
 		saveSync = func() {}
-	} else {
+	case "bolt":
+		// Embedded bolt storage in a single file
+		sugar.Infof("Initializing bolt storage at %s", flagBoltPath)
+		boltStorage, err := storage.NewBoltStorage(flagBoltPath)
+		if err != nil {
+			sugar.Fatalf("Failed to open bolt storage: %v", err)
+		}
+		store = boltStorage
+		defer boltStorage.Close()
+
+		// Every tenant gets its own buckets in the same file
+		if flagMultiTenant {
+			registry = storage.NewTenantRegistry(store, func(_ context.Context, tenant string) (storage.Storage, error) {
+				return storage.NewTenantBoltStorage(boltStorage, tenant)
+			}, flagTenantQuota, flagMaxTenants)
+		}
+
+		// Every write is committed and fsynced in its own transaction
+		saveSync = func() {}
+	case "file", "memory":
 		// File-based or in-memory storage
-		if flagFileStoragePath != "" && flagRestore {
+		if backend == "file" && flagFileStoragePath != "" && flagRestore {
 			// Attempt to restore metrics from file if configured
-			fileStorage, err := storage.NewFileStorage(flagFileStoragePath)
+			fileStorage, err := storage.NewFileStorageWithOptions(flagFileStoragePath, fileOptions())
 			if err != nil {
 				sugar.Warnf("Failed to restore metrics from file: %v", err)
 			} else {
 				store = fileStorage
+				// Sync and close the write-ahead log on exit
+				defer fileStorage.Close()
 			}
 		}
 
@@ -121,32 +212,39 @@ func main() {
 			store = storage.NewMemStorage()
 		}
 
-		// Configure periodic background saving for file storage
+		// Tenants other than the default one get storage of the same kind
+		if flagMultiTenant {
+			_, fileBacked := store.(*storage.FileStorage)
+			registry = storage.NewTenantRegistry(store, func(_ context.Context, tenant string) (storage.Storage, error) {
+				if fileBacked {
+					return storage.NewFileStorageWithOptions(storage.TenantFilePath(flagFileStoragePath, tenant), fileOptions())
+				}
+				return storage.NewMemStorage(), nil
+			}, flagTenantQuota, flagMaxTenants)
+		}
+
+		// Configure periodic snapshots for file storage; they keep the write-ahead log short
 		if flagStoreInterval > 0 && flagFileStoragePath != "" {
-			if fs, ok := store.(*storage.FileStorage); ok {
-				go func() {
-					ticker := time.NewTicker(flagStoreInterval)
-					defer ticker.Stop()
-					for range ticker.C {
-						if err := fs.Save(); err != nil {
-							sugar.Errorf("Periodic save failed: %v", err)
+			jobs = append(jobs, leader.Job{
+				Name:     "file-save",
+				Interval: flagStoreInterval,
+				Run: func(context.Context) error {
+					var firstErr error
+					eachFileStorage(store, registry, func(fs *storage.FileStorage) {
+						if err := fs.Save(); err != nil && firstErr == nil {
+							firstErr = err
 						}
-					}
-				}()
-			}
+					})
+					return firstErr
+				},
+			})
 		}
 
-		// Configure synchronous save function for file storage
-		// This is used when flagStoreInterval == 0 (save after each update)
-		saveSync = func() {
-			if flagStoreInterval == 0 && flagFileStoragePath != "" {
-				if fs, ok := store.(*storage.FileStorage); ok {
-					if err := fs.Save(); err != nil {
-						sugar.Errorf("Sync save failed: %v", err)
-					}
-				}
-			}
-		}
+		// File storage logs every update to its write-ahead log before acknowledging it
+		// (see -wal-sync-interval), so no synchronous save is needed
+		saveSync = func() {}
+	default:
+		sugar.Fatalf("Unknown storage backend %q (want memory, file, bolt or postgres)", backend)
 	}
 
 	// Configure audit logging observers
@@ -159,6 +257,10 @@ func main() {
 		// Add HTTP-based audit logging
 		auditObservers = append(auditObservers, NewHTTPSenderObserver(flagAuditURL))
 	}
+	if flagAuditTenantDir != "" {
+		// Add per-tenant audit logging
+		auditObservers = append(auditObservers, NewTenantFileWriterObserver(flagAuditTenantDir))
+	}
 
 	// Create audit publisher if any observers are configured
 	var auditPublisher *Publisher
@@ -167,9 +269,77 @@ func main() {
 		defer auditPublisher.Close() // Ensure all audit logs are flushed on shutdown
 	}
 
+	// Configure API token authentication
+	var tokenStore auth.TokenStore
+	switch {
+	case flagAuthDB:
+		if flagSQL == "" {
+			sugar.Fatal("AUTH_DB requires DATABASE_DSN to be set")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		dbTokens, err := auth.NewDBTokenStore(ctx, flagSQL)
+		if err != nil {
+			sugar.Fatalf("Failed to open token store: %v", err)
+		}
+		tokenStore = dbTokens
+	case flagAuthFile != "":
+		fileTokens, err := auth.NewFileTokenStore(flagAuthFile)
+		if err != nil {
+			sugar.Fatalf("Failed to load API tokens: %v", err)
+		}
+		tokenStore = fileTokens
+	}
+	if tokenStore != nil {
+		defer tokenStore.Close()
+		sugar.Info("API token authentication enabled")
+	}
+
+	if registry != nil {
+		// Release connections of tenant storages on exit
+		defer func() {
+			if err := registry.Close(); err != nil {
+				sugar.Errorf("Failed to close tenant storage: %v", err)
+			}
+		}()
+		sugar.Infof("Multi-tenancy enabled (series quota per tenant: %d, tenants: %d)", flagTenantQuota, flagMaxTenants)
+	}
+	allowedTenants, err := parseTenantList(flagTenants)
+	if err != nil {
+		sugar.Fatalf("Invalid tenant list: %v", err)
+	}
+
+	// Configure client IP resolution and the trusted subnet
+	trustedProxies, err := parseCIDRList(flagTrustedProxies)
+	if err != nil {
+		sugar.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	var trustedSubnet *net.IPNet
+	if flagTrustedSubnet != "" {
+		if _, trustedSubnet, err = net.ParseCIDR(flagTrustedSubnet); err != nil {
+			sugar.Fatalf("Invalid TRUSTED_SUBNET: %v", err)
+		}
+		sugar.Infof("Accepting requests only from %s", trustedSubnet)
+	}
+
+	// Configure per-client rate limiting
+	var limiter *ratelimit.Limiter
+	if flagRateLimit > 0 {
+		burst := flagRateBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(flagRateLimit))
+		}
+		limiter = ratelimit.New(flagRateLimit, burst)
+		sugar.Infof("Rate limiting clients to %.2f requests per second (burst %d)", flagRateLimit, burst)
+	}
+
 	// Apply global middleware to all routes
-	router.Use(middleware.StripSlashes) // Remove trailing slashes from URLs
-	router.Use(gzipMiddleware)          // Support gzip compression for requests/responses
+	router.Use(middleware.StripSlashes)                                // Remove trailing slashes from URLs
+	router.Use(realIPMiddleware(trustedProxies))                       // Resolve client IP, trusting headers only from proxies
+	router.Use(trustedSubnetMiddleware(trustedSubnet, auditPublisher)) // Reject clients outside of the trusted subnet
+	router.Use(ipRateLimitMiddleware(limiter))                         // Throttle clients per IP before any body processing
+	router.Use(gzipMiddleware)                                         // Support gzip compression for requests/responses
+	router.Use(bodyLimitMiddleware(flagMaxBodySize))                   // Limit the size of (decompressed) request bodies
 	if flagKey != "" {
 		// Add HMAC signature verification middleware if key is configured
 		router.Use(hashVerificationMiddleware)
@@ -178,12 +348,27 @@ func main() {
 
 	// Initialize all handler functions
 	indexHandlerFunc := indexHandler(store)
-	updateJSONHandlerFunc := updateJSONHandler(context.Background(), store, saveSync, auditPublisher)
-	updatesBatchHandlerFunc := updatesBatchHandler(context.Background(), store, saveSync, auditPublisher)
+	// Cumulative counters of agents are turned into increments per tenant and source.
+	// The baselines are kept in memory, so replicas sharing a database would each keep
+	// their own; such servers reject cumulative counters unless declared the only replica.
+	var tracker *storage.CumulativeTracker
+	if backend != "postgres" || flagDBSingleReplica {
+		tracker = storage.NewCumulativeTracker(storage.DefaultSourceTTL)
+	} else {
+		sugar.Info("Cumulative counters disabled: the database may be shared by several replicas (see -db-single-replica)")
+	}
+	updateJSONHandlerFunc := updateJSONHandler(context.Background(), store, tracker, saveSync, auditPublisher)
+	updatesBatchHandlerFunc := updatesBatchHandler(context.Background(), store, tracker, saveSync, auditPublisher)
 	valueJSONHandlerFunc := valueJSONHandler(store, auditPublisher)
 	postHandlerFunc := postHandler(context.Background(), store, saveSync, auditPublisher)
 	getHandlerFunc := getHandler(store, auditPublisher)
 	pingSQLHandlerFunc := pingSQLHandler(store)
+	deleteHandlerFunc := deleteHandler(context.Background(), store, saveSync, auditPublisher)
+	configHandlerFunc := configHandler()
+	metadataListHandlerFunc := metadataListHandler(store)
+	metadataGetHandlerFunc := metadataGetHandler(store, auditPublisher)
+	metadataUpdateHandlerFunc := metadataUpdateHandler(context.Background(), store, saveSync, auditPublisher)
+	prometheusHandlerFunc := prometheusHandler(store)
 
 	// Configure custom error handlers
 	router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
@@ -196,17 +381,51 @@ func main() {
 	})
 
 	// Register routes with their handlers
-	router.Get("/", indexHandlerFunc)                             // HTML metrics listing
-	router.Post("/update", updateJSONHandlerFunc)                 // Single metric JSON update
-	router.Post("/updates", updatesBatchHandlerFunc)              // Batch JSON update
-	router.Get("/ping", pingSQLHandlerFunc)                       // Database health check
-	router.Post("/value", valueJSONHandlerFunc)                   // JSON metric retrieval
-	router.Post("/update/{type}/{name}/{value}", postHandlerFunc) // Legacy URL param update
-	router.Get("/value/{type}/{name}", getHandlerFunc)            // Legacy URL param retrieval
+	router.Get("/ping", pingSQLHandlerFunc) // Database health check
 
-	// Create a context that will be canceled when a shutdown signal is received
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	defer stop()
+	// Read-only routes require the reader role when authentication is enabled
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokenStore, auditPublisher, auth.RoleReader))
+		r.Use(tenantMiddleware(registry, allowedTenants, auditPublisher))
+		r.Use(tokenRateLimitMiddleware(limiter))
+		r.Get("/", indexHandlerFunc)                      // HTML metrics listing
+		r.Post("/value", valueJSONHandlerFunc)            // JSON metric retrieval
+		r.Get("/value/{type}/{name}", getHandlerFunc)     // Legacy URL param retrieval
+		r.Get("/metadata", metadataListHandlerFunc)       // Registered metadata listing
+		r.Get("/metadata/{name}", metadataGetHandlerFunc) // Metadata of one metric
+		r.Get("/metrics", prometheusHandlerFunc)          // Prometheus text exposition
+	})
+
+	// Update routes require the writer role when authentication is enabled
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokenStore, auditPublisher, auth.RoleWriter))
+		r.Use(tenantMiddleware(registry, allowedTenants, auditPublisher))
+		r.Use(tokenRateLimitMiddleware(limiter))
+		r.Post("/update", updateJSONHandlerFunc)                 // Single metric JSON update
+		r.Post("/updates", updatesBatchHandlerFunc)              // Batch JSON update
+		r.Post("/update/{type}/{name}/{value}", postHandlerFunc) // Legacy URL param update
+		r.Post("/metadata", metadataUpdateHandlerFunc)           // Metadata registration
+	})
+
+	// Administrative routes require the admin role when authentication is enabled
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokenStore, auditPublisher, auth.RoleAdmin))
+		r.Use(tenantMiddleware(registry, allowedTenants, auditPublisher))
+		r.Use(tokenRateLimitMiddleware(limiter))
+		r.Delete("/value/{type}/{name}", deleteHandlerFunc) // Metric removal
+		r.Get("/config", configHandlerFunc)                 // Effective configuration
+	})
+
+	// Run background jobs on the leader until shutdown
+	scheduler := leader.NewScheduler(elector, sugar.Infof)
+	for _, job := range jobs {
+		scheduler.Register(job)
+	}
+	schedulerDone := make(chan struct{})
+	go func() {
+		scheduler.Run(ctx)
+		close(schedulerDone)
+	}()
 
 	// Start the HTTP server in a goroutine
 	srv := &http.Server{
@@ -240,7 +459,38 @@ func main() {
 		sugar.Info("Server shutdown complete")
 	}
 
-	// Start the HTTP server
-	sugar.Infof("Running server on %s", flagRunAddr)
-	sugar.Fatal(http.ListenAndServe(flagRunAddr, router))
+	// Wait for the background jobs and the leader's shutdown tasks
+	<-schedulerDone
+}
+
+// fileOptions returns the write-ahead log settings of file storage from the flags.
+//
+// Returns:
+//   - storage.FileOptions: File storage options
+func fileOptions() storage.FileOptions {
+	return storage.FileOptions{
+		SyncInterval: flagWALSyncInterval,
+		SnapshotSize: flagWALSnapshotSize,
+	}
+}
+
+// eachFileStorage calls fn for every file-backed storage served by the server:
+// the default storage and, when multi-tenancy is enabled, the storage of every tenant.
+//
+// Parameters:
+//   - store: Default storage
+//   - registry: Per-tenant storage registry (can be nil)
+//   - fn: Callback receiving each file storage
+func eachFileStorage(store storage.Storage, registry *storage.TenantRegistry, fn func(fs *storage.FileStorage)) {
+	if registry == nil {
+		if fs, ok := store.(*storage.FileStorage); ok {
+			fn(fs)
+		}
+		return
+	}
+	registry.Each(func(_ string, s storage.Storage) {
+		if fs, ok := s.(*storage.FileStorage); ok {
+			fn(fs)
+		}
+	})
 }
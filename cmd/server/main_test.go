@@ -5,9 +5,13 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -208,7 +212,7 @@ func Test_updateJSONHandler(t *testing.T) {
 			flagKey = ""
 			defer func() { flagKey = oldFlagKey }()
 
-			router.Post("/update", updateJSONHandler(context.Background(), store, func() {}, nil))
+			router.Post("/update", updateJSONHandler(context.Background(), store, nil, func() {}, nil))
 
 			req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(tt.jsonBody))
 			req.Header.Set("Content-Type", "application/json")
@@ -365,7 +369,7 @@ func Test_batchUpdateHandler(t *testing.T) {
 				{"id": "Test", "type": "gauge"}
 			]`,
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   "Missing 'value' for gauge metric Test",
+			expectedBody:   `"id":"Test","type":"gauge","error":"invalid metric: missing value for gauge"`,
 		},
 		{
 			name: "Counter without delta",
@@ -373,7 +377,7 @@ func Test_batchUpdateHandler(t *testing.T) {
 				{"id": "Test", "type": "counter"}
 			]`,
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   "Missing 'delta' for counter metric Test",
+			expectedBody:   `"id":"Test","type":"counter","error":"invalid metric: missing delta for counter"`,
 		},
 		{
 			name: "Invalid metric type",
@@ -381,7 +385,18 @@ func Test_batchUpdateHandler(t *testing.T) {
 				{"id": "Test", "type": "unknown", "value": 100}
 			]`,
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   "Unknown metric type for Test",
+			expectedBody:   `"id":"Test","type":"unknown","error":"invalid metric: unknown type \"unknown\""`,
+		},
+		{
+			name: "Every invalid item is reported and nothing is stored",
+			jsonBody: `[
+				{"id": "Good", "type": "gauge", "value": 1},
+				{"id": "NoValue", "type": "gauge"},
+				{"id": "AlsoGood", "type": "counter", "delta": 1},
+				{"id": "NoDelta", "type": "counter"}
+			]`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `"failed":[{"index":1,"id":"NoValue","type":"gauge","error":"invalid metric: missing value for gauge"},{"index":3,"id":"NoDelta","type":"counter","error":"invalid metric: missing delta for counter"}]`,
 		},
 	}
 
@@ -393,7 +408,7 @@ func Test_batchUpdateHandler(t *testing.T) {
 			flagKey = ""
 			defer func() { flagKey = oldFlagKey }()
 
-			router.Post("/updates", updatesBatchHandler(context.Background(), store, func() {}, nil))
+			router.Post("/updates", updatesBatchHandler(context.Background(), store, nil, func() {}, nil))
 
 			req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(tt.jsonBody))
 			req.Header.Set("Content-Type", "application/json")
@@ -418,6 +433,146 @@ func Test_batchUpdateHandler(t *testing.T) {
 				assert.True(t, ok, "Counter %s not found", name)
 				assert.Equal(t, expected, actual, "Counter %s value mismatch", name)
 			}
+
+			if tt.expectedStatus != http.StatusOK {
+				all, err := store.GetAll()
+				require.NoError(t, err)
+				assert.Empty(t, all, "rejected batch must not be partially applied")
+			}
+		})
+	}
+}
+
+func Test_batchUpdateHandler_StorageRejectsItem(t *testing.T) {
+	store := storage.NewMemStorage()
+	store.UpdateGauge(t.Context(), "Existing", 1)
+	quota := storage.NewQuotaStorage(store, 2)
+
+	router := chi.NewRouter()
+	router.Post("/updates", updatesBatchHandler(context.Background(), quota, nil, func() {}, nil))
+
+	body := `[
+		{"id": "Existing", "type": "gauge", "value": 2},
+		{"id": "Fits", "type": "counter", "delta": 1},
+		{"id": "OverQuota", "type": "gauge", "value": 3}
+	]`
+	req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"failed":[{"index":2,"id":"OverQuota","type":"gauge","error":"Series quota exceeded"}]`)
+
+	// Nothing from the batch was applied
+	v, _ := store.GetGauge("Existing")
+	assert.Equal(t, 1.0, v)
+	_, ok := store.GetCounter("Fits")
+	assert.False(t, ok)
+}
+
+func Test_cumulativeCounters_AgentRestart(t *testing.T) {
+	store := storage.NewMemStorage()
+	tracker := storage.NewCumulativeTracker(time.Hour)
+
+	router := chi.NewRouter()
+	router.Post("/update", updateJSONHandler(context.Background(), store, tracker, func() {}, nil))
+	router.Post("/updates", updatesBatchHandler(context.Background(), store, tracker, func() {}, nil))
+
+	// Agents started after the tracker; agent-c has been running since before
+	firstStart := time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano)
+	restart := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	longRunning := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339Nano)
+
+	steps := []struct {
+		name          string
+		path          string
+		source        string
+		start         string
+		total         int64
+		expectedValue int64
+	}{
+		{name: "First sample of a new agent counts in full", path: "/updates", source: "agent-a", start: firstStart, total: 5, expectedValue: 5},
+		{name: "Next sample adds the difference", path: "/update", source: "agent-a", start: firstStart, total: 12, expectedValue: 12},
+		{name: "Other agents are tracked separately", path: "/updates", source: "agent-b", start: firstStart, total: 4, expectedValue: 16},
+		{name: "Restarted agent counts from zero again", path: "/updates", source: "agent-a", start: restart, total: 3, expectedValue: 19},
+		{name: "Resent sample is not counted twice", path: "/update", source: "agent-a", start: restart, total: 3, expectedValue: 19},
+		{name: "Lower total without start time is a reset", path: "/updates", source: "agent-a", total: 1, expectedValue: 20},
+		{name: "Agent older than the server only sets the baseline", path: "/updates", source: "agent-c", start: longRunning, total: 100, expectedValue: 20},
+		{name: "Old agent counts from its baseline", path: "/updates", source: "agent-c", start: longRunning, total: 110, expectedValue: 30},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":%d,"temporality":"cumulative"}`, step.total)
+			if step.path == "/updates" {
+				body = "[" + body + "]"
+			}
+			req := httptest.NewRequest(http.MethodPost, step.path, strings.NewReader(body))
+			req.Header.Set(sourceHeader, step.source)
+			if step.start != "" {
+				req.Header.Set(sourceStartHeader, step.start)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+			v, _ := store.GetCounter("PollCount")
+			assert.Equal(t, step.expectedValue, v)
+		})
+	}
+}
+
+func Test_cumulativeCounters_Errors(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		source         string
+		start          string
+		noTracker      bool
+		expectedStatus int
+		expectedError  string
+	}{
+		{name: "Missing source", path: "/updates", body: `[{"id":"c","type":"counter","delta":1,"temporality":"cumulative"}]`, expectedStatus: http.StatusBadRequest, expectedError: "require the X-Source-ID header"},
+		{name: "Malformed start time", path: "/update", body: `{"id":"c","type":"counter","delta":1,"temporality":"cumulative"}`, source: "a", start: "yesterday", expectedStatus: http.StatusBadRequest, expectedError: "X-Source-Start"},
+		{name: "Negative total", path: "/updates", body: `[{"id":"c","type":"counter","delta":-1,"temporality":"cumulative"}]`, source: "a", expectedStatus: http.StatusBadRequest, expectedError: "must not be negative"},
+		{name: "Cumulative gauge", path: "/update", body: `{"id":"g","type":"gauge","value":1,"temporality":"cumulative"}`, source: "a", expectedStatus: http.StatusBadRequest, expectedError: "Only counters can be cumulative"},
+		{name: "Unknown temporality", path: "/updates", body: `[{"id":"c","type":"counter","delta":1,"temporality":"monotonic"}]`, source: "a", expectedStatus: http.StatusBadRequest, expectedError: `unknown temporality \"monotonic\"`},
+		{name: "Server without tracker", path: "/updates", body: `[{"id":"c","type":"counter","delta":1,"temporality":"cumulative"}]`, source: "a", noTracker: true, expectedStatus: http.StatusBadRequest, expectedError: "Cumulative counters are disabled"},
+		{name: "Counter overflow", path: "/update", body: `{"id":"big","type":"counter","delta":1}`, expectedStatus: http.StatusUnprocessableEntity, expectedError: "Counter overflow"},
+		{name: "Counter overflow in batch", path: "/updates", body: `[{"id":"big","type":"counter","delta":1}]`, expectedStatus: http.StatusUnprocessableEntity, expectedError: `"index":0,"id":"big","type":"counter","error":"Counter overflow"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemStorage()
+			require.NoError(t, store.SetCounter(t.Context(), "big", math.MaxInt64))
+			tracker := storage.NewCumulativeTracker(time.Hour)
+			if tt.noTracker {
+				tracker = nil
+			}
+			router := chi.NewRouter()
+			router.Post("/update", updateJSONHandler(context.Background(), store, tracker, func() {}, nil))
+			router.Post("/updates", updatesBatchHandler(context.Background(), store, tracker, func() {}, nil))
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.source != "" {
+				req.Header.Set(sourceHeader, tt.source)
+			}
+			if tt.start != "" {
+				req.Header.Set(sourceStartHeader, tt.start)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tt.expectedError)
+
+			// Rejected requests change nothing
+			_, ok := store.GetCounter("c")
+			assert.False(t, ok)
+			v, _ := store.GetCounter("big")
+			assert.Equal(t, int64(math.MaxInt64), v)
 		})
 	}
 }
@@ -430,7 +585,7 @@ func Test_batchUpdateHandler_Gzip(t *testing.T) {
 	flagKey = ""
 	defer func() { flagKey = oldFlagKey }()
 
-	router.Post("/updates", updatesBatchHandler(context.Background(), store, func() {}, nil))
+	router.Post("/updates", updatesBatchHandler(context.Background(), store, nil, func() {}, nil))
 
 	data := `[{"id": "GzipTest", "type": "gauge", "value": 42.0}]`
 	var buf bytes.Buffer
@@ -543,3 +698,53 @@ func TestAuditPublisher(t *testing.T) {
 	assert.Contains(t, string(data), "test_metric")
 	assert.Contains(t, string(data), "127.0.0.1")
 }
+
+func Test_run_ShutdownClosesStorage(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	runAddr, backend, filePath, restore, syncInterval := flagRunAddr, flagStorage, flagFileStoragePath, flagRestore, flagWALSyncInterval
+	t.Cleanup(func() {
+		flagRunAddr, flagStorage, flagFileStoragePath, flagRestore, flagWALSyncInterval = runAddr, backend, filePath, restore, syncInterval
+	})
+	// The log is fsynced only when the storage is closed
+	flagRunAddr, flagStorage, flagFileStoragePath, flagRestore, flagWALSyncInterval = addr, "file", path, true, time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		run(ctx)
+		close(done)
+	}()
+
+	// Write once the server is listening
+	require.Eventually(t, func() bool {
+		resp, err := http.Post("http://"+addr+"/update", "application/json", strings.NewReader(`{"id":"Alloc","type":"gauge","value":42}`))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Shutdown returns instead of serving again, so the deferred cleanup closes the storage
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not return after shutdown")
+	}
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err, "nothing listens after shutdown")
+
+	reopened, err := storage.NewFileStorageWithOptions(path, storage.FileOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	v, ok := reopened.GetGauge("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, 42.0, v)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// auditActionMetadata marks audit events of metadata registrations.
+const auditActionMetadata = "metadata"
+
+// checkInlineMetadata checks the metadata sent alongside the samples of a batch.
+// The ID and type of inline metadata are taken from its sample, and metadata equal
+// to the registered one is not written again, so agents can repeat it cheaply.
+// Nothing is written: the caller registers the returned metadata with registerMetadata
+// once the samples are stored, so a rejected batch leaves the registry unchanged.
+//
+// Parameters:
+//   - store: Storage of the request's tenant
+//   - batch: Validated metrics, possibly carrying metadata
+//
+// Returns:
+//   - []metrics.Metrics: The batch without inline metadata, ready to be stored
+//   - []metrics.Metadata: Metadata to register after the batch is stored
+//   - error: *storage.BatchError listing the items whose metadata was rejected
+func checkInlineMetadata(store storage.Storage, batch []metrics.Metrics) ([]metrics.Metrics, []metrics.Metadata, error) {
+	out := batch
+	copied := false
+	var pending []metrics.Metadata
+	var failed []storage.BatchItemError
+	for i, m := range batch {
+		if m.Meta == nil {
+			continue
+		}
+		if !copied {
+			// Copy before clearing the metadata, the caller still echoes the request
+			out = append([]metrics.Metrics(nil), batch...)
+			copied = true
+		}
+		out[i].Meta = nil
+
+		md, err := checkMetadata(store, m)
+		if err != nil {
+			failed = append(failed, storage.BatchItemError{Index: i, ID: m.ID, MType: m.MType, Err: err})
+			continue
+		}
+		if md != nil {
+			pending = append(pending, *md)
+		}
+	}
+	if len(failed) > 0 {
+		return nil, nil, &storage.BatchError{Items: failed}
+	}
+	return out, pending, nil
+}
+
+// checkMetadata checks the metadata sent alongside a single sample, taking its ID
+// and type from the sample. Inline metadata never changes the registered type; that
+// takes POST /metadata. Nothing is written, so the sample can be stored first.
+//
+// Parameters:
+//   - store: Storage of the request's tenant
+//   - m: Validated metric, possibly carrying metadata
+//
+// Returns:
+//   - *metrics.Metadata: Metadata to register, or nil if m has none or it equals the
+//     registered metadata
+//   - error: Error wrapping storage.ErrTypeConflict if the sample's type differs from
+//     the registered type, or storage.ErrInvalidMetric if the metadata is invalid
+func checkMetadata(store storage.Storage, m metrics.Metrics) (*metrics.Metadata, error) {
+	if m.Meta == nil {
+		return nil, nil
+	}
+	md := *m.Meta
+	md.ID, md.MType = m.ID, m.MType
+	if cur, ok := store.GetMetadata(md.ID); ok {
+		if cur.MType != md.MType {
+			return nil, fmt.Errorf("%w: %s is registered as %s, got %s", storage.ErrTypeConflict, md.ID, cur.MType, md.MType)
+		}
+		if cur == md {
+			return nil, nil
+		}
+	}
+	if err := storage.ValidateMetadata(md); err != nil {
+		return nil, err
+	}
+	return &md, nil
+}
+
+// registerMetadata registers metadata checked by checkMetadata or checkInlineMetadata
+// after its samples were stored.
+//
+// Parameters:
+//   - ctx: Context for the storage operations
+//   - store: Storage of the request's tenant
+//   - pending: Metadata to register
+//
+// Returns:
+//   - error: Any error of Storage.SetMetadata
+func registerMetadata(ctx context.Context, store storage.Storage, pending ...metrics.Metadata) error {
+	for _, md := range pending {
+		if err := store.SetMetadata(ctx, md); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataListHandler returns an HTTP handler listing the registered metadata of the
+// tenant as a JSON array sorted by metric name. Metrics outside of the token scope are omitted.
+// URL pattern: GET /metadata
+//
+// Parameters:
+//   - store: Storage interface for reading metadata
+//
+// Returns:
+//   - http.HandlerFunc: Handler function for the metadata listing endpoint
+func metadataListHandler(store storage.Storage) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
+		all, err := store.AllMetadata()
+		if err != nil {
+			writeJSONError(res, http.StatusInternalServerError, "Failed to fetch metadata")
+			return
+		}
+
+		token := tokenFromContext(req.Context())
+		out := make([]metrics.Metadata, 0, len(all))
+		for _, md := range all {
+			if token != nil && !token.InScope(md.ID) {
+				continue
+			}
+			out = append(out, md)
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(out)
+	}
+}
+
+// metadataGetHandler returns an HTTP handler for the metadata of a single metric.
+// URL pattern: GET /metadata/{name}
+// Returns 404 if no metadata is registered for the metric.
+//
+// Parameters:
+//   - store: Storage interface for reading metadata
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
+//
+// Returns:
+//   - http.HandlerFunc: Handler function for the metadata endpoint
+func metadataGetHandler(store storage.Storage, auditPublisher *Publisher) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
+		name := chi.URLParam(req, "name")
+
+		if !authorizeMetrics(req, auditPublisher, name) {
+			writeJSONError(res, http.StatusForbidden, "Metric is outside of token scope")
+			return
+		}
+
+		md, ok := store.GetMetadata(name)
+		if !ok {
+			writeJSONError(res, http.StatusNotFound, "Metadata not found")
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(md)
+	}
+}
+
+// metadataUpdateHandler returns an HTTP handler registering the metadata of a metric.
+// URL pattern: POST /metadata
+// Accepts a JSON object with the metric ID, its expected type and optional description,
+// unit and owner, and returns the registered metadata. Registering metadata whose type
+// differs from a stored series of the metric is rejected with 409 Conflict.
+//
+// Request example:
+//
+//	{"id":"GCCPUFraction","type":"gauge","description":"Fraction of CPU time used by the GC","unit":"ratio"}
+//
+// Parameters:
+//   - store: Storage interface for registering metadata
+//   - saveFunc: Function to persist metrics to disk/database
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
+//
+// Returns:
+//   - http.HandlerFunc: Handler function for the metadata update endpoint
+func metadataUpdateHandler(ctx context.Context, store storage.Storage, saveFunc func(), auditPublisher *Publisher) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
+		var md metrics.Metadata
+		if err := json.NewDecoder(req.Body).Decode(&md); err != nil {
+			if isBodyTooLarge(err) {
+				writeJSONError(res, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
+			writeJSONError(res, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+
+		if md.ID == "" {
+			writeJSONError(res, http.StatusBadRequest, "Missing metric ID")
+			return
+		}
+
+		if !authorizeMetrics(req, auditPublisher, md.ID) {
+			writeJSONError(res, http.StatusForbidden, "Metric is outside of token scope")
+			return
+		}
+
+		if err := store.SetMetadata(ctx, md); err != nil {
+			writeJSONError(res, storageErrorStatus(err), storageErrorMessage(err, "Storage error"))
+			return
+		}
+
+		// Log audit event if publisher is configured
+		if auditPublisher != nil {
+			event := AuditEvent{
+				Timestamp: time.Now().Unix(),
+				Metrics:   []string{md.ID},
+				IPAddress: getRealIP(req),
+				Tenant:    requestTenant(req),
+				Action:    auditActionMetadata,
+			}
+			if token := tokenFromContext(req.Context()); token != nil {
+				event.Subject = token.Name
+			}
+			auditPublisher.Notify(event)
+		}
+
+		saveFunc()
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(md)
+	}
+}
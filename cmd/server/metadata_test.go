@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+func newMetadataRouter(store storage.Storage) *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/", indexHandler(store))
+	router.Get("/metrics", prometheusHandler(store))
+	router.Get("/metadata", metadataListHandler(store))
+	router.Get("/metadata/{name}", metadataGetHandler(store, nil))
+	router.Post("/metadata", metadataUpdateHandler(context.Background(), store, func() {}, nil))
+	router.Post("/update", updateJSONHandler(context.Background(), store, nil, func() {}, nil))
+	router.Post("/updates", updatesBatchHandler(context.Background(), store, nil, func() {}, nil))
+	router.Post("/value", valueJSONHandler(store, nil))
+	return router
+}
+
+func serve(t *testing.T, router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func Test_metadataHandlers(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Register", method: http.MethodPost, path: "/metadata", body: `{"id":"Alloc","type":"gauge","description":"Bytes of allocated heap objects","unit":"bytes"}`, expectedStatus: http.StatusOK, expectedBody: `"unit":"bytes"`},
+		{name: "Get", method: http.MethodGet, path: "/metadata/HeapObjects", expectedStatus: http.StatusOK, expectedBody: `{"id":"HeapObjects","type":"gauge","unit":"objects"}`},
+		{name: "List", method: http.MethodGet, path: "/metadata", expectedStatus: http.StatusOK, expectedBody: `[{"id":"HeapObjects","type":"gauge","unit":"objects"}]`},
+		{name: "Unknown metric", method: http.MethodGet, path: "/metadata/Missing", expectedStatus: http.StatusNotFound, expectedBody: "Metadata not found"},
+		{name: "Invalid JSON", method: http.MethodPost, path: "/metadata", body: `{`, expectedStatus: http.StatusBadRequest, expectedBody: "Invalid JSON"},
+		{name: "Missing ID", method: http.MethodPost, path: "/metadata", body: `{"type":"gauge"}`, expectedStatus: http.StatusBadRequest, expectedBody: "Missing metric ID"},
+		{name: "Unknown type", method: http.MethodPost, path: "/metadata", body: `{"id":"x","type":"rate"}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unit too long", method: http.MethodPost, path: "/metadata", body: `{"id":"x","type":"gauge","unit":"` + strings.Repeat("b", 65) + `"}`, expectedStatus: http.StatusBadRequest},
+		{name: "Conflicts with stored series", method: http.MethodPost, path: "/metadata", body: `{"id":"PollCount","type":"gauge"}`, expectedStatus: http.StatusConflict, expectedBody: "Metric type conflicts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemStorage()
+			require.NoError(t, store.UpdateCounter(t.Context(), "PollCount", 1))
+			require.NoError(t, store.SetMetadata(t.Context(), metrics.Metadata{ID: "HeapObjects", MType: "gauge", Unit: "objects"}))
+
+			rr := serve(t, newMetadataRouter(store), tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tt.expectedBody)
+		})
+	}
+}
+
+func Test_inlineMetadata(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		expectedStatus int
+		expectedError  string
+		expectedMeta   *metrics.Metadata
+	}{
+		{
+			name:           "Registered from single update",
+			path:           "/update",
+			body:           `{"id":"Alloc","type":"gauge","value":1,"meta":{"id":"ignored","type":"counter","unit":"bytes"}}`,
+			expectedStatus: http.StatusOK,
+			expectedMeta:   &metrics.Metadata{ID: "Alloc", MType: "gauge", Unit: "bytes"},
+		},
+		{
+			name:           "Registered from batch",
+			path:           "/updates",
+			body:           `[{"id":"Alloc","type":"gauge","value":1,"meta":{"description":"Heap","unit":"bytes"}}]`,
+			expectedStatus: http.StatusOK,
+			expectedMeta:   &metrics.Metadata{ID: "Alloc", MType: "gauge", Description: "Heap", Unit: "bytes"},
+		},
+		{
+			name:           "Sample conflicts with registered type",
+			path:           "/update",
+			body:           `{"id":"Frees","type":"gauge","value":1}`,
+			expectedStatus: http.StatusConflict,
+			expectedError:  "Metric type conflicts with its registered type",
+		},
+		{
+			name:           "Inline metadata cannot change the type",
+			path:           "/update",
+			body:           `{"id":"Frees","type":"gauge","value":1,"meta":{"unit":"objects"}}`,
+			expectedStatus: http.StatusConflict,
+			expectedError:  "Metric type conflicts with its registered type",
+		},
+		{
+			name:           "Batch reports the conflicting index",
+			path:           "/updates",
+			body:           `[{"id":"Alloc","type":"gauge","value":1},{"id":"Frees","type":"gauge","value":1}]`,
+			expectedStatus: http.StatusConflict,
+			expectedError:  `"index":1,"id":"Frees","type":"gauge"`,
+		},
+		{
+			name:           "Batch metadata conflict",
+			path:           "/updates",
+			body:           `[{"id":"Alloc","type":"gauge","value":1},{"id":"Frees","type":"gauge","value":1,"meta":{"unit":"objects"}}]`,
+			expectedStatus: http.StatusConflict,
+			expectedError:  `"index":1,"id":"Frees","type":"gauge"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemStorage()
+			require.NoError(t, store.SetMetadata(t.Context(), metrics.Metadata{ID: "Frees", MType: "counter"}))
+
+			rr := serve(t, newMetadataRouter(store), http.MethodPost, tt.path, tt.body)
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tt.expectedError)
+
+			md, ok := store.GetMetadata("Alloc")
+			if tt.expectedMeta == nil {
+				assert.False(t, ok)
+				_, ok = store.GetGauge("Frees")
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, *tt.expectedMeta, md)
+			v, ok := store.GetGauge("Alloc")
+			require.True(t, ok)
+			assert.Equal(t, 1.0, v)
+		})
+	}
+}
+
+func Test_inlineMetadata_RejectedSample(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{
+			name: "Single update",
+			path: "/update",
+			body: `{"id":"latency","type":"histogram","histogram":{"bounds":[0.5],"counts":[1,0],"count":1,"sum":0.2},"meta":{"unit":"seconds"}}`,
+		},
+		{
+			name: "Batch",
+			path: "/updates",
+			body: `[{"id":"latency","type":"histogram","histogram":{"bounds":[0.5],"counts":[1,0],"count":1,"sum":0.2},"meta":{"unit":"seconds"}}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemStorage()
+			require.NoError(t, store.UpdateHistogram(t.Context(), "latency", metrics.Histogram{Bounds: []float64{0.1, 1}, Counts: []int64{1, 0, 0}, Count: 1, Sum: 0.05}))
+
+			rr := serve(t, newMetadataRouter(store), http.MethodPost, tt.path, tt.body)
+			assert.Equal(t, http.StatusConflict, rr.Code)
+			_, ok := store.GetMetadata("latency")
+			assert.False(t, ok, "metadata of a rejected sample must not be registered")
+		})
+	}
+}
+
+func Test_valueJSONHandler_Metadata(t *testing.T) {
+	store := storage.NewMemStorage()
+	require.NoError(t, store.UpdateGauge(t.Context(), "Alloc", 512))
+	require.NoError(t, store.SetMetadata(t.Context(), metrics.Metadata{ID: "Alloc", MType: "gauge", Unit: "bytes"}))
+
+	rr := serve(t, newMetadataRouter(store), http.MethodPost, "/value", `{"id":"Alloc","type":"gauge"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp metrics.Metrics
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Meta)
+	assert.Equal(t, "bytes", resp.Meta.Unit)
+}
+
+func Test_prometheusHandler(t *testing.T) {
+	store := storage.NewMemStorage()
+	require.NoError(t, store.UpdateGauge(t.Context(), "GCCPUFraction", 0.5))
+	require.NoError(t, store.SetMetadata(t.Context(), metrics.Metadata{ID: "GCCPUFraction", MType: "gauge", Description: "Fraction of CPU time used by the GC", Unit: "ratio"}))
+	require.NoError(t, store.UpdateGauge(t.Context(), "cpu.util-1", 12))
+	require.NoError(t, store.UpdateGauge(t.Context(), "Requests", 3))
+	require.NoError(t, store.UpdateCounter(t.Context(), "Requests", 7))
+
+	rr := serve(t, newMetadataRouter(store), http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, prometheusContentType, rr.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP GCCPUFraction Fraction of CPU time used by the GC (unit: ratio)
+# TYPE GCCPUFraction gauge
+GCCPUFraction 0.5
+# TYPE Requests gauge
+Requests 3
+# TYPE Requests_total counter
+Requests_total 7
+# TYPE cpu_util_1 gauge
+cpu_util_1 12
+`, rr.Body.String())
+}
+
+func Test_indexHandler_Metadata(t *testing.T) {
+	store := storage.NewMemStorage()
+	require.NoError(t, store.UpdateGauge(t.Context(), "Alloc", 512))
+	require.NoError(t, store.SetMetadata(t.Context(), metrics.Metadata{ID: "Alloc", MType: "gauge", Description: "Heap <objects>", Unit: "bytes"}))
+
+	rr := serve(t, newMetadataRouter(store), http.MethodGet, "/", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "bytes")
+	assert.Contains(t, rr.Body.String(), "Heap &lt;objects&gt;")
+}
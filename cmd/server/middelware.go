@@ -249,6 +249,10 @@ func hashVerificationMiddleware(next http.Handler) http.Handler {
 		if flagCryptoKey != "" {
 			// Read the entire request body
 			body, err := io.ReadAll(r.Body)
+			if isBodyTooLarge(err) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
 				http.Error(w, "Failed to read request body", http.StatusBadRequest)
 				return
@@ -275,6 +279,10 @@ func hashVerificationMiddleware(next http.Handler) http.Handler {
 		if flagKey != "" {
 			// Read the entire request body
 			body, err := io.ReadAll(r.Body)
+			if isBodyTooLarge(err) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
 				http.Error(w, "Failed to read request body", http.StatusBadRequest)
 				return
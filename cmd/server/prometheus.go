@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// prometheusContentType is the content type of the Prometheus text exposition format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// prometheusName turns a metric name into a valid Prometheus metric name by replacing
+// every character outside [a-zA-Z0-9_:] with an underscore. Names starting with a
+// digit get a leading underscore.
+//
+// Parameters:
+//   - name: Metric name as stored
+//
+// Returns:
+//   - string: Name matching [a-zA-Z_:][a-zA-Z0-9_:]*
+func prometheusName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// prometheusHelp builds the HELP text of a metric from its metadata, escaping
+// backslashes and line breaks as the exposition format requires.
+//
+// Parameters:
+//   - md: Registered metadata of the metric
+//
+// Returns:
+//   - string: HELP text, or an empty string if neither description nor unit is registered
+func prometheusHelp(md metrics.Metadata) string {
+	help := md.Description
+	if md.Unit != "" {
+		if help != "" {
+			help += " "
+		}
+		help += "(unit: " + md.Unit + ")"
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// typeOrder orders the metric types of the same name in the exposition.
+var typeOrder = map[string]int{"gauge": 0, "counter": 1, "histogram": 2, "summary": 3}
+
+// formatFloat formats a sample value or label value as the exposition format expects.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// prometheusSamples renders the sample lines of a metric.
+//
+// Parameters:
+//   - name: Sanitized family name
+//   - m: Metric as returned by GetAll
+//
+// Returns:
+//   - []string: Names of all series written, which must not be used by other families
+//   - string: Sample lines, each ending with a line break
+//   - bool: false if the metric has no value of its type
+func prometheusSamples(name string, m metrics.Metrics) ([]string, string, bool) {
+	var b strings.Builder
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		fmt.Fprintf(&b, "%s %s\n", name, formatFloat(*m.Value))
+		return []string{name}, b.String(), true
+	case m.MType == "counter" && m.Delta != nil:
+		fmt.Fprintf(&b, "%s %d\n", name, *m.Delta)
+		return []string{name}, b.String(), true
+	case m.MType == "histogram" && m.Histogram != nil:
+		// Stored bucket counts are per bucket; the format wants them cumulative
+		h := m.Histogram
+		var cumulative int64
+		for i, bound := range h.Bounds {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, h.Count, name, formatFloat(h.Sum), name, h.Count)
+		return []string{name, name + "_bucket", name + "_sum", name + "_count"}, b.String(), true
+	case m.MType == "summary" && m.Summary != nil:
+		sm := m.Summary
+		for _, q := range sm.Quantiles {
+			fmt.Fprintf(&b, "%s{quantile=\"%s\"} %s\n", name, formatFloat(q.Quantile), formatFloat(q.Value))
+		}
+		fmt.Fprintf(&b, "%s_sum %s\n%s_count %d\n", name, formatFloat(sm.Sum), name, sm.Count)
+		return []string{name, name + "_sum", name + "_count"}, b.String(), true
+	}
+	return nil, "", false
+}
+
+// prometheusHandler returns an HTTP handler exposing the tenant's metrics in the
+// Prometheus text exposition format. Every metric gets a TYPE line, and a HELP line
+// with its description and unit if metadata is registered. Metrics outside of the
+// token scope are omitted.
+// URL pattern: GET /metrics
+//
+// Output example:
+//
+//	# HELP GCCPUFraction Fraction of CPU time used by the GC (unit: ratio)
+//	# TYPE GCCPUFraction gauge
+//	GCCPUFraction 0.0012
+//	# TYPE ReportLatency histogram
+//	ReportLatency_bucket{le="0.1"} 4
+//	ReportLatency_bucket{le="+Inf"} 5
+//	ReportLatency_sum 0.62
+//	ReportLatency_count 5
+//
+// Names are sanitized with prometheusName. If a gauge and a counter share a name,
+// the counter is exposed with a "_total" suffix. Histograms and summaries also take
+// their "_bucket", "_sum" and "_count" series names. A metric whose sanitized names
+// are still taken is skipped, since the format does not allow duplicate series.
+//
+// Parameters:
+//   - store: Storage interface for retrieving metrics and metadata
+//
+// Returns:
+//   - http.HandlerFunc: Handler function for the Prometheus endpoint
+func prometheusHandler(store storage.Storage) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		store := requestStore(req, store)
+		all, err := store.GetAll()
+		if err != nil {
+			http.Error(res, "Failed to fetch metrics", http.StatusInternalServerError)
+			return
+		}
+		// Gauges before counters of the same name, so the counter gets the suffix
+		sort.Slice(all, func(i, j int) bool {
+			if all[i].ID != all[j].ID {
+				return all[i].ID < all[j].ID
+			}
+			return typeOrder[all[i].MType] < typeOrder[all[j].MType]
+		})
+
+		var b strings.Builder
+		token := tokenFromContext(req.Context())
+		used := make(map[string]bool, len(all))
+		for _, m := range all {
+			if token != nil && !token.InScope(m.ID) {
+				continue
+			}
+			name := prometheusName(m.ID)
+			if used[name] && m.MType == "counter" {
+				name += "_total"
+			}
+
+			series, samples, ok := prometheusSamples(name, m)
+			if !ok || slices.ContainsFunc(series, func(s string) bool { return used[s] }) {
+				continue
+			}
+			for _, s := range series {
+				used[s] = true
+			}
+
+			if md, ok := store.GetMetadata(m.ID); ok {
+				if help := prometheusHelp(md); help != "" {
+					fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+				}
+			}
+			fmt.Fprintf(&b, "# TYPE %s %s\n%s", name, m.MType, samples)
+		}
+
+		res.Header().Set("Content-Type", prometheusContentType)
+		io.WriteString(res, b.String())
+	}
+}
@@ -12,6 +12,10 @@ func (s *AuditEvent) Reset() {
 	s.Timestamp = 0
 	s.Metrics = s.Metrics[:0]
 	s.IPAddress = ""
+	s.Action = ""
+	s.Subject = ""
+	s.Reason = ""
+	s.Tenant = ""
 }
 
 // Reset resets the Publisher struct to its zero state.
@@ -109,3 +113,19 @@ func (s *conditionalGzipResponseWriter) Reset() {
 	s.supportsGzip = false
 	s.wroteHeader = false
 }
+
+// Reset resets the TenantFileWriterObserver struct to its zero state.
+func (s *TenantFileWriterObserver) Reset() {
+	if s == nil {
+		return
+	}
+
+	s.dir = ""
+	clear(s.writers)
+	// Reset field mutex of external type sync.Mutex
+	if resetter, ok := interface{}(&s.mutex).(interface{ Reset() }); ok {
+		resetter.Reset()
+	} else {
+		// TODO: manually reset external field mutex
+	}
+}
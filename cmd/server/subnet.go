@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPContextKey is the type of the context key under which the resolved client IP is stored.
+type clientIPContextKey struct{}
+
+// parseCIDRList parses a comma-separated list of CIDR ranges.
+// Bare IP addresses are accepted and treated as single-host ranges.
+//
+// Parameters:
+//   - list: Comma-separated list such as "10.0.0.0/8, 192.168.1.10"
+//
+// Returns:
+//   - []*net.IPNet: Parsed ranges (nil for an empty list)
+//   - error: An error naming the first invalid entry
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether any of the ranges contains the address.
+//
+// Parameters:
+//   - nets: Ranges to check
+//   - ip: Address to look up (nil never matches)
+//
+// Returns:
+//   - bool: true if the address is inside one of the ranges
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of the directly connected peer from RemoteAddr.
+//
+// Parameters:
+//   - req: HTTP request object
+//
+// Returns:
+//   - string: The peer's IP address
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// resolveClientIP determines the client IP of a request. Proxy headers are honoured
+// only when the directly connected peer is one of the trusted proxies:
+//  1. X-Real-IP header
+//  2. X-Forwarded-For header, taking the rightmost address that is not a trusted proxy
+//  3. RemoteAddr otherwise
+//
+// Parameters:
+//   - req: HTTP request object
+//   - trustedProxies: Ranges of proxies whose headers are trusted
+//
+// Returns:
+//   - string: The client's IP address
+func resolveClientIP(req *http.Request, trustedProxies []*net.IPNet) string {
+	peer := peerIP(req)
+	if !containsIP(trustedProxies, net.ParseIP(peer)) {
+		return peer
+	}
+
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	// Walk the chain from the nearest hop and stop at the first untrusted address
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(hop)
+			if ip == nil {
+				break
+			}
+			if !containsIP(trustedProxies, ip) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	return peer
+}
+
+// realIPMiddleware resolves the client IP of every request once and stores it in the
+// request context, where getRealIP picks it up for audit events and access checks.
+// X-Real-IP and X-Forwarded-For are trusted only from the given proxies.
+//
+// Parameters:
+//   - trustedProxies: Ranges of proxies whose headers are trusted (nil trusts none)
+//
+// Returns:
+//   - func(http.Handler) http.Handler: Middleware function
+func realIPMiddleware(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPContextKey{}, resolveClientIP(r, trustedProxies))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// trustedSubnetMiddleware rejects requests whose client IP is outside the trusted subnet.
+// It must run after realIPMiddleware. When subnet is nil, all requests pass through.
+//
+// Responses:
+//   - 403 Forbidden: the client IP is missing, malformed, or outside the subnet
+//
+// Every rejected request is reported to the audit publisher.
+//
+// Parameters:
+//   - subnet: Trusted subnet (nil disables the check)
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
+//
+// Returns:
+//   - func(http.Handler) http.Handler: Middleware function
+func trustedSubnetMiddleware(subnet *net.IPNet, auditPublisher *Publisher) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if subnet == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := getRealIP(r)
+			if ip := net.ParseIP(clientIP); ip == nil || !subnet.Contains(ip) {
+				auditAuthFailure(auditPublisher, r, "", fmt.Sprintf("client ip %s is outside of trusted subnet %s", clientIP, subnet))
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
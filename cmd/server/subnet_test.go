@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseCIDRList(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Empty list", list: "", want: nil},
+		{name: "CIDR ranges", list: "10.0.0.0/8, 192.168.0.0/16", want: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{name: "Bare IPv4 address", list: "127.0.0.1", want: []string{"127.0.0.1/32"}},
+		{name: "Bare IPv6 address", list: "::1", want: []string{"::1/128"}},
+		{name: "Invalid address", list: "10.0.0.0/8,not-an-ip", wantErr: true},
+		{name: "Invalid mask", list: "10.0.0.0/33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseCIDRList(tt.list)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_resolveClientIP(t *testing.T) {
+	proxies, err := parseCIDRList("10.0.0.1, 10.0.1.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		realIP       string
+		forwardedFor string
+		expectedIP   string
+		trustProxies bool
+	}{
+		{name: "No headers", remoteAddr: "192.168.1.5:4000", expectedIP: "192.168.1.5", trustProxies: true},
+		{name: "Spoofed X-Real-IP from untrusted peer", remoteAddr: "192.168.1.5:4000", realIP: "10.10.10.10", expectedIP: "192.168.1.5", trustProxies: true},
+		{name: "Spoofed X-Forwarded-For from untrusted peer", remoteAddr: "192.168.1.5:4000", forwardedFor: "10.10.10.10", expectedIP: "192.168.1.5", trustProxies: true},
+		{name: "Headers ignored without trusted proxies", remoteAddr: "10.0.0.1:4000", realIP: "172.16.0.9", expectedIP: "10.0.0.1", trustProxies: false},
+		{name: "X-Real-IP from trusted proxy", remoteAddr: "10.0.0.1:4000", realIP: "172.16.0.9", expectedIP: "172.16.0.9", trustProxies: true},
+		{name: "X-Forwarded-For from trusted proxy", remoteAddr: "10.0.0.1:4000", forwardedFor: "172.16.0.9", expectedIP: "172.16.0.9", trustProxies: true},
+		{name: "X-Forwarded-For skips trusted hops", remoteAddr: "10.0.0.1:4000", forwardedFor: "1.2.3.4, 172.16.0.9, 10.0.1.7", expectedIP: "172.16.0.9", trustProxies: true},
+		{name: "Malformed X-Real-IP falls back to chain", remoteAddr: "10.0.0.1:4000", realIP: "garbage", forwardedFor: "172.16.0.9", expectedIP: "172.16.0.9", trustProxies: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			var trusted []*net.IPNet
+			if tt.trustProxies {
+				trusted = proxies
+			}
+			assert.Equal(t, tt.expectedIP, resolveClientIP(req, trusted))
+		})
+	}
+}
+
+func Test_trustedSubnetMiddleware(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	proxies, err := parseCIDRList("10.0.0.1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		subnet         *net.IPNet
+		remoteAddr     string
+		realIP         string
+		expectedStatus int
+	}{
+		{name: "Check disabled", subnet: nil, remoteAddr: "8.8.8.8:1234", expectedStatus: http.StatusOK},
+		{name: "Client inside subnet", subnet: subnet, remoteAddr: "192.168.1.20:1234", expectedStatus: http.StatusOK},
+		{name: "Client outside subnet", subnet: subnet, remoteAddr: "8.8.8.8:1234", expectedStatus: http.StatusForbidden},
+		{name: "Spoofed header from outside", subnet: subnet, remoteAddr: "8.8.8.8:1234", realIP: "192.168.1.20", expectedStatus: http.StatusForbidden},
+		{name: "Proxy forwards client inside subnet", subnet: subnet, remoteAddr: "10.0.0.1:1234", realIP: "192.168.1.20", expectedStatus: http.StatusOK},
+		{name: "Proxy forwards client outside subnet", subnet: subnet, remoteAddr: "10.0.0.1:1234", realIP: "8.8.8.8", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			handler := realIPMiddleware(proxies)(trustedSubnetMiddleware(tt.subnet, nil)(next))
+
+			req := httptest.NewRequest(http.MethodPost, "/update", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func Test_trustedSubnetMiddleware_AuditsRejections(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	tmpFile := tempFile(t)
+	publisher := NewPublisher([]Observer{NewFileWriterObserver(tmpFile)})
+	defer publisher.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := realIPMiddleware(nil)(trustedSubnetMiddleware(subnet, publisher)(next))
+
+	req := httptest.NewRequest(http.MethodPost, "/update", nil)
+	req.RemoteAddr = "8.8.8.8:1234"
+	req.Header.Set("X-Real-IP", "192.168.1.20")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"ip_address":"8.8.8.8"`)
+	assert.Contains(t, string(data), "outside of trusted subnet")
+}
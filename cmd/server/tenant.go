@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// tenantHeader is the request header that selects the tenant namespace
+// when the API token does not bind the request to a tenant.
+const tenantHeader = "X-Tenant-ID"
+
+// tenantContextKey is the type of the context key under which the tenant and its storage are stored.
+type tenantContextKey struct{}
+
+// tenantContext holds the tenant resolved for a request and the storage serving it.
+type tenantContext struct {
+	id    string          // Tenant identifier (empty for the default tenant)
+	store storage.Storage // Storage of the tenant
+}
+
+// requestTenant returns the tenant identifier resolved for the request.
+//
+// Parameters:
+//   - req: HTTP request object
+//
+// Returns:
+//   - string: Tenant identifier, or an empty string for the default tenant
+func requestTenant(req *http.Request) string {
+	if tc, ok := req.Context().Value(tenantContextKey{}).(*tenantContext); ok {
+		return tc.id
+	}
+	return storage.DefaultTenant
+}
+
+// requestStore returns the storage of the tenant resolved for the request.
+// If multi-tenancy is disabled, the fallback storage is returned.
+//
+// Parameters:
+//   - req: HTTP request object
+//   - fallback: Storage used when no tenant storage is attached to the request
+//
+// Returns:
+//   - storage.Storage: Storage to serve the request from
+func requestStore(req *http.Request, fallback storage.Storage) storage.Storage {
+	if tc, ok := req.Context().Value(tenantContextKey{}).(*tenantContext); ok {
+		return tc.store
+	}
+	return fallback
+}
+
+// parseTenantList parses a comma-separated list of tenant identifiers.
+//
+// Parameters:
+//   - list: Comma-separated list such as "team-a, team-b"
+//
+// Returns:
+//   - []string: Parsed tenant identifiers (nil for an empty list)
+//   - error: An error naming the first invalid or reserved identifier
+func parseTenantList(list string) ([]string, error) {
+	var tenants []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !storage.ValidTenantID(entry) {
+			return nil, fmt.Errorf("invalid tenant id %q", entry)
+		}
+		tenants = append(tenants, entry)
+	}
+	return tenants, nil
+}
+
+// tenantMiddleware resolves the tenant of a request and attaches its isolated storage
+// to the request context. The tenant is taken from the authenticated token if the token
+// is bound to one; otherwise from the X-Tenant-ID header if the allow-list contains it;
+// otherwise the default tenant is used. A token bound to a tenant may not address
+// another tenant through the header.
+//
+// This middleware must run after authMiddleware. When registry is nil,
+// multi-tenancy is disabled and requests pass through unchanged.
+//
+// Responses:
+//   - 400 Bad Request: the tenant identifier is malformed
+//   - 403 Forbidden: the header names a tenant other than the token's or one not on
+//     the allow-list, or the registry holds the maximum number of tenants
+//   - 500 Internal Server Error: the tenant storage could not be created
+//
+// Parameters:
+//   - registry: Per-tenant storage registry (nil disables multi-tenancy)
+//   - allowed: Tenants that may be selected through the header without a bound token
+//   - auditPublisher: Optional publisher for audit logging (can be nil)
+//
+// Returns:
+//   - func(http.Handler) http.Handler: Middleware function
+func tenantMiddleware(registry *storage.TenantRegistry, allowed []string, auditPublisher *Publisher) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if registry == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := r.Header.Get(tenantHeader)
+
+			if token := tokenFromContext(r.Context()); token != nil && token.Tenant != "" {
+				if tenant != "" && tenant != token.Tenant {
+					auditAuthFailure(auditPublisher, r, token.Name, fmt.Sprintf("token is bound to tenant %s, requested %s", token.Tenant, tenant))
+					http.Error(w, "Tenant does not match token", http.StatusForbidden)
+					return
+				}
+				tenant = token.Tenant
+			} else if tenant != "" {
+				if !storage.ValidTenantID(tenant) {
+					http.Error(w, "Invalid tenant id", http.StatusBadRequest)
+					return
+				}
+				if !slices.Contains(allowed, tenant) {
+					tokenName := ""
+					if token != nil {
+						tokenName = token.Name
+					}
+					auditAuthFailure(auditPublisher, r, tokenName, fmt.Sprintf("tenant %s is not on the allow-list", tenant))
+					http.Error(w, "Tenant not allowed", http.StatusForbidden)
+					return
+				}
+			}
+
+			if !storage.ValidTenantID(tenant) {
+				http.Error(w, "Invalid tenant id", http.StatusBadRequest)
+				return
+			}
+
+			store, err := registry.Get(r.Context(), tenant)
+			if errors.Is(err, storage.ErrTooManyTenants) {
+				http.Error(w, "Tenant limit reached", http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to open tenant storage", http.StatusInternalServerError)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), tenantContextKey{}, &tenantContext{id: tenant, store: store})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
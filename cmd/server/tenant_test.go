@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/auth"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/storage"
+)
+
+// testTenants are the tenants the test routers allow to be selected by header.
+var testTenants = []string{"team-a", "team-b", "team-c"}
+
+func newTenantRouter(t *testing.T, tokens auth.TokenStore, maxSeries, maxTenants int, publisher *Publisher) (http.Handler, *storage.TenantRegistry) {
+	t.Helper()
+	store := storage.NewMemStorage()
+	registry := storage.NewTenantRegistry(store, func(_ context.Context, _ string) (storage.Storage, error) {
+		return storage.NewMemStorage(), nil
+	}, maxSeries, maxTenants)
+
+	router := chi.NewRouter()
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokens, publisher, auth.RoleReader))
+		r.Use(tenantMiddleware(registry, testTenants, publisher))
+		r.Get("/value/{type}/{name}", getHandler(store, publisher))
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware(tokens, publisher, auth.RoleWriter))
+		r.Use(tenantMiddleware(registry, testTenants, publisher))
+		r.Post("/update", updateJSONHandler(context.Background(), store, nil, func() {}, publisher))
+		r.Post("/updates", updatesBatchHandler(context.Background(), store, nil, func() {}, publisher))
+	})
+	return router, registry
+}
+
+func doTenantRequest(router http.Handler, method, url, body, tenant, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		req.Header.Set(tenantHeader, tenant)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func Test_tenantMiddleware_Isolation(t *testing.T) {
+	router, _ := newTenantRouter(t, nil, 0, 0, nil)
+
+	rr := doTenantRequest(router, http.MethodPost, "/update", `{"id":"Alloc","type":"gauge","value":1}`, "team-a", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doTenantRequest(router, http.MethodPost, "/update", `{"id":"Alloc","type":"gauge","value":2}`, "team-b", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	tests := []struct {
+		name           string
+		tenant         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Tenant A sees own value", tenant: "team-a", expectedStatus: http.StatusOK, expectedBody: "1"},
+		{name: "Tenant B sees own value", tenant: "team-b", expectedStatus: http.StatusOK, expectedBody: "2"},
+		{name: "Default tenant sees nothing", tenant: "", expectedStatus: http.StatusNotFound},
+		{name: "Unknown tenant sees nothing", tenant: "team-c", expectedStatus: http.StatusNotFound},
+		{name: "Invalid tenant id", tenant: "../etc", expectedStatus: http.StatusBadRequest},
+		{name: "Reserved tenant id", tenant: "Default", expectedStatus: http.StatusBadRequest},
+		{name: "Tenant not on the allow-list", tenant: "team-z", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doTenantRequest(router, http.MethodGet, "/value/gauge/Alloc", "", tt.tenant, "")
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func Test_tenantMiddleware_Quota(t *testing.T) {
+	router, _ := newTenantRouter(t, nil, 2, 0, nil)
+
+	tests := []struct {
+		name           string
+		url            string
+		body           string
+		tenant         string
+		expectedStatus int
+	}{
+		{name: "First series", url: "/update", body: `{"id":"a","type":"gauge","value":1}`, tenant: "team-a", expectedStatus: http.StatusOK},
+		{name: "Second series", url: "/update", body: `{"id":"b","type":"counter","delta":1}`, tenant: "team-a", expectedStatus: http.StatusOK},
+		{name: "Third series rejected", url: "/update", body: `{"id":"c","type":"gauge","value":1}`, tenant: "team-a", expectedStatus: http.StatusForbidden},
+		{name: "Existing series still updatable", url: "/update", body: `{"id":"b","type":"counter","delta":5}`, tenant: "team-a", expectedStatus: http.StatusOK},
+		{name: "Batch with new series rejected", url: "/updates", body: `[{"id":"a","type":"gauge","value":2},{"id":"d","type":"gauge","value":1}]`, tenant: "team-a", expectedStatus: http.StatusForbidden},
+		{name: "Quota is per tenant", url: "/update", body: `{"id":"c","type":"gauge","value":1}`, tenant: "team-b", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doTenantRequest(router, http.MethodPost, tt.url, tt.body, tt.tenant, "")
+			assert.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+		})
+	}
+}
+
+func Test_tenantMiddleware_TokenTenant(t *testing.T) {
+	tokens, err := auth.NewMemoryTokenStore([]auth.Token{
+		{Name: "team-a-writer", Hash: auth.HashToken("a-secret"), Role: auth.RoleAdmin, Tenant: "team-a"},
+		{Name: "global", Hash: auth.HashToken("global-secret"), Role: auth.RoleAdmin},
+	})
+	require.NoError(t, err)
+	router, registry := newTenantRouter(t, tokens, 0, 0, nil)
+
+	// Token bound to a tenant writes into that tenant without a header
+	rr := doTenantRequest(router, http.MethodPost, "/update", `{"id":"Alloc","type":"gauge","value":3}`, "", "a-secret")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	teamA, err := registry.Get(t.Context(), "team-a")
+	require.NoError(t, err)
+	v, ok := teamA.GetGauge("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, 3.0, v)
+
+	// Token bound to a tenant cannot address another tenant
+	rr = doTenantRequest(router, http.MethodGet, "/value/gauge/Alloc", "", "team-b", "a-secret")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Matching header is accepted
+	rr = doTenantRequest(router, http.MethodGet, "/value/gauge/Alloc", "", "team-a", "a-secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Unbound token selects an allowed tenant by header
+	rr = doTenantRequest(router, http.MethodGet, "/value/gauge/Alloc", "", "team-a", "global-secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = doTenantRequest(router, http.MethodGet, "/value/gauge/Alloc", "", "", "global-secret")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doTenantRequest(router, http.MethodGet, "/value/gauge/Alloc", "", "team-z", "global-secret")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func Test_tenantMiddleware_MaxTenants(t *testing.T) {
+	tokens, err := auth.NewMemoryTokenStore([]auth.Token{
+		{Name: "team-d-writer", Hash: auth.HashToken("d-secret"), Role: auth.RoleAdmin, Tenant: "team-d"},
+		{Name: "global", Hash: auth.HashToken("global-secret"), Role: auth.RoleAdmin},
+	})
+	require.NoError(t, err)
+	router, _ := newTenantRouter(t, tokens, 0, 1, nil)
+
+	tests := []struct {
+		name           string
+		tenant         string
+		token          string
+		expectedStatus int
+	}{
+		{name: "First tenant", tenant: "team-a", token: "global-secret", expectedStatus: http.StatusOK},
+		{name: "First tenant again", tenant: "team-a", token: "global-secret", expectedStatus: http.StatusOK},
+		{name: "Default tenant does not count", token: "global-secret", expectedStatus: http.StatusOK},
+		{name: "Second tenant by header rejected", tenant: "team-b", token: "global-secret", expectedStatus: http.StatusForbidden},
+		{name: "Second tenant by token rejected", token: "d-secret", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doTenantRequest(router, http.MethodPost, "/update", `{"id":"Alloc","type":"gauge","value":1}`, tt.tenant, tt.token)
+			assert.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+		})
+	}
+}
+
+func Test_parseTenantList(t *testing.T) {
+	tests := []struct {
+		name          string
+		list          string
+		expected      []string
+		expectedError string
+	}{
+		{name: "Empty", list: ""},
+		{name: "Trimmed", list: " team-a, ,team-b ", expected: []string{"team-a", "team-b"}},
+		{name: "Invalid", list: "team-a,../etc", expectedError: `invalid tenant id "../etc"`},
+		{name: "Reserved", list: "default", expectedError: `invalid tenant id "default"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenants, err := parseTenantList(tt.list)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, tenants)
+		})
+	}
+}
+
+func Test_TenantFileWriterObserver(t *testing.T) {
+	dir := t.TempDir()
+	publisher := NewPublisher([]Observer{NewTenantFileWriterObserver(dir)})
+	defer publisher.Close()
+
+	router, _ := newTenantRouter(t, nil, 0, 0, publisher)
+	doTenantRequest(router, http.MethodPost, "/update", `{"id":"a_metric","type":"gauge","value":1}`, "team-a", "")
+	doTenantRequest(router, http.MethodPost, "/update", `{"id":"b_metric","type":"gauge","value":1}`, "team-b", "")
+	doTenantRequest(router, http.MethodPost, "/update", `{"id":"default_metric","type":"gauge","value":1}`, "", "")
+
+	tests := []struct {
+		file     string
+		contains string
+		excludes string
+	}{
+		{file: "team-a.log", contains: "a_metric", excludes: "b_metric"},
+		{file: "team-b.log", contains: "b_metric", excludes: "a_metric"},
+		{file: "default.log", contains: "default_metric", excludes: "a_metric"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(dir, tt.file))
+			require.NoError(t, err)
+			assert.Contains(t, string(data), tt.contains)
+			assert.NotContains(t, string(data), tt.excludes)
+		})
+	}
+}
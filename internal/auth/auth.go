@@ -0,0 +1,237 @@
+// Package auth provides bearer-token authentication and role-based access control
+// for the metrics server. Tokens are never stored in plain text: only their
+// SHA-256 hashes are kept in the token store (a JSON file or a PostgreSQL table).
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Role describes the set of operations a token is allowed to perform.
+type Role string
+
+const (
+	// RoleReader allows reading metric values and the HTML dashboard.
+	RoleReader Role = "reader"
+
+	// RoleWriter allows updating metrics via the /update and /updates routes.
+	RoleWriter Role = "writer"
+
+	// RoleAdmin allows everything, including deleting metrics and reading the configuration.
+	RoleAdmin Role = "admin"
+)
+
+// ErrTokenNotFound is returned by a TokenStore when no token matches the given hash.
+var ErrTokenNotFound = errors.New("token not found")
+
+// Token describes a single API token as it is kept in a token store.
+//
+// Example JSON representation:
+//
+//	{"name":"agent-1","hash":"9f86d08...","role":"writer","scope":"agent1_","tenant":"team-a"}
+type Token struct {
+	// Name is a human-readable identifier of the token owner (e.g., "agent-1").
+	Name string `json:"name"`
+
+	// Hash is the hex-encoded SHA-256 hash of the bearer token.
+	Hash string `json:"hash"`
+
+	// Role determines which routes the token may access.
+	Role Role `json:"role"`
+
+	// Scope restricts the token to metrics whose names start with this prefix.
+	// An empty scope allows access to all metrics.
+	Scope string `json:"scope,omitempty"`
+
+	// Tenant binds the token to a tenant namespace. Requests made with the token
+	// always use this tenant; an empty value leaves tenant selection to the request.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Allows reports whether the token's role permits an operation that requires the given role.
+// Admin tokens are allowed everything; reader and writer roles only match themselves.
+//
+// Parameters:
+//   - required: Role required by the route
+//
+// Returns:
+//   - bool: true if the token may perform the operation
+func (t *Token) Allows(required Role) bool {
+	if t.Role == RoleAdmin {
+		return true
+	}
+	return t.Role == required
+}
+
+// InScope reports whether the metric name matches the token's scope prefix.
+//
+// Parameters:
+//   - name: Metric name to check
+//
+// Returns:
+//   - bool: true if the token has no scope or the name starts with the scope prefix
+func (t *Token) InScope(name string) bool {
+	return t.Scope == "" || strings.HasPrefix(name, t.Scope)
+}
+
+// TokenStore looks up tokens by the hash of their secret value.
+type TokenStore interface {
+	// Lookup returns the token with the given SHA-256 hash,
+	// or ErrTokenNotFound if no such token exists.
+	Lookup(ctx context.Context, hash string) (*Token, error)
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// HashToken returns the hex-encoded SHA-256 hash of a plain-text bearer token.
+// Use it to produce the value stored in the "hash" field of a token store.
+//
+// Parameters:
+//   - token: Plain-text bearer token
+//
+// Returns:
+//   - string: Hex-encoded SHA-256 hash
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateToken checks that a token loaded from a store has a known role and a hash.
+func validateToken(t *Token) error {
+	if t.Hash == "" {
+		return fmt.Errorf("token %q has empty hash", t.Name)
+	}
+	switch t.Role {
+	case RoleReader, RoleWriter, RoleAdmin:
+		return nil
+	default:
+		return fmt.Errorf("token %q has unknown role %q", t.Name, t.Role)
+	}
+}
+
+// FileTokenStore keeps tokens loaded from a JSON file in memory.
+// The file contains a JSON array of Token objects.
+type FileTokenStore struct {
+	tokens map[string]Token // Tokens indexed by hash
+	mu     sync.RWMutex     // Protects tokens
+}
+
+// NewFileTokenStore loads tokens from the JSON file at the given path.
+//
+// Parameters:
+//   - path: Path to the JSON file with the token list
+//
+// Returns:
+//   - *FileTokenStore: Store with all tokens loaded
+//   - error: Any error during reading, parsing or validating the file
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read token file: %w", err)
+	}
+
+	var list []Token
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse token file: %w", err)
+	}
+
+	return NewMemoryTokenStore(list)
+}
+
+// NewMemoryTokenStore creates a FileTokenStore from an in-memory list of tokens.
+// It is useful for tests and for embedding tokens from other configuration sources.
+//
+// Parameters:
+//   - list: Tokens to serve
+//
+// Returns:
+//   - *FileTokenStore: Store serving the given tokens
+//   - error: An error if any token is invalid
+func NewMemoryTokenStore(list []Token) (*FileTokenStore, error) {
+	s := &FileTokenStore{tokens: make(map[string]Token, len(list))}
+	for i := range list {
+		t := list[i]
+		if err := validateToken(&t); err != nil {
+			return nil, err
+		}
+		s.tokens[strings.ToLower(t.Hash)] = t
+	}
+	return s, nil
+}
+
+// Lookup returns the token with the given hash.
+func (s *FileTokenStore) Lookup(ctx context.Context, hash string) (*Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tokens[strings.ToLower(hash)]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &t, nil
+}
+
+// Close implements the TokenStore interface. The file store holds no resources.
+func (s *FileTokenStore) Close() error {
+	return nil
+}
+
+// DBTokenStore looks tokens up in the api_tokens PostgreSQL table.
+// The table is created by the migrations shipped with the server.
+type DBTokenStore struct {
+	pool *pgxpool.Pool // PostgreSQL connection pool
+}
+
+// NewDBTokenStore connects to PostgreSQL and returns a token store backed by the api_tokens table.
+//
+// Parameters:
+//   - ctx: Context for the connection attempt
+//   - dsn: PostgreSQL connection string
+//
+// Returns:
+//   - *DBTokenStore: Connected token store
+//   - error: Any error during connection
+func NewDBTokenStore(ctx context.Context, dsn string) (*DBTokenStore, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DB: %w", err)
+	}
+	return &DBTokenStore{pool: pool}, nil
+}
+
+// Lookup returns the token with the given hash from the api_tokens table.
+func (s *DBTokenStore) Lookup(ctx context.Context, hash string) (*Token, error) {
+	var t Token
+	err := s.pool.QueryRow(ctx,
+		`SELECT name, hash, role, scope, tenant FROM api_tokens WHERE hash = $1`,
+		strings.ToLower(hash),
+	).Scan(&t.Name, &t.Hash, &t.Role, &t.Scope, &t.Tenant)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup token: %w", err)
+	}
+	if err := validateToken(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Close closes the connection pool.
+func (s *DBTokenStore) Close() error {
+	s.pool.Close()
+	return nil
+}
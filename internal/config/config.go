@@ -8,25 +8,102 @@ import (
 
 // DBConfig represents database configuration
 type DBConfig struct {
-	DSN string `json:"dsn"`
+	DSN               string `json:"dsn"`
+	MaxConns          int32  `json:"max_conns"`
+	MinConns          int32  `json:"min_conns"`
+	MaxConnLifetime   string `json:"max_conn_lifetime"`
+	MaxConnIdleTime   string `json:"max_conn_idle_time"`
+	HealthCheckPeriod string `json:"health_check_period"`
+	ConnectTimeout    string `json:"connect_timeout"`
+	QueryTimeout      string `json:"query_timeout"`
+	SingleReplica     bool   `json:"single_replica"`
+}
+
+// WALConfig represents write-ahead log configuration of file storage
+type WALConfig struct {
+	SyncInterval string `json:"sync_interval"`
+	SnapshotSize int64  `json:"snapshot_size"`
+}
+
+// AuthConfig represents API token authentication configuration
+type AuthConfig struct {
+	File string `json:"file"`
+	DB   bool   `json:"db"`
+}
+
+// TenancyConfig represents multi-tenancy configuration
+type TenancyConfig struct {
+	Enabled    bool     `json:"enabled"`
+	MaxSeries  int      `json:"max_series"`
+	AuditDir   string   `json:"audit_dir"`
+	Allowed    []string `json:"allowed"`
+	MaxTenants int      `json:"max_tenants"`
+}
+
+// LimitsConfig represents request size and rate limit configuration
+type LimitsConfig struct {
+	MaxBodySize  int64   `json:"max_body_size"`
+	MaxBatchSize int     `json:"max_batch_size"`
+	RateLimit    float64 `json:"rate_limit"`
+	RateBurst    int     `json:"rate_burst"`
 }
 
 // ServerConfig represents the server configuration structure
 type ServerConfig struct {
-	Address       string   `json:"address"`
-	Restore       bool     `json:"restore"`
-	StoreFile     string   `json:"store_file"`
-	CryptoKey     string   `json:"crypto_key"`
-	StoreInterval string   `json:"store_interval"`
-	DB            DBConfig `json:"db"`
+	Address        string        `json:"address"`
+	Restore        bool          `json:"restore"`
+	StoreFile      string        `json:"store_file"`
+	CryptoKey      string        `json:"crypto_key"`
+	StoreInterval  string        `json:"store_interval"`
+	Storage        string        `json:"storage"`
+	BoltPath       string        `json:"bolt_path"`
+	WAL            WALConfig     `json:"wal"`
+	DB             DBConfig      `json:"db"`
+	Auth           AuthConfig    `json:"auth"`
+	Tenancy        TenancyConfig `json:"tenancy"`
+	TrustedSubnet  string        `json:"trusted_subnet"`
+	TrustedProxies []string      `json:"trusted_proxies"`
+	Limits         LimitsConfig  `json:"limits"`
+}
+
+// CollectorConfig represents the configuration of one agent collector
+type CollectorConfig struct {
+	Enabled  *bool  `json:"enabled"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+// ExecConfig represents a command run by the agent's exec collector
+type ExecConfig struct {
+	Command []string `json:"command"`
+	Timeout string   `json:"timeout"`
+}
+
+// ScrapeConfig represents a Prometheus endpoint scraped by the agent's scrape collector
+type ScrapeConfig struct {
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Timeout   string   `json:"timeout"`
+	LabelMode string   `json:"label_mode"`
+	Prefix    string   `json:"prefix"`
+	Keep      []string `json:"keep"`
+	Drop      []string `json:"drop"`
+	MaxSeries int      `json:"max_series"`
 }
 
 // AgentConfig represents the agent configuration structure
 type AgentConfig struct {
-	Address        string `json:"address"`
-	ReportInterval string `json:"report_interval"`
-	PollInterval   string `json:"poll_interval"`
-	CryptoKey      string `json:"crypto_key"`
+	Address        string                     `json:"address"`
+	ReportInterval string                     `json:"report_interval"`
+	PollInterval   string                     `json:"poll_interval"`
+	CryptoKey      string                     `json:"crypto_key"`
+	Token          string                     `json:"token"`
+	SourceID       string                     `json:"source_id"`
+	Collectors     map[string]CollectorConfig `json:"collectors"`
+	Processes      []string                   `json:"processes"`
+	Exec           []ExecConfig               `json:"exec"`
+	TextfileDir    string                     `json:"textfile_dir"`
+	Scrape         []ScrapeConfig             `json:"scrape"`
 }
 
 // LoadServerConfig loads server configuration from a JSON file
@@ -0,0 +1,173 @@
+// Package leader elects a single server instance to run singleton background jobs,
+// such as periodic metric saving or retention cleanup, when several replicas run
+// side by side.
+//
+// An Elector decides which instance is the leader. Two implementations are provided:
+//   - Local: in-process election for single-node deployments and tests
+//   - Postgres: election through a PostgreSQL session-level advisory lock
+//
+// A Scheduler runs registered jobs only while its instance is the leader.
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Elector campaigns for leadership.
+type Elector interface {
+	// Run campaigns for leadership until ctx is canceled. onChange is called with true
+	// when leadership is gained and with false when it is lost; if the instance is the
+	// leader when ctx is canceled, onChange(false) is called before Run returns and
+	// before leadership is released. onError receives errors that interrupt the campaign.
+	Run(ctx context.Context, onChange func(leader bool), onError func(error))
+}
+
+// shutdownTimeout bounds the shutdown tasks of all jobs.
+const shutdownTimeout = 10 * time.Second
+
+// Job is a background task that must run on one instance only.
+type Job struct {
+	Name     string                          // Name used in log messages
+	Interval time.Duration                   // Time between runs (0 for no periodic runs)
+	Run      func(ctx context.Context) error // Periodic task; ctx is canceled when leadership is lost
+	Shutdown func(ctx context.Context) error // Optional task run once by the leader when the scheduler stops
+}
+
+// Scheduler runs registered jobs while its instance holds leadership.
+// Jobs are started when leadership is gained and stopped when it is lost.
+type Scheduler struct {
+	elector Elector                                  // Leadership source
+	logf    func(format string, args ...interface{}) // Logger for leadership changes and job errors
+	jobs    []Job                                    // Registered jobs
+	leader  atomic.Bool                              // Whether this instance is the leader
+
+	cancel context.CancelFunc // Stops the running jobs
+	wg     sync.WaitGroup     // Tracks the running jobs
+}
+
+// NewScheduler creates a scheduler that runs jobs when elector grants leadership.
+//
+// Parameters:
+//   - elector: Leadership source
+//   - logf: Printf-style logger for leadership changes and job errors (can be nil)
+//
+// Returns:
+//   - *Scheduler: Scheduler without jobs
+func NewScheduler(elector Elector, logf func(format string, args ...interface{})) *Scheduler {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	return &Scheduler{elector: elector, logf: logf}
+}
+
+// Register adds a job. Jobs must be registered before Run is called.
+//
+// Parameters:
+//   - job: Job to run on the leader
+func (s *Scheduler) Register(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// IsLeader reports whether this instance currently holds leadership.
+//
+// Returns:
+//   - bool: true if registered jobs are running on this instance
+func (s *Scheduler) IsLeader() bool {
+	return s.leader.Load()
+}
+
+// Run campaigns for leadership and runs the jobs while leading.
+// It blocks until ctx is canceled and all jobs have stopped. If this instance is the
+// leader at that point, the shutdown tasks of the jobs run before leadership is released.
+//
+// Parameters:
+//   - ctx: Context that stops the scheduler when canceled
+func (s *Scheduler) Run(ctx context.Context) {
+	s.elector.Run(ctx, func(leader bool) {
+		if leader {
+			s.start(ctx)
+		} else {
+			s.stop(ctx.Err() != nil)
+		}
+	}, func(err error) {
+		s.logf("Leader election: %v", err)
+	})
+	s.stop(true)
+}
+
+// start launches all jobs after leadership was gained.
+//
+// Parameters:
+//   - ctx: Parent context of the jobs
+func (s *Scheduler) start(ctx context.Context) {
+	if s.leader.Swap(true) {
+		return
+	}
+	s.logf("Became leader, starting %d background job(s)", len(s.jobs))
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	for _, job := range s.jobs {
+		if job.Interval <= 0 || job.Run == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func(job Job) {
+			defer s.wg.Done()
+			s.runJob(jobCtx, job)
+		}(job)
+	}
+}
+
+// stop cancels all jobs and waits for them to finish after leadership was lost.
+//
+// Parameters:
+//   - shutdown: Whether the scheduler is stopping, so shutdown tasks must run
+func (s *Scheduler) stop(shutdown bool) {
+	if !s.leader.Swap(false) {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+
+	if !shutdown {
+		s.logf("Lost leadership, background jobs stopped")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, job := range s.jobs {
+		if job.Shutdown == nil {
+			continue
+		}
+		if err := job.Shutdown(ctx); err != nil {
+			s.logf("Shutdown of background job %s failed: %v", job.Name, err)
+		}
+	}
+	s.logf("Stepped down as leader, background jobs stopped")
+}
+
+// runJob runs the job every interval until ctx is canceled.
+//
+// Parameters:
+//   - ctx: Context canceled when leadership is lost
+//   - job: Job to run
+func (s *Scheduler) runJob(ctx context.Context, job Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := job.Run(ctx); err != nil && ctx.Err() == nil {
+				s.logf("Background job %s failed: %v", job.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logRecorder collects log lines of a scheduler.
+type logRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *logRecorder) logf(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+func (r *logRecorder) all() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// countingJob returns a job that counts its runs.
+func countingJob(runs *atomic.Int64) Job {
+	return Job{
+		Name:     "count",
+		Interval: 5 * time.Millisecond,
+		Run: func(context.Context) error {
+			runs.Add(1)
+			return nil
+		},
+	}
+}
+
+func TestLocal_SingleNodeIsLeader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan bool, 2)
+	done := make(chan struct{})
+	go func() {
+		NewLocal(nil).Run(ctx, func(leader bool) { changes <- leader }, nil)
+		close(done)
+	}()
+
+	assert.True(t, <-changes)
+	cancel()
+	assert.False(t, <-changes)
+	<-done
+}
+
+func TestScheduler_JobsRunOnlyOnLeader(t *testing.T) {
+	var lock sync.Mutex
+	var firstRuns, secondRuns atomic.Int64
+	firstLog, secondLog := &logRecorder{}, &logRecorder{}
+
+	first := NewScheduler(NewLocal(&lock), firstLog.logf)
+	first.Register(countingJob(&firstRuns))
+	second := NewScheduler(NewLocal(&lock), secondLog.logf)
+	second.Register(countingJob(&secondRuns))
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		first.Run(firstCtx)
+		close(firstDone)
+	}()
+	require.Eventually(t, first.IsLeader, time.Second, time.Millisecond)
+
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	secondDone := make(chan struct{})
+	go func() {
+		second.Run(secondCtx)
+		close(secondDone)
+	}()
+
+	// Only the leader runs its jobs
+	require.Eventually(t, func() bool { return firstRuns.Load() >= 3 }, time.Second, time.Millisecond)
+	assert.False(t, second.IsLeader())
+	assert.Zero(t, secondRuns.Load())
+
+	// When the leader stops, the other instance takes over
+	stopFirst()
+	<-firstDone
+	assert.False(t, first.IsLeader())
+	stoppedAt := firstRuns.Load()
+
+	require.Eventually(t, second.IsLeader, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return secondRuns.Load() >= 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, stoppedAt, firstRuns.Load(), "jobs kept running after leadership was lost")
+
+	stopSecond()
+	<-secondDone
+
+	assert.Equal(t, []string{
+		"Became leader, starting 1 background job(s)",
+		"Stepped down as leader, background jobs stopped",
+	}, firstLog.all())
+	assert.Equal(t, []string{
+		"Became leader, starting 1 background job(s)",
+		"Stepped down as leader, background jobs stopped",
+	}, secondLog.all())
+}
+
+// flakyElector grants leadership, revokes it, grants it again and then stops the scheduler.
+type flakyElector struct {
+	stop context.CancelFunc
+}
+
+func (e flakyElector) Run(ctx context.Context, onChange func(leader bool), onError func(error)) {
+	onChange(true)
+	onChange(false)
+	onError(fmt.Errorf("connection reset"))
+	onChange(true)
+	e.stop()
+	<-ctx.Done()
+	onChange(false)
+}
+
+func TestScheduler_ShutdownTasksRunOnlyWhenStopping(t *testing.T) {
+	log := &logRecorder{}
+	var shutdowns atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewScheduler(flakyElector{stop: cancel}, log.logf)
+	s.Register(Job{
+		Name: "save",
+		Shutdown: func(context.Context) error {
+			shutdowns.Add(1)
+			return nil
+		},
+	})
+
+	s.Run(ctx)
+
+	assert.Equal(t, int64(1), shutdowns.Load())
+	assert.Equal(t, []string{
+		"Became leader, starting 1 background job(s)",
+		"Lost leadership, background jobs stopped",
+		"Leader election: connection reset",
+		"Became leader, starting 1 background job(s)",
+		"Stepped down as leader, background jobs stopped",
+	}, log.all())
+}
+
+func TestScheduler_FollowerSkipsShutdownTasks(t *testing.T) {
+	var lock sync.Mutex
+	lock.Lock()
+	defer lock.Unlock()
+
+	var shutdowns atomic.Int64
+	s := NewScheduler(NewLocal(&lock), nil)
+	s.Register(Job{Name: "save", Shutdown: func(context.Context) error {
+		shutdowns.Add(1)
+		return nil
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	assert.False(t, s.IsLeader())
+	assert.Zero(t, shutdowns.Load())
+}
+
+func TestScheduler_LogsJobErrors(t *testing.T) {
+	log := &logRecorder{}
+	s := NewScheduler(NewLocal(nil), log.logf)
+	s.Register(Job{
+		Name:     "broken",
+		Interval: 5 * time.Millisecond,
+		Run:      func(context.Context) error { return fmt.Errorf("disk full") },
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		for _, line := range log.all() {
+			if line == "Background job broken failed: disk full" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
+
+// TestPostgres_Failover runs against a real database. Set TEST_DATABASE_DSN to run it.
+func TestPostgres_Failover(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	pool, err := pgxpool.New(context.Background(), dsn)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	newElector := func() *Postgres {
+		e := NewPostgres(pool, DefaultLockKey+1)
+		e.RetryInterval = 20 * time.Millisecond
+		e.CheckInterval = 20 * time.Millisecond
+		return e
+	}
+	first := NewScheduler(newElector(), t.Logf)
+	second := NewScheduler(newElector(), t.Logf)
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		first.Run(firstCtx)
+		close(firstDone)
+	}()
+	require.Eventually(t, first.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	go second.Run(secondCtx)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, second.IsLeader(), "two leaders at once")
+	assert.Zero(t, pool.Stat().AcquireCount(), "retries use the elector's own connection, not the pool")
+
+	stopFirst()
+	<-firstDone
+	require.Eventually(t, second.IsLeader, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,55 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultLocalRetry is how often a Local elector retries to take the lock.
+const defaultLocalRetry = 100 * time.Millisecond
+
+// Local elects a leader among electors of one process that share a mutex.
+// With a private mutex the elector always wins, which suits single-node deployments.
+type Local struct {
+	lock  *sync.Mutex   // Lock held by the leader
+	retry time.Duration // Interval between attempts to take the lock
+}
+
+// NewLocal creates an in-process elector.
+//
+// Parameters:
+//   - lock: Mutex shared by competing electors (nil for a private one)
+//
+// Returns:
+//   - *Local: Elector that leads while holding the mutex
+func NewLocal(lock *sync.Mutex) *Local {
+	if lock == nil {
+		lock = &sync.Mutex{}
+	}
+	return &Local{lock: lock, retry: defaultLocalRetry}
+}
+
+// Run implements Elector. Leadership is held until ctx is canceled.
+//
+// Parameters:
+//   - ctx: Context that ends the campaign
+//   - onChange: Leadership change callback
+//   - onError: Unused; taking an in-process lock cannot fail
+func (e *Local) Run(ctx context.Context, onChange func(leader bool), onError func(error)) {
+	for {
+		if e.lock.TryLock() {
+			onChange(true)
+			<-ctx.Done()
+			onChange(false)
+			e.lock.Unlock()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.retry):
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultLockKey is the advisory lock key used by the metrics server.
+const DefaultLockKey int64 = 0x6d65747269637331 // "metrics1"
+
+// Default intervals of the Postgres elector.
+const (
+	defaultRetryInterval = 5 * time.Second
+	defaultCheckInterval = 2 * time.Second
+)
+
+// Postgres elects a leader with a session-level PostgreSQL advisory lock.
+// Each instance opens one dedicated connection, outside of the pool, and keeps it for
+// the whole campaign: followers retry the lock on it, the leader holds the lock on it.
+// If that connection breaks, the server releases the lock and another instance can
+// take it. Loss of the connection is detected within CheckInterval, so for a short
+// time two instances may both consider themselves leaders; jobs must tolerate that.
+type Postgres struct {
+	pool *pgxpool.Pool // Pool whose configuration the lock connection is opened with
+	key  int64         // Advisory lock key shared by all instances
+
+	RetryInterval time.Duration // Interval between attempts to take the lock
+	CheckInterval time.Duration // Interval between health checks of the lock connection
+}
+
+// NewPostgres creates an advisory-lock elector.
+//
+// Parameters:
+//   - pool: Connection pool of the shared database; the elector connects with its configuration
+//   - key: Advisory lock key; all competing instances must use the same key
+//
+// Returns:
+//   - *Postgres: Elector with default intervals
+func NewPostgres(pool *pgxpool.Pool, key int64) *Postgres {
+	return &Postgres{
+		pool:          pool,
+		key:           key,
+		RetryInterval: defaultRetryInterval,
+		CheckInterval: defaultCheckInterval,
+	}
+}
+
+// Run implements Elector. The lock connection is opened on the first attempt and
+// reused for all later ones; it is only replaced after it failed.
+//
+// Parameters:
+//   - ctx: Context that ends the campaign
+//   - onChange: Leadership change callback
+//   - onError: Callback for connection errors
+func (e *Postgres) Run(ctx context.Context, onChange func(leader bool), onError func(error)) {
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+
+	for {
+		var err error
+		if conn == nil {
+			conn, err = pgx.ConnectConfig(ctx, e.pool.Config().ConnConfig.Copy())
+			if err != nil {
+				conn = nil
+				err = fmt.Errorf("connect: %w", err)
+			}
+		}
+		if conn != nil {
+			err = e.campaign(ctx, conn, onChange)
+			if err != nil {
+				// The connection may be broken; open a new one for the next attempt
+				conn.Close(context.Background())
+				conn = nil
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.RetryInterval):
+		}
+	}
+}
+
+// campaign tries to take the lock once on the connection and, if successful, holds
+// it until ctx is canceled or the connection fails.
+//
+// Parameters:
+//   - ctx: Context that ends the campaign
+//   - conn: Dedicated lock connection
+//   - onChange: Leadership change callback
+//
+// Returns:
+//   - error: Error that interrupted the attempt or the leadership
+func (e *Postgres) campaign(ctx context.Context, conn *pgx.Conn, onChange func(leader bool)) error {
+	var acquired bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, e.key).Scan(&acquired); err != nil {
+		return fmt.Errorf("try advisory lock: %w", err)
+	}
+	if !acquired {
+		return nil
+	}
+
+	onChange(true)
+	err := e.hold(ctx, conn)
+	onChange(false)
+
+	if ctx.Err() != nil {
+		// Release explicitly so that another instance can take over without waiting
+		// for the connection to close
+		unlockCtx, cancel := context.WithTimeout(context.Background(), e.CheckInterval)
+		defer cancel()
+		conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, e.key)
+		return nil
+	}
+	return err
+}
+
+// hold checks the lock connection until ctx is canceled or the connection fails.
+//
+// Parameters:
+//   - ctx: Context that ends the leadership
+//   - conn: Connection holding the lock
+//
+// Returns:
+//   - error: Connection error, or nil when ctx was canceled
+func (e *Postgres) hold(ctx context.Context, conn *pgx.Conn) error {
+	ticker := time.NewTicker(e.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, e.CheckInterval)
+			err := conn.Ping(pingCtx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				return fmt.Errorf("lost advisory lock connection: %w", err)
+			}
+		}
+	}
+}
@@ -17,5 +17,63 @@ func (s *Metrics) Reset() {
 	if s.Value != nil {
 		*s.Value = 0
 	}
+	if s.Histogram != nil {
+		if resetter, ok := interface{}(s.Histogram).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field Histogram
+		}
+	}
+	if s.Summary != nil {
+		if resetter, ok := interface{}(s.Summary).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field Summary
+		}
+	}
+	s.Temporality = ""
+	if s.Meta != nil {
+		if resetter, ok := interface{}(s.Meta).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field Meta
+		}
+	}
 	s.Hash = ""
 }
+
+// Reset resets the Metadata struct to its zero state.
+func (s *Metadata) Reset() {
+	if s == nil {
+		return
+	}
+
+	s.ID = ""
+	s.MType = ""
+	s.Description = ""
+	s.Unit = ""
+	s.Owner = ""
+}
+
+// Reset resets the Histogram struct to its zero state.
+func (s *Histogram) Reset() {
+	if s == nil {
+		return
+	}
+
+	s.Bounds = s.Bounds[:0]
+	s.Counts = s.Counts[:0]
+	s.Count = 0
+	s.Sum = 0
+}
+
+// Reset resets the Summary struct to its zero state.
+func (s *Summary) Reset() {
+	if s == nil {
+		return
+	}
+
+	s.Count = 0
+	s.Sum = 0
+	s.Quantiles = s.Quantiles[:0]
+}
@@ -0,0 +1,111 @@
+// Package ratelimit provides token-bucket rate limiting keyed by an arbitrary client identifier,
+// such as a client IP address or an API token name.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepEvery is the number of Allow calls between sweeps of idle buckets.
+const sweepEvery = 1024
+
+// bucket holds the token-bucket state of a single client.
+type bucket struct {
+	tokens float64   // Tokens available at the time of the last update
+	last   time.Time // Time of the last update
+}
+
+// Limiter is a set of token buckets, one per key. Every bucket holds up to burst tokens
+// and is refilled at rate tokens per second; each request consumes one token.
+//
+// Example usage:
+//
+//	limiter := ratelimit.New(10, 20) // 10 requests per second, bursts of up to 20
+//	if ok, retryAfter := limiter.Allow(clientIP); !ok {
+//		// reject the request and ask the client to retry after retryAfter
+//	}
+type Limiter struct {
+	rate    float64            // Refill rate in tokens per second
+	burst   float64            // Bucket capacity
+	buckets map[string]*bucket // Bucket per key
+	calls   int                // Calls since the last sweep
+	now     func() time.Time   // Clock, replaceable in tests
+	mu      sync.Mutex         // Protects buckets and calls
+}
+
+// New creates a limiter that allows rate requests per second per key with bursts of up to burst requests.
+// A burst below 1 is raised to 1 so that at least one request can ever pass.
+//
+// Parameters:
+//   - rate: Sustained number of requests per second per key (must be positive)
+//   - burst: Maximum number of requests allowed at once
+//
+// Returns:
+//   - *Limiter: Ready-to-use limiter
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow consumes a token from the key's bucket.
+//
+// Parameters:
+//   - key: Client identifier
+//
+// Returns:
+//   - bool: true if the request is allowed
+//   - time.Duration: When the request is rejected, how long until a token becomes available
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	// Refill for the time elapsed since the last request
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	missing := 1 - b.tokens
+	return false, time.Duration(missing / l.rate * float64(time.Second))
+}
+
+// sweep periodically removes buckets that have refilled completely,
+// since a new bucket for the same key would be in the same state.
+// Must be called with l.mu held.
+func (l *Limiter) sweep(now time.Time) {
+	l.calls++
+	if l.calls < sweepEvery {
+		return
+	}
+	l.calls = 0
+
+	fullAfter := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= fullAfter {
+			delete(l.buckets, key)
+		}
+	}
+}
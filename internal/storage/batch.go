@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// ErrInvalidMetric is returned for batch items with an unknown type or a missing value.
+var ErrInvalidMetric = errors.New("invalid metric")
+
+// ErrCounterOverflow is returned when an increment would take a counter outside
+// the int64 range. The counter keeps its previous value.
+var ErrCounterOverflow = errors.New("counter overflow")
+
+// AddCounter adds delta to a counter value without wrapping around.
+//
+// Parameters:
+//   - value: Current counter value
+//   - delta: Amount to add (can be negative)
+//
+// Returns:
+//   - int64: The sum, or value unchanged on overflow
+//   - error: Error wrapping ErrCounterOverflow if the sum does not fit into int64
+func AddCounter(value, delta int64) (int64, error) {
+	sum := value + delta
+	if (delta > 0 && sum < value) || (delta < 0 && sum > value) {
+		return value, fmt.Errorf("%w: %d%+d", ErrCounterOverflow, value, delta)
+	}
+	return sum, nil
+}
+
+// BatchItemError describes why a single item of a batch could not be applied.
+type BatchItemError struct {
+	Index int    // Position of the item in the batch
+	ID    string // Metric name
+	MType string // Metric type
+	Err   error  // Cause of the failure
+}
+
+// Error implements the error interface for BatchItemError.
+func (e BatchItemError) Error() string {
+	return fmt.Sprintf("item %d (%s %s): %v", e.Index, e.MType, e.ID, e.Err)
+}
+
+// Unwrap returns the cause of the failure.
+func (e BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by UpdateBatch when any item of the batch fails.
+// The batch is applied atomically, so when a BatchError is returned no item has been stored.
+type BatchError struct {
+	Items []BatchItemError // Items that failed, in batch order
+}
+
+// Error implements the error interface for BatchError.
+func (e *BatchError) Error() string {
+	parts := make([]string, len(e.Items))
+	for i, item := range e.Items {
+		parts[i] = item.Error()
+	}
+	return fmt.Sprintf("batch rejected, %d item(s) failed: %s", len(e.Items), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the causes of all failed items, so that errors.Is can find
+// sentinel errors such as ErrQuotaExceeded.
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Items))
+	for i, item := range e.Items {
+		errs[i] = item
+	}
+	return errs
+}
+
+// ValidateBatch checks a batch as received from a client: every item needs an ID,
+// a known type with exactly the matching value field and, for histograms and
+// summaries, a well-formed distribution. Counters may carry cumulative totals,
+// which a CumulativeTracker turns into increments before they are stored.
+//
+// Parameters:
+//   - batch: Metrics to validate
+//
+// Returns:
+//   - error: *BatchError listing invalid items, or nil if all items are valid
+func ValidateBatch(batch []metrics.Metrics) error {
+	return checkBatch(batch, true)
+}
+
+// validateBatch checks a batch before it is stored. Unlike ValidateBatch it rejects
+// cumulative samples, which must go through a CumulativeTracker first.
+//
+// Parameters:
+//   - batch: Metrics to validate
+//
+// Returns:
+//   - error: *BatchError listing invalid items, or nil if all items are valid
+func validateBatch(batch []metrics.Metrics) error {
+	return checkBatch(batch, false)
+}
+
+// checkBatch validates every item of a batch with validateMetric.
+//
+// Parameters:
+//   - batch: Metrics to validate
+//   - cumulative: Whether counters may carry cumulative totals
+//
+// Returns:
+//   - error: *BatchError listing invalid items, or nil if all items are valid
+func checkBatch(batch []metrics.Metrics, cumulative bool) error {
+	var failed []BatchItemError
+	for i, m := range batch {
+		if err := validateMetric(m, cumulative); err != nil {
+			failed = append(failed, BatchItemError{Index: i, ID: m.ID, MType: m.MType, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Items: failed}
+	}
+	return nil
+}
+
+// validateMetric checks that a metric has an ID, a known type, exactly the value
+// field of its type, a valid temporality and a well-formed histogram or summary.
+//
+// Parameters:
+//   - m: Metric to validate
+//   - cumulative: Whether a counter may carry a cumulative total
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric, or nil if the metric is valid
+func validateMetric(m metrics.Metrics, cumulative bool) error {
+	if m.ID == "" {
+		return fmt.Errorf("%w: missing id", ErrInvalidMetric)
+	}
+	var err error
+	switch m.MType {
+	case "gauge":
+		switch {
+		case m.Value == nil:
+			err = fmt.Errorf("%w: missing value for gauge", ErrInvalidMetric)
+		case m.Delta != nil || m.Histogram != nil || m.Summary != nil:
+			err = fmt.Errorf("%w: unexpected fields for gauge, only value is allowed", ErrInvalidMetric)
+		}
+	case "counter":
+		switch {
+		case m.Delta == nil:
+			err = fmt.Errorf("%w: missing delta for counter", ErrInvalidMetric)
+		case m.Value != nil || m.Histogram != nil || m.Summary != nil:
+			err = fmt.Errorf("%w: unexpected fields for counter, only delta is allowed", ErrInvalidMetric)
+		}
+	case "histogram":
+		switch {
+		case m.Histogram == nil:
+			err = fmt.Errorf("%w: missing histogram", ErrInvalidMetric)
+		case m.Value != nil || m.Delta != nil || m.Summary != nil:
+			err = fmt.Errorf("%w: unexpected fields for histogram, only histogram is allowed", ErrInvalidMetric)
+		}
+	case "summary":
+		switch {
+		case m.Summary == nil:
+			err = fmt.Errorf("%w: missing summary", ErrInvalidMetric)
+		case m.Value != nil || m.Delta != nil || m.Histogram != nil:
+			err = fmt.Errorf("%w: unexpected fields for summary, only summary is allowed", ErrInvalidMetric)
+		}
+	default:
+		err = fmt.Errorf("%w: unknown type %q", ErrInvalidMetric, m.MType)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch m.Temporality {
+	case "", metrics.TemporalityDelta:
+	case metrics.TemporalityCumulative:
+		switch {
+		case !cumulative:
+			// Cumulative samples must go through a CumulativeTracker first
+			return fmt.Errorf("%w: cannot store %q samples directly", ErrInvalidMetric, m.Temporality)
+		case m.MType != "counter":
+			return fmt.Errorf("%w: only counters can be cumulative", ErrInvalidMetric)
+		case *m.Delta < 0:
+			return fmt.Errorf("%w: cumulative total must not be negative", ErrInvalidMetric)
+		}
+	default:
+		return fmt.Errorf("%w: unknown temporality %q", ErrInvalidMetric, m.Temporality)
+	}
+
+	switch m.MType {
+	case "histogram":
+		return ValidateHistogram(*m.Histogram)
+	case "summary":
+		return ValidateSummary(*m.Summary)
+	}
+	return nil
+}
+
+// checkCounters checks that no counter of a validated batch overflows when the
+// batch is applied in order on top of the current values.
+//
+// Parameters:
+//   - batch: Validated metrics to check
+//   - current: Returns the stored value of a counter (0 if it does not exist)
+//
+// Returns:
+//   - error: *BatchError listing the items that overflow, or nil
+func checkCounters(batch []metrics.Metrics, current func(name string) int64) error {
+	var failed []BatchItemError
+	sums := make(map[string]int64)
+	for i, m := range batch {
+		if m.MType != "counter" {
+			continue
+		}
+		sum, seen := sums[m.ID]
+		if !seen {
+			sum = current(m.ID)
+		}
+		next, err := AddCounter(sum, *m.Delta)
+		if err != nil {
+			failed = append(failed, BatchItemError{Index: i, ID: m.ID, MType: m.MType, Err: err})
+		}
+		sums[m.ID] = next
+	}
+	if len(failed) > 0 {
+		return &BatchError{Items: failed}
+	}
+	return nil
+}
+
+// prevValue is the value of a series before a batch was applied.
+type prevValue[T any] struct {
+	value  T    // Previous value
+	exists bool // Whether the series existed
+}
+
+// remember records the value of a series before its first change by a batch.
+//
+// Parameters:
+//   - m: Map holding the series of one type
+//   - prev: Previous values recorded so far
+//   - name: Metric name
+func remember[T any](m map[string]T, prev map[string]prevValue[T], name string) {
+	if _, seen := prev[name]; !seen {
+		v, ok := m[name]
+		prev[name] = prevValue[T]{value: v, exists: ok}
+	}
+}
+
+// restore resets the series of one type to their values before a batch.
+//
+// Parameters:
+//   - m: Map holding the series of one type
+//   - prev: Values recorded by remember
+func restore[T any](m map[string]T, prev map[string]prevValue[T]) {
+	for name, p := range prev {
+		if p.exists {
+			m[name] = p.value
+		} else {
+			delete(m, name)
+		}
+	}
+}
+
+// applyBatch applies a validated and checked batch to the maps and returns a function that
+// restores the previous values of all touched series.
+// Must be called with s.mu held for writing.
+//
+// Parameters:
+//   - batch: Validated metrics to apply
+//
+// Returns:
+//   - func(): Undo function; must also be called with s.mu held
+func (s *MemStorage) applyBatch(batch []metrics.Metrics) func() {
+	gauges := make(map[string]prevValue[float64])
+	counters := make(map[string]prevValue[int64])
+	histograms := make(map[string]prevValue[metrics.Histogram])
+	summaries := make(map[string]prevValue[metrics.Summary])
+
+	for _, m := range batch {
+		switch m.MType {
+		case "gauge":
+			remember(s.gauge, gauges, m.ID)
+			s.gauge[m.ID] = *m.Value
+		case "counter":
+			remember(s.counter, counters, m.ID)
+			s.counter[m.ID] += *m.Delta
+		case "histogram":
+			remember(s.histogram, histograms, m.ID)
+			v, ok := s.histogram[m.ID]
+			// Merges cannot fail here, the batch was checked by checkDistributions
+			s.histogram[m.ID], _ = mergeHistogramInto(v, ok, *m.Histogram)
+		case "summary":
+			remember(s.summary, summaries, m.ID)
+			v, ok := s.summary[m.ID]
+			s.summary[m.ID], _ = mergeSummaryInto(v, ok, *m.Summary)
+		}
+	}
+
+	return func() {
+		restore(s.gauge, gauges)
+		restore(s.counter, counters)
+		restore(s.histogram, histograms)
+		restore(s.summary, summaries)
+	}
+}
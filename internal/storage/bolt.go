@@ -0,0 +1,818 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// boltLockTimeout is how long opening a database waits for the file lock held by
+// another process before giving up.
+const boltLockTimeout = 5 * time.Second
+
+// Bucket names of the bolt database. The default tenant keeps its series in the
+// top-level gauge, counter, histogram and summary buckets and its metadata in the
+// metadata bucket; every other tenant has a bucket of the same layout below the
+// tenants bucket.
+var (
+	boltGaugeBucket     = []byte("gauge")
+	boltCounterBucket   = []byte("counter")
+	boltHistogramBucket = []byte("histogram")
+	boltSummaryBucket   = []byte("summary")
+	boltMetadataBucket  = []byte("metadata")
+	boltTenantsBucket   = []byte("tenants")
+)
+
+// BoltStorage implements the Storage interface on an embedded bbolt key-value file.
+// It needs neither a database server nor a rewrite of the whole data set on save:
+// every write is a bbolt transaction that is fsynced on commit, and bbolt's
+// copy-on-write pages leave the file consistent if the process crashes mid-write.
+//
+// Series are kept in one bucket per metric type, keyed by metric name. Gauge and
+// counter values are encoded as 8 big-endian bytes, histograms and summaries as JSON.
+// Metadata is kept as JSON in a metadata bucket keyed by metric name, and type
+// checks run in the same transaction as the write.
+// Reads run in read-only transactions on the memory-mapped file, so there is no
+// separate cache to keep coherent.
+//
+// The file is locked while open; a second process opening the same file fails
+// after boltLockTimeout.
+//
+// generate:reset
+type BoltStorage struct {
+	db     *bolt.DB // Open bbolt database
+	ownsDB bool     // Whether Close closes the database
+	tenant string   // Tenant whose buckets this instance reads and writes
+}
+
+// NewBoltStorage opens or creates the bbolt database at path.
+//
+// Parameters:
+//   - path: Database file path (e.g., "/var/lib/metrics/metrics.db")
+//
+// Returns:
+//   - *BoltStorage: Storage of the default tenant; Close closes the database
+//   - error: Any error opening the file or creating the buckets
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt database: %w", err)
+	}
+
+	s := &BoltStorage{db: db, ownsDB: true, tenant: DefaultTenant}
+	if err := s.createBuckets(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewTenantBoltStorage creates a BoltStorage that only sees the series of the given
+// tenant. It shares the database file of parent; closing the tenant storage leaves
+// the database open.
+//
+// Parameters:
+//   - parent: Storage owning the database
+//   - tenant: Tenant identifier
+//
+// Returns:
+//   - *BoltStorage: Storage scoped to the tenant
+//   - error: Any error creating the tenant's buckets
+func NewTenantBoltStorage(parent *BoltStorage, tenant string) (*BoltStorage, error) {
+	s := &BoltStorage{db: parent.db, tenant: tenant}
+	if err := s.createBuckets(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createBuckets creates the series and metadata buckets of the tenant if they are
+// missing. Databases created by older versions get the newer buckets here.
+//
+// Returns:
+//   - error: Any error in the write transaction
+func (s *BoltStorage) createBuckets() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		parent, err := s.tenantRoot(tx, true)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltGaugeBucket, boltCounterBucket, boltHistogramBucket, boltSummaryBucket, boltMetadataBucket} {
+			if _, err := parent.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("create bolt buckets: %w", err)
+	}
+	return nil
+}
+
+// boltParent is the common part of bolt.Tx and bolt.Bucket used to reach the
+// buckets of a tenant.
+type boltParent interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+}
+
+// tenantRoot returns the bucket holding the tenant's series and metadata buckets.
+//
+// Parameters:
+//   - tx: Transaction
+//   - create: Whether to create missing buckets (requires a writable transaction)
+//
+// Returns:
+//   - boltParent: The transaction itself for the default tenant, otherwise the tenant's bucket
+//   - error: Any error creating buckets
+func (s *BoltStorage) tenantRoot(tx *bolt.Tx, create bool) (boltParent, error) {
+	if s.tenant == DefaultTenant {
+		return tx, nil
+	}
+	if create {
+		tenants, err := tx.CreateBucketIfNotExists(boltTenantsBucket)
+		if err != nil {
+			return nil, err
+		}
+		return tenants.CreateBucketIfNotExists([]byte(s.tenant))
+	}
+	tenants := tx.Bucket(boltTenantsBucket)
+	if tenants == nil {
+		return nil, errors.New("bolt tenants bucket missing")
+	}
+	root := tenants.Bucket([]byte(s.tenant))
+	if root == nil {
+		return nil, fmt.Errorf("bolt bucket of tenant %q missing", s.tenant)
+	}
+	return root, nil
+}
+
+// boltBuckets are the buckets of a tenant within one transaction.
+type boltBuckets struct {
+	gauges     *bolt.Bucket // Gauge values by metric name
+	counters   *bolt.Bucket // Counter values by metric name
+	histograms *bolt.Bucket // JSON-encoded metrics.Histogram by metric name
+	summaries  *bolt.Bucket // JSON-encoded metrics.Summary by metric name
+	metadata   *bolt.Bucket // JSON-encoded metrics.Metadata by metric name
+}
+
+// buckets returns the buckets of the tenant.
+//
+// Parameters:
+//   - tx: Transaction
+//
+// Returns:
+//   - boltBuckets: Series and metadata buckets
+//   - error: Error if the buckets do not exist
+func (s *BoltStorage) buckets(tx *bolt.Tx) (boltBuckets, error) {
+	root, err := s.tenantRoot(tx, false)
+	if err != nil {
+		return boltBuckets{}, err
+	}
+	b := boltBuckets{
+		gauges:     root.Bucket(boltGaugeBucket),
+		counters:   root.Bucket(boltCounterBucket),
+		histograms: root.Bucket(boltHistogramBucket),
+		summaries:  root.Bucket(boltSummaryBucket),
+		metadata:   root.Bucket(boltMetadataBucket),
+	}
+	if b.gauges == nil || b.counters == nil || b.histograms == nil || b.summaries == nil || b.metadata == nil {
+		return boltBuckets{}, errors.New("bolt metric buckets missing")
+	}
+	return b, nil
+}
+
+// series returns the bucket holding the series of a metric type.
+//
+// Parameters:
+//   - mtype: Metric type
+//
+// Returns:
+//   - *bolt.Bucket: Bucket of the type, or nil for an unknown type
+func (b boltBuckets) series(mtype string) *bolt.Bucket {
+	switch mtype {
+	case "gauge":
+		return b.gauges
+	case "counter":
+		return b.counters
+	case "histogram":
+		return b.histograms
+	case "summary":
+		return b.summaries
+	}
+	return nil
+}
+
+// histogram reads a stored histogram.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Histogram: Stored histogram
+//   - bool: true if the histogram exists and could be decoded
+func (b boltBuckets) histogram(name string) (metrics.Histogram, bool) {
+	var h metrics.Histogram
+	v := b.histograms.Get([]byte(name))
+	if v == nil || json.Unmarshal(v, &h) != nil {
+		return metrics.Histogram{}, false
+	}
+	return h, true
+}
+
+// summary reads a stored summary.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Summary: Stored summary
+//   - bool: true if the summary exists and could be decoded
+func (b boltBuckets) summary(name string) (metrics.Summary, bool) {
+	var sm metrics.Summary
+	v := b.summaries.Get([]byte(name))
+	if v == nil || json.Unmarshal(v, &sm) != nil {
+		return metrics.Summary{}, false
+	}
+	return sm, true
+}
+
+// mergeHistogram merges a histogram into the stored one.
+//
+// Parameters:
+//   - name: Metric name
+//   - h: Validated observations to add
+//
+// Returns:
+//   - error: Error wrapping ErrBucketMismatch or ErrCounterOverflow if the histogram
+//     cannot be merged, or any error writing the value
+func (b boltBuckets) mergeHistogram(name string, h metrics.Histogram) error {
+	cur, ok := b.histogram(name)
+	merged, err := mergeHistogramInto(cur, ok, h)
+	if err != nil {
+		return fmt.Errorf("histogram %s: %w", name, err)
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("encode histogram %s: %w", name, err)
+	}
+	return b.histograms.Put([]byte(name), data)
+}
+
+// mergeSummary merges a summary into the stored one.
+//
+// Parameters:
+//   - name: Metric name
+//   - sm: Validated summary of the new observations
+//
+// Returns:
+//   - error: Error wrapping ErrCounterOverflow if the count would overflow,
+//     or any error writing the value
+func (b boltBuckets) mergeSummary(name string, sm metrics.Summary) error {
+	cur, ok := b.summary(name)
+	merged, err := mergeSummaryInto(cur, ok, sm)
+	if err != nil {
+		return fmt.Errorf("summary %s: %w", name, err)
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("encode summary %s: %w", name, err)
+	}
+	return b.summaries.Put([]byte(name), data)
+}
+
+// registeredType returns the type registered for a metric in the metadata bucket.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - string: Registered type, or "" if the metric has no (readable) metadata
+func (b boltBuckets) registeredType(name string) string {
+	md, ok := decodeBoltMetadata(b.metadata.Get([]byte(name)))
+	if !ok {
+		return ""
+	}
+	return md.MType
+}
+
+// decodeBoltMetadata decodes metadata stored in the metadata bucket.
+//
+// Parameters:
+//   - v: Stored value (nil if the key does not exist)
+//
+// Returns:
+//   - metrics.Metadata: Decoded metadata
+//   - bool: true if v holds valid metadata
+func decodeBoltMetadata(v []byte) (metrics.Metadata, bool) {
+	var md metrics.Metadata
+	if v == nil || json.Unmarshal(v, &md) != nil {
+		return metrics.Metadata{}, false
+	}
+	return md, true
+}
+
+// encodeBoltGauge encodes a gauge value as its IEEE 754 bits in big-endian order.
+func encodeBoltGauge(v float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+}
+
+// decodeBoltGauge decodes a value written by encodeBoltGauge.
+func decodeBoltGauge(b []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+// encodeBoltCounter encodes a counter value in big-endian order.
+func encodeBoltCounter(v int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(v))
+}
+
+// decodeBoltCounter decodes a value written by encodeBoltCounter.
+func decodeBoltCounter(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// update runs fn in a write transaction on the tenant's buckets. The transaction is
+// committed and fsynced if fn succeeds and rolled back otherwise.
+//
+// Parameters:
+//   - fn: Function applying the writes
+//
+// Returns:
+//   - error: Error returned by fn or by the commit
+func (s *BoltStorage) update(fn func(b boltBuckets) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.buckets(tx)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// view runs fn in a read-only transaction on the tenant's buckets.
+//
+// Parameters:
+//   - fn: Function reading the buckets
+//
+// Returns:
+//   - error: Error returned by fn or by opening the transaction
+func (s *BoltStorage) view(fn func(b boltBuckets) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.buckets(tx)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// addBoltCounter increments a counter in the bucket.
+//
+// Parameters:
+//   - counters: Counter bucket of a writable transaction
+//   - name: Metric name
+//   - delta: Amount to add
+//
+// Returns:
+//   - error: Error wrapping ErrCounterOverflow if the counter would overflow,
+//     or any error writing the value
+func addBoltCounter(counters *bolt.Bucket, name string, delta int64) error {
+	key := []byte(name)
+	value, err := AddCounter(boltCounter(counters, name), delta)
+	if err != nil {
+		return fmt.Errorf("counter %s: %w", name, err)
+	}
+	return counters.Put(key, encodeBoltCounter(value))
+}
+
+// boltCounter reads a counter from the bucket.
+//
+// Parameters:
+//   - counters: Counter bucket
+//   - name: Metric name
+//
+// Returns:
+//   - int64: Stored value, or 0 if the counter does not exist
+func boltCounter(counters *bolt.Bucket, name string) int64 {
+	if v := counters.Get([]byte(name)); v != nil {
+		return decodeBoltCounter(v)
+	}
+	return 0
+}
+
+// UpdateGauge sets a gauge metric in a single transaction.
+//
+// Parameters:
+//   - name: Metric name
+//   - value: New gauge value
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a counter,
+//     or any error committing the transaction
+func (s *BoltStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return s.update(func(b boltBuckets) error {
+		if err := checkType(name, b.registeredType(name), "gauge"); err != nil {
+			return err
+		}
+		return b.gauges.Put([]byte(name), encodeBoltGauge(value))
+	})
+}
+
+// UpdateCounter increments a counter metric in a single transaction.
+//
+// Parameters:
+//   - name: Metric name
+//   - delta: Amount to increment by
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge,
+//     ErrCounterOverflow if the counter would overflow, or any error committing the
+//     transaction
+func (s *BoltStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
+	return s.update(func(b boltBuckets) error {
+		if err := checkType(name, b.registeredType(name), "counter"); err != nil {
+			return err
+		}
+		return addBoltCounter(b.counters, name, delta)
+	})
+}
+
+// SetCounter sets a counter metric to an absolute value in a single transaction.
+//
+// Parameters:
+//   - name: Metric name
+//   - value: New absolute value
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge,
+//     or any error committing the transaction
+func (s *BoltStorage) SetCounter(ctx context.Context, name string, value int64) error {
+	return s.update(func(b boltBuckets) error {
+		if err := checkType(name, b.registeredType(name), "counter"); err != nil {
+			return err
+		}
+		return b.counters.Put([]byte(name), encodeBoltCounter(value))
+	})
+}
+
+// UpdateHistogram merges a histogram into the stored one in a single transaction.
+//
+// Parameters:
+//   - name: Metric name
+//   - h: Observations to add
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the histogram is invalid, ErrTypeConflict
+//     if the metric is registered with another type, ErrBucketMismatch if the stored
+//     histogram has other bounds, ErrCounterOverflow if a count would overflow, or any
+//     error committing the transaction
+func (s *BoltStorage) UpdateHistogram(ctx context.Context, name string, h metrics.Histogram) error {
+	if err := ValidateHistogram(h); err != nil {
+		return err
+	}
+	return s.update(func(b boltBuckets) error {
+		if err := checkType(name, b.registeredType(name), "histogram"); err != nil {
+			return err
+		}
+		return b.mergeHistogram(name, h)
+	})
+}
+
+// UpdateSummary merges a summary into the stored one in a single transaction.
+//
+// Parameters:
+//   - name: Metric name
+//   - sm: Summary of the new observations
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the summary is invalid, ErrTypeConflict
+//     if the metric is registered with another type, ErrCounterOverflow if the count
+//     would overflow, or any error committing the transaction
+func (s *BoltStorage) UpdateSummary(ctx context.Context, name string, sm metrics.Summary) error {
+	if err := ValidateSummary(sm); err != nil {
+		return err
+	}
+	return s.update(func(b boltBuckets) error {
+		if err := checkType(name, b.registeredType(name), "summary"); err != nil {
+			return err
+		}
+		return b.mergeSummary(name, sm)
+	})
+}
+
+// UpdateBatch applies a batch of updates in a single transaction, so the batch is
+// committed completely or not at all, including after a crash.
+//
+// Parameters:
+//   - batch: Metrics to apply
+//
+// Returns:
+//   - error: *BatchError if any item is invalid, conflicts with its registered type,
+//     a counter would overflow or a histogram has other bounds, or any error
+//     committing the transaction
+func (s *BoltStorage) UpdateBatch(ctx context.Context, batch []metrics.Metrics) error {
+	if err := validateBatch(batch); err != nil {
+		return err
+	}
+	return s.update(func(b boltBuckets) error {
+		if err := checkTypes(batch, b.registeredType); err != nil {
+			return err
+		}
+		current := func(name string) int64 { return boltCounter(b.counters, name) }
+		if err := checkCounters(batch, current); err != nil {
+			return err
+		}
+		if err := checkDistributions(batch, b.histogram, b.summary); err != nil {
+			return err
+		}
+		for _, m := range batch {
+			var err error
+			switch m.MType {
+			case "gauge":
+				err = b.gauges.Put([]byte(m.ID), encodeBoltGauge(*m.Value))
+			case "counter":
+				err = addBoltCounter(b.counters, m.ID, *m.Delta)
+			case "histogram":
+				err = b.mergeHistogram(m.ID, *m.Histogram)
+			case "summary":
+				err = b.mergeSummary(m.ID, *m.Summary)
+			}
+			if err != nil {
+				return fmt.Errorf("write %s %s: %w", m.MType, m.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetGauge retrieves the current value of a gauge metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - float64: The current value of the gauge metric
+//   - bool: true if the metric exists, false otherwise
+func (s *BoltStorage) GetGauge(name string) (float64, bool) {
+	var value float64
+	var ok bool
+	s.view(func(b boltBuckets) error {
+		if v := b.gauges.Get([]byte(name)); v != nil {
+			value, ok = decodeBoltGauge(v), true
+		}
+		return nil
+	})
+	return value, ok
+}
+
+// GetCounter retrieves the current value of a counter metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - int64: The current value of the counter metric
+//   - bool: true if the metric exists, false otherwise
+func (s *BoltStorage) GetCounter(name string) (int64, bool) {
+	var value int64
+	var ok bool
+	s.view(func(b boltBuckets) error {
+		if v := b.counters.Get([]byte(name)); v != nil {
+			value, ok = decodeBoltCounter(v), true
+		}
+		return nil
+	})
+	return value, ok
+}
+
+// GetHistogram retrieves the merged histogram of a metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Histogram: The stored histogram
+//   - bool: true if the metric exists, false otherwise
+func (s *BoltStorage) GetHistogram(name string) (metrics.Histogram, bool) {
+	var h metrics.Histogram
+	var ok bool
+	s.view(func(b boltBuckets) error {
+		h, ok = b.histogram(name)
+		return nil
+	})
+	return h, ok
+}
+
+// GetSummary retrieves the merged summary of a metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Summary: The stored summary
+//   - bool: true if the metric exists, false otherwise
+func (s *BoltStorage) GetSummary(name string) (metrics.Summary, bool) {
+	var sm metrics.Summary
+	var ok bool
+	s.view(func(b boltBuckets) error {
+		sm, ok = b.summary(name)
+		return nil
+	})
+	return sm, ok
+}
+
+// DeleteGauge removes a gauge metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error committing the transaction
+func (s *BoltStorage) DeleteGauge(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries("gauge", name)
+}
+
+// DeleteCounter removes a counter metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error committing the transaction
+func (s *BoltStorage) DeleteCounter(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries("counter", name)
+}
+
+// DeleteHistogram removes a histogram metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error committing the transaction
+func (s *BoltStorage) DeleteHistogram(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries("histogram", name)
+}
+
+// DeleteSummary removes a summary metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error committing the transaction
+func (s *BoltStorage) DeleteSummary(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries("summary", name)
+}
+
+// deleteSeries removes a series in a single transaction.
+//
+// Parameters:
+//   - mtype: Metric type
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error committing the transaction
+func (s *BoltStorage) deleteSeries(mtype, name string) (bool, error) {
+	var existed bool
+	err := s.update(func(b boltBuckets) error {
+		bucket := b.series(mtype)
+		existed = bucket.Get([]byte(name)) != nil
+		return bucket.Delete([]byte(name))
+	})
+	return existed && err == nil, err
+}
+
+// GetAll returns all metrics of the tenant from a consistent read-only snapshot.
+//
+// Returns:
+//   - []metrics.Metrics: All gauges, counters, histograms and summaries in this order,
+//     each sorted by name
+//   - error: Any error reading the database or decoding a stored distribution
+func (s *BoltStorage) GetAll() ([]metrics.Metrics, error) {
+	var out []metrics.Metrics
+	err := s.view(func(b boltBuckets) error {
+		b.gauges.ForEach(func(k, v []byte) error {
+			value := decodeBoltGauge(v)
+			out = append(out, metrics.Metrics{ID: string(k), MType: "gauge", Value: &value})
+			return nil
+		})
+		b.counters.ForEach(func(k, v []byte) error {
+			delta := decodeBoltCounter(v)
+			out = append(out, metrics.Metrics{ID: string(k), MType: "counter", Delta: &delta})
+			return nil
+		})
+		err := b.histograms.ForEach(func(k, v []byte) error {
+			var h metrics.Histogram
+			if err := json.Unmarshal(v, &h); err != nil {
+				return fmt.Errorf("decode histogram %s: %w", k, err)
+			}
+			out = append(out, metrics.Metrics{ID: string(k), MType: "histogram", Histogram: &h})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return b.summaries.ForEach(func(k, v []byte) error {
+			var sm metrics.Summary
+			if err := json.Unmarshal(v, &sm); err != nil {
+				return fmt.Errorf("decode summary %s: %w", k, err)
+			}
+			out = append(out, metrics.Metrics{ID: string(k), MType: "summary", Summary: &sm})
+			return nil
+		})
+	})
+	return out, err
+}
+
+// SetMetadata registers the metadata of a metric in a single transaction.
+//
+// Parameters:
+//   - md: Metadata to register
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the metadata is invalid,
+//     ErrTypeConflict if a series of another type is stored under its name,
+//     or any error committing the transaction
+func (s *BoltStorage) SetMetadata(ctx context.Context, md metrics.Metadata) error {
+	if err := ValidateMetadata(md); err != nil {
+		return err
+	}
+	data, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("encode metadata %s: %w", md.ID, err)
+	}
+	return s.update(func(b boltBuckets) error {
+		for _, mtype := range metricTypes {
+			if mtype != md.MType && b.series(mtype).Get([]byte(md.ID)) != nil {
+				return seriesConflict(md, mtype)
+			}
+		}
+		return b.metadata.Put([]byte(md.ID), data)
+	})
+}
+
+// GetMetadata retrieves the metadata registered for a metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Metadata: Registered metadata
+//   - bool: true if metadata is registered, false otherwise
+func (s *BoltStorage) GetMetadata(name string) (metrics.Metadata, bool) {
+	var md metrics.Metadata
+	var ok bool
+	s.view(func(b boltBuckets) error {
+		md, ok = decodeBoltMetadata(b.metadata.Get([]byte(name)))
+		return nil
+	})
+	return md, ok
+}
+
+// AllMetadata returns the metadata of all documented metrics of the tenant.
+//
+// Returns:
+//   - []metrics.Metadata: Registered metadata sorted by metric name
+//   - error: Any error reading the database or decoding a value
+func (s *BoltStorage) AllMetadata() ([]metrics.Metadata, error) {
+	var out []metrics.Metadata
+	err := s.view(func(b boltBuckets) error {
+		return b.metadata.ForEach(func(k, v []byte) error {
+			var md metrics.Metadata
+			if err := json.Unmarshal(v, &md); err != nil {
+				return fmt.Errorf("decode metadata %s: %w", k, err)
+			}
+			out = append(out, md)
+			return nil
+		})
+	})
+	// Keys are already in byte order
+	return out, err
+}
+
+// Close closes the database if this storage opened it.
+//
+// Returns:
+//   - error: Any error closing the database
+func (s *BoltStorage) Close() error {
+	if !s.ownsDB {
+		return nil
+	}
+	return s.db.Close()
+}
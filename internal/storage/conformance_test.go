@@ -0,0 +1,788 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// conformanceBackend describes how the conformance suite opens a Storage backend.
+type conformanceBackend struct {
+	// open creates an empty storage. It is closed by the test's cleanup.
+	open func(t *testing.T) Storage
+	// reopen closes s and opens the storage again from what it persisted.
+	// nil for backends that keep nothing across restarts.
+	reopen func(t *testing.T, s Storage) Storage
+	// breakWrites makes every later write of s fail, e.g. by closing the file it
+	// writes to. nil if the backend cannot fail.
+	breakWrites func(t *testing.T, s Storage)
+}
+
+// runConformance runs the behaviour every Storage implementation must share.
+//
+// Parameters:
+//   - t: Test to run the subtests in
+//   - b: Backend under test
+func runConformance(t *testing.T, b conformanceBackend) {
+	t.Run("GaugeSetAndOverwrite", func(t *testing.T) { conformGauge(t, b) })
+	t.Run("CounterIncrementAndSet", func(t *testing.T) { conformCounter(t, b) })
+	t.Run("TypesAreSeparateNamespaces", func(t *testing.T) { conformNamespaces(t, b) })
+	t.Run("Delete", func(t *testing.T) { conformDelete(t, b) })
+	t.Run("GetAll", func(t *testing.T) { conformGetAll(t, b) })
+	t.Run("UpdateBatch", func(t *testing.T) { conformBatch(t, b) })
+	t.Run("UpdateBatchRejectsInvalidItems", func(t *testing.T) { conformBatchInvalid(t, b) })
+	t.Run("CounterOverflowIsRejected", func(t *testing.T) { conformCounterOverflow(t, b) })
+	t.Run("ConcurrentWrites", func(t *testing.T) { conformConcurrent(t, b) })
+	t.Run("MetadataRegistry", func(t *testing.T) { conformMetadata(t, b) })
+	t.Run("Distributions", func(t *testing.T) { conformDistributions(t, b) })
+	t.Run("PersistenceRoundTrip", func(t *testing.T) {
+		if b.reopen == nil {
+			t.Skip("backend does not persist")
+		}
+		conformPersistence(t, b)
+	})
+	t.Run("FailedWritesAreNotApplied", func(t *testing.T) {
+		if b.breakWrites == nil {
+			t.Skip("backend has no failing writes")
+		}
+		conformFailedWrites(t, b)
+	})
+}
+
+// seriesSnapshot returns all series of s keyed by "type/name" with their formatted values.
+func seriesSnapshot(t *testing.T, s Storage) map[string]string {
+	t.Helper()
+	all, err := s.GetAll()
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	out := make(map[string]string, len(all))
+	for _, m := range all {
+		key := m.MType + "/" + m.ID
+		if _, dup := out[key]; dup {
+			t.Errorf("GetAll returned %s twice", key)
+		}
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			out[key] = fmt.Sprint(*m.Value)
+		case m.MType == "counter" && m.Delta != nil:
+			out[key] = fmt.Sprint(*m.Delta)
+		case m.MType == "histogram" && m.Histogram != nil:
+			out[key] = fmt.Sprintf("%v %v %d %v", m.Histogram.Bounds, m.Histogram.Counts, m.Histogram.Count, m.Histogram.Sum)
+		case m.MType == "summary" && m.Summary != nil:
+			out[key] = fmt.Sprintf("%d %v %v", m.Summary.Count, m.Summary.Sum, m.Summary.Quantiles)
+		default:
+			t.Errorf("GetAll returned malformed metric %+v", m)
+		}
+	}
+	return out
+}
+
+// assertSeries compares all series of s with want.
+func assertSeries(t *testing.T, s Storage, want map[string]string) {
+	t.Helper()
+	got := seriesSnapshot(t, s)
+	for key, w := range want {
+		if g, ok := got[key]; !ok {
+			t.Errorf("%s missing, want %s", key, w)
+		} else if g != w {
+			t.Errorf("%s = %s, want %s", key, g, w)
+		}
+	}
+	for key, g := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected series %s = %s", key, g)
+		}
+	}
+}
+
+// mustNoErr fails the test if err is not nil.
+func mustNoErr(t *testing.T, op string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", op, err)
+	}
+}
+
+func conformGauge(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	if _, ok := s.GetGauge("temp"); ok {
+		t.Fatal("gauge exists before the first write")
+	}
+	for _, v := range []float64{1.5, -273.15, 0, math.MaxFloat64, math.SmallestNonzeroFloat64, 42} {
+		mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", v))
+		if got, ok := s.GetGauge("temp"); !ok || got != v {
+			t.Errorf("GetGauge = %v, %v after writing %v", got, ok, v)
+		}
+	}
+}
+
+func conformCounter(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	if _, ok := s.GetCounter("hits"); ok {
+		t.Fatal("counter exists before the first write")
+	}
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 5))
+	if v, ok := s.GetCounter("hits"); !ok || v != 5 {
+		t.Errorf("first increment: GetCounter = %v, %v, want 5", v, ok)
+	}
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 7))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", -2))
+	if v, _ := s.GetCounter("hits"); v != 10 {
+		t.Errorf("after increments: GetCounter = %v, want 10", v)
+	}
+
+	// SetCounter replaces the value; later increments start from it
+	mustNoErr(t, "SetCounter", s.SetCounter(ctx, "hits", 100))
+	if v, _ := s.GetCounter("hits"); v != 100 {
+		t.Errorf("after set: GetCounter = %v, want 100", v)
+	}
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 1))
+	if v, _ := s.GetCounter("hits"); v != 101 {
+		t.Errorf("after set and increment: GetCounter = %v, want 101", v)
+	}
+
+	// SetCounter creates missing counters
+	mustNoErr(t, "SetCounter", s.SetCounter(ctx, "fresh", 3))
+	if v, ok := s.GetCounter("fresh"); !ok || v != 3 {
+		t.Errorf("set on missing counter: GetCounter = %v, %v, want 3", v, ok)
+	}
+}
+
+func conformNamespaces(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "shared", 2.5))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "shared", 4))
+	if v, _ := s.GetGauge("shared"); v != 2.5 {
+		t.Errorf("gauge = %v, want 2.5", v)
+	}
+	if v, _ := s.GetCounter("shared"); v != 4 {
+		t.Errorf("counter = %v, want 4", v)
+	}
+
+	if _, err := s.DeleteGauge(ctx, "shared"); err != nil {
+		t.Fatalf("DeleteGauge: %v", err)
+	}
+	if v, ok := s.GetCounter("shared"); !ok || v != 4 {
+		t.Errorf("deleting the gauge removed the counter: %v, %v", v, ok)
+	}
+}
+
+func conformDelete(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", 1))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 1))
+
+	tests := []struct {
+		name   string
+		delete func() (bool, error)
+		want   bool
+	}{
+		{"existing gauge", func() (bool, error) { return s.DeleteGauge(ctx, "temp") }, true},
+		{"deleted gauge", func() (bool, error) { return s.DeleteGauge(ctx, "temp") }, false},
+		{"missing gauge", func() (bool, error) { return s.DeleteGauge(ctx, "missing") }, false},
+		{"existing counter", func() (bool, error) { return s.DeleteCounter(ctx, "hits") }, true},
+		{"deleted counter", func() (bool, error) { return s.DeleteCounter(ctx, "hits") }, false},
+		{"missing counter", func() (bool, error) { return s.DeleteCounter(ctx, "missing") }, false},
+	}
+	for _, tt := range tests {
+		got, err := tt.delete()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: deleted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, ok := s.GetGauge("temp"); ok {
+		t.Error("deleted gauge is still readable")
+	}
+	if _, ok := s.GetCounter("hits"); ok {
+		t.Error("deleted counter is still readable")
+	}
+
+	// A deleted counter starts again from zero
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 3))
+	if v, _ := s.GetCounter("hits"); v != 3 {
+		t.Errorf("recreated counter = %v, want 3", v)
+	}
+}
+
+func conformGetAll(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	if all, err := s.GetAll(); err != nil || len(all) != 0 {
+		t.Fatalf("GetAll on empty storage = %v, %v", all, err)
+	}
+
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", 1.5))
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "load", 0.25))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 2))
+	assertSeries(t, s, map[string]string{
+		"gauge/temp":   "1.5",
+		"gauge/load":   "0.25",
+		"counter/hits": "2",
+	})
+
+	// The returned metrics are copies
+	all, _ := s.GetAll()
+	for _, m := range all {
+		if m.Value != nil {
+			*m.Value = -1
+		}
+		if m.Delta != nil {
+			*m.Delta = -1
+		}
+	}
+	if v, _ := s.GetGauge("temp"); v != 1.5 {
+		t.Errorf("modifying GetAll result changed gauge to %v", v)
+	}
+	if v, _ := s.GetCounter("hits"); v != 2 {
+		t.Errorf("modifying GetAll result changed counter to %v", v)
+	}
+}
+
+func conformBatch(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 5))
+	mustNoErr(t, "UpdateBatch", s.UpdateBatch(ctx, nil))
+	mustNoErr(t, "UpdateBatch", s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "temp", MType: "gauge", Value: ptrFloat(1)},
+		{ID: "hits", MType: "counter", Delta: ptrInt(2)},
+		{ID: "temp", MType: "gauge", Value: ptrFloat(2)},
+		{ID: "hits", MType: "counter", Delta: ptrInt(3)},
+		{ID: "new", MType: "counter", Delta: ptrInt(1)},
+	}))
+
+	// Gauges keep the last value of the batch, counters add up all deltas
+	assertSeries(t, s, map[string]string{
+		"gauge/temp":   "2",
+		"counter/hits": "10",
+		"counter/new":  "1",
+	})
+}
+
+func conformBatchInvalid(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", 1))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 1))
+	before := seriesSnapshot(t, s)
+
+	err := s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "temp", MType: "gauge", Value: ptrFloat(99)},
+		{ID: "", MType: "gauge", Value: ptrFloat(1)},
+		{ID: "hits", MType: "counter", Delta: ptrInt(99)},
+		{ID: "nodelta", MType: "counter"},
+		{ID: "novalue", MType: "gauge"},
+		{ID: "odd", MType: "rate", Value: ptrFloat(1)},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected *BatchError, got %v", err)
+	}
+	if !errors.Is(err, ErrInvalidMetric) {
+		t.Errorf("expected ErrInvalidMetric, got %v", err)
+	}
+	var indexes []int
+	for _, item := range batchErr.Items {
+		indexes = append(indexes, item.Index)
+	}
+	if fmt.Sprint(indexes) != "[1 3 4 5]" {
+		t.Errorf("failed indexes = %v, want [1 3 4 5]", indexes)
+	}
+
+	// Valid items of a rejected batch are not applied either
+	assertSeries(t, s, before)
+}
+
+func conformCounterOverflow(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	mustNoErr(t, "SetCounter", s.SetCounter(ctx, "big", math.MaxInt64-1))
+	mustNoErr(t, "SetCounter", s.SetCounter(ctx, "small", math.MinInt64+1))
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", 1))
+	before := seriesSnapshot(t, s)
+
+	if err := s.UpdateCounter(ctx, "big", 2); !errors.Is(err, ErrCounterOverflow) {
+		t.Errorf("UpdateCounter past MaxInt64: expected ErrCounterOverflow, got %v", err)
+	}
+	if err := s.UpdateCounter(ctx, "small", -2); !errors.Is(err, ErrCounterOverflow) {
+		t.Errorf("UpdateCounter past MinInt64: expected ErrCounterOverflow, got %v", err)
+	}
+
+	// Each item fits on its own, together they overflow; nothing is applied
+	err := s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "temp", MType: "gauge", Value: ptrFloat(2)},
+		{ID: "big", MType: "counter", Delta: ptrInt(1)},
+		{ID: "big", MType: "counter", Delta: ptrInt(1)},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || !errors.Is(err, ErrCounterOverflow) {
+		t.Fatalf("expected *BatchError wrapping ErrCounterOverflow, got %v", err)
+	}
+	if len(batchErr.Items) != 1 || batchErr.Items[0].Index != 2 {
+		t.Errorf("failed items = %v, want only index 2", batchErr.Items)
+	}
+	assertSeries(t, s, before)
+
+	// Up to the limit is fine
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "big", 1))
+	if v, _ := s.GetCounter("big"); v != math.MaxInt64 {
+		t.Errorf("big = %d, want %d", v, int64(math.MaxInt64))
+	}
+}
+
+func conformMetadata(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	if _, ok := s.GetMetadata("GCCPUFraction"); ok {
+		t.Fatal("metadata exists before it was registered")
+	}
+	for _, md := range []metrics.Metadata{
+		{MType: "gauge"},
+		{ID: "x", MType: "rate"},
+		{ID: "x", MType: "gauge", Unit: string(make([]byte, maxMetadataUnit+1))},
+	} {
+		if err := s.SetMetadata(ctx, md); !errors.Is(err, ErrInvalidMetric) {
+			t.Errorf("SetMetadata(%+v): expected ErrInvalidMetric, got %v", md, err)
+		}
+	}
+
+	gc := metrics.Metadata{ID: "GCCPUFraction", MType: "gauge", Description: "Fraction of CPU time used by the GC", Unit: "ratio", Owner: "runtime"}
+	polls := metrics.Metadata{ID: "PollCount", MType: "counter", Description: "Number of polls"}
+	mustNoErr(t, "SetMetadata", s.SetMetadata(ctx, gc))
+	mustNoErr(t, "SetMetadata", s.SetMetadata(ctx, polls))
+	// Registering again replaces the metadata
+	polls.Unit = "polls"
+	mustNoErr(t, "SetMetadata", s.SetMetadata(ctx, polls))
+
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "GCCPUFraction", 0.01))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "PollCount", 3))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "plain", 1))
+	before := seriesSnapshot(t, s)
+
+	// Samples of the other type are rejected
+	conflicts := []struct {
+		name  string
+		write func() error
+	}{
+		{"UpdateCounter", func() error { return s.UpdateCounter(ctx, "GCCPUFraction", 1) }},
+		{"SetCounter", func() error { return s.SetCounter(ctx, "GCCPUFraction", 1) }},
+		{"UpdateGauge", func() error { return s.UpdateGauge(ctx, "PollCount", 1) }},
+	}
+	for _, c := range conflicts {
+		if err := c.write(); !errors.Is(err, ErrTypeConflict) {
+			t.Errorf("%s: expected ErrTypeConflict, got %v", c.name, err)
+		}
+	}
+	err := s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: ptrInt(1)},
+		{ID: "PollCount", MType: "gauge", Value: ptrFloat(1)},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || !errors.Is(err, ErrTypeConflict) {
+		t.Fatalf("expected *BatchError wrapping ErrTypeConflict, got %v", err)
+	}
+	if len(batchErr.Items) != 1 || batchErr.Items[0].Index != 1 {
+		t.Errorf("failed items = %v, want only index 1", batchErr.Items)
+	}
+	// Metadata must not contradict a stored series
+	if err := s.SetMetadata(ctx, metrics.Metadata{ID: "plain", MType: "gauge"}); !errors.Is(err, ErrTypeConflict) {
+		t.Errorf("SetMetadata against a stored counter: expected ErrTypeConflict, got %v", err)
+	}
+	assertSeries(t, s, before)
+
+	check := func(s Storage) {
+		t.Helper()
+		if got, ok := s.GetMetadata("GCCPUFraction"); !ok || got != gc {
+			t.Errorf("GetMetadata = %+v, %v, want %+v", got, ok, gc)
+		}
+		all, err := s.AllMetadata()
+		mustNoErr(t, "AllMetadata", err)
+		if want := []metrics.Metadata{gc, polls}; fmt.Sprint(all) != fmt.Sprint(want) {
+			t.Errorf("AllMetadata = %+v, want %+v", all, want)
+		}
+	}
+	check(s)
+
+	if b.reopen != nil {
+		s = b.reopen(t, s)
+		check(s)
+		if err := s.UpdateGauge(ctx, "PollCount", 1); !errors.Is(err, ErrTypeConflict) {
+			t.Errorf("UpdateGauge after reopen: expected ErrTypeConflict, got %v", err)
+		}
+	}
+}
+
+func conformDistributions(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	latency := func(counts ...int64) metrics.Histogram {
+		h := metrics.Histogram{Bounds: []float64{0.1, 0.5}, Counts: counts}
+		for _, c := range counts {
+			h.Count += c
+		}
+		h.Sum = float64(h.Count) / 10
+		return h
+	}
+	mustNoErr(t, "UpdateHistogram", s.UpdateHistogram(ctx, "latency", latency(1, 2, 0)))
+	mustNoErr(t, "UpdateHistogram", s.UpdateHistogram(ctx, "latency", latency(0, 1, 3)))
+	mustNoErr(t, "UpdateSummary", s.UpdateSummary(ctx, "size", metrics.Summary{Count: 2, Sum: 10, Quantiles: []metrics.Quantile{{Quantile: 0.5, Value: 4}}}))
+	mustNoErr(t, "UpdateSummary", s.UpdateSummary(ctx, "size", metrics.Summary{Count: 1, Sum: 2, Quantiles: []metrics.Quantile{{Quantile: 0.5, Value: 2}}}))
+	// Histograms and summaries are separate namespaces like gauges and counters
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "latency", 1))
+
+	want := map[string]string{
+		"gauge/latency":     "1",
+		"histogram/latency": "[0.1 0.5] [1 3 3] 7 0.7",
+		"summary/size":      "3 12 [{0.5 2}]",
+	}
+	assertSeries(t, s, want)
+
+	// Readers get copies
+	h, ok := s.GetHistogram("latency")
+	if !ok {
+		t.Fatal("GetHistogram: latency missing")
+	}
+	h.Counts[0] = 100
+	if h, _ := s.GetHistogram("latency"); h.Counts[0] != 1 {
+		t.Errorf("GetHistogram returned shared memory: counts = %v", h.Counts)
+	}
+	if sm, ok := s.GetSummary("size"); !ok || sm.Count != 3 {
+		t.Errorf("GetSummary = %+v, %v, want count 3", sm, ok)
+	}
+
+	// Rejected writes leave the stored series unchanged
+	rebucketed := metrics.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5}
+	if err := s.UpdateHistogram(ctx, "latency", rebucketed); !errors.Is(err, ErrBucketMismatch) {
+		t.Errorf("UpdateHistogram with other bounds: expected ErrBucketMismatch, got %v", err)
+	}
+	for _, h := range []metrics.Histogram{
+		{Bounds: []float64{0.5, 0.1}, Counts: []int64{0, 0, 0}},
+		{Bounds: []float64{0.1}, Counts: []int64{1}, Count: 1},
+		{Bounds: []float64{0.1}, Counts: []int64{1, 1}, Count: 1},
+		{Bounds: []float64{0.1}, Counts: []int64{-1, 1}},
+		{Bounds: []float64{math.Inf(1)}, Counts: []int64{0, 0}},
+	} {
+		if err := s.UpdateHistogram(ctx, "latency", h); !errors.Is(err, ErrInvalidMetric) {
+			t.Errorf("UpdateHistogram(%+v): expected ErrInvalidMetric, got %v", h, err)
+		}
+	}
+	for _, sm := range []metrics.Summary{
+		{Count: -1},
+		{Quantiles: []metrics.Quantile{{Quantile: 1.5, Value: 1}}},
+		{Quantiles: []metrics.Quantile{{Quantile: 0.9, Value: 1}, {Quantile: 0.5, Value: 1}}},
+	} {
+		if err := s.UpdateSummary(ctx, "size", sm); !errors.Is(err, ErrInvalidMetric) {
+			t.Errorf("UpdateSummary(%+v): expected ErrInvalidMetric, got %v", sm, err)
+		}
+	}
+	overflow := metrics.Histogram{Bounds: []float64{0.1, 0.5}, Counts: []int64{math.MaxInt64, 0, 0}, Count: math.MaxInt64}
+	if err := s.UpdateHistogram(ctx, "latency", overflow); !errors.Is(err, ErrCounterOverflow) {
+		t.Errorf("UpdateHistogram overflowing: expected ErrCounterOverflow, got %v", err)
+	}
+	assertSeries(t, s, want)
+
+	// Batches with an invalid or mismatching histogram are rejected as a whole
+	err := s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "size", MType: "summary", Summary: &metrics.Summary{Count: 1, Sum: 1}},
+		{ID: "nohistogram", MType: "histogram"},
+	})
+	if !errors.Is(err, ErrInvalidMetric) {
+		t.Errorf("batch with a histogram item missing its histogram: expected ErrInvalidMetric, got %v", err)
+	}
+	err = s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "latency", MType: "histogram", Histogram: ptrHistogram(latency(1, 0, 0))},
+		{ID: "latency", MType: "histogram", Histogram: &rebucketed},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || !errors.Is(err, ErrBucketMismatch) {
+		t.Fatalf("expected *BatchError wrapping ErrBucketMismatch, got %v", err)
+	}
+	if len(batchErr.Items) != 1 || batchErr.Items[0].Index != 1 {
+		t.Errorf("failed items = %v, want only index 1", batchErr.Items)
+	}
+	assertSeries(t, s, want)
+
+	// Items of a batch merge in order, including with each other
+	mustNoErr(t, "UpdateBatch", s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "latency", MType: "histogram", Histogram: ptrHistogram(latency(1, 0, 0))},
+		{ID: "latency", MType: "histogram", Histogram: ptrHistogram(latency(0, 0, 1))},
+		{ID: "fresh", MType: "histogram", Histogram: &rebucketed},
+		{ID: "size", MType: "summary", Summary: &metrics.Summary{Count: 1, Sum: 1}},
+	}))
+	want["histogram/latency"] = "[0.1 0.5] [2 3 4] 9 0.8999999999999999"
+	want["histogram/fresh"] = "[1] [1 0] 1 0.5"
+	want["summary/size"] = "4 13 []"
+	assertSeries(t, s, want)
+
+	// The registered type applies to every type
+	mustNoErr(t, "SetMetadata", s.SetMetadata(ctx, metrics.Metadata{ID: "size", MType: "summary", Unit: "bytes"}))
+	if err := s.UpdateHistogram(ctx, "size", latency(1, 0, 0)); !errors.Is(err, ErrTypeConflict) {
+		t.Errorf("UpdateHistogram of a summary: expected ErrTypeConflict, got %v", err)
+	}
+	if err := s.SetMetadata(ctx, metrics.Metadata{ID: "fresh", MType: "summary"}); !errors.Is(err, ErrTypeConflict) {
+		t.Errorf("SetMetadata against a stored histogram: expected ErrTypeConflict, got %v", err)
+	}
+
+	// Deleting a histogram allows other buckets
+	if ok, err := s.DeleteHistogram(ctx, "fresh"); err != nil || !ok {
+		t.Fatalf("DeleteHistogram = %v, %v, want true", ok, err)
+	}
+	if ok, err := s.DeleteHistogram(ctx, "fresh"); err != nil || ok {
+		t.Errorf("DeleteHistogram of a missing series = %v, %v, want false", ok, err)
+	}
+	mustNoErr(t, "UpdateHistogram", s.UpdateHistogram(ctx, "fresh", latency(1, 1, 1)))
+	want["histogram/fresh"] = "[0.1 0.5] [1 1 1] 3 0.3"
+	if ok, err := s.DeleteSummary(ctx, "size"); err != nil || !ok {
+		t.Fatalf("DeleteSummary = %v, %v, want true", ok, err)
+	}
+	delete(want, "summary/size")
+	assertSeries(t, s, want)
+
+	if b.reopen != nil {
+		s = b.reopen(t, s)
+		assertSeries(t, s, want)
+		mustNoErr(t, "UpdateHistogram", s.UpdateHistogram(ctx, "fresh", latency(1, 0, 0)))
+		if err := s.UpdateHistogram(ctx, "fresh", rebucketed); !errors.Is(err, ErrBucketMismatch) {
+			t.Errorf("UpdateHistogram after reopen: expected ErrBucketMismatch, got %v", err)
+		}
+		want["histogram/fresh"] = "[0.1 0.5] [2 1 1] 4 0.4"
+		assertSeries(t, s, want)
+	}
+}
+
+func conformConcurrent(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+	const workers, writes = 8, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*writes*3)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				errs <- s.UpdateCounter(ctx, "hits", 1)
+				errs <- s.UpdateBatch(ctx, []metrics.Metrics{
+					{ID: "hits", MType: "counter", Delta: ptrInt(2)},
+					{ID: fmt.Sprintf("worker%d", w), MType: "gauge", Value: ptrFloat(float64(i))},
+				})
+				errs <- s.UpdateGauge(ctx, "shared", float64(w))
+				// Readers run alongside the writers
+				s.GetCounter("hits")
+				s.GetAll()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent write: %v", err)
+		}
+	}
+
+	check := func(s Storage) {
+		t.Helper()
+		if v, _ := s.GetCounter("hits"); v != workers*writes*3 {
+			t.Errorf("hits = %v, want %v", v, workers*writes*3)
+		}
+		for w := 0; w < workers; w++ {
+			if v, _ := s.GetGauge(fmt.Sprintf("worker%d", w)); v != writes-1 {
+				t.Errorf("worker%d = %v, want %v", w, v, writes-1)
+			}
+		}
+		if v, ok := s.GetGauge("shared"); !ok || v < 0 || v >= workers {
+			t.Errorf("shared = %v, %v, want one of the written values", v, ok)
+		}
+	}
+	check(s)
+
+	// What was acknowledged is also what was persisted
+	if b.reopen != nil {
+		shared, _ := s.GetGauge("shared")
+		s = b.reopen(t, s)
+		check(s)
+		if v, _ := s.GetGauge("shared"); v != shared {
+			t.Errorf("shared = %v after reopen, want %v", v, shared)
+		}
+	}
+}
+
+func conformPersistence(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", 1.5))
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", -3.25))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 2))
+	mustNoErr(t, "UpdateBatch", s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "hits", MType: "counter", Delta: ptrInt(3)},
+		{ID: "load", MType: "gauge", Value: ptrFloat(0.5)},
+	}))
+	mustNoErr(t, "SetCounter", s.SetCounter(ctx, "resets", 7))
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "gone", 1))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "gone", 1))
+	if _, err := s.DeleteGauge(ctx, "gone"); err != nil {
+		t.Fatalf("DeleteGauge: %v", err)
+	}
+	if _, err := s.DeleteCounter(ctx, "gone"); err != nil {
+		t.Fatalf("DeleteCounter: %v", err)
+	}
+
+	want := map[string]string{
+		"gauge/temp":     "-3.25",
+		"gauge/load":     "0.5",
+		"counter/hits":   "5",
+		"counter/resets": "7",
+	}
+	assertSeries(t, s, want)
+
+	s = b.reopen(t, s)
+	assertSeries(t, s, want)
+
+	// Counters continue from the restored value
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 1))
+	s = b.reopen(t, s)
+	want["counter/hits"] = "6"
+	assertSeries(t, s, want)
+}
+
+func conformFailedWrites(t *testing.T, b conformanceBackend) {
+	s := b.open(t)
+	ctx := context.Background()
+
+	mustNoErr(t, "UpdateGauge", s.UpdateGauge(ctx, "temp", 1))
+	mustNoErr(t, "UpdateCounter", s.UpdateCounter(ctx, "hits", 1))
+	before := seriesSnapshot(t, s)
+
+	b.breakWrites(t, s)
+
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"UpdateGauge", func() error { return s.UpdateGauge(ctx, "temp", 2) }},
+		{"UpdateCounter", func() error { return s.UpdateCounter(ctx, "hits", 1) }},
+		{"SetCounter", func() error { return s.SetCounter(ctx, "hits", 50) }},
+		{"UpdateBatch", func() error {
+			return s.UpdateBatch(ctx, []metrics.Metrics{
+				{ID: "temp", MType: "gauge", Value: ptrFloat(3)},
+				{ID: "new", MType: "counter", Delta: ptrInt(1)},
+			})
+		}},
+		{"DeleteGauge", func() error { _, err := s.DeleteGauge(ctx, "temp"); return err }},
+		{"DeleteCounter", func() error { _, err := s.DeleteCounter(ctx, "hits"); return err }},
+		{"UpdateHistogram", func() error {
+			return s.UpdateHistogram(ctx, "latency", metrics.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5})
+		}},
+		{"UpdateSummary", func() error { return s.UpdateSummary(ctx, "size", metrics.Summary{Count: 1, Sum: 1}) }},
+	}
+	for _, w := range writes {
+		if err := w.write(); err == nil {
+			t.Errorf("%s succeeded on a broken backend", w.name)
+		}
+	}
+
+	// Readers must not see writes that were reported as failed
+	assertSeries(t, s, before)
+}
+
+func TestConformanceMemStorage(t *testing.T) {
+	runConformance(t, conformanceBackend{
+		open: func(t *testing.T) Storage { return NewMemStorage() },
+	})
+}
+
+func TestConformanceFileStorage(t *testing.T) {
+	open := func(t *testing.T, path string) Storage {
+		s, err := NewFileStorage(path)
+		if err != nil {
+			t.Fatalf("NewFileStorage: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	runConformance(t, conformanceBackend{
+		open: func(t *testing.T) Storage {
+			return open(t, filepath.Join(t.TempDir(), "metrics.json"))
+		},
+		reopen: func(t *testing.T, s Storage) Storage {
+			fs := s.(*FileStorage)
+			mustNoErr(t, "Close", fs.Close())
+			return open(t, fs.filePath)
+		},
+		breakWrites: func(t *testing.T, s Storage) {
+			s.(*FileStorage).wal.file.Close()
+		},
+	})
+}
+
+func TestConformanceFileStorageSnapshot(t *testing.T) {
+	open := func(t *testing.T, path string) Storage {
+		s, err := NewFileStorage(path)
+		if err != nil {
+			t.Fatalf("NewFileStorage: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	// Restores from a snapshot instead of the log
+	runConformance(t, conformanceBackend{
+		open: func(t *testing.T) Storage {
+			return open(t, filepath.Join(t.TempDir(), "metrics.json"))
+		},
+		reopen: func(t *testing.T, s Storage) Storage {
+			fs := s.(*FileStorage)
+			mustNoErr(t, "Save", fs.Save())
+			mustNoErr(t, "Close", fs.Close())
+			return open(t, fs.filePath)
+		},
+	})
+}
+
+func TestConformanceBoltStorage(t *testing.T) {
+	open := func(t *testing.T, path string) Storage {
+		s, err := NewBoltStorage(path)
+		if err != nil {
+			t.Fatalf("NewBoltStorage: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	runConformance(t, conformanceBackend{
+		open: func(t *testing.T) Storage {
+			return open(t, filepath.Join(t.TempDir(), "metrics.db"))
+		},
+		reopen: func(t *testing.T, s Storage) Storage {
+			bs := s.(*BoltStorage)
+			path := bs.db.Path()
+			mustNoErr(t, "Close", bs.Close())
+			return open(t, path)
+		},
+	})
+}
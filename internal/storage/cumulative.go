@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// DefaultSourceTTL is how long a CumulativeTracker remembers a source that stopped sending.
+const DefaultSourceTTL = time.Hour
+
+// ErrMissingSource is returned when cumulative counters arrive without a source identifier,
+// since their running totals can only be compared with earlier samples of the same source.
+var ErrMissingSource = errors.New("cumulative counters require a source")
+
+// Source identifies the sender of cumulative counters.
+type Source struct {
+	Tenant string    // Tenant the samples are written to
+	ID     string    // Stable identifier of the sender, e.g. the agent's host name
+	Start  time.Time // Start time of the sending process (zero if unknown)
+}
+
+// sourceKey identifies a source across tenants.
+type sourceKey struct {
+	tenant string
+	id     string
+}
+
+// sourceState holds the last accepted running totals of a source.
+type sourceState struct {
+	mu       sync.Mutex       // Serializes the batches of the source
+	start    time.Time        // Start time of the process that sent the totals
+	totals   map[string]int64 // Last accepted running total per counter
+	lastSeen time.Time        // Time of the last batch, for pruning; guarded by CumulativeTracker.mu
+}
+
+// CumulativeTracker converts cumulative counter samples into increments.
+//
+// For every source it remembers the last running total accepted per counter and
+// writes the difference to the storage. A changed start time of the source means
+// the source restarted: its new totals are counted in full, so nothing is counted
+// twice or lost across agent restarts. A total lower than the previous one with an
+// unchanged start time comes from an older report that arrived late, e.g. from
+// another worker or a retry; it adds nothing and keeps the baseline. Only a source
+// that sends no start time is assumed to have restarted when a total goes down.
+//
+// The first sample of a source the tracker does not know is counted in full only
+// if the source started after the tracker (or after it last forgot idle sources);
+// otherwise the tracker cannot tell which part of the total was already stored,
+// and the sample only sets the baseline. The state lives in memory, so after a
+// server restart every long-running source contributes from its second sample on,
+// and servers sharing a database must not each run a tracker: a source whose
+// requests alternate between them would be counted twice or lose increments.
+type CumulativeTracker struct {
+	mu      sync.Mutex                 // Protects sources, epoch and pruned
+	sources map[sourceKey]*sourceState // Known sources
+	ttl     time.Duration              // How long idle sources are kept
+	epoch   time.Time                  // Sources started after this have no stored history
+	pruned  time.Time                  // Time of the last pruning pass
+	now     func() time.Time           // Clock, replaceable in tests
+}
+
+// NewCumulativeTracker creates a tracker that forgets sources idle for longer than ttl.
+//
+// Parameters:
+//   - ttl: Idle time after which a source is forgotten (DefaultSourceTTL if not positive)
+//
+// Returns:
+//   - *CumulativeTracker: Tracker without any known source
+func NewCumulativeTracker(ttl time.Duration) *CumulativeTracker {
+	if ttl <= 0 {
+		ttl = DefaultSourceTTL
+	}
+	now := time.Now()
+	return &CumulativeTracker{
+		sources: make(map[sourceKey]*sourceState),
+		ttl:     ttl,
+		epoch:   now,
+		pruned:  now,
+		now:     time.Now,
+	}
+}
+
+// hasCumulative reports whether any item of the batch is a cumulative sample.
+//
+// Parameters:
+//   - batch: Metrics to inspect
+//
+// Returns:
+//   - bool: true if at least one item has TemporalityCumulative
+func hasCumulative(batch []metrics.Metrics) bool {
+	for _, m := range batch {
+		if m.Temporality == metrics.TemporalityCumulative {
+			return true
+		}
+	}
+	return false
+}
+
+// state returns the state of a source, creating it if needed, and forgets sources
+// that have been idle for longer than the TTL.
+//
+// Parameters:
+//   - key: Source to look up
+//
+// Returns:
+//   - *sourceState: State of the source
+//   - time.Time: Epoch to compare the start time of a new source with
+func (t *CumulativeTracker) state(key sourceKey) (*sourceState, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if now.Sub(t.pruned) >= t.ttl {
+		for k, st := range t.sources {
+			if now.Sub(st.lastSeen) >= t.ttl {
+				delete(t.sources, k)
+			}
+		}
+		t.pruned = now
+		// A forgotten source that returns may have been counted already
+		t.epoch = now
+	}
+
+	st, ok := t.sources[key]
+	if !ok {
+		st = &sourceState{totals: make(map[string]int64)}
+		t.sources[key] = st
+	}
+	st.lastSeen = now
+	return st, t.epoch
+}
+
+// UpdateBatch writes a batch to the storage, converting its cumulative counter
+// samples into increments relative to the previous samples of the source.
+// Batches without cumulative samples are passed to the storage unchanged.
+//
+// The batches of one source are serialized. The running totals are remembered
+// only after the storage accepted the batch, so a rejected batch can be resent.
+//
+// Parameters:
+//   - ctx: Context for the storage operation
+//   - store: Storage to write to
+//   - src: Sender of the batch
+//   - batch: Metrics to apply; cumulative items must be non-negative counters
+//
+// Returns:
+//   - error: ErrMissingSource if the batch has cumulative samples but src has no ID,
+//     *BatchError for invalid items, or any error from store.UpdateBatch
+func (t *CumulativeTracker) UpdateBatch(ctx context.Context, store Storage, src Source, batch []metrics.Metrics) error {
+	if !hasCumulative(batch) {
+		return store.UpdateBatch(ctx, batch)
+	}
+	if src.ID == "" {
+		return ErrMissingSource
+	}
+
+	st, epoch := t.state(sourceKey{tenant: src.Tenant, id: src.ID})
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Without any history, count a source in full only if it started after the epoch
+	baseline := st.totals
+	known := len(baseline) > 0 || !st.start.IsZero()
+	countFirst := !src.Start.IsZero() && src.Start.After(epoch)
+	if known && !src.Start.IsZero() && !st.start.IsZero() && !src.Start.Equal(st.start) {
+		// The source restarted; all its counters start over
+		baseline = nil
+		countFirst = true
+	}
+
+	sameStart := !src.Start.IsZero() && src.Start.Equal(st.start)
+
+	var failed []BatchItemError
+	totals := make(map[string]int64, len(baseline))
+	for name, v := range baseline {
+		totals[name] = v
+	}
+	converted := make([]metrics.Metrics, len(batch))
+	for i, m := range batch {
+		converted[i] = m
+		if m.Temporality != metrics.TemporalityCumulative {
+			continue
+		}
+		var err error
+		switch {
+		case m.MType != "counter":
+			err = fmt.Errorf("%w: only counters can be cumulative", ErrInvalidMetric)
+		case m.Delta == nil:
+			err = fmt.Errorf("%w: missing delta for counter", ErrInvalidMetric)
+		case *m.Delta < 0:
+			err = fmt.Errorf("%w: cumulative value %d is negative", ErrInvalidMetric, *m.Delta)
+		}
+		if err != nil {
+			failed = append(failed, BatchItemError{Index: i, ID: m.ID, MType: m.MType, Err: err})
+			continue
+		}
+
+		total := *m.Delta
+		prev, seen := totals[m.ID]
+		var delta int64
+		switch {
+		case seen && total >= prev:
+			delta = total - prev
+		case seen && sameStart:
+			// An older report that arrived after a newer one
+			total = prev
+		case seen:
+			// The total went down: the source restarted without telling its start time
+			delta = total
+		case known || countFirst:
+			// A new counter of a known source, or a source without history
+			delta = total
+		}
+		totals[m.ID] = total
+		converted[i].Delta = &delta
+		converted[i].Temporality = ""
+	}
+	if len(failed) > 0 {
+		return &BatchError{Items: failed}
+	}
+
+	if err := store.UpdateBatch(ctx, converted); err != nil {
+		return err
+	}
+	st.totals = totals
+	if !src.Start.IsZero() {
+		st.start = src.Start
+	}
+	return nil
+}
@@ -2,15 +2,16 @@ package storage
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
-	"sync"
+	"slices"
 	"time"
 
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/pressly/goose/v3"
 	"github.com/sethvargo/go-retry"
 
@@ -20,26 +21,46 @@ import (
 
 // DBStorage implements the Storage interface using PostgreSQL as the persistent backend.
 // It maintains an in-memory cache (MemStorage) for fast reads and synchronizes writes
-// to the database with retry logic for transient failures.
+// to the database with retry logic for transient failures. Statements run on a
+// pgxpool connection pool, so independent writes proceed in parallel.
 //
-// The storage uses two tables:
-//   - gauge: Stores floating-point metrics (name VARCHAR PRIMARY KEY, value DOUBLE PRECISION)
-//   - counter: Stores integer counter metrics (name VARCHAR PRIMARY KEY, value BIGINT)
+// The storage uses five tables:
+//   - gauge: Stores floating-point metrics (tenant_id, name, value DOUBLE PRECISION)
+//   - counter: Stores integer counter metrics (tenant_id, name, value BIGINT)
+//   - histogram: Stores histograms (tenant_id, name, bounds, counts, count, sum)
+//   - summary: Stores summaries (tenant_id, name, count, sum, quantiles, quantile_values)
+//   - metric_metadata: Stores the registered metadata (tenant_id, name, type, description, unit, owner)
 //
-// All write operations are protected by a mutex to ensure consistency between
-// the database and in-memory cache.
+// A trigger rejects writes to a series table that differs from the registered type,
+// so type conflicts are caught across instances. Histograms and summaries are merged
+// by a single upsert statement, like counter increments.
+//
+// Each DBStorage instance works with the rows of a single tenant; the default
+// tenant is the empty string, so single-tenant deployments are unaffected.
+//
+// There is no global write lock. Writes to the same series are serialized by a
+// sharded per-series lock held across the database statement and the cache update.
+// Every row carries a version that grows in commit order; the cache stores the values
+// returned by the database and only accepts changes newer than the cached version.
+//
+// Several server instances can share one database. Writes are published with NOTIFY
+// by database triggers, and Listen applies the writes of other instances to the cache.
 //
 // generate:reset
 type DBStorage struct {
-	conn  *pgx.Conn    // PostgreSQL connection
-	cache *MemStorage  // In-memory cache for fast reads
-	mu    sync.RWMutex // Mutex for thread-safe cache operations
-	dsn   string       // Database connection string (for migrations)
+	pool         *pgxpool.Pool   // PostgreSQL connection pool
+	ownsPool     bool            // Whether Close closes the pool
+	cache        *MemStorage     // In-memory cache for fast reads
+	versions     *seriesVersions // Row versions of the cached series
+	locks        *keyLocks       // Per-series write locks
+	feed         *changeFeed     // Change notification subscribers sharing the pool
+	queryTimeout time.Duration   // Timeout for a single statement or transaction (0 for none)
+	tenant       string          // Tenant whose rows this instance reads and writes
 }
 
-// NewDBStorage creates and initializes a new DBStorage instance.
+// NewDBStorage creates and initializes a new DBStorage instance with the default pool settings.
 // It performs the following steps:
-//  1. Establishes a connection to the PostgreSQL database using the provided DSN
+//  1. Opens a connection pool to the PostgreSQL database using the provided DSN
 //  2. Ensures the database schema is up-to-date using migrations
 //  3. Loads existing metrics from the database into the in-memory cache
 //
@@ -51,32 +72,104 @@ type DBStorage struct {
 //   - *DBStorage: Initialized database storage
 //   - error: Any error during connection, schema initialization, or data loading
 func NewDBStorage(ctx context.Context, dsn string) (*DBStorage, error) {
-	conn, err := pgx.Connect(ctx, dsn)
+	return NewPooledDBStorage(ctx, dsn, PoolConfig{})
+}
+
+// NewPooledDBStorage creates and initializes a new DBStorage instance with the given
+// pool size, timeouts and health check settings. It performs the same initialization
+// steps as NewDBStorage. The pool is closed by Close.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - dsn: PostgreSQL connection string
+//   - cfg: Connection pool configuration
+//
+// Returns:
+//   - *DBStorage: Initialized database storage
+//   - error: Any error during connection, schema initialization, or data loading
+func NewPooledDBStorage(ctx context.Context, dsn string, cfg PoolConfig) (*DBStorage, error) {
+	pool, err := NewPool(ctx, dsn, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to DB: %w", err)
 	}
 
 	s := &DBStorage{
-		conn:  conn,
-		cache: NewMemStorage(),
-		dsn:   dsn,
+		pool:         pool,
+		ownsPool:     true,
+		cache:        NewMemStorage(),
+		versions:     newSeriesVersions(),
+		locks:        &keyLocks{},
+		feed:         newChangeFeed(),
+		queryTimeout: cfg.QueryTimeout,
+		tenant:       DefaultTenant,
 	}
 
 	// Ensure database schema is up-to-date using migrations
 	if err := s.runMigrations(ctx); err != nil {
-		conn.Close(ctx)
+		pool.Close()
 		return nil, fmt.Errorf("run migrations: %w", err)
 	}
 
 	// Load existing data from database into cache
 	if err := s.loadFromDB(ctx); err != nil {
-		conn.Close(ctx)
+		pool.Close()
+		return nil, fmt.Errorf("load from DB: %w", err)
+	}
+	s.feed.register(s)
+
+	return s, nil
+}
+
+// NewTenantDBStorage creates a DBStorage that only sees the rows of the given tenant.
+// It shares the connection pool and settings of parent, so tenants do not open
+// connections of their own; closing the tenant storage leaves the pool open.
+// The tenant's cache is kept coherent by the parent's Listen.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - parent: Storage whose pool is shared (usually the default tenant's)
+//   - tenant: Tenant identifier
+//
+// Returns:
+//   - *DBStorage: Initialized database storage for the tenant
+//   - error: Any error while loading the tenant's rows
+func NewTenantDBStorage(ctx context.Context, parent *DBStorage, tenant string) (*DBStorage, error) {
+	s := &DBStorage{
+		pool:         parent.pool,
+		cache:        NewMemStorage(),
+		versions:     newSeriesVersions(),
+		locks:        &keyLocks{},
+		feed:         parent.feed,
+		queryTimeout: parent.queryTimeout,
+		tenant:       tenant,
+	}
+
+	// Subscribe before loading so that no change between the two is missed.
+	// Schema migrations already ran for the parent.
+	s.feed.register(s)
+	if err := s.loadFromDB(ctx); err != nil {
+		s.feed.unregister(s)
 		return nil, fmt.Errorf("load from DB: %w", err)
 	}
 
 	return s, nil
 }
 
+// withTimeout derives a context bounded by the configured query timeout.
+//
+// Parameters:
+//   - ctx: Parent context
+//
+// Returns:
+//   - context.Context: Context for a single statement or transaction
+//   - context.CancelFunc: Function releasing the context's resources
+func (s *DBStorage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
 // runMigrations executes database schema migrations using the goose migration tool.
 // It applies all pending migrations from the "migrations" directory to bring the
 // database schema up to date with the current version of the application.
@@ -88,10 +181,7 @@ func NewDBStorage(ctx context.Context, dsn string) (*DBStorage, error) {
 //   - error: nil if migrations run successfully or no migrations are pending,
 //     otherwise an error describing what went wrong
 func (s *DBStorage) runMigrations(ctx context.Context) error {
-	sqlDB, err := sql.Open("pgx", s.dsn)
-	if err != nil {
-		return fmt.Errorf("failed to open connection for migrations: %w", err)
-	}
+	sqlDB := stdlib.OpenDBFromPool(s.pool)
 	defer sqlDB.Close()
 
 	goose.SetLogger(goose.NopLogger())
@@ -103,29 +193,68 @@ func (s *DBStorage) runMigrations(ctx context.Context) error {
 }
 
 // initSchema creates the required database tables if they don't already exist.
-// It creates two tables:
-//   - gauge: For floating-point metrics with name as primary key
-//   - counter: For integer counter metrics with name as primary key
+// It creates five tables:
+//   - gauge: For floating-point metrics with (tenant_id, name) as primary key
+//   - counter: For integer counter metrics with (tenant_id, name) as primary key
+//   - histogram: For histograms with (tenant_id, name) as primary key
+//   - summary: For summaries with (tenant_id, name) as primary key
+//   - metric_metadata: For metric metadata with (tenant_id, name) as primary key
 //
 // Returns:
 //   - error: Any error during table creation
 func (s *DBStorage) initSchema() error {
-	_, err := s.conn.Exec(context.Background(), `
+	_, err := s.pool.Exec(context.Background(), `
 		CREATE TABLE IF NOT EXISTS gauge (
-			name VARCHAR(255) PRIMARY KEY,
-			value DOUBLE PRECISION NOT NULL
+			tenant_id TEXT NOT NULL DEFAULT '',
+			name VARCHAR(255) NOT NULL,
+			value DOUBLE PRECISION NOT NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (tenant_id, name)
 		);
 		CREATE TABLE IF NOT EXISTS counter (
-			name VARCHAR(255) PRIMARY KEY,
-			value BIGINT NOT NULL
+			tenant_id TEXT NOT NULL DEFAULT '',
+			name VARCHAR(255) NOT NULL,
+			value BIGINT NOT NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (tenant_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS histogram (
+			tenant_id TEXT NOT NULL DEFAULT '',
+			name VARCHAR(255) NOT NULL,
+			bounds DOUBLE PRECISION[] NOT NULL,
+			counts BIGINT[] NOT NULL,
+			count BIGINT NOT NULL,
+			sum DOUBLE PRECISION NOT NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (tenant_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS summary (
+			tenant_id TEXT NOT NULL DEFAULT '',
+			name VARCHAR(255) NOT NULL,
+			count BIGINT NOT NULL,
+			sum DOUBLE PRECISION NOT NULL,
+			quantiles DOUBLE PRECISION[] NOT NULL,
+			quantile_values DOUBLE PRECISION[] NOT NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (tenant_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS metric_metadata (
+			tenant_id TEXT NOT NULL DEFAULT '',
+			name VARCHAR(255) NOT NULL,
+			type TEXT NOT NULL CHECK (type IN ('gauge', 'counter', 'histogram', 'summary')),
+			description TEXT NOT NULL DEFAULT '',
+			unit TEXT NOT NULL DEFAULT '',
+			owner TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (tenant_id, name)
 		);
 	`)
 	return err
 }
 
-// loadFromDB populates the in-memory cache with existing data from the database.
-// This is called during initialization to ensure the cache reflects the current
-// database state.
+// loadFromDB replaces the in-memory cache with the current database state.
+// This is called during initialization and whenever the change listener reconnects.
+// Writes are blocked while the cache is replaced, and changes older than the loaded
+// rows are skipped afterwards by their version.
 //
 // Parameters:
 //   - ctx: Context for the operation
@@ -133,8 +262,15 @@ func (s *DBStorage) initSchema() error {
 // Returns:
 //   - error: Any error during query execution or scanning
 func (s *DBStorage) loadFromDB(ctx context.Context) error {
+	unlock := s.locks.lockAll()
+	defer unlock()
+
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
+	versions := make(map[seriesKey]int64)
+
 	// Load all gauge metrics
-	rows, err := s.conn.Query(ctx, `SELECT name, value FROM gauge`)
+	rows, err := s.pool.Query(ctx, `SELECT name, value, version FROM gauge WHERE tenant_id = $1`, s.tenant)
 	if err != nil {
 		return fmt.Errorf("query gauge: %w", err)
 	}
@@ -142,14 +278,19 @@ func (s *DBStorage) loadFromDB(ctx context.Context) error {
 	for rows.Next() {
 		var name string
 		var value float64
-		if err := rows.Scan(&name, &value); err != nil {
+		var version int64
+		if err := rows.Scan(&name, &value, &version); err != nil {
 			return fmt.Errorf("scan gauge: %w", err)
 		}
-		s.cache.gauge[name] = value
+		gauges[name] = value
+		versions[seriesKey{mtype: "gauge", name: name}] = version
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read gauge: %w", err)
 	}
 
 	// Load all counter metrics
-	rows, err = s.conn.Query(ctx, `SELECT name, value FROM counter`)
+	rows, err = s.pool.Query(ctx, `SELECT name, value, version FROM counter WHERE tenant_id = $1`, s.tenant)
 	if err != nil {
 		return fmt.Errorf("query counter: %w", err)
 	}
@@ -157,30 +298,109 @@ func (s *DBStorage) loadFromDB(ctx context.Context) error {
 	for rows.Next() {
 		var name string
 		var value int64
-		if err := rows.Scan(&name, &value); err != nil {
+		var version int64
+		if err := rows.Scan(&name, &value, &version); err != nil {
 			return fmt.Errorf("scan counter: %w", err)
 		}
-		s.cache.counter[name] = value
+		counters[name] = value
+		versions[seriesKey{mtype: "counter", name: name}] = version
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read counter: %w", err)
+	}
+
+	// Load all histograms
+	histograms := make(map[string]metrics.Histogram)
+	rows, err = s.pool.Query(ctx, `SELECT name, bounds, counts, count, sum, version FROM histogram WHERE tenant_id = $1`, s.tenant)
+	if err != nil {
+		return fmt.Errorf("query histogram: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var h metrics.Histogram
+		var version int64
+		if err := rows.Scan(&name, &h.Bounds, &h.Counts, &h.Count, &h.Sum, &version); err != nil {
+			return fmt.Errorf("scan histogram: %w", err)
+		}
+		histograms[name] = h
+		versions[seriesKey{mtype: "histogram", name: name}] = version
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read histogram: %w", err)
+	}
+
+	// Load all summaries
+	summaries := make(map[string]metrics.Summary)
+	rows, err = s.pool.Query(ctx, `SELECT name, count, sum, quantiles, quantile_values, version FROM summary WHERE tenant_id = $1`, s.tenant)
+	if err != nil {
+		return fmt.Errorf("query summary: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var sm metrics.Summary
+		var quantiles, values []float64
+		var version int64
+		if err := rows.Scan(&name, &sm.Count, &sm.Sum, &quantiles, &values, &version); err != nil {
+			return fmt.Errorf("scan summary: %w", err)
+		}
+		sm.Quantiles = zipQuantiles(quantiles, values)
+		summaries[name] = sm
+		versions[seriesKey{mtype: "summary", name: name}] = version
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read summary: %w", err)
 	}
+
+	// Load the metadata registry
+	meta := make(map[string]metrics.Metadata)
+	rows, err = s.pool.Query(ctx, `SELECT name, type, description, unit, owner FROM metric_metadata WHERE tenant_id = $1`, s.tenant)
+	if err != nil {
+		return fmt.Errorf("query metadata: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var md metrics.Metadata
+		if err := rows.Scan(&md.ID, &md.MType, &md.Description, &md.Unit, &md.Owner); err != nil {
+			return fmt.Errorf("scan metadata: %w", err)
+		}
+		meta[md.ID] = md
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read metadata: %w", err)
+	}
+
+	s.cache.mu.Lock()
+	s.cache.gauge = gauges
+	s.cache.counter = counters
+	s.cache.histogram = histograms
+	s.cache.summary = summaries
+	s.cache.meta = meta
+	s.cache.mu.Unlock()
+	s.versions.replace(versions)
 	return nil
 }
 
-// execWithRetry executes a database query with retry logic for transient errors.
+// withRetry runs a database operation with retry logic for transient errors.
 // It uses the go-retry library to implement exponential backoff retry strategy
 // for handling transient database errors (like connection issues, deadlocks, etc.).
+// Each attempt runs on a pooled connection and is bounded by the query timeout.
 //
 // Parameters:
 //   - ctx: Context for the operation
-//   - query: SQL query to execute
-//   - args: Query arguments
+//   - op: Operation to run; receives the context of the attempt
 //
 // Returns:
 //   - error: nil if successful, otherwise the last error encountered
-func (s *DBStorage) execWithRetry(ctx context.Context, query string, args ...interface{}) error {
+func (s *DBStorage) withRetry(ctx context.Context, op func(ctx context.Context) error) error {
 	backoff := retry.WithMaxRetries(3, retry.NewExponential(1*time.Second))
 
 	return retry.Do(ctx, backoff, func(ctx context.Context) error {
-		_, err := s.conn.Exec(ctx, query, args...)
+		attemptCtx, cancel := s.withTimeout(ctx)
+		defer cancel()
+
+		err := op(attemptCtx)
 		if err == nil {
 			return nil
 		}
@@ -196,8 +416,25 @@ func (s *DBStorage) execWithRetry(ctx context.Context, query string, args ...int
 	})
 }
 
+// queryRowWithRetry executes a query returning one row with retry logic for transient errors.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - query: SQL query to execute
+//   - dest: Destinations for the columns of the returned row
+//   - args: Query arguments
+//
+// Returns:
+//   - error: nil if successful, otherwise the last error encountered
+func (s *DBStorage) queryRowWithRetry(ctx context.Context, query string, dest []interface{}, args ...interface{}) error {
+	return s.withRetry(ctx, func(ctx context.Context) error {
+		return s.pool.QueryRow(ctx, query, args...).Scan(dest...)
+	})
+}
+
 // UpdateGauge updates or creates a gauge metric with the given name and value.
-// The operation is atomic and updates the database.
+// The operation is atomic and updates the database. Only writes to the same
+// series wait for each other.
 //
 // Parameters:
 //   - ctx: Context for the operation
@@ -205,23 +442,30 @@ func (s *DBStorage) execWithRetry(ctx context.Context, query string, args ...int
 //   - value: New gauge value
 //
 // Returns:
-//   - error: Any error during database operation
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a counter,
+//     otherwise any error during database operation
 func (s *DBStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.checkCachedType(name, "gauge"); err != nil {
+		return err
+	}
 
-	query := `INSERT INTO gauge (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = $2`
-	if err := s.execWithRetry(ctx, query, name, value); err != nil {
-		return fmt.Errorf("save gauge %s: %w", name, err)
+	unlock := s.locks.lock("gauge", name)
+	defer unlock()
+
+	var version int64
+	query := `INSERT INTO gauge (tenant_id, name, value) VALUES ($1, $2, $3) ON CONFLICT (tenant_id, name) DO UPDATE SET value = $3 RETURNING version`
+	if err := s.queryRowWithRetry(ctx, query, []interface{}{&version}, s.tenant, name, value); err != nil {
+		return fmt.Errorf("save gauge %s: %w", name, dbWriteError(err))
 	}
 
 	// Update cache to maintain consistency with database
-	s.cache.gauge[name] = value
+	s.applyGauge(name, value, version)
 	return nil
 }
 
 // UpdateCounter increments a counter metric by the given delta.
-// The operation adds the delta to the existing value in the database.
+// The operation adds the delta to the existing value in the database; the cache
+// takes the resulting value, which includes increments made by other instances.
 //
 // Parameters:
 //   - ctx: Context for the operation
@@ -229,17 +473,24 @@ func (s *DBStorage) UpdateGauge(ctx context.Context, name string, value float64)
 //   - delta: Amount to increment by
 //
 // Returns:
-//   - error: Any error during database operation
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge,
+//     ErrCounterOverflow if the BIGINT column would overflow, otherwise any error
+//     during database operation
 func (s *DBStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.checkCachedType(name, "counter"); err != nil {
+		return err
+	}
+
+	unlock := s.locks.lock("counter", name)
+	defer unlock()
 
-	query := `INSERT INTO counter (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = counter.value + $2`
-	if err := s.execWithRetry(ctx, query, name, delta); err != nil {
-		return fmt.Errorf("save counter %s: %w", name, err)
+	var value, version int64
+	query := `INSERT INTO counter (tenant_id, name, value) VALUES ($1, $2, $3) ON CONFLICT (tenant_id, name) DO UPDATE SET value = counter.value + $3 RETURNING value, version`
+	if err := s.queryRowWithRetry(ctx, query, []interface{}{&value, &version}, s.tenant, name, delta); err != nil {
+		return fmt.Errorf("save counter %s: %w", name, dbWriteError(err))
 	}
 
-	s.cache.counter[name] += delta
+	s.applyCounter(name, value, version)
 	return nil
 }
 
@@ -252,19 +503,367 @@ func (s *DBStorage) UpdateCounter(ctx context.Context, name string, delta int64)
 //   - value: New absolute value
 //
 // Returns:
-//   - error: Any error during database operation
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge,
+//     otherwise any error during database operation
 func (s *DBStorage) SetCounter(ctx context.Context, name string, value int64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.checkCachedType(name, "counter"); err != nil {
+		return err
+	}
 
-	query := `INSERT INTO counter (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = $2`
-	if err := s.execWithRetry(ctx, query, name, value); err != nil {
-		return fmt.Errorf("set counter %s: %w", name, err)
+	unlock := s.locks.lock("counter", name)
+	defer unlock()
+
+	var version int64
+	query := `INSERT INTO counter (tenant_id, name, value) VALUES ($1, $2, $3) ON CONFLICT (tenant_id, name) DO UPDATE SET value = $3 RETURNING version`
+	if err := s.queryRowWithRetry(ctx, query, []interface{}{&version}, s.tenant, name, value); err != nil {
+		return fmt.Errorf("set counter %s: %w", name, dbWriteError(err))
 	}
-	s.cache.counter[name] = value
+
+	s.applyCounter(name, value, version)
 	return nil
 }
 
+// Upsert statements merging histograms and summaries. A histogram is only merged if
+// the stored bounds equal the given ones; otherwise no row is returned.
+const (
+	histogramUpsert = `INSERT INTO histogram (tenant_id, name, bounds, counts, count, sum) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET
+			counts = ARRAY(SELECT c + d FROM unnest(histogram.counts, $4::bigint[]) WITH ORDINALITY AS t(c, d, i) ORDER BY i),
+			count = histogram.count + $5,
+			sum = histogram.sum + $6
+		WHERE histogram.bounds = $3::double precision[]
+		RETURNING counts, count, sum, version`
+	summaryUpsert = `INSERT INTO summary (tenant_id, name, count, sum, quantiles, quantile_values) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET
+			count = summary.count + $3,
+			sum = summary.sum + $4,
+			quantiles = $5,
+			quantile_values = $6
+		RETURNING count, sum, version`
+)
+
+// splitQuantiles splits quantiles into the rank and value arrays stored in the summary table.
+//
+// Parameters:
+//   - qs: Quantiles of a summary
+//
+// Returns:
+//   - []float64: Ranks
+//   - []float64: Values
+func splitQuantiles(qs []metrics.Quantile) ([]float64, []float64) {
+	ranks := make([]float64, len(qs))
+	values := make([]float64, len(qs))
+	for i, q := range qs {
+		ranks[i], values[i] = q.Quantile, q.Value
+	}
+	return ranks, values
+}
+
+// zipQuantiles joins the rank and value arrays of the summary table.
+//
+// Parameters:
+//   - ranks: Stored ranks
+//   - values: Stored values, as many as ranks
+//
+// Returns:
+//   - []metrics.Quantile: Quantiles, or nil if there are none
+func zipQuantiles(ranks, values []float64) []metrics.Quantile {
+	if len(ranks) == 0 {
+		return nil
+	}
+	qs := make([]metrics.Quantile, min(len(ranks), len(values)))
+	for i := range qs {
+		qs[i] = metrics.Quantile{Quantile: ranks[i], Value: values[i]}
+	}
+	return qs
+}
+
+// histogramArgs returns the arguments of histogramUpsert.
+func (s *DBStorage) histogramArgs(name string, h metrics.Histogram) []interface{} {
+	bounds := h.Bounds
+	if bounds == nil {
+		bounds = []float64{} // NOT NULL column
+	}
+	return []interface{}{s.tenant, name, bounds, h.Counts, h.Count, h.Sum}
+}
+
+// summaryArgs returns the arguments of summaryUpsert.
+func (s *DBStorage) summaryArgs(name string, sm metrics.Summary) []interface{} {
+	ranks, values := splitQuantiles(sm.Quantiles)
+	return []interface{}{s.tenant, name, sm.Count, sm.Sum, ranks, values}
+}
+
+// histogramWriteError maps the missing row of a histogram merge with other bounds
+// to ErrBucketMismatch and other errors with dbWriteError.
+//
+// Parameters:
+//   - err: Error returned by histogramUpsert
+//
+// Returns:
+//   - error: err wrapped with the matching sentinel error
+func histogramWriteError(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: stored histogram has other bounds", ErrBucketMismatch)
+	}
+	return dbWriteError(err)
+}
+
+// UpdateHistogram merges a histogram into the stored one with a single upsert; the
+// cache takes the merged row, which includes observations added by other instances.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - name: Metric name
+//   - h: Observations to add
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the histogram is invalid, ErrTypeConflict
+//     if the metric is registered with another type, ErrBucketMismatch if the stored
+//     histogram has other bounds, ErrCounterOverflow if a count would overflow,
+//     otherwise any error during database operation
+func (s *DBStorage) UpdateHistogram(ctx context.Context, name string, h metrics.Histogram) error {
+	if err := ValidateHistogram(h); err != nil {
+		return err
+	}
+	if err := s.checkCachedType(name, "histogram"); err != nil {
+		return err
+	}
+
+	unlock := s.locks.lock("histogram", name)
+	defer unlock()
+
+	stored := metrics.Histogram{Bounds: slices.Clone(h.Bounds)}
+	var version int64
+	dest := []interface{}{&stored.Counts, &stored.Count, &stored.Sum, &version}
+	if err := s.queryRowWithRetry(ctx, histogramUpsert, dest, s.histogramArgs(name, h)...); err != nil {
+		return fmt.Errorf("save histogram %s: %w", name, histogramWriteError(err))
+	}
+
+	s.applyHistogram(name, stored, version)
+	return nil
+}
+
+// UpdateSummary merges a summary into the stored one with a single upsert; the cache
+// takes the merged row.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - name: Metric name
+//   - sm: Summary of the new observations
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the summary is invalid, ErrTypeConflict
+//     if the metric is registered with another type, ErrCounterOverflow if the count
+//     would overflow, otherwise any error during database operation
+func (s *DBStorage) UpdateSummary(ctx context.Context, name string, sm metrics.Summary) error {
+	if err := ValidateSummary(sm); err != nil {
+		return err
+	}
+	if err := s.checkCachedType(name, "summary"); err != nil {
+		return err
+	}
+
+	unlock := s.locks.lock("summary", name)
+	defer unlock()
+
+	stored := metrics.Summary{Quantiles: slices.Clone(sm.Quantiles)}
+	var version int64
+	dest := []interface{}{&stored.Count, &stored.Sum, &version}
+	if err := s.queryRowWithRetry(ctx, summaryUpsert, dest, s.summaryArgs(name, sm)...); err != nil {
+		return fmt.Errorf("save summary %s: %w", name, dbWriteError(err))
+	}
+
+	s.applySummary(name, stored, version)
+	return nil
+}
+
+// UpdateBatch applies a batch of updates in a single transaction. All statements are
+// sent in one round trip with pgx.Batch; if any statement fails, the transaction is
+// rolled back and the failing item is reported in a *BatchError. Transient errors
+// retry the whole transaction. The cache is updated only after a successful commit.
+// The locks of all series in the batch are held until the cache is updated.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - batch: Metrics to apply
+//
+// Returns:
+//   - error: *BatchError if an item is invalid, conflicts with its registered type,
+//     a counter would overflow, a histogram has other bounds or an item is rejected
+//     by the database, otherwise any error from the transaction
+func (s *DBStorage) UpdateBatch(ctx context.Context, batch []metrics.Metrics) error {
+	if err := validateBatch(batch); err != nil {
+		return err
+	}
+
+	unlock := s.locks.lockBatch(batch)
+	defer unlock()
+
+	// Reject type conflicts and overflows known from the cache without a round trip;
+	// the database still catches those caused by writes of other instances
+	registered := func(name string) string {
+		md, _ := s.cache.GetMetadata(name)
+		return md.MType
+	}
+	if err := checkTypes(batch, registered); err != nil {
+		return err
+	}
+	current := func(name string) int64 {
+		v, _ := s.cache.GetCounter(name)
+		return v
+	}
+	if err := checkCounters(batch, current); err != nil {
+		return err
+	}
+	if err := checkDistributions(batch, s.cache.GetHistogram, s.cache.GetSummary); err != nil {
+		return err
+	}
+
+	var rows []committedRow
+	err := s.withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		rows, err = s.execBatchTx(ctx, batch)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Mirror the committed rows in the cache, in batch order
+	for i, m := range batch {
+		switch m.MType {
+		case "gauge":
+			s.applyGauge(m.ID, rows[i].gauge, rows[i].version)
+		case "counter":
+			s.applyCounter(m.ID, rows[i].counter, rows[i].version)
+		case "histogram":
+			s.applyHistogram(m.ID, rows[i].histogram, rows[i].version)
+		case "summary":
+			s.applySummary(m.ID, rows[i].summary, rows[i].version)
+		}
+	}
+	return nil
+}
+
+// committedRow is the state of a row after one statement of a batch.
+type committedRow struct {
+	gauge     float64           // Stored gauge value
+	counter   int64             // Stored counter value
+	histogram metrics.Histogram // Stored histogram
+	summary   metrics.Summary   // Stored summary
+	version   int64             // Row version after the statement
+}
+
+// execBatchTx executes the batch inside one transaction.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - batch: Validated metrics to apply
+//
+// Returns:
+//   - []committedRow: State of the row written by each item, in batch order
+//   - error: *BatchError wrapping the database error of the first failing item,
+//     or an error from beginning or committing the transaction
+func (s *DBStorage) execBatchTx(ctx context.Context, batch []metrics.Metrics) ([]committedRow, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin batch transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	b := &pgx.Batch{}
+	for _, m := range batch {
+		switch m.MType {
+		case "gauge":
+			b.Queue(
+				`INSERT INTO gauge (tenant_id, name, value) VALUES ($1, $2, $3) ON CONFLICT (tenant_id, name) DO UPDATE SET value = $3 RETURNING version`,
+				s.tenant, m.ID, *m.Value,
+			)
+		case "counter":
+			b.Queue(
+				`INSERT INTO counter (tenant_id, name, value) VALUES ($1, $2, $3) ON CONFLICT (tenant_id, name) DO UPDATE SET value = counter.value + $3 RETURNING value, version`,
+				s.tenant, m.ID, *m.Delta,
+			)
+		case "histogram":
+			b.Queue(histogramUpsert, s.histogramArgs(m.ID, *m.Histogram)...)
+		case "summary":
+			b.Queue(summaryUpsert, s.summaryArgs(m.ID, *m.Summary)...)
+		}
+	}
+
+	rows := make([]committedRow, len(batch))
+	results := tx.SendBatch(ctx, b)
+	for i, m := range batch {
+		row := results.QueryRow()
+		var err error
+		switch m.MType {
+		case "gauge":
+			rows[i].gauge = *m.Value
+			err = row.Scan(&rows[i].version)
+		case "counter":
+			err = row.Scan(&rows[i].counter, &rows[i].version)
+		case "histogram":
+			h := &rows[i].histogram
+			h.Bounds = slices.Clone(m.Histogram.Bounds)
+			if err = row.Scan(&h.Counts, &h.Count, &h.Sum, &rows[i].version); err != nil {
+				err = histogramWriteError(err)
+			}
+		case "summary":
+			sm := &rows[i].summary
+			sm.Quantiles = slices.Clone(m.Summary.Quantiles)
+			err = row.Scan(&sm.Count, &sm.Sum, &rows[i].version)
+		}
+		if err != nil {
+			results.Close()
+			// Keep the PgError reachable so that the caller can classify it for retries
+			return nil, &BatchError{Items: []BatchItemError{{Index: i, ID: m.ID, MType: m.MType, Err: dbWriteError(err)}}}
+		}
+	}
+	if err := results.Close(); err != nil {
+		return nil, fmt.Errorf("close batch results: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit batch transaction: %w", err)
+	}
+	return rows, nil
+}
+
+// dbWriteError marks a BIGINT overflow reported by PostgreSQL with ErrCounterOverflow
+// and a rejection by the metric_check_type trigger with ErrTypeConflict.
+//
+// Parameters:
+//   - err: Error returned by a gauge or counter statement
+//
+// Returns:
+//   - error: err wrapped with the matching sentinel error, otherwise err
+func dbWriteError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgerrcode.NumericValueOutOfRange:
+			return fmt.Errorf("%w: %w", ErrCounterOverflow, err)
+		case pgerrcode.CheckViolation:
+			return fmt.Errorf("%w: %w", ErrTypeConflict, err)
+		}
+	}
+	return err
+}
+
+// checkCachedType checks a sample's type against the cached metadata, so that known
+// conflicts are rejected without a round trip.
+//
+// Parameters:
+//   - name: Metric name
+//   - mtype: Type of the sample
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict if the types differ, otherwise nil
+func (s *DBStorage) checkCachedType(name, mtype string) error {
+	md, _ := s.cache.GetMetadata(name)
+	return checkType(name, md.MType, mtype)
+}
+
 // SaveCounterValue is an alias for SetCounter, provided for backward compatibility.
 //
 // Parameters:
@@ -275,80 +874,184 @@ func (s *DBStorage) SetCounter(ctx context.Context, name string, value int64) er
 // Returns:
 //   - error: Any error during database operation
 func (s *DBStorage) SaveCounterValue(ctx context.Context, name string, value int64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	_, err := s.conn.Exec(
-		ctx,
-		`INSERT INTO counter (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = $2`,
-		name, value,
-	)
-	if err != nil {
+	if err := s.SetCounter(ctx, name, value); err != nil {
 		return fmt.Errorf("save counter value %s: %w", name, err)
 	}
-	s.cache.counter[name] = value
 	return nil
 }
 
-// SaveAll persists all metrics from the in-memory cache to the database in a batch operation.
-// This is useful for periodic backups or during shutdown.
+// DeleteGauge removes a gauge metric from the database and the cache.
 //
 // Parameters:
 //   - ctx: Context for the operation
+//   - name: Metric name
 //
 // Returns:
-//   - error: First error encountered during batch execution, or nil if successful
-func (s *DBStorage) SaveAll(ctx context.Context) error {
-	s.mu.RLock()
-	gauges := make(map[string]float64)
-	counters := make(map[string]int64)
-	for k, v := range s.cache.gauge {
-		gauges[k] = v
-	}
-	for k, v := range s.cache.counter {
-		counters[k] = v
-	}
-	s.mu.RUnlock()
+//   - bool: true if the metric existed
+//   - error: Any error during database operation
+func (s *DBStorage) DeleteGauge(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries(ctx, "gauge", name)
+}
 
-	if len(gauges) == 0 && len(counters) == 0 {
-		return nil
+// DeleteCounter removes a counter metric from the database and the cache.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error during database operation
+func (s *DBStorage) DeleteCounter(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries(ctx, "counter", name)
+}
+
+// DeleteHistogram removes a histogram metric from the database and the cache.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error during database operation
+func (s *DBStorage) DeleteHistogram(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries(ctx, "histogram", name)
+}
+
+// DeleteSummary removes a summary metric from the database and the cache.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error during database operation
+func (s *DBStorage) DeleteSummary(ctx context.Context, name string) (bool, error) {
+	return s.deleteSeries(ctx, "summary", name)
+}
+
+// deleteSeries removes a series from the database and the cache.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - mtype: Metric type, which is also the table name
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error during database operation
+func (s *DBStorage) deleteSeries(ctx context.Context, mtype, name string) (bool, error) {
+	unlock := s.locks.lock(mtype, name)
+	defer unlock()
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// mtype is one of the fixed table names, never user input
+	tag, err := s.pool.Exec(ctx, `DELETE FROM `+mtype+` WHERE tenant_id = $1 AND name = $2`, s.tenant, name)
+	if err != nil {
+		return false, fmt.Errorf("delete %s %s: %w", mtype, name, err)
 	}
+	s.cache.mu.Lock()
+	s.cache.deleteSeriesLocked(mtype, name)
+	s.cache.mu.Unlock()
+	return tag.RowsAffected() > 0, nil
+}
 
-	// Create a batch operation for efficiency
-	batch := &pgx.Batch{}
+// SaveAll is kept for compatibility and does nothing: every write reaches the database
+// before it is acknowledged, so the cache holds nothing that is not stored yet.
+// Writing the cache back would bump the version of every row, notify all replicas
+// and could bring back rows that another replica deleted since they were cached.
+//
+// Parameters:
+//   - ctx: Context for the operation (unused)
+//
+// Returns:
+//   - error: Always nil
+func (s *DBStorage) SaveAll(ctx context.Context) error {
+	return nil
+}
 
-	for name, value := range gauges {
-		batch.Queue(
-			`INSERT INTO gauge (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = $2`,
-			name, value,
-		)
+// SetMetadata registers the metadata of a metric in the database and the cache.
+// The row is only written if no series of another type exists, checked in the
+// same statement.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//   - md: Metadata to register
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the metadata is invalid,
+//     ErrTypeConflict if a series of another type is stored under its name,
+//     otherwise any error during database operation
+func (s *DBStorage) SetMetadata(ctx context.Context, md metrics.Metadata) error {
+	if err := ValidateMetadata(md); err != nil {
+		return err
 	}
 
-	for name, value := range counters {
-		batch.Queue(
-			`INSERT INTO counter (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = $2`,
-			name, value,
+	unlock := s.locks.lock("metadata", md.ID)
+	defer unlock()
+
+	// The statement returns the type of a conflicting series, or NULL once written
+	query := `WITH conflict AS (
+			SELECT 'gauge' AS type FROM gauge WHERE $3::text <> 'gauge' AND tenant_id = $1 AND name = $2
+			UNION ALL SELECT 'counter' FROM counter WHERE $3::text <> 'counter' AND tenant_id = $1 AND name = $2
+			UNION ALL SELECT 'histogram' FROM histogram WHERE $3::text <> 'histogram' AND tenant_id = $1 AND name = $2
+			UNION ALL SELECT 'summary' FROM summary WHERE $3::text <> 'summary' AND tenant_id = $1 AND name = $2
+		), written AS (
+			INSERT INTO metric_metadata (tenant_id, name, type, description, unit, owner)
+			SELECT $1, $2, $3::text, $4, $5, $6
+			WHERE NOT EXISTS (SELECT 1 FROM conflict)
+			ON CONFLICT (tenant_id, name) DO UPDATE SET type = $3::text, description = $4, unit = $5, owner = $6
+			RETURNING 1
 		)
+		SELECT (SELECT type FROM conflict LIMIT 1)`
+	var stored *string
+	err := s.queryRowWithRetry(ctx, query, []interface{}{&stored}, s.tenant, md.ID, md.MType, md.Description, md.Unit, md.Owner)
+	if err != nil {
+		return fmt.Errorf("save metadata %s: %w", md.ID, err)
+	}
+	if stored != nil {
+		return seriesConflict(md, *stored)
 	}
 
-	// Execute batch and collect errors
-	results := s.conn.SendBatch(ctx, batch)
-	defer results.Close()
+	s.applyMetadata(md)
+	return nil
+}
 
-	var firstErr error
-	total := len(gauges) + len(counters)
-	for i := 0; i < total; i++ {
-		if _, err := results.Exec(); err != nil {
-			if firstErr == nil {
-				firstErr = err
-			}
-		}
-	}
+// GetMetadata retrieves the metadata of a metric from the in-memory cache.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Metadata: Registered metadata
+//   - bool: true if metadata is registered, false otherwise
+func (s *DBStorage) GetMetadata(name string) (metrics.Metadata, bool) {
+	return s.cache.GetMetadata(name)
+}
 
-	return firstErr
+// AllMetadata returns the metadata of all documented metrics from the in-memory cache.
+//
+// Returns:
+//   - []metrics.Metadata: Registered metadata sorted by metric name
+//   - error: Always nil (kept for interface compatibility)
+func (s *DBStorage) AllMetadata() ([]metrics.Metadata, error) {
+	return s.cache.AllMetadata()
 }
 
-// Ping checks the database connection health.
+// Pool returns the connection pool, for components that share the database
+// with the storage, such as leader election.
+//
+// Returns:
+//   - *pgxpool.Pool: Connection pool of the storage
+func (s *DBStorage) Pool() *pgxpool.Pool {
+	return s.pool
+}
+
+// Ping checks the database connection health by acquiring a pooled connection.
 //
 // Parameters:
 //   - ctx: Context for the ping operation
@@ -356,7 +1059,7 @@ func (s *DBStorage) SaveAll(ctx context.Context) error {
 // Returns:
 //   - error: nil if connection is healthy, otherwise connection error
 func (s *DBStorage) Ping(ctx context.Context) error {
-	return s.conn.PgConn().Ping(ctx)
+	return s.pool.Ping(ctx)
 }
 
 // GetGauge retrieves a gauge metric value from the in-memory cache.
@@ -368,8 +1071,6 @@ func (s *DBStorage) Ping(ctx context.Context) error {
 //   - float64: The metric value
 //   - bool: true if the metric exists, false otherwise
 func (s *DBStorage) GetGauge(name string) (float64, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
 	return s.cache.GetGauge(name)
 }
 
@@ -382,26 +1083,52 @@ func (s *DBStorage) GetGauge(name string) (float64, bool) {
 //   - int64: The metric value
 //   - bool: true if the metric exists, false otherwise
 func (s *DBStorage) GetCounter(name string) (int64, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
 	return s.cache.GetCounter(name)
 }
 
-// GetAll returns all metrics (both gauge and counter) from the in-memory cache.
+// GetHistogram retrieves a histogram from the in-memory cache.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Histogram: A copy of the cached histogram
+//   - bool: true if the metric exists, false otherwise
+func (s *DBStorage) GetHistogram(name string) (metrics.Histogram, bool) {
+	return s.cache.GetHistogram(name)
+}
+
+// GetSummary retrieves a summary from the in-memory cache.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Summary: A copy of the cached summary
+//   - bool: true if the metric exists, false otherwise
+func (s *DBStorage) GetSummary(name string) (metrics.Summary, bool) {
+	return s.cache.GetSummary(name)
+}
+
+// GetAll returns all metrics of every type from the in-memory cache.
 //
 // Returns:
 //   - []metrics.Metrics: Slice of all metrics
 //   - error: Always nil (kept for interface compatibility)
 func (s *DBStorage) GetAll() ([]metrics.Metrics, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
 	return s.cache.GetAll()
 }
 
-// Close closes the database connection.
+// Close closes the connection pool if this storage owns it and stops applying
+// change notifications to the cache.
+// Tenant storages created by NewTenantDBStorage leave the shared pool open.
 //
 // Returns:
-//   - error: Any error during connection closure
+//   - error: Always nil (kept for io.Closer compatibility)
 func (s *DBStorage) Close() error {
-	return s.conn.Close(context.Background())
+	s.feed.unregister(s)
+	if s.ownsPool {
+		s.pool.Close()
+	}
+	return nil
 }
@@ -0,0 +1,94 @@
+//go:build integration
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TestConformanceDBStorage runs the conformance suite against a real database.
+// Run it with:
+//
+//	TEST_DATABASE_DSN=postgres://... go test -tags integration ./internal/storage/
+//
+// Every subtest works in a tenant of its own, whose rows are deleted afterwards.
+func TestConformanceDBStorage(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+	// Migrations are read from the repository root
+	t.Chdir("../..")
+
+	ctx := context.Background()
+	var seq atomic.Int64
+	runConformance(t, conformanceBackend{
+		open: func(t *testing.T) Storage {
+			// A pool per subtest, so that breakWrites can close it
+			parent, err := NewDBStorage(ctx, dsn)
+			if err != nil {
+				t.Fatalf("NewDBStorage: %v", err)
+			}
+			tenant := fmt.Sprintf("conformance-%d-%d", time.Now().UnixNano(), seq.Add(1))
+			s, err := NewTenantDBStorage(ctx, parent, tenant)
+			if err != nil {
+				parent.Close()
+				t.Fatalf("NewTenantDBStorage: %v", err)
+			}
+			t.Cleanup(func() {
+				parent.Close()
+				deleteTenantRows(t, dsn, tenant)
+			})
+			return s
+		},
+		reopen: func(t *testing.T, s Storage) Storage {
+			// A fresh cache loaded from the rows of the tenant
+			old := s.(*DBStorage)
+			mustNoErr(t, "Close", old.Close())
+			reopened, err := NewTenantDBStorage(ctx, old, old.tenant)
+			if err != nil {
+				t.Fatalf("NewTenantDBStorage: %v", err)
+			}
+			t.Cleanup(func() { reopened.Close() })
+			return reopened
+		},
+		breakWrites: func(t *testing.T, s Storage) {
+			s.(*DBStorage).pool.Close()
+		},
+	})
+}
+
+// deleteTenantRows removes everything a conformance subtest wrote, from every table
+// of the schema that has a tenant_id column.
+func deleteTenantRows(t *testing.T, dsn, tenant string) {
+	ctx := context.Background()
+	pool, err := NewPool(ctx, dsn, PoolConfig{})
+	if err != nil {
+		t.Errorf("clean up tenant %s: %v", tenant, err)
+		return
+	}
+	defer pool.Close()
+
+	rows, err := pool.Query(ctx, `SELECT table_name FROM information_schema.columns WHERE table_schema = current_schema() AND column_name = 'tenant_id'`)
+	if err != nil {
+		t.Errorf("clean up tenant %s: %v", tenant, err)
+		return
+	}
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Errorf("clean up tenant %s: %v", tenant, err)
+		return
+	}
+	for _, table := range tables {
+		if _, err := pool.Exec(ctx, "DELETE FROM "+pgx.Identifier{table}.Sanitize()+" WHERE tenant_id = $1", tenant); err != nil {
+			t.Errorf("clean up tenant %s: %v", tenant, err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// ErrBucketMismatch is returned when a histogram is merged into a stored histogram
+// with different bucket bounds. The stored histogram is left unchanged; delete it
+// to change its buckets.
+var ErrBucketMismatch = errors.New("histogram buckets differ")
+
+// Size limits of distributions, which keep rows and change notifications small.
+const (
+	maxHistogramBounds  = 64
+	maxSummaryQuantiles = 32
+)
+
+// metricTypes lists all metric types in the order GetAll returns them.
+var metricTypes = []string{"gauge", "counter", "histogram", "summary"}
+
+// knownType reports whether mtype is a supported metric type.
+//
+// Parameters:
+//   - mtype: Metric type
+//
+// Returns:
+//   - bool: true for "gauge", "counter", "histogram" and "summary"
+func knownType(mtype string) bool {
+	return slices.Contains(metricTypes, mtype)
+}
+
+// finite reports whether v is neither infinite nor NaN.
+func finite(v float64) bool {
+	return !math.IsInf(v, 0) && !math.IsNaN(v)
+}
+
+// ValidateHistogram checks that a histogram has finite, strictly ascending bounds,
+// one non-negative count per bucket plus the overflow bucket, a total matching
+// the bucket counts and a finite sum.
+//
+// Parameters:
+//   - h: Histogram to validate
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the histogram is invalid, otherwise nil
+func ValidateHistogram(h metrics.Histogram) error {
+	if len(h.Bounds) > maxHistogramBounds {
+		return fmt.Errorf("%w: more than %d histogram bounds", ErrInvalidMetric, maxHistogramBounds)
+	}
+	for i, b := range h.Bounds {
+		if !finite(b) || (i > 0 && b <= h.Bounds[i-1]) {
+			return fmt.Errorf("%w: histogram bounds must be finite and strictly ascending", ErrInvalidMetric)
+		}
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: histogram needs %d counts for %d bounds, got %d", ErrInvalidMetric, len(h.Bounds)+1, len(h.Bounds), len(h.Counts))
+	}
+	var total int64
+	for _, c := range h.Counts {
+		if c < 0 {
+			return fmt.Errorf("%w: histogram counts must not be negative", ErrInvalidMetric)
+		}
+		var err error
+		if total, err = AddCounter(total, c); err != nil {
+			return fmt.Errorf("%w: histogram count: %w", ErrInvalidMetric, err)
+		}
+	}
+	if h.Count != total {
+		return fmt.Errorf("%w: histogram count %d differs from the bucket total %d", ErrInvalidMetric, h.Count, total)
+	}
+	if !finite(h.Sum) {
+		return fmt.Errorf("%w: histogram sum must be finite", ErrInvalidMetric)
+	}
+	return nil
+}
+
+// ValidateSummary checks that a summary has a non-negative count, a finite sum and
+// finite quantiles whose ranks lie in [0, 1] in strictly ascending order.
+//
+// Parameters:
+//   - sm: Summary to validate
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the summary is invalid, otherwise nil
+func ValidateSummary(sm metrics.Summary) error {
+	switch {
+	case sm.Count < 0:
+		return fmt.Errorf("%w: summary count must not be negative", ErrInvalidMetric)
+	case !finite(sm.Sum):
+		return fmt.Errorf("%w: summary sum must be finite", ErrInvalidMetric)
+	case len(sm.Quantiles) > maxSummaryQuantiles:
+		return fmt.Errorf("%w: more than %d summary quantiles", ErrInvalidMetric, maxSummaryQuantiles)
+	}
+	for i, q := range sm.Quantiles {
+		if q.Quantile < 0 || q.Quantile > 1 || (i > 0 && q.Quantile <= sm.Quantiles[i-1].Quantile) {
+			return fmt.Errorf("%w: summary quantiles must lie in [0, 1] in strictly ascending order", ErrInvalidMetric)
+		}
+		if !finite(q.Value) {
+			return fmt.Errorf("%w: summary quantile values must be finite", ErrInvalidMetric)
+		}
+	}
+	return nil
+}
+
+// MergeHistogram adds the observations of delta to a stored histogram.
+//
+// Parameters:
+//   - cur: Stored histogram
+//   - delta: Validated observations to add; must have the bounds of cur
+//
+// Returns:
+//   - metrics.Histogram: The merged histogram, sharing no memory with its inputs
+//   - error: Error wrapping ErrBucketMismatch if the bounds differ, or
+//     ErrCounterOverflow if a count would overflow
+func MergeHistogram(cur, delta metrics.Histogram) (metrics.Histogram, error) {
+	if !slices.Equal(cur.Bounds, delta.Bounds) {
+		return cur, fmt.Errorf("%w: stored %v, got %v", ErrBucketMismatch, cur.Bounds, delta.Bounds)
+	}
+	out := CloneHistogram(cur)
+	for i, c := range delta.Counts {
+		var err error
+		if out.Counts[i], err = AddCounter(out.Counts[i], c); err != nil {
+			return cur, err
+		}
+	}
+	var err error
+	if out.Count, err = AddCounter(out.Count, delta.Count); err != nil {
+		return cur, err
+	}
+	out.Sum += delta.Sum
+	return out, nil
+}
+
+// MergeSummary adds the count and sum of delta to a stored summary and takes the
+// quantiles of delta, since quantiles of separate reports cannot be combined.
+//
+// Parameters:
+//   - cur: Stored summary
+//   - delta: Validated newer summary
+//
+// Returns:
+//   - metrics.Summary: The merged summary, sharing no memory with its inputs
+//   - error: Error wrapping ErrCounterOverflow if the count would overflow
+func MergeSummary(cur, delta metrics.Summary) (metrics.Summary, error) {
+	count, err := AddCounter(cur.Count, delta.Count)
+	if err != nil {
+		return cur, err
+	}
+	return metrics.Summary{
+		Count:     count,
+		Sum:       cur.Sum + delta.Sum,
+		Quantiles: slices.Clone(delta.Quantiles),
+	}, nil
+}
+
+// CloneHistogram returns a deep copy of a histogram.
+//
+// Parameters:
+//   - h: Histogram to copy
+//
+// Returns:
+//   - metrics.Histogram: Copy sharing no memory with h
+func CloneHistogram(h metrics.Histogram) metrics.Histogram {
+	h.Bounds = slices.Clone(h.Bounds)
+	h.Counts = slices.Clone(h.Counts)
+	return h
+}
+
+// CloneSummary returns a deep copy of a summary.
+//
+// Parameters:
+//   - sm: Summary to copy
+//
+// Returns:
+//   - metrics.Summary: Copy sharing no memory with sm
+func CloneSummary(sm metrics.Summary) metrics.Summary {
+	sm.Quantiles = slices.Clone(sm.Quantiles)
+	return sm
+}
+
+// mergeHistogramInto merges delta into the stored histogram of a series, or returns a
+// copy of delta if the series does not exist yet.
+//
+// Parameters:
+//   - cur: Stored histogram
+//   - exists: Whether the series exists
+//   - delta: Validated observations to add
+//
+// Returns:
+//   - metrics.Histogram: The new stored histogram
+//   - error: Any error of MergeHistogram
+func mergeHistogramInto(cur metrics.Histogram, exists bool, delta metrics.Histogram) (metrics.Histogram, error) {
+	if !exists {
+		return CloneHistogram(delta), nil
+	}
+	return MergeHistogram(cur, delta)
+}
+
+// mergeSummaryInto merges delta into the stored summary of a series, or returns a
+// copy of delta if the series does not exist yet.
+//
+// Parameters:
+//   - cur: Stored summary
+//   - exists: Whether the series exists
+//   - delta: Validated newer summary
+//
+// Returns:
+//   - metrics.Summary: The new stored summary
+//   - error: Any error of MergeSummary
+func mergeSummaryInto(cur metrics.Summary, exists bool, delta metrics.Summary) (metrics.Summary, error) {
+	if !exists {
+		return CloneSummary(delta), nil
+	}
+	return MergeSummary(cur, delta)
+}
+
+// checkDistributions checks that every histogram and summary of a validated batch
+// can be merged when the batch is applied in order on top of the stored series.
+//
+// Parameters:
+//   - batch: Validated metrics to check
+//   - histogram: Returns the stored histogram of a series and whether it exists
+//   - summary: Returns the stored summary of a series and whether it exists
+//
+// Returns:
+//   - error: *BatchError listing the items with mismatching buckets or an overflow, or nil
+func checkDistributions(batch []metrics.Metrics, histogram func(name string) (metrics.Histogram, bool), summary func(name string) (metrics.Summary, bool)) error {
+	var failed []BatchItemError
+	histograms := make(map[string]metrics.Histogram)
+	summaries := make(map[string]metrics.Summary)
+	for i, m := range batch {
+		var err error
+		switch m.MType {
+		case "histogram":
+			cur, seen := histograms[m.ID]
+			exists := seen
+			if !seen {
+				cur, exists = histogram(m.ID)
+			}
+			var next metrics.Histogram
+			if next, err = mergeHistogramInto(cur, exists, *m.Histogram); err == nil {
+				histograms[m.ID] = next
+			}
+		case "summary":
+			cur, seen := summaries[m.ID]
+			exists := seen
+			if !seen {
+				cur, exists = summary(m.ID)
+			}
+			var next metrics.Summary
+			if next, err = mergeSummaryInto(cur, exists, *m.Summary); err == nil {
+				summaries[m.ID] = next
+			}
+		}
+		if err != nil {
+			failed = append(failed, BatchItemError{Index: i, ID: m.ID, MType: m.MType, Err: fmt.Errorf("%s %s: %w", m.MType, m.ID, err)})
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Items: failed}
+	}
+	return nil
+}
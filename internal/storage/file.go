@@ -3,169 +3,622 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 
 	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
 )
 
-// FileStorage implements the Storage interface by persisting metrics to a JSON file on disk.
+// DefaultSnapshotSize is the write-ahead log size after which a snapshot is taken automatically.
+const DefaultSnapshotSize = 64 << 20
+
+// FileStorage implements the Storage interface by persisting metrics to disk.
 // It embeds MemStorage to provide in-memory storage and adds file persistence capabilities.
-// The storage supports both synchronous saves (after each update) and can be used with
-// periodic save strategies by calling Save() manually.
 //
-// File format: JSON array of metrics.Metrics objects, one per line or pretty-printed.
+// Every update is first appended to a write-ahead log (see wal) and then applied in
+// memory, so a write costs one append instead of rewriting all metrics. Save writes a
+// snapshot of all metrics and drops the log segments it covers. On startup the snapshot
+// is loaded and the log records after it are replayed; a torn record at the tail of
+// the log, detected by its checksum, is discarded.
+//
+// Snapshot format: JSON object with the LSN of the last record it contains, the metrics
+// and their registered metadata.
 // Example:
-// [
 //
-//	{"id":"Alloc","type":"gauge","value":42.5},
-//	{"id":"PollCount","type":"counter","delta":10}
+//	{"lsn":42,"metrics":[
+//	  {"id":"Alloc","type":"gauge","value":42.5},
+//	  {"id":"PollCount","type":"counter","delta":10},
+//	  {"id":"RequestLatency","type":"histogram","histogram":{"bounds":[0.1,0.5],"counts":[7,2,1],"count":10,"sum":1.9}}
+//	],"metadata":[
+//	  {"id":"Alloc","type":"gauge","description":"Bytes of allocated heap objects","unit":"bytes"}
+//	]}
 //
-// ]
+// Snapshots written by older versions (a plain JSON array of metrics) are still loaded.
 //
 // generate:reset
 type FileStorage struct {
-	*MemStorage            // Embedded in-memory storage for fast access
-	filePath    string     // Path to the JSON file for persistence
-	mu          sync.Mutex // Mutex to prevent concurrent file writes
+	*MemStorage                // Embedded in-memory storage for fast access
+	filePath     string        // Path to the snapshot file
+	mu           sync.Mutex    // Serializes writes so that log order matches memory order
+	snapMu       sync.Mutex    // Serializes snapshots
+	wal          *wal          // Write-ahead log
+	lsn          uint64        // LSN of the last logged record
+	snapshotSize int64         // Log size that triggers an automatic snapshot (0 to disable)
+	snapshotting atomic.Bool   // Whether an automatic snapshot is running
+	syncInterval time.Duration // Background fsync interval of the log (0 to sync every write)
+}
+
+// FileOptions configures the durability of FileStorage.
+type FileOptions struct {
+	SyncInterval time.Duration // Background fsync interval of the log; 0 syncs before every write returns
+	SnapshotSize int64         // Log size that triggers an automatic snapshot; 0 uses DefaultSnapshotSize, negative disables
 }
 
-// NewFileStorage creates a new FileStorage instance and loads existing data from the specified file.
+// fileSnapshot is the on-disk snapshot format.
+type fileSnapshot struct {
+	LSN      uint64             `json:"lsn"`                // LSN of the last log record included
+	Metrics  []metrics.Metrics  `json:"metrics"`            // All metrics
+	Metadata []metrics.Metadata `json:"metadata,omitempty"` // Registered metadata
+}
+
+// NewFileStorage creates a new FileStorage instance with default options and loads
+// existing data from the specified file and its write-ahead log.
 // If the file doesn't exist, it creates an empty storage.
 //
 // Parameters:
-//   - filePath: Path to the JSON file for persistence (e.g., "/tmp/metrics.json")
+//   - filePath: Path to the snapshot file (e.g., "/tmp/metrics.json")
 //
 // Returns:
 //   - *FileStorage: Initialized file storage with loaded data
-//   - error: Any error during file loading (except file not found)
+//   - error: Any error during loading (except file not found)
 func NewFileStorage(filePath string) (*FileStorage, error) {
+	return NewFileStorageWithOptions(filePath, FileOptions{})
+}
+
+// NewFileStorageWithOptions creates a new FileStorage instance and restores its state
+// from the snapshot and the write-ahead log.
+//
+// Parameters:
+//   - filePath: Path to the snapshot file
+//   - opts: Log sync and snapshot settings
+//
+// Returns:
+//   - *FileStorage: Initialized file storage with loaded data
+//   - error: Any error during loading, or ErrWALCorrupt for damage before the log tail
+func NewFileStorageWithOptions(filePath string, opts FileOptions) (*FileStorage, error) {
+	snapshotSize := opts.SnapshotSize
+	if snapshotSize == 0 {
+		snapshotSize = DefaultSnapshotSize
+	}
 	s := &FileStorage{
-		MemStorage: NewMemStorage(),
-		filePath:   filePath,
+		MemStorage:   NewMemStorage(),
+		filePath:     filePath,
+		snapshotSize: snapshotSize,
+		syncInterval: opts.SyncInterval,
 	}
-	// Load existing data from file (if it exists)
+	// Load existing data from the snapshot and the log (if they exist)
 	if err := s.load(); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
-// UpdateGauge updates a gauge metric and immediately persists the change to disk.
-// This provides synchronous persistence guarantee.
+// UpdateGauge updates a gauge metric. The change is logged before it is applied.
 //
 // Parameters:
 //   - name: Metric name
 //   - value: New gauge value
 //
 // Returns:
-//   - error: Any error during in-memory update or file save
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a counter,
+//     or any error writing or syncing the log
 func (s *FileStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
-	// Update in-memory storage first
-	if err := s.MemStorage.UpdateGauge(ctx, name, value); err != nil {
-		return err
+	check := func() error {
+		s.MemStorage.mu.RLock()
+		defer s.MemStorage.mu.RUnlock()
+		return s.MemStorage.checkTypeLocked(name, "gauge")
 	}
-	// Persist to disk synchronously
-	return s.Save()
+	return s.logAndApply(walRecord{Op: walUpdate, Items: []metrics.Metrics{
+		{ID: name, MType: "gauge", Value: &value},
+	}}, check)
 }
 
-// UpdateCounter increments a counter metric and immediately persists the change to disk.
-// This provides synchronous persistence guarantee.
+// UpdateCounter increments a counter metric. The change is logged before it is applied.
 //
 // Parameters:
 //   - name: Metric name
 //   - delta: Amount to increment by
 //
 // Returns:
-//   - error: Any error during in-memory update or file save
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge,
+//     ErrCounterOverflow if the counter would overflow, or any error writing or
+//     syncing the log
 func (s *FileStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
-	// Update in-memory storage first
-	if err := s.MemStorage.UpdateCounter(ctx, name, delta); err != nil {
-		return err
+	check := func() error {
+		s.MemStorage.mu.RLock()
+		defer s.MemStorage.mu.RUnlock()
+		if err := s.MemStorage.checkTypeLocked(name, "counter"); err != nil {
+			return err
+		}
+		if _, err := AddCounter(s.MemStorage.counter[name], delta); err != nil {
+			return fmt.Errorf("counter %s: %w", name, err)
+		}
+		return nil
 	}
-	// Persist to disk synchronously
-	return s.Save()
+	return s.logAndApply(walRecord{Op: walUpdate, Items: []metrics.Metrics{
+		{ID: name, MType: "counter", Delta: &delta},
+	}}, check)
 }
 
-// SetCounter sets a counter metric to an absolute value and immediately persists the change to disk.
-// This provides synchronous persistence guarantee.
+// SetCounter sets a counter metric to an absolute value. The change is logged before it is applied.
 //
 // Parameters:
 //   - name: Metric name
 //   - value: New absolute value
 //
 // Returns:
-//   - error: Any error during in-memory update or file save
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge,
+//     or any error writing or syncing the log
 func (s *FileStorage) SetCounter(ctx context.Context, name string, value int64) error {
-	// Update in-memory storage first
-	if err := s.MemStorage.SetCounter(ctx, name, value); err != nil {
+	check := func() error {
+		s.MemStorage.mu.RLock()
+		defer s.MemStorage.mu.RUnlock()
+		return s.MemStorage.checkTypeLocked(name, "counter")
+	}
+	return s.logAndApply(walRecord{Op: walSet, Items: []metrics.Metrics{
+		{ID: name, MType: "counter", Delta: &value},
+	}}, check)
+}
+
+// UpdateHistogram merges a histogram into the stored one. The change is logged before it is applied.
+//
+// Parameters:
+//   - name: Metric name
+//   - h: Observations to add
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the histogram is invalid, ErrTypeConflict
+//     if the metric is registered with another type, ErrBucketMismatch if the stored
+//     histogram has other bounds, ErrCounterOverflow if a count would overflow, or any
+//     error writing or syncing the log
+func (s *FileStorage) UpdateHistogram(ctx context.Context, name string, h metrics.Histogram) error {
+	if err := ValidateHistogram(h); err != nil {
 		return err
 	}
-	// Persist to disk synchronously
-	return s.Save()
+	check := func() error {
+		s.MemStorage.mu.RLock()
+		defer s.MemStorage.mu.RUnlock()
+		if err := s.MemStorage.checkTypeLocked(name, "histogram"); err != nil {
+			return err
+		}
+		cur, ok := s.MemStorage.histogram[name]
+		if _, err := mergeHistogramInto(cur, ok, h); err != nil {
+			return fmt.Errorf("histogram %s: %w", name, err)
+		}
+		return nil
+	}
+	return s.logAndApply(walRecord{Op: walUpdate, Items: []metrics.Metrics{
+		{ID: name, MType: "histogram", Histogram: &h},
+	}}, check)
 }
 
-// Save persists all current metrics from memory to the JSON file.
-// This method is thread-safe and uses a mutex to prevent concurrent file writes.
-// The file is written with O_SYNC flag to ensure data is written to disk immediately.
+// UpdateSummary merges a summary into the stored one. The change is logged before it is applied.
+//
+// Parameters:
+//   - name: Metric name
+//   - sm: Summary of the new observations
 //
 // Returns:
-//   - error: Any error during JSON marshaling or file write
-func (s *FileStorage) Save() error {
+//   - error: Error wrapping ErrInvalidMetric if the summary is invalid, ErrTypeConflict
+//     if the metric is registered with another type, ErrCounterOverflow if the count
+//     would overflow, or any error writing or syncing the log
+func (s *FileStorage) UpdateSummary(ctx context.Context, name string, sm metrics.Summary) error {
+	if err := ValidateSummary(sm); err != nil {
+		return err
+	}
+	check := func() error {
+		s.MemStorage.mu.RLock()
+		defer s.MemStorage.mu.RUnlock()
+		if err := s.MemStorage.checkTypeLocked(name, "summary"); err != nil {
+			return err
+		}
+		cur, ok := s.MemStorage.summary[name]
+		if _, err := mergeSummaryInto(cur, ok, sm); err != nil {
+			return fmt.Errorf("summary %s: %w", name, err)
+		}
+		return nil
+	}
+	return s.logAndApply(walRecord{Op: walUpdate, Items: []metrics.Metrics{
+		{ID: name, MType: "summary", Summary: &sm},
+	}}, check)
+}
+
+// UpdateBatch applies a batch of updates atomically. The batch is logged as a single
+// record, so after a crash it is replayed completely or not at all. If the record
+// cannot be written, nothing is applied.
+//
+// Parameters:
+//   - batch: Metrics to apply
+//
+// Returns:
+//   - error: *BatchError if any item is invalid, conflicts with its registered type,
+//     a counter would overflow or a histogram has other bounds, or an error writing
+//     or syncing the log
+func (s *FileStorage) UpdateBatch(ctx context.Context, batch []metrics.Metrics) error {
+	if err := validateBatch(batch); err != nil {
+		return err
+	}
+	check := func() error {
+		s.MemStorage.mu.RLock()
+		defer s.MemStorage.mu.RUnlock()
+		return s.MemStorage.checkBatchLocked(batch)
+	}
+	return s.logAndApply(walRecord{Op: walUpdate, Items: batch}, check)
+}
+
+// SetMetadata registers the metadata of a metric. The change is logged before it is applied.
+//
+// Parameters:
+//   - md: Metadata to register
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the metadata is invalid,
+//     ErrTypeConflict if a series of another type is stored under its name,
+//     or any error writing or syncing the log
+func (s *FileStorage) SetMetadata(ctx context.Context, md metrics.Metadata) error {
+	if err := ValidateMetadata(md); err != nil {
+		return err
+	}
+	check := func() error {
+		s.MemStorage.mu.RLock()
+		defer s.MemStorage.mu.RUnlock()
+		return s.MemStorage.checkMetadataLocked(md)
+	}
+	return s.logAndApply(walRecord{Op: walMeta, Meta: &md}, check)
+}
+
+// DeleteGauge removes a gauge metric. The removal is logged before it is applied.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error writing or syncing the log
+func (s *FileStorage) DeleteGauge(ctx context.Context, name string) (bool, error) {
+	return s.logDelete("gauge", name)
+}
+
+// DeleteCounter removes a counter metric. The removal is logged before it is applied.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error writing or syncing the log
+func (s *FileStorage) DeleteCounter(ctx context.Context, name string) (bool, error) {
+	return s.logDelete("counter", name)
+}
+
+// DeleteHistogram removes a histogram metric. The removal is logged before it is applied.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error writing or syncing the log
+func (s *FileStorage) DeleteHistogram(ctx context.Context, name string) (bool, error) {
+	return s.logDelete("histogram", name)
+}
+
+// DeleteSummary removes a summary metric. The removal is logged before it is applied.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error writing or syncing the log
+func (s *FileStorage) DeleteSummary(ctx context.Context, name string) (bool, error) {
+	return s.logDelete("summary", name)
+}
+
+// logDelete logs and applies the removal of a series if it exists.
+//
+// Parameters:
+//   - mtype: Metric type
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Any error writing or syncing the log
+func (s *FileStorage) logDelete(mtype, name string) (bool, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.MemStorage.mu.RLock()
+	exists := s.MemStorage.hasSeriesLocked(mtype, name)
+	s.MemStorage.mu.RUnlock()
+	if !exists {
+		s.mu.Unlock()
+		return false, nil
+	}
+	lsn, err := s.appendLocked(walRecord{Op: walDelete, Items: []metrics.Metrics{{ID: name, MType: mtype}}})
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, s.afterAppend(lsn)
+}
 
-	// Get all metrics from in-memory storage
+// logAndApply appends the record to the log, applies it in memory and waits until
+// it is durable.
+//
+// Parameters:
+//   - rec: Record to log; its LSN is assigned here
+//   - check: Optional precondition run under s.mu before logging; since all writers
+//     hold s.mu, the state it checks cannot change before the record is applied
+//
+// Returns:
+//   - error: The error of check, or any error writing or syncing the log
+func (s *FileStorage) logAndApply(rec walRecord, check func() error) error {
+	s.mu.Lock()
+	if check != nil {
+		if err := check(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	lsn, err := s.appendLocked(rec)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.afterAppend(lsn)
+}
+
+// appendLocked assigns the next LSN, appends the record and applies it in memory.
+// Must be called with s.mu held.
+//
+// Parameters:
+//   - rec: Record to log
+//
+// Returns:
+//   - uint64: LSN of the record
+//   - error: Any error writing the record; nothing is applied in that case
+func (s *FileStorage) appendLocked(rec walRecord) (uint64, error) {
+	rec.LSN = s.lsn + 1
+	if err := s.wal.append(rec); err != nil {
+		return 0, err
+	}
+	s.lsn = rec.LSN
+	s.apply(rec)
+	return rec.LSN, nil
+}
+
+// afterAppend waits for the record to become durable and starts an automatic
+// snapshot in the background when the log has grown too large.
+//
+// Parameters:
+//   - lsn: LSN of the appended record
+//
+// Returns:
+//   - error: Error of the fsync covering the record
+func (s *FileStorage) afterAppend(lsn uint64) error {
+	if err := s.wal.waitDurable(lsn); err != nil {
+		return err
+	}
+	if s.snapshotSize > 0 && s.wal.activeSize() >= s.snapshotSize && s.snapshotting.CompareAndSwap(false, true) {
+		go func() {
+			defer s.snapshotting.Store(false)
+			s.Save()
+		}()
+	}
+	return nil
+}
+
+// apply applies a logged record to the in-memory storage.
+//
+// Parameters:
+//   - rec: Record to apply
+func (s *FileStorage) apply(rec walRecord) {
+	s.MemStorage.mu.Lock()
+	defer s.MemStorage.mu.Unlock()
+
+	switch rec.Op {
+	case walUpdate:
+		s.MemStorage.applyBatch(rec.Items)
+	case walSet:
+		for _, m := range rec.Items {
+			switch {
+			case m.MType == "gauge" && m.Value != nil:
+				s.gauge[m.ID] = *m.Value
+			case m.MType == "counter" && m.Delta != nil:
+				s.counter[m.ID] = *m.Delta
+			}
+		}
+	case walDelete:
+		for _, m := range rec.Items {
+			s.MemStorage.deleteSeriesLocked(m.MType, m.ID)
+		}
+	case walMeta:
+		if rec.Meta != nil {
+			s.meta[rec.Meta.ID] = *rec.Meta
+		}
+	}
+}
+
+// Save writes a snapshot of all metrics and their metadata and removes the log segments it covers.
+// Writers are blocked only while the log switches to a new segment; the snapshot
+// itself is written to a temporary file and renamed into place, so a crash never
+// leaves a partial snapshot behind.
+//
+// Returns:
+//   - error: Any error switching segments or writing the snapshot
+func (s *FileStorage) Save() error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	// Capture the state and start a new segment atomically with respect to writers
+	s.mu.Lock()
 	metricsList, err := s.MemStorage.GetAll()
 	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	metadata, err := s.MemStorage.AllMetadata()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	lsn := s.lsn
+	seq, err := s.wal.rotate()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeSnapshot(s.filePath, fileSnapshot{LSN: lsn, Metrics: metricsList, Metadata: metadata}); err != nil {
 		return err
 	}
+	// Older segments only hold records up to lsn, which the snapshot contains
+	return s.wal.removeBefore(seq)
+}
 
+// Close syncs and closes the write-ahead log.
+//
+// Returns:
+//   - error: Any error syncing or closing the log
+func (s *FileStorage) Close() error {
+	return s.wal.close()
+}
+
+// writeSnapshot atomically replaces the snapshot file.
+//
+// Parameters:
+//   - path: Snapshot path
+//   - snap: Snapshot to write
+//
+// Returns:
+//   - error: Any error during marshaling, writing or renaming
+func writeSnapshot(path string, snap fileSnapshot) error {
 	// Marshal to JSON with indentation for human readability
-	data, err := json.MarshalIndent(metricsList, "", "  ")
+	data, err := json.MarshalIndent(snap, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	// Open file with O_SYNC flag for immediate disk write
-	// O_TRUNC ensures we overwrite the file completely
-	file, err := os.OpenFile(s.filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_SYNC, 0644)
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace snapshot: %w", err)
+	}
+
+	// Make the rename durable before the log segments are removed
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// load restores the in-memory storage from the snapshot and the write-ahead log and
+// opens the log for appending. Missing files mean an empty storage. A damaged record
+// at the tail of the last segment is truncated; damage anywhere else is an error.
+//
+// Returns:
+//   - error: Any error during file read, JSON unmarshaling or log replay
+func (s *FileStorage) load() error {
+	lsn, err := s.loadSnapshot()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// Write JSON data to file
-	_, err = file.Write(data)
+	seqs, err := walSegments(s.filePath)
+	if err != nil {
+		return fmt.Errorf("list WAL segments: %w", err)
+	}
+	for i, seq := range seqs {
+		path := walSegmentPath(s.filePath, seq)
+		records, size, torn, err := readWALSegment(path)
+		if err != nil {
+			return fmt.Errorf("read WAL segment: %w", err)
+		}
+		if torn {
+			if i != len(seqs)-1 {
+				return fmt.Errorf("%w: damaged record in %s", ErrWALCorrupt, path)
+			}
+			// Torn write from a crash; drop it so that new records follow intact ones
+			if err := os.Truncate(path, size); err != nil {
+				return fmt.Errorf("truncate torn WAL tail: %w", err)
+			}
+		}
+		for _, rec := range records {
+			// Records already contained in the snapshot are skipped
+			if rec.LSN <= lsn {
+				continue
+			}
+			s.apply(rec)
+			lsn = rec.LSN
+		}
+	}
+	s.lsn = lsn
+
+	active := uint64(1)
+	if len(seqs) > 0 {
+		active = seqs[len(seqs)-1]
+	}
+	s.wal, err = openWAL(s.filePath, active, lsn, s.syncInterval)
 	return err
 }
 
-// load reads metrics from the JSON file and populates the in-memory storage.
-// If the file doesn't exist, it silently returns nil (starting with empty storage).
-// If the file exists but is corrupted, it returns an error.
+// loadSnapshot reads the snapshot file into the in-memory storage.
+// Both the current format and the legacy JSON array are accepted.
 //
 // Returns:
+//   - uint64: LSN of the last log record contained in the snapshot (0 for legacy files)
 //   - error: Any error during file read or JSON unmarshaling (except file not found)
-func (s *FileStorage) load() error {
+func (s *FileStorage) loadSnapshot() (uint64, error) {
 	// Read file contents
 	data, err := os.ReadFile(s.filePath)
 	if err != nil {
 		// If file doesn't exist, start with empty storage
 		if os.IsNotExist(err) {
-			return nil
+			return 0, nil
 		}
-		return err
+		return 0, err
 	}
 
-	// Unmarshal JSON array
-	var metricsList []metrics.Metrics
-	if err := json.Unmarshal(data, &metricsList); err != nil {
-		return err
+	var snap fileSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		// Fall back to the legacy format: a plain JSON array of metrics
+		if legacyErr := json.Unmarshal(data, &snap.Metrics); legacyErr != nil {
+			return 0, err
+		}
 	}
 
 	// Populate in-memory storage
-	for _, m := range metricsList {
+	for _, m := range snap.Metrics {
 		switch m.MType {
 		case "gauge":
 			if m.Value != nil {
@@ -175,7 +628,18 @@ func (s *FileStorage) load() error {
 			if m.Delta != nil {
 				s.counter[m.ID] = *m.Delta
 			}
+		case "histogram":
+			if m.Histogram != nil {
+				s.histogram[m.ID] = *m.Histogram
+			}
+		case "summary":
+			if m.Summary != nil {
+				s.summary[m.ID] = *m.Summary
+			}
 		}
 	}
-	return nil
+	for _, md := range snap.Metadata {
+		s.meta[md.ID] = md
+	}
+	return snap.LSN, nil
 }
@@ -1,5 +1,5 @@
 // Package storage provides interfaces and implementations for metrics persistence.
-// It supports multiple storage backends: in-memory, file-based, and PostgreSQL.
+// It supports multiple storage backends: in-memory, file-based, embedded bbolt, and PostgreSQL.
 package storage
 
 import (
@@ -9,7 +9,8 @@ import (
 )
 
 // Storage defines the interface for metrics storage backends.
-// It provides methods for updating and retrieving both gauge and counter metrics.
+// It provides methods for updating and retrieving gauge, counter, histogram and
+// summary metrics and the metadata documenting them.
 // This interface allows the application to work with different storage implementations
 // (in-memory, file-based, database) without changing the business logic.
 //
@@ -72,6 +73,47 @@ type Storage interface {
 	//   - error: nil if successful, otherwise an error describing what went wrong
 	SetCounter(ctx context.Context, name string, value int64) error
 
+	// UpdateHistogram merges a histogram into the stored histogram of the metric by
+	// adding its bucket counts, count and sum. If the metric doesn't exist, it is
+	// created from the histogram. The bucket bounds of a stored histogram never change.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric
+	//   - h: Observations since the previous report
+	//
+	// Returns:
+	//   - error: Error wrapping ErrInvalidMetric if the histogram is invalid,
+	//     ErrTypeConflict if the metric is registered with another type,
+	//     ErrBucketMismatch if the stored histogram has other bounds,
+	//     ErrCounterOverflow if a count would overflow, otherwise any error of the backend
+	UpdateHistogram(ctx context.Context, name string, h metrics.Histogram) error
+
+	// UpdateSummary merges a summary into the stored summary of the metric by adding
+	// its count and sum and replacing the quantiles. If the metric doesn't exist, it is
+	// created from the summary.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric
+	//   - sm: Summary of the observations since the previous report
+	//
+	// Returns:
+	//   - error: Error wrapping ErrInvalidMetric if the summary is invalid,
+	//     ErrTypeConflict if the metric is registered with another type,
+	//     ErrCounterOverflow if the count would overflow, otherwise any error of the backend
+	UpdateSummary(ctx context.Context, name string, sm metrics.Summary) error
+
+	// UpdateBatch applies a batch of updates atomically: either every item is stored
+	// or none is. Gauges are overwritten, counters are incremented and histograms and
+	// summaries are merged, as with the single-metric update methods.
+	//
+	// Parameters:
+	//   - batch: Metrics to apply, each with a type and the matching value or delta
+	//
+	// Returns:
+	//   - error: nil if the whole batch was stored; *BatchError listing the failed
+	//     items if any item was rejected; another error if the backend failed
+	UpdateBatch(ctx context.Context, batch []metrics.Metrics) error
+
 	// GetGauge retrieves the current value of a gauge metric.
 	//
 	// Parameters:
@@ -92,7 +134,67 @@ type Storage interface {
 	//   - bool: true if the metric exists, false if it doesn't
 	GetCounter(name string) (int64, bool)
 
-	// GetAll returns all metrics (both gauge and counter) currently stored.
+	// GetHistogram retrieves the merged histogram of a metric.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric to retrieve
+	//
+	// Returns:
+	//   - metrics.Histogram: The stored histogram; the caller may modify it
+	//   - bool: true if the metric exists, false if it doesn't
+	GetHistogram(name string) (metrics.Histogram, bool)
+
+	// GetSummary retrieves the merged summary of a metric.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric to retrieve
+	//
+	// Returns:
+	//   - metrics.Summary: The stored summary; the caller may modify it
+	//   - bool: true if the metric exists, false if it doesn't
+	GetSummary(name string) (metrics.Summary, bool)
+
+	// DeleteGauge removes a gauge metric.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric to remove
+	//
+	// Returns:
+	//   - bool: true if the metric existed and was removed
+	//   - error: nil if successful, otherwise an error describing what went wrong
+	DeleteGauge(ctx context.Context, name string) (bool, error)
+
+	// DeleteCounter removes a counter metric.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric to remove
+	//
+	// Returns:
+	//   - bool: true if the metric existed and was removed
+	//   - error: nil if successful, otherwise an error describing what went wrong
+	DeleteCounter(ctx context.Context, name string) (bool, error)
+
+	// DeleteHistogram removes a histogram metric, e.g. to change its bucket bounds.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric to remove
+	//
+	// Returns:
+	//   - bool: true if the metric existed and was removed
+	//   - error: nil if successful, otherwise an error describing what went wrong
+	DeleteHistogram(ctx context.Context, name string) (bool, error)
+
+	// DeleteSummary removes a summary metric.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric to remove
+	//
+	// Returns:
+	//   - bool: true if the metric existed and was removed
+	//   - error: nil if successful, otherwise an error describing what went wrong
+	DeleteSummary(ctx context.Context, name string) (bool, error)
+
+	// GetAll returns all metrics of every type currently stored.
 	// The metrics are returned as a slice of metrics.Metrics objects,
 	// which contain both the type information and the value.
 	//
@@ -100,4 +202,34 @@ type Storage interface {
 	//   - []metrics.Metrics: Slice containing all stored metrics
 	//   - error: nil if successful, otherwise an error describing what went wrong
 	GetAll() ([]metrics.Metrics, error)
+
+	// SetMetadata registers or replaces the metadata of a metric: its description,
+	// unit, owner and expected type. Once registered, updates of the metric with
+	// another type are rejected with ErrTypeConflict.
+	//
+	// Parameters:
+	//   - md: Metadata to register; ID and MType are required
+	//
+	// Returns:
+	//   - error: Error wrapping ErrInvalidMetric if the metadata is invalid,
+	//     ErrTypeConflict if a series of another type is stored under its name,
+	//     otherwise any error of the backend
+	SetMetadata(ctx context.Context, md metrics.Metadata) error
+
+	// GetMetadata retrieves the metadata registered for a metric.
+	//
+	// Parameters:
+	//   - name: The unique identifier of the metric
+	//
+	// Returns:
+	//   - metrics.Metadata: Registered metadata
+	//   - bool: true if metadata is registered, false otherwise
+	GetMetadata(name string) (metrics.Metadata, bool)
+
+	// AllMetadata returns the metadata of all documented metrics.
+	//
+	// Returns:
+	//   - []metrics.Metadata: Registered metadata sorted by metric name
+	//   - error: nil if successful, otherwise an error describing what went wrong
+	AllMetadata() ([]metrics.Metadata, error)
 }
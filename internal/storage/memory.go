@@ -2,13 +2,14 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"sync"
 
 	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
 )
 
 // MemStorage implements the Storage interface using in-memory maps.
-// It provides thread-safe storage for both gauge and counter metrics
+// It provides thread-safe storage for gauge, counter, histogram and summary metrics
 // using read-write mutexes for concurrent access.
 //
 // This is the simplest storage implementation and serves as the foundation
@@ -23,19 +24,31 @@ type MemStorage struct {
 	// counter stores integer counter metrics with their names as keys
 	counter map[string]int64
 
-	// mu protects both maps from concurrent access
+	// histogram stores the merged histograms with their names as keys
+	histogram map[string]metrics.Histogram
+
+	// summary stores the merged summaries with their names as keys
+	summary map[string]metrics.Summary
+
+	// meta stores the registered metadata with the metric names as keys
+	meta map[string]metrics.Metadata
+
+	// mu protects all maps from concurrent access
 	mu sync.RWMutex
 }
 
 // NewMemStorage creates and initializes a new in-memory storage.
-// It initializes empty maps for both gauge and counter metrics.
+// It initializes empty maps for all metric types and their metadata.
 //
 // Returns:
 //   - *MemStorage: A ready-to-use memory storage instance
 func NewMemStorage() *MemStorage {
 	return &MemStorage{
-		gauge:   make(map[string]float64),
-		counter: make(map[string]int64),
+		gauge:     make(map[string]float64),
+		counter:   make(map[string]int64),
+		histogram: make(map[string]metrics.Histogram),
+		summary:   make(map[string]metrics.Summary),
+		meta:      make(map[string]metrics.Metadata),
 	}
 }
 
@@ -48,10 +61,13 @@ func NewMemStorage() *MemStorage {
 //   - value: The new floating-point value for the gauge
 //
 // Returns:
-//   - error: Always nil (kept for interface compatibility)
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a counter
 func (s *MemStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.checkTypeLocked(name, "gauge"); err != nil {
+		return err
+	}
 	s.gauge[name] = value
 	return nil
 }
@@ -65,11 +81,19 @@ func (s *MemStorage) UpdateGauge(ctx context.Context, name string, value float64
 //   - delta: The amount to add to the counter
 //
 // Returns:
-//   - error: Always nil (kept for interface compatibility)
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge, or
+//     ErrCounterOverflow if the counter would overflow; it is left unchanged
 func (s *MemStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.counter[name] += delta
+	if err := s.checkTypeLocked(name, "counter"); err != nil {
+		return err
+	}
+	v, err := AddCounter(s.counter[name], delta)
+	if err != nil {
+		return fmt.Errorf("counter %s: %w", name, err)
+	}
+	s.counter[name] = v
 	return nil
 }
 
@@ -83,14 +107,101 @@ func (s *MemStorage) UpdateCounter(ctx context.Context, name string, delta int64
 //   - value: The new absolute value for the counter
 //
 // Returns:
-//   - error: Always nil (kept for interface compatibility)
+//   - error: Error wrapping ErrTypeConflict if the metric is registered as a gauge
 func (s *MemStorage) SetCounter(ctx context.Context, name string, value int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.checkTypeLocked(name, "counter"); err != nil {
+		return err
+	}
 	s.counter[name] = value
 	return nil
 }
 
+// UpdateHistogram merges the observations of a histogram into the stored histogram.
+// If the metric doesn't exist, it's created from the given histogram.
+// This operation is thread-safe and acquires a write lock.
+//
+// Parameters:
+//   - name: The metric name/identifier
+//   - h: Observations to add
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the histogram is invalid, ErrTypeConflict
+//     if the metric is registered with another type, ErrBucketMismatch if the stored
+//     histogram has other bounds, or ErrCounterOverflow if a count would overflow;
+//     the stored histogram is left unchanged
+func (s *MemStorage) UpdateHistogram(ctx context.Context, name string, h metrics.Histogram) error {
+	if err := ValidateHistogram(h); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkTypeLocked(name, "histogram"); err != nil {
+		return err
+	}
+	cur, ok := s.histogram[name]
+	merged, err := mergeHistogramInto(cur, ok, h)
+	if err != nil {
+		return fmt.Errorf("histogram %s: %w", name, err)
+	}
+	s.histogram[name] = merged
+	return nil
+}
+
+// UpdateSummary merges a summary into the stored summary: counts and sums are added
+// and the quantiles are replaced. If the metric doesn't exist, it's created from the
+// given summary. This operation is thread-safe and acquires a write lock.
+//
+// Parameters:
+//   - name: The metric name/identifier
+//   - sm: Summary of the new observations
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the summary is invalid, ErrTypeConflict
+//     if the metric is registered with another type, or ErrCounterOverflow if the
+//     count would overflow; the stored summary is left unchanged
+func (s *MemStorage) UpdateSummary(ctx context.Context, name string, sm metrics.Summary) error {
+	if err := ValidateSummary(sm); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkTypeLocked(name, "summary"); err != nil {
+		return err
+	}
+	cur, ok := s.summary[name]
+	merged, err := mergeSummaryInto(cur, ok, sm)
+	if err != nil {
+		return fmt.Errorf("summary %s: %w", name, err)
+	}
+	s.summary[name] = merged
+	return nil
+}
+
+// UpdateBatch applies a batch of updates atomically.
+// The batch is validated first and applied under a single write lock,
+// so readers never observe a partially applied batch.
+//
+// Parameters:
+//   - batch: Metrics to apply
+//
+// Returns:
+//   - error: *BatchError if any item is invalid, conflicts with its registered type,
+//     a counter would overflow or a histogram has other bounds, otherwise nil
+func (s *MemStorage) UpdateBatch(ctx context.Context, batch []metrics.Metrics) error {
+	if err := validateBatch(batch); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkBatchLocked(batch); err != nil {
+		return err
+	}
+	s.applyBatch(batch)
+	return nil
+}
+
 // GetGauge retrieves the current value of a gauge metric.
 // This operation is thread-safe and acquires a read lock.
 //
@@ -123,9 +234,109 @@ func (s *MemStorage) GetCounter(name string) (int64, bool) {
 	return v, ok
 }
 
+// GetHistogram retrieves the merged histogram of a metric.
+// This operation is thread-safe and acquires a read lock.
+//
+// Parameters:
+//   - name: The metric name/identifier to retrieve
+//
+// Returns:
+//   - metrics.Histogram: A copy of the stored histogram
+//   - bool: true if the metric exists, false otherwise
+func (s *MemStorage) GetHistogram(name string) (metrics.Histogram, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.histogram[name]
+	return CloneHistogram(h), ok
+}
+
+// GetSummary retrieves the merged summary of a metric.
+// This operation is thread-safe and acquires a read lock.
+//
+// Parameters:
+//   - name: The metric name/identifier to retrieve
+//
+// Returns:
+//   - metrics.Summary: A copy of the stored summary
+//   - bool: true if the metric exists, false otherwise
+func (s *MemStorage) GetSummary(name string) (metrics.Summary, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sm, ok := s.summary[name]
+	return CloneSummary(sm), ok
+}
+
+// DeleteGauge removes a gauge metric from memory.
+// This operation is thread-safe and acquires a write lock.
+//
+// Parameters:
+//   - name: The metric name/identifier to remove
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Always nil (kept for interface compatibility)
+func (s *MemStorage) DeleteGauge(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.gauge[name]
+	delete(s.gauge, name)
+	return ok, nil
+}
+
+// DeleteCounter removes a counter metric from memory.
+// This operation is thread-safe and acquires a write lock.
+//
+// Parameters:
+//   - name: The metric name/identifier to remove
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Always nil (kept for interface compatibility)
+func (s *MemStorage) DeleteCounter(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.counter[name]
+	delete(s.counter, name)
+	return ok, nil
+}
+
+// DeleteHistogram removes a histogram metric from memory.
+// This operation is thread-safe and acquires a write lock.
+//
+// Parameters:
+//   - name: The metric name/identifier to remove
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Always nil (kept for interface compatibility)
+func (s *MemStorage) DeleteHistogram(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.histogram[name]
+	delete(s.histogram, name)
+	return ok, nil
+}
+
+// DeleteSummary removes a summary metric from memory.
+// This operation is thread-safe and acquires a write lock.
+//
+// Parameters:
+//   - name: The metric name/identifier to remove
+//
+// Returns:
+//   - bool: true if the metric existed
+//   - error: Always nil (kept for interface compatibility)
+func (s *MemStorage) DeleteSummary(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.summary[name]
+	delete(s.summary, name)
+	return ok, nil
+}
+
 // GetAll returns all metrics currently stored in memory.
 // The metrics are returned as a slice of metrics.Metrics objects,
-// with separate entries for gauge and counter metrics.
+// with separate entries per metric type.
 // This operation is thread-safe and acquires a read lock.
 //
 // Returns:
@@ -149,5 +360,58 @@ func (s *MemStorage) GetAll() ([]metrics.Metrics, error) {
 		out = append(out, metrics.Metrics{ID: name, MType: "counter", Delta: &delta})
 	}
 
+	// Add copies of all histograms and summaries
+	for name, h := range s.histogram {
+		h := CloneHistogram(h)
+		out = append(out, metrics.Metrics{ID: name, MType: "histogram", Histogram: &h})
+	}
+	for name, sm := range s.summary {
+		sm := CloneSummary(sm)
+		out = append(out, metrics.Metrics{ID: name, MType: "summary", Summary: &sm})
+	}
+
 	return out, nil
 }
+
+// hasSeriesLocked reports whether a series of the given type is stored.
+// Must be called with s.mu held.
+//
+// Parameters:
+//   - mtype: Metric type
+//   - name: Metric name
+//
+// Returns:
+//   - bool: true if the series exists
+func (s *MemStorage) hasSeriesLocked(mtype, name string) bool {
+	var ok bool
+	switch mtype {
+	case "gauge":
+		_, ok = s.gauge[name]
+	case "counter":
+		_, ok = s.counter[name]
+	case "histogram":
+		_, ok = s.histogram[name]
+	case "summary":
+		_, ok = s.summary[name]
+	}
+	return ok
+}
+
+// deleteSeriesLocked removes a series of the given type.
+// Must be called with s.mu held for writing.
+//
+// Parameters:
+//   - mtype: Metric type
+//   - name: Metric name
+func (s *MemStorage) deleteSeriesLocked(mtype, name string) {
+	switch mtype {
+	case "gauge":
+		delete(s.gauge, name)
+	case "counter":
+		delete(s.counter, name)
+	case "histogram":
+		delete(s.histogram, name)
+	case "summary":
+		delete(s.summary, name)
+	}
+}
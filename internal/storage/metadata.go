@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// ErrTypeConflict is returned when a sample's type differs from the type registered
+// for the metric, or when metadata declares a type other than that of a stored series.
+var ErrTypeConflict = errors.New("metric type conflict")
+
+// Length limits of metadata fields, in bytes.
+const (
+	maxMetadataDescription = 1024
+	maxMetadataUnit        = 64
+	maxMetadataOwner       = 256
+)
+
+// ValidateMetadata checks that metadata names a metric, has a known type and that
+// its text fields fit the length limits.
+//
+// Parameters:
+//   - md: Metadata to validate
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the metadata is invalid, otherwise nil
+func ValidateMetadata(md metrics.Metadata) error {
+	switch {
+	case md.ID == "":
+		return fmt.Errorf("%w: missing id", ErrInvalidMetric)
+	case !knownType(md.MType):
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidMetric, md.MType)
+	case len(md.Description) > maxMetadataDescription:
+		return fmt.Errorf("%w: description longer than %d bytes", ErrInvalidMetric, maxMetadataDescription)
+	case len(md.Unit) > maxMetadataUnit:
+		return fmt.Errorf("%w: unit longer than %d bytes", ErrInvalidMetric, maxMetadataUnit)
+	case len(md.Owner) > maxMetadataOwner:
+		return fmt.Errorf("%w: owner longer than %d bytes", ErrInvalidMetric, maxMetadataOwner)
+	}
+	return nil
+}
+
+// checkType compares the type of a sample with the type registered for the metric.
+//
+// Parameters:
+//   - name: Metric name
+//   - registered: Registered type ("" if the metric has no metadata)
+//   - mtype: Type of the sample
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict if the types differ, otherwise nil
+func checkType(name, registered, mtype string) error {
+	if registered == "" || registered == mtype {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is registered as %s, got %s", ErrTypeConflict, name, registered, mtype)
+}
+
+// checkTypes checks the types of all items of a validated batch against the registry.
+//
+// Parameters:
+//   - batch: Validated metrics to check
+//   - registered: Returns the registered type of a metric ("" if it has no metadata)
+//
+// Returns:
+//   - error: *BatchError listing the items with a conflicting type, or nil
+func checkTypes(batch []metrics.Metrics, registered func(name string) string) error {
+	var failed []BatchItemError
+	for i, m := range batch {
+		if err := checkType(m.ID, registered(m.ID), m.MType); err != nil {
+			failed = append(failed, BatchItemError{Index: i, ID: m.ID, MType: m.MType, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Items: failed}
+	}
+	return nil
+}
+
+// seriesConflict builds the error for metadata declaring a type other than that of
+// a stored series.
+//
+// Parameters:
+//   - md: Metadata being registered
+//   - stored: Type of the stored series
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict
+func seriesConflict(md metrics.Metadata, stored string) error {
+	return fmt.Errorf("%w: %s is stored as %s, cannot register it as %s", ErrTypeConflict, md.ID, stored, md.MType)
+}
+
+// sortMetadata sorts metadata by metric name.
+//
+// Parameters:
+//   - list: Metadata to sort in place
+func sortMetadata(list []metrics.Metadata) {
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+}
+
+// checkTypeLocked checks a sample's type against the metadata in memory.
+// Must be called with s.mu held.
+//
+// Parameters:
+//   - name: Metric name
+//   - mtype: Type of the sample
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict if the types differ, otherwise nil
+func (s *MemStorage) checkTypeLocked(name, mtype string) error {
+	return checkType(name, s.meta[name].MType, mtype)
+}
+
+// checkMetadataLocked checks that no series of another type than the metadata's exists.
+// Must be called with s.mu held.
+//
+// Parameters:
+//   - md: Validated metadata to register
+//
+// Returns:
+//   - error: Error wrapping ErrTypeConflict if such a series exists, otherwise nil
+func (s *MemStorage) checkMetadataLocked(md metrics.Metadata) error {
+	for _, mtype := range metricTypes {
+		if mtype != md.MType && s.hasSeriesLocked(mtype, md.ID) {
+			return seriesConflict(md, mtype)
+		}
+	}
+	return nil
+}
+
+// checkBatchLocked checks a validated batch against the metadata and series in
+// memory: first the types of all items, then counter overflows, then the merges of
+// histograms and summaries.
+// Must be called with s.mu held.
+//
+// Parameters:
+//   - batch: Validated metrics to check
+//
+// Returns:
+//   - error: *BatchError listing the items with a conflicting type, an overflow or
+//     mismatching histogram bounds, or nil
+func (s *MemStorage) checkBatchLocked(batch []metrics.Metrics) error {
+	if err := checkTypes(batch, func(name string) string { return s.meta[name].MType }); err != nil {
+		return err
+	}
+	if err := checkCounters(batch, func(name string) int64 { return s.counter[name] }); err != nil {
+		return err
+	}
+	return checkDistributions(batch,
+		func(name string) (metrics.Histogram, bool) { h, ok := s.histogram[name]; return h, ok },
+		func(name string) (metrics.Summary, bool) { sm, ok := s.summary[name]; return sm, ok },
+	)
+}
+
+// SetMetadata registers or replaces the metadata of a metric.
+//
+// Parameters:
+//   - md: Metadata to register
+//
+// Returns:
+//   - error: Error wrapping ErrInvalidMetric if the metadata is invalid, or
+//     ErrTypeConflict if a series of another type is stored under its name
+func (s *MemStorage) SetMetadata(ctx context.Context, md metrics.Metadata) error {
+	if err := ValidateMetadata(md); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkMetadataLocked(md); err != nil {
+		return err
+	}
+	s.meta[md.ID] = md
+	return nil
+}
+
+// GetMetadata retrieves the metadata registered for a metric.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - metrics.Metadata: Registered metadata
+//   - bool: true if metadata is registered, false otherwise
+func (s *MemStorage) GetMetadata(name string) (metrics.Metadata, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	md, ok := s.meta[name]
+	return md, ok
+}
+
+// AllMetadata returns the metadata of all documented metrics.
+//
+// Returns:
+//   - []metrics.Metadata: Registered metadata sorted by metric name
+//   - error: Always nil (kept for interface compatibility)
+func (s *MemStorage) AllMetadata() ([]metrics.Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]metrics.Metadata, 0, len(s.meta))
+	for _, md := range s.meta {
+		out = append(out, md)
+	}
+	sortMetadata(out)
+	return out, nil
+}
@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// changeChannel is the PostgreSQL notification channel the metric tables publish on.
+// The triggers are created by the add_change_notifications migration.
+const changeChannel = "metric_changes"
+
+// Reconnect delays of the change listener.
+const (
+	listenMinDelay = 1 * time.Second
+	listenMaxDelay = 30 * time.Second
+)
+
+// seriesKey identifies a series within one tenant.
+type seriesKey struct {
+	mtype string // Metric type ("gauge" or "counter")
+	name  string // Metric name
+}
+
+// seriesVersions tracks the row version of every cached series. A change is applied
+// to the cache only if its version is newer, so notifications that arrive late or
+// twice never roll a series back.
+type seriesVersions struct {
+	mu sync.Mutex          // Protects m
+	m  map[seriesKey]int64 // Latest applied version per series
+}
+
+// newSeriesVersions creates an empty version table.
+//
+// Returns:
+//   - *seriesVersions: Empty version table
+func newSeriesVersions() *seriesVersions {
+	return &seriesVersions{m: make(map[seriesKey]int64)}
+}
+
+// advance records the version if it is newer than the known one.
+//
+// Parameters:
+//   - mtype: Metric type
+//   - name: Metric name
+//   - version: Row version of the change
+//
+// Returns:
+//   - bool: true if the change is newer and must be applied
+func (v *seriesVersions) advance(mtype, name string, version int64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := seriesKey{mtype: mtype, name: name}
+	if known, ok := v.m[key]; ok && version <= known {
+		return false
+	}
+	v.m[key] = version
+	return true
+}
+
+// replace swaps the whole version table, used after a full reload.
+//
+// Parameters:
+//   - m: New version table
+func (v *seriesVersions) replace(m map[seriesKey]int64) {
+	v.mu.Lock()
+	v.m = m
+	v.mu.Unlock()
+}
+
+// changeFeed dispatches change notifications to the DBStorage of each tenant.
+// All storages sharing a connection pool share one feed.
+type changeFeed struct {
+	mu     sync.RWMutex          // Protects stores
+	stores map[string]*DBStorage // Storages by tenant
+}
+
+// newChangeFeed creates a feed without subscribers.
+//
+// Returns:
+//   - *changeFeed: Empty feed
+func newChangeFeed() *changeFeed {
+	return &changeFeed{stores: make(map[string]*DBStorage)}
+}
+
+// register subscribes the storage to changes of its tenant.
+//
+// Parameters:
+//   - s: Storage to subscribe
+func (f *changeFeed) register(s *DBStorage) {
+	f.mu.Lock()
+	f.stores[s.tenant] = s
+	f.mu.Unlock()
+}
+
+// unregister removes the storage from the feed.
+//
+// Parameters:
+//   - s: Storage to unsubscribe
+func (f *changeFeed) unregister(s *DBStorage) {
+	f.mu.Lock()
+	if f.stores[s.tenant] == s {
+		delete(f.stores, s.tenant)
+	}
+	f.mu.Unlock()
+}
+
+// resync reloads the caches of all subscribed storages from the database.
+//
+// Parameters:
+//   - ctx: Context for the operation
+//
+// Returns:
+//   - error: The first error encountered while reloading
+func (f *changeFeed) resync(ctx context.Context) error {
+	f.mu.RLock()
+	stores := make([]*DBStorage, 0, len(f.stores))
+	for _, s := range f.stores {
+		stores = append(stores, s)
+	}
+	f.mu.RUnlock()
+
+	for _, s := range stores {
+		if err := s.loadFromDB(ctx); err != nil {
+			return fmt.Errorf("resync tenant %q: %w", s.tenant, err)
+		}
+	}
+	return nil
+}
+
+// metricChange is the payload of a change notification.
+type metricChange struct {
+	Op          string          `json:"op"`          // "set", "delete" or "meta"
+	Tenant      string          `json:"tenant"`      // Tenant of the row
+	Type        string          `json:"type"`        // Table name, which is the metric type; the registered type for "meta"
+	Name        string          `json:"name"`        // Metric name
+	Value       json.RawMessage `json:"value"`       // Stored value, or distribution object (absent for deletes and metadata)
+	Version     int64           `json:"version"`     // Row version of the change (absent for metadata)
+	Description string          `json:"description"` // Registered description ("meta" only)
+	Unit        string          `json:"unit"`        // Registered unit ("meta" only)
+	Owner       string          `json:"owner"`       // Registered owner ("meta" only)
+}
+
+// apply decodes a notification and applies it to the cache of its tenant.
+// Changes of tenants without a subscribed storage are ignored.
+//
+// Parameters:
+//   - payload: Notification payload
+//
+// Returns:
+//   - error: Error if the payload is malformed
+func (f *changeFeed) apply(payload string) error {
+	var c metricChange
+	if err := json.Unmarshal([]byte(payload), &c); err != nil {
+		return fmt.Errorf("decode change notification: %w", err)
+	}
+
+	f.mu.RLock()
+	s := f.stores[c.Tenant]
+	f.mu.RUnlock()
+	if s == nil {
+		return nil
+	}
+
+	if c.Op == "meta" {
+		// Metadata has no versions; notifications arrive in commit order
+		unlock := s.locks.lock("metadata", c.Name)
+		defer unlock()
+		s.applyMetadata(metrics.Metadata{ID: c.Name, MType: c.Type, Description: c.Description, Unit: c.Unit, Owner: c.Owner})
+		return nil
+	}
+
+	unlock := s.locks.lock(c.Type, c.Name)
+	defer unlock()
+
+	if c.Op == "delete" {
+		s.applyDelete(c.Type, c.Name, c.Version)
+		return nil
+	}
+	switch c.Type {
+	case "gauge":
+		var value float64
+		if err := json.Unmarshal(c.Value, &value); err != nil {
+			return fmt.Errorf("decode gauge %s: %w", c.Name, err)
+		}
+		s.applyGauge(c.Name, value, c.Version)
+	case "counter":
+		var value int64
+		if err := json.Unmarshal(c.Value, &value); err != nil {
+			return fmt.Errorf("decode counter %s: %w", c.Name, err)
+		}
+		s.applyCounter(c.Name, value, c.Version)
+	case "histogram":
+		var h metrics.Histogram
+		if err := json.Unmarshal(c.Value, &h); err != nil {
+			return fmt.Errorf("decode histogram %s: %w", c.Name, err)
+		}
+		s.applyHistogram(c.Name, h, c.Version)
+	case "summary":
+		var sm metrics.Summary
+		if err := json.Unmarshal(c.Value, &sm); err != nil {
+			return fmt.Errorf("decode summary %s: %w", c.Name, err)
+		}
+		if len(sm.Quantiles) == 0 {
+			sm.Quantiles = nil
+		}
+		s.applySummary(c.Name, sm, c.Version)
+	default:
+		return fmt.Errorf("unknown metric type %q in change notification", c.Type)
+	}
+	return nil
+}
+
+// applyGauge stores a committed gauge value in the cache unless a newer one is cached.
+// Must be called with the series lock held.
+//
+// Parameters:
+//   - name: Metric name
+//   - value: Committed value
+//   - version: Row version of the write
+func (s *DBStorage) applyGauge(name string, value float64, version int64) {
+	if s.versions.advance("gauge", name, version) {
+		// The database already checked the type; the cached metadata may be older
+		s.cache.mu.Lock()
+		s.cache.gauge[name] = value
+		s.cache.mu.Unlock()
+	}
+}
+
+// applyCounter stores a committed counter value in the cache unless a newer one is cached.
+// Must be called with the series lock held.
+//
+// Parameters:
+//   - name: Metric name
+//   - value: Committed absolute value
+//   - version: Row version of the write
+func (s *DBStorage) applyCounter(name string, value int64, version int64) {
+	if s.versions.advance("counter", name, version) {
+		s.cache.mu.Lock()
+		s.cache.counter[name] = value
+		s.cache.mu.Unlock()
+	}
+}
+
+// applyHistogram stores a committed histogram in the cache unless a newer one is cached.
+// Must be called with the series lock held.
+//
+// Parameters:
+//   - name: Metric name
+//   - h: Committed histogram, owned by the cache afterwards
+//   - version: Row version of the write
+func (s *DBStorage) applyHistogram(name string, h metrics.Histogram, version int64) {
+	if s.versions.advance("histogram", name, version) {
+		s.cache.mu.Lock()
+		s.cache.histogram[name] = h
+		s.cache.mu.Unlock()
+	}
+}
+
+// applySummary stores a committed summary in the cache unless a newer one is cached.
+// Must be called with the series lock held.
+//
+// Parameters:
+//   - name: Metric name
+//   - sm: Committed summary, owned by the cache afterwards
+//   - version: Row version of the write
+func (s *DBStorage) applySummary(name string, sm metrics.Summary, version int64) {
+	if s.versions.advance("summary", name, version) {
+		s.cache.mu.Lock()
+		s.cache.summary[name] = sm
+		s.cache.mu.Unlock()
+	}
+}
+
+// applyMetadata stores committed metadata in the cache.
+// Must be called with the metadata lock of the metric held.
+//
+// Parameters:
+//   - md: Committed metadata
+func (s *DBStorage) applyMetadata(md metrics.Metadata) {
+	s.cache.mu.Lock()
+	s.cache.meta[md.ID] = md
+	s.cache.mu.Unlock()
+}
+
+// applyDelete removes a series from the cache unless a newer write is cached.
+// Must be called with the series lock held.
+//
+// Parameters:
+//   - mtype: Metric type
+//   - name: Metric name
+//   - version: Version assigned to the deletion
+func (s *DBStorage) applyDelete(mtype, name string, version int64) {
+	if !s.versions.advance(mtype, name, version) {
+		return
+	}
+	s.cache.mu.Lock()
+	s.cache.deleteSeriesLocked(mtype, name)
+	s.cache.mu.Unlock()
+}
+
+// Listen keeps the caches of this storage and of all tenant storages sharing its pool
+// coherent with writes made by other server instances. It subscribes to the change
+// notifications published by the database triggers and applies them to the caches.
+//
+// Notifications are lost while the listener is disconnected, so after every
+// (re)connect all caches are fully reloaded before notifications are applied again.
+// Connection failures are retried with exponential backoff.
+//
+// Listen blocks until ctx is canceled; run it in its own goroutine.
+//
+// Parameters:
+//   - ctx: Context that stops the listener when canceled
+//   - onError: Callback for connection and payload errors (can be nil)
+func (s *DBStorage) Listen(ctx context.Context, onError func(error)) {
+	report := func(err error) {
+		if onError != nil {
+			onError(err)
+		}
+	}
+
+	delay := listenMinDelay
+	for {
+		err := s.listenOnce(ctx, report, func() { delay = listenMinDelay })
+		if ctx.Err() != nil {
+			return
+		}
+		report(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, listenMaxDelay)
+	}
+}
+
+// listenOnce opens a dedicated connection, subscribes to the change channel,
+// resynchronizes all caches and applies notifications until the connection fails.
+//
+// Parameters:
+//   - ctx: Context that stops the listener when canceled
+//   - report: Callback for payload errors
+//   - connected: Called once the subscription and the resync succeeded
+//
+// Returns:
+//   - error: Reason the listener stopped
+func (s *DBStorage) listenOnce(ctx context.Context, report func(error), connected func()) error {
+	// LISTEN needs a session of its own; pooled connections are shared by queries
+	conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return fmt.Errorf("connect listener: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changeChannel); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	// Changes committed while not subscribed were missed; reload everything.
+	// Notifications for changes committed from now on are queued on the connection
+	// and older ones are skipped by their version.
+	if err := s.feed.resync(ctx); err != nil {
+		return err
+	}
+	connected()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("wait for notification: %w", err)
+		}
+		if err := s.feed.apply(n.Payload); err != nil {
+			report(err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// PoolConfig configures the PostgreSQL connection pool used by DBStorage.
+// Zero values keep the pgxpool defaults.
+type PoolConfig struct {
+	MaxConns          int32         // Maximum number of open connections
+	MinConns          int32         // Number of connections kept open when idle
+	MaxConnLifetime   time.Duration // Connections older than this are closed and replaced
+	MaxConnIdleTime   time.Duration // Idle connections older than this are closed
+	HealthCheckPeriod time.Duration // How often idle connections are checked
+	ConnectTimeout    time.Duration // Timeout for establishing a new connection
+	QueryTimeout      time.Duration // Timeout for a single statement or transaction (0 for none)
+}
+
+// NewPool creates a PostgreSQL connection pool and checks that the database is reachable.
+//
+// Parameters:
+//   - ctx: Context for the initial connection
+//   - dsn: PostgreSQL connection string
+//   - cfg: Pool size, timeouts and health check settings
+//
+// Returns:
+//   - *pgxpool.Pool: Ready-to-use connection pool
+//   - error: Any error parsing the DSN or connecting to the database
+func NewPool(ctx context.Context, dsn string, cfg PoolConfig) (*pgxpool.Pool, error) {
+	poolCfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse DSN: %w", err)
+	}
+
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolCfg.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+	if cfg.HealthCheckPeriod > 0 {
+		poolCfg.HealthCheckPeriod = cfg.HealthCheckPeriod
+	}
+	if cfg.ConnectTimeout > 0 {
+		poolCfg.ConnConfig.ConnectTimeout = cfg.ConnectTimeout
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		return nil, fmt.Errorf("create pool: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("ping: %w", err)
+	}
+	return pool, nil
+}
+
+// lockShards is the number of mutexes series keys are spread over.
+const lockShards = 64
+
+// keyLocks serializes writes per series without a global lock. Series are hashed
+// onto a fixed number of mutexes, so writes to different series rarely contend
+// while the database and the cache always see writes to one series in the same order.
+type keyLocks struct {
+	shards [lockShards]sync.Mutex
+}
+
+// shard returns the index of the mutex guarding the series.
+//
+// Parameters:
+//   - mtype: Metric type ("gauge" or "counter")
+//   - name: Metric name
+//
+// Returns:
+//   - int: Shard index
+func (l *keyLocks) shard(mtype, name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(mtype))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return int(h.Sum32() % lockShards)
+}
+
+// lock acquires the lock of a single series.
+//
+// Parameters:
+//   - mtype: Metric type
+//   - name: Metric name
+//
+// Returns:
+//   - func(): Function that releases the lock
+func (l *keyLocks) lock(mtype, name string) func() {
+	mu := &l.shards[l.shard(mtype, name)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// lockBatch acquires the locks of all series in the batch. Shards are locked
+// in ascending order, so concurrent batches cannot deadlock.
+//
+// Parameters:
+//   - batch: Metrics whose series are locked
+//
+// Returns:
+//   - func(): Function that releases all acquired locks
+func (l *keyLocks) lockBatch(batch []metrics.Metrics) func() {
+	seen := make(map[int]struct{}, len(batch))
+	idx := make([]int, 0, len(batch))
+	for _, m := range batch {
+		i := l.shard(m.MType, m.ID)
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	return l.lockShards(idx)
+}
+
+// lockAll acquires every shard, blocking all writes until released.
+//
+// Returns:
+//   - func(): Function that releases all locks
+func (l *keyLocks) lockAll() func() {
+	idx := make([]int, lockShards)
+	for i := range idx {
+		idx[i] = i
+	}
+	return l.lockShards(idx)
+}
+
+// lockShards locks the given shards, which must be sorted in ascending order.
+//
+// Parameters:
+//   - idx: Sorted shard indexes
+//
+// Returns:
+//   - func(): Function that releases the locks in reverse order
+func (l *keyLocks) lockShards(idx []int) func() {
+	for _, i := range idx {
+		l.shards[i].Lock()
+	}
+	return func() {
+		for j := len(idx) - 1; j >= 0; j-- {
+			l.shards[idx[j]].Unlock()
+		}
+	}
+}
@@ -3,19 +3,37 @@
 
 package storage
 
+// Reset resets the BoltStorage struct to its zero state.
+func (s *BoltStorage) Reset() {
+	if s == nil {
+		return
+	}
+
+	if s.db != nil {
+		if resetter, ok := interface{}(s.db).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field db
+		}
+	}
+	s.ownsDB = false
+	s.tenant = ""
+}
+
 // Reset resets the DBStorage struct to its zero state.
 func (s *DBStorage) Reset() {
 	if s == nil {
 		return
 	}
 
-	if s.conn != nil {
-		if resetter, ok := interface{}(s.conn).(interface{ Reset() }); ok {
+	if s.pool != nil {
+		if resetter, ok := interface{}(s.pool).(interface{ Reset() }); ok {
 			resetter.Reset()
 		} else {
-			// TODO: manually reset pointer field conn
+			// TODO: manually reset pointer field pool
 		}
 	}
+	s.ownsPool = false
 	if s.cache != nil {
 		if resetter, ok := interface{}(s.cache).(interface{ Reset() }); ok {
 			resetter.Reset()
@@ -23,12 +41,29 @@ func (s *DBStorage) Reset() {
 			// TODO: manually reset pointer field cache
 		}
 	}
-	// Reset field mu of external type sync.RWMutex
-	if resetter, ok := interface{}(&s.mu).(interface{ Reset() }); ok {
-		resetter.Reset()
-	} else {
-		// TODO: manually reset external field mu
+	if s.versions != nil {
+		if resetter, ok := interface{}(s.versions).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field versions
+		}
 	}
+	if s.locks != nil {
+		if resetter, ok := interface{}(s.locks).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field locks
+		}
+	}
+	if s.feed != nil {
+		if resetter, ok := interface{}(s.feed).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field feed
+		}
+	}
+	s.queryTimeout = 0
+	s.tenant = ""
 }
 
 // Reset resets the FileStorage struct to its zero state.
@@ -48,6 +83,28 @@ func (s *FileStorage) Reset() {
 	} else {
 		// TODO: manually reset external field mu
 	}
+	// Reset field snapMu of external type sync.Mutex
+	if resetter, ok := interface{}(&s.snapMu).(interface{ Reset() }); ok {
+		resetter.Reset()
+	} else {
+		// TODO: manually reset external field snapMu
+	}
+	if s.wal != nil {
+		if resetter, ok := interface{}(s.wal).(interface{ Reset() }); ok {
+			resetter.Reset()
+		} else {
+			// TODO: manually reset pointer field wal
+		}
+	}
+	s.lsn = 0
+	s.snapshotSize = 0
+	// Reset field snapshotting of external type atomic.Bool
+	if resetter, ok := interface{}(&s.snapshotting).(interface{ Reset() }); ok {
+		resetter.Reset()
+	} else {
+		// TODO: manually reset external field snapshotting
+	}
+	s.syncInterval = 0
 }
 
 // Reset resets the MemStorage struct to its zero state.
@@ -58,6 +115,9 @@ func (s *MemStorage) Reset() {
 
 	clear(s.gauge)
 	clear(s.counter)
+	clear(s.histogram)
+	clear(s.summary)
+	clear(s.meta)
 	// Reset field mu of external type sync.RWMutex
 	if resetter, ok := interface{}(&s.mu).(interface{ Reset() }); ok {
 		resetter.Reset()
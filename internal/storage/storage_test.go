@@ -2,7 +2,17 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
 )
 
 func BenchmarkMemStorageUpdateGauge(b *testing.B) {
@@ -23,3 +33,727 @@ func BenchmarkMemStorageGetAll(b *testing.B) {
 		storage.GetAll()
 	}
 }
+
+func ptrFloat(v float64) *float64 { return &v }
+func ptrInt(v int64) *int64       { return &v }
+
+func ptrHistogram(h metrics.Histogram) *metrics.Histogram { return &h }
+
+func TestMemStorageUpdateBatch(t *testing.T) {
+	s := NewMemStorage()
+	s.UpdateCounter(context.Background(), "hits", 5)
+
+	err := s.UpdateBatch(context.Background(), []metrics.Metrics{
+		{ID: "temp", MType: "gauge", Value: ptrFloat(1.5)},
+		{ID: "hits", MType: "counter", Delta: ptrInt(2)},
+		{ID: "hits", MType: "counter", Delta: ptrInt(3)},
+	})
+	if err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	if v, _ := s.GetGauge("temp"); v != 1.5 {
+		t.Errorf("temp = %v, want 1.5", v)
+	}
+	if v, _ := s.GetCounter("hits"); v != 10 {
+		t.Errorf("hits = %v, want 10", v)
+	}
+
+	// An invalid item rejects the whole batch
+	err = s.UpdateBatch(context.Background(), []metrics.Metrics{
+		{ID: "temp", MType: "gauge", Value: ptrFloat(99)},
+		{ID: "broken", MType: "gauge"},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Items) != 1 || batchErr.Items[0].Index != 1 {
+		t.Fatalf("expected BatchError for item 1, got %v", err)
+	}
+	if !errors.Is(err, ErrInvalidMetric) {
+		t.Errorf("expected ErrInvalidMetric, got %v", err)
+	}
+	if v, _ := s.GetGauge("temp"); v != 1.5 {
+		t.Errorf("temp = %v after rejected batch, want 1.5", v)
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	cumulative := metrics.Metrics{ID: "hits", MType: "counter", Delta: ptrInt(7), Temporality: metrics.TemporalityCumulative}
+	tests := []struct {
+		name    string
+		m       metrics.Metrics
+		wantErr string
+	}{
+		{name: "gauge", m: metrics.Metrics{ID: "temp", MType: "gauge", Value: ptrFloat(1)}},
+		{name: "missing id", m: metrics.Metrics{MType: "gauge", Value: ptrFloat(1)}, wantErr: "missing id"},
+		{name: "gauge with delta", m: metrics.Metrics{ID: "temp", MType: "gauge", Value: ptrFloat(1), Delta: ptrInt(1)}, wantErr: "unexpected fields for gauge"},
+		{name: "counter with value", m: metrics.Metrics{ID: "hits", MType: "counter", Delta: ptrInt(1), Value: ptrFloat(1)}, wantErr: "unexpected fields for counter"},
+		{name: "unknown type", m: metrics.Metrics{ID: "x", MType: "meter"}, wantErr: `unknown type "meter"`},
+		{name: "cumulative counter", m: cumulative},
+		{name: "cumulative gauge", m: metrics.Metrics{ID: "temp", MType: "gauge", Value: ptrFloat(1), Temporality: metrics.TemporalityCumulative}, wantErr: "only counters can be cumulative"},
+		{name: "negative total", m: metrics.Metrics{ID: "hits", MType: "counter", Delta: ptrInt(-1), Temporality: metrics.TemporalityCumulative}, wantErr: "must not be negative"},
+		{name: "unknown temporality", m: metrics.Metrics{ID: "hits", MType: "counter", Delta: ptrInt(1), Temporality: "monotonic"}, wantErr: `unknown temporality "monotonic"`},
+	}
+	for _, tt := range tests {
+		err := ValidateBatch([]metrics.Metrics{tt.m})
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.wantErr != "" && (!errors.Is(err, ErrInvalidMetric) || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: expected ErrInvalidMetric with %q, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+
+	// Cumulative totals cannot be stored without a tracker
+	if err := validateBatch([]metrics.Metrics{cumulative}); !errors.Is(err, ErrInvalidMetric) {
+		t.Errorf("validateBatch(cumulative): expected ErrInvalidMetric, got %v", err)
+	}
+}
+
+func TestFileStorageUpdateBatchNotAppliedOnWALError(t *testing.T) {
+	s, err := NewFileStorage(filepath.Join(t.TempDir(), "metrics.json"))
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	s.UpdateGauge(context.Background(), "temp", 1)
+
+	// Make the log unwritable
+	s.wal.file.Close()
+
+	err = s.UpdateBatch(context.Background(), []metrics.Metrics{
+		{ID: "temp", MType: "gauge", Value: ptrFloat(2)},
+		{ID: "new", MType: "counter", Delta: ptrInt(1)},
+	})
+	if err == nil {
+		t.Fatal("expected WAL write error")
+	}
+	if v, _ := s.GetGauge("temp"); v != 1 {
+		t.Errorf("temp = %v after failed write, want 1", v)
+	}
+	if _, ok := s.GetCounter("new"); ok {
+		t.Error("counter from failed batch must not be applied")
+	}
+}
+
+// writeFileStorage fills a new file storage at path and closes it without a snapshot.
+func writeFileStorage(t *testing.T, path string, opts FileOptions) {
+	t.Helper()
+	s, err := NewFileStorageWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	ctx := context.Background()
+	s.UpdateGauge(ctx, "temp", 1.5)
+	s.UpdateCounter(ctx, "hits", 2)
+	s.UpdateCounter(ctx, "hits", 3)
+	s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "load", MType: "gauge", Value: ptrFloat(0.5)},
+		{ID: "hits", MType: "counter", Delta: ptrInt(5)},
+	})
+	s.SetCounter(ctx, "resets", 7)
+	s.UpdateGauge(ctx, "gone", 1)
+	s.DeleteGauge(ctx, "gone")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// checkStoredValues verifies the series written by writeFileStorage (TestBoltStorage writes the same).
+func checkStoredValues(t *testing.T, s Storage) {
+	t.Helper()
+	if v, _ := s.GetGauge("temp"); v != 1.5 {
+		t.Errorf("temp = %v, want 1.5", v)
+	}
+	if v, _ := s.GetGauge("load"); v != 0.5 {
+		t.Errorf("load = %v, want 0.5", v)
+	}
+	if v, _ := s.GetCounter("hits"); v != 10 {
+		t.Errorf("hits = %v, want 10", v)
+	}
+	if v, _ := s.GetCounter("resets"); v != 7 {
+		t.Errorf("resets = %v, want 7", v)
+	}
+	if _, ok := s.GetGauge("gone"); ok {
+		t.Error("deleted gauge was restored")
+	}
+}
+
+func TestFileStorageReplaysWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	writeFileStorage(t, path, FileOptions{})
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("no snapshot expected before Save, stat: %v", err)
+	}
+	s, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	checkStoredValues(t, s)
+}
+
+func TestFileStorageBackgroundSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	writeFileStorage(t, path, FileOptions{SyncInterval: time.Millisecond})
+
+	s, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	checkStoredValues(t, s)
+}
+
+func TestFileStorageSnapshotTruncatesWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+	s, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	s.UpdateCounter(ctx, "hits", 2)
+	s.UpdateGauge(ctx, "temp", 1)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// Written after the snapshot; only in the log
+	s.UpdateCounter(ctx, "hits", 3)
+	s.Close()
+
+	seqs, err := walSegments(path)
+	if err != nil {
+		t.Fatalf("walSegments: %v", err)
+	}
+	if len(seqs) != 1 || seqs[0] != 2 {
+		t.Fatalf("segments = %v, want [2]", seqs)
+	}
+
+	// Counter increments in the snapshot must not be replayed twice
+	s, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if v, _ := s.GetCounter("hits"); v != 5 {
+		t.Errorf("hits = %v, want 5", v)
+	}
+	if v, _ := s.GetGauge("temp"); v != 1 {
+		t.Errorf("temp = %v, want 1", v)
+	}
+	s.Close()
+}
+
+func TestFileStorageAutomaticSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	s, err := NewFileStorageWithOptions(path, FileOptions{SnapshotSize: 1024})
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		s.UpdateCounter(context.Background(), "hits", 1)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil && !s.snapshotting.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no snapshot written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+
+	s, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if v, _ := s.GetCounter("hits"); v != 100 {
+		t.Errorf("hits = %v, want 100", v)
+	}
+}
+
+func TestFileStorageTruncatesTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{name: "partial header", tail: []byte{0x10, 0x00}},
+		{name: "partial payload", tail: []byte{0x40, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, '{'}},
+		{name: "checksum mismatch", tail: []byte{0x02, 0x00, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef, '{', '}'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.json")
+			writeFileStorage(t, path, FileOptions{})
+
+			segment := walSegmentPath(path, 1)
+			info, err := os.Stat(segment)
+			if err != nil {
+				t.Fatalf("stat segment: %v", err)
+			}
+			f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatalf("open segment: %v", err)
+			}
+			f.Write(tt.tail)
+			f.Close()
+
+			s, err := NewFileStorage(path)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			checkStoredValues(t, s)
+
+			// The damaged tail is dropped so that new records follow intact ones
+			if info2, _ := os.Stat(segment); info2.Size() != info.Size() {
+				t.Errorf("segment size = %d, want %d", info2.Size(), info.Size())
+			}
+			s.UpdateCounter(context.Background(), "hits", 1)
+			s.Close()
+
+			s, err = NewFileStorage(path)
+			if err != nil {
+				t.Fatalf("reopen after append: %v", err)
+			}
+			defer s.Close()
+			if v, _ := s.GetCounter("hits"); v != 11 {
+				t.Errorf("hits = %v, want 11", v)
+			}
+		})
+	}
+}
+
+func TestFileStorageRejectsCorruptOlderSegment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	writeFileStorage(t, path, FileOptions{})
+
+	// Flip a payload byte in the first segment and add a later one
+	segment := walSegmentPath(path, 1)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatalf("read segment: %v", err)
+	}
+	data[walHeaderSize+2] ^= 0xff
+	if err := os.WriteFile(segment, data, 0644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+	if err := os.WriteFile(walSegmentPath(path, 2), nil, 0644); err != nil {
+		t.Fatalf("create segment: %v", err)
+	}
+
+	if _, err := NewFileStorage(path); !errors.Is(err, ErrWALCorrupt) {
+		t.Fatalf("expected ErrWALCorrupt, got %v", err)
+	}
+}
+
+func TestFileStorageLoadsLegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	legacy := `[{"id":"temp","type":"gauge","value":2.5},{"id":"hits","type":"counter","delta":4}]`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatalf("write snapshot: %v", err)
+	}
+
+	s, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	defer s.Close()
+	if v, _ := s.GetGauge("temp"); v != 2.5 {
+		t.Errorf("temp = %v, want 2.5", v)
+	}
+	if v, _ := s.GetCounter("hits"); v != 4 {
+		t.Errorf("hits = %v, want 4", v)
+	}
+}
+
+// BenchmarkFileStorageUpdateGauge measures parallel durable writes; concurrent
+// writers share fsyncs.
+func BenchmarkFileStorageUpdateGauge(b *testing.B) {
+	s, err := NewFileStorage(filepath.Join(b.TempDir(), "metrics.json"))
+	if err != nil {
+		b.Fatalf("NewFileStorage: %v", err)
+	}
+	defer s.Close()
+
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.UpdateGauge(context.Background(), "temp", 1)
+		}
+	})
+}
+
+func TestKeyLocksBatchDoesNotDeadlock(t *testing.T) {
+	var locks keyLocks
+	batch := func(names ...string) []metrics.Metrics {
+		b := make([]metrics.Metrics, len(names))
+		for i, n := range names {
+			b[i] = metrics.Metrics{ID: n, MType: "gauge"}
+		}
+		return b
+	}
+	// Duplicate series and batches touching the same series in opposite orders
+	batches := [][]metrics.Metrics{
+		batch("a", "b", "c", "a"),
+		batch("c", "b", "a"),
+		batch("b", "d"),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			for _, b := range batches {
+				wg.Add(1)
+				go func(b []metrics.Metrics) {
+					defer wg.Done()
+					unlock := locks.lockBatch(b)
+					unlock()
+				}(b)
+			}
+		}
+		wg.Wait()
+		unlock := locks.lockAll()
+		unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lockBatch deadlocked")
+	}
+}
+
+// BenchmarkWriteLocking compares a global write lock with per-series locks
+// around a simulated database round trip. Run with -cpu to vary parallelism.
+func BenchmarkWriteLocking(b *testing.B) {
+	const roundTrip = 100 * time.Microsecond
+	names := make([]string, 256)
+	for i := range names {
+		names[i] = fmt.Sprintf("series%d", i)
+	}
+
+	b.Run("GlobalMutex", func(b *testing.B) {
+		var mu sync.Mutex
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.Lock()
+				time.Sleep(roundTrip)
+				mu.Unlock()
+			}
+		})
+	})
+
+	b.Run("ShardedKeyLocks", func(b *testing.B) {
+		var locks keyLocks
+		var n atomic.Int64
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				name := names[n.Add(1)%int64(len(names))]
+				unlock := locks.lock("gauge", name)
+				time.Sleep(roundTrip)
+				unlock()
+			}
+		})
+	})
+}
+
+// BenchmarkDBStorageParallelWrites measures write throughput against a real database
+// with a single connection and with a pool. Set TEST_DATABASE_DSN to run it.
+func BenchmarkDBStorageParallelWrites(b *testing.B) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	for _, maxConns := range []int32{1, 16} {
+		b.Run(fmt.Sprintf("MaxConns=%d", maxConns), func(b *testing.B) {
+			s, err := NewPooledDBStorage(context.Background(), dsn, PoolConfig{MaxConns: maxConns})
+			if err != nil {
+				b.Fatalf("NewPooledDBStorage: %v", err)
+			}
+			defer s.Close()
+
+			var n atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := n.Add(1)
+					name := fmt.Sprintf("bench%d", i%256)
+					var err error
+					if i%2 == 0 {
+						err = s.UpdateGauge(context.Background(), name, float64(i))
+					} else {
+						err = s.UpdateCounter(context.Background(), name, 1)
+					}
+					if err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestChangeFeedApply(t *testing.T) {
+	feed := newChangeFeed()
+	s := &DBStorage{
+		cache:    NewMemStorage(),
+		versions: newSeriesVersions(),
+		locks:    &keyLocks{},
+		feed:     feed,
+		tenant:   DefaultTenant,
+	}
+	feed.register(s)
+
+	apply := func(payload string) {
+		t.Helper()
+		if err := feed.apply(payload); err != nil {
+			t.Fatalf("apply %s: %v", payload, err)
+		}
+	}
+
+	apply(`{"op":"set","tenant":"","type":"gauge","name":"temp","value":21.5,"version":5}`)
+	apply(`{"op":"set","tenant":"","type":"counter","name":"hits","value":42,"version":6}`)
+	if v, _ := s.GetGauge("temp"); v != 21.5 {
+		t.Errorf("temp = %v, want 21.5", v)
+	}
+	if v, _ := s.GetCounter("hits"); v != 42 {
+		t.Errorf("hits = %v, want 42", v)
+	}
+
+	// A late notification of an older write does not roll the series back
+	apply(`{"op":"set","tenant":"","type":"gauge","name":"temp","value":10,"version":3}`)
+	if v, _ := s.GetGauge("temp"); v != 21.5 {
+		t.Errorf("temp = %v after stale change, want 21.5", v)
+	}
+
+	// Local writes record their version as well
+	unlock := s.locks.lock("counter", "hits")
+	s.applyCounter("hits", 50, 9)
+	unlock()
+	apply(`{"op":"set","tenant":"","type":"counter","name":"hits","value":45,"version":8}`)
+	if v, _ := s.GetCounter("hits"); v != 50 {
+		t.Errorf("hits = %v, want 50", v)
+	}
+
+	apply(`{"op":"delete","tenant":"","type":"gauge","name":"temp","version":10}`)
+	if _, ok := s.GetGauge("temp"); ok {
+		t.Error("temp still cached after delete")
+	}
+
+	// Distributions carry the stored object as their value
+	apply(`{"op":"set","tenant":"","type":"histogram","name":"latency","value":{"bounds":[0.1,1],"counts":[1,2,0],"count":3,"sum":1.2},"version":12}`)
+	apply(`{"op":"set","tenant":"","type":"summary","name":"size","value":{"count":2,"sum":8,"quantiles":[{"quantile":0.5,"value":3}]},"version":13}`)
+	if h, ok := s.GetHistogram("latency"); !ok || fmt.Sprint(h) != "{[0.1 1] [1 2 0] 3 1.2}" {
+		t.Errorf("latency = %+v, %v", h, ok)
+	}
+	if sm, ok := s.GetSummary("size"); !ok || fmt.Sprint(sm) != "{2 8 [{0.5 3}]}" {
+		t.Errorf("size = %+v, %v", sm, ok)
+	}
+	apply(`{"op":"delete","tenant":"","type":"histogram","name":"latency","version":14}`)
+	if _, ok := s.GetHistogram("latency"); ok {
+		t.Error("latency still cached after delete")
+	}
+
+	// Metadata registered by another instance replaces the cached one
+	apply(`{"op":"meta","tenant":"","type":"counter","name":"hits","description":"Requests served","unit":"requests","owner":"api"}`)
+	want := metrics.Metadata{ID: "hits", MType: "counter", Description: "Requests served", Unit: "requests", Owner: "api"}
+	if md, ok := s.GetMetadata("hits"); !ok || md != want {
+		t.Errorf("metadata = %+v, %v, want %+v", md, ok, want)
+	}
+
+	// Changes of tenants without a storage are ignored
+	apply(`{"op":"set","tenant":"other","type":"gauge","name":"temp","value":1,"version":11}`)
+	if _, ok := s.GetGauge("temp"); ok {
+		t.Error("change of another tenant applied")
+	}
+
+	if err := feed.apply(`not json`); err == nil {
+		t.Error("expected error for malformed payload")
+	}
+}
+
+func TestBoltStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	ctx := context.Background()
+	s, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatalf("NewBoltStorage: %v", err)
+	}
+
+	s.UpdateGauge(ctx, "temp", 1.5)
+	s.UpdateCounter(ctx, "hits", 2)
+	s.UpdateCounter(ctx, "hits", 3)
+	s.SetCounter(ctx, "resets", 7)
+	s.UpdateGauge(ctx, "gone", 1)
+	if ok, err := s.DeleteGauge(ctx, "gone"); !ok || err != nil {
+		t.Fatalf("DeleteGauge = %v, %v", ok, err)
+	}
+	if ok, _ := s.DeleteCounter(ctx, "missing"); ok {
+		t.Error("DeleteCounter reported a missing series as deleted")
+	}
+
+	// An invalid item rejects the whole batch
+	err = s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "temp", MType: "gauge", Value: ptrFloat(99)},
+		{ID: "broken", MType: "counter"},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected BatchError, got %v", err)
+	}
+	if err := s.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "load", MType: "gauge", Value: ptrFloat(0.5)},
+		{ID: "hits", MType: "counter", Delta: ptrInt(5)},
+	}); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+
+	// Tenants are isolated and share the file
+	tenant, err := NewTenantBoltStorage(s, "acme")
+	if err != nil {
+		t.Fatalf("NewTenantBoltStorage: %v", err)
+	}
+	tenant.UpdateCounter(ctx, "hits", 100)
+	if err := tenant.Close(); err != nil {
+		t.Fatalf("close tenant: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s, err = NewBoltStorage(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	checkStoredValues(t, s)
+
+	tenant, err = NewTenantBoltStorage(s, "acme")
+	if err != nil {
+		t.Fatalf("reopen tenant: %v", err)
+	}
+	if v, _ := tenant.GetCounter("hits"); v != 100 {
+		t.Errorf("tenant hits = %v, want 100", v)
+	}
+	if all, _ := tenant.GetAll(); len(all) != 1 {
+		t.Errorf("tenant has %d series, want 1", len(all))
+	}
+}
+
+func TestCumulativeTracker(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage()
+	tracker := NewCumulativeTracker(time.Hour)
+	clock := time.Now()
+	tracker.now = func() time.Time { return clock }
+
+	cumulative := func(name string, total int64) metrics.Metrics {
+		return metrics.Metrics{ID: name, MType: "counter", Delta: &total, Temporality: metrics.TemporalityCumulative}
+	}
+	send := func(src Source, batch ...metrics.Metrics) error {
+		return tracker.UpdateBatch(ctx, s, src, batch)
+	}
+	expect := func(name string, want int64) {
+		t.Helper()
+		if v, _ := s.GetCounter(name); v != want {
+			t.Errorf("%s = %d, want %d", name, v, want)
+		}
+	}
+
+	agent := Source{ID: "host-1", Start: clock.Add(time.Second)}
+	if err := send(agent, cumulative("polls", 5), cumulative("polls", 7)); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 7) // the second sample of a batch counts from the first
+
+	// A rejected batch does not move the baseline, so resending it counts once
+	bad := metrics.Metrics{ID: "temp", MType: "gauge"}
+	if err := send(agent, cumulative("polls", 9), bad); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+	expect("polls", 7)
+	if err := send(agent, cumulative("polls", 9)); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 9)
+
+	// Plain increments pass through, even without a source
+	if err := send(Source{}, metrics.Metrics{ID: "polls", MType: "counter", Delta: ptrInt(1)}); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 10)
+	if err := send(Source{}, cumulative("polls", 1)); !errors.Is(err, ErrMissingSource) {
+		t.Errorf("expected ErrMissingSource, got %v", err)
+	}
+
+	// The same source ID in another tenant is another source
+	other := Source{Tenant: "team-a", ID: "host-1", Start: agent.Start}
+	if err := send(other, cumulative("polls", 2)); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 12)
+	if err := send(agent, cumulative("polls", 9)); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 12)
+
+	// Stored values cannot bypass the tracker
+	if err := s.UpdateBatch(ctx, []metrics.Metrics{cumulative("polls", 1)}); !errors.Is(err, ErrInvalidMetric) {
+		t.Errorf("MemStorage accepted a cumulative sample: %v", err)
+	}
+
+	// An idle source is forgotten; when it returns, its total only sets the baseline
+	clock = clock.Add(2 * time.Hour)
+	if err := send(agent, cumulative("polls", 15)); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 12)
+	if err := send(agent, cumulative("polls", 16)); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 13)
+
+	// An agent started after the sources were forgotten has no history and counts in full
+	if err := send(Source{ID: "host-2", Start: clock.Add(time.Second)}, cumulative("polls", 4)); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	expect("polls", 17)
+}
+
+func TestCumulativeTracker_Reordered(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage()
+	tracker := NewCumulativeTracker(time.Hour)
+	agent := Source{ID: "host-1", Start: time.Now().Add(time.Second)}
+
+	// The report with total 5 was sent before the one with 10 but arrives after it
+	for _, total := range []int64{10, 5, 12} {
+		m := metrics.Metrics{ID: "polls", MType: "counter", Delta: ptrInt(total), Temporality: metrics.TemporalityCumulative}
+		if err := tracker.UpdateBatch(ctx, s, agent, []metrics.Metrics{m}); err != nil {
+			t.Fatalf("UpdateBatch(%d): %v", total, err)
+		}
+	}
+	if v, _ := s.GetCounter("polls"); v != 12 {
+		t.Errorf("polls = %d, want 12", v)
+	}
+
+	// Without a start time a lower total still means a restart
+	other := Source{ID: "host-2"}
+	for _, total := range []int64{3, 8, 2} {
+		m := metrics.Metrics{ID: "jobs", MType: "counter", Delta: ptrInt(total), Temporality: metrics.TemporalityCumulative}
+		if err := tracker.UpdateBatch(ctx, s, other, []metrics.Metrics{m}); err != nil {
+			t.Fatalf("UpdateBatch(%d): %v", total, err)
+		}
+	}
+	if v, _ := s.GetCounter("jobs"); v != 7 {
+		t.Errorf("jobs = %d, want 7", v)
+	}
+}
@@ -0,0 +1,367 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// DefaultTenant is the tenant used when a request does not identify one.
+// Its data lives in the same places as in single-tenant mode.
+const DefaultTenant = ""
+
+// ReservedTenant is the name under which the default tenant appears where it needs
+// a non-empty one, e.g. its audit file. It cannot be used as a tenant identifier.
+const ReservedTenant = "default"
+
+var (
+	// ErrQuotaExceeded is returned when a write would create a new series
+	// beyond the tenant's series quota.
+	ErrQuotaExceeded = errors.New("series quota exceeded")
+
+	// ErrInvalidTenant is returned for tenant identifiers that are not safe
+	// to use as file name parts or database keys.
+	ErrInvalidTenant = errors.New("invalid tenant id")
+
+	// ErrTooManyTenants is returned when a new tenant would exceed the tenant limit
+	// of the registry.
+	ErrTooManyTenants = errors.New("too many tenants")
+)
+
+// tenantIDPattern restricts tenant identifiers to characters that are safe in file names.
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidTenantID reports whether the identifier may be used as a tenant name.
+// The default (empty) tenant is always valid; ReservedTenant, in any case, is not.
+//
+// Parameters:
+//   - tenant: Tenant identifier to check
+//
+// Returns:
+//   - bool: true if the identifier is valid
+func ValidTenantID(tenant string) bool {
+	if tenant == DefaultTenant {
+		return true
+	}
+	return tenantIDPattern.MatchString(tenant) && !strings.EqualFold(tenant, ReservedTenant)
+}
+
+// TenantFilePath derives the storage file of a tenant from the base file path
+// by inserting the tenant name before the extension:
+// "/tmp/metrics.json" becomes "/tmp/metrics.team-a.json".
+// The default tenant keeps the base path.
+//
+// Parameters:
+//   - base: Base file path used in single-tenant mode
+//   - tenant: Tenant identifier
+//
+// Returns:
+//   - string: File path for the tenant
+func TenantFilePath(base, tenant string) string {
+	if tenant == DefaultTenant {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "." + tenant + ext
+}
+
+// TenantFactory creates the storage backend for a tenant the first time it is seen.
+type TenantFactory func(ctx context.Context, tenant string) (Storage, error)
+
+// TenantRegistry keeps an isolated Storage per tenant. Stores are created lazily
+// by the factory and, when a series quota is configured, wrapped in QuotaStorage.
+// Every tenant holds resources such as connections or open files, so the number
+// of tenants can be capped.
+type TenantRegistry struct {
+	stores     map[string]Storage // Storage per tenant, as returned to callers
+	backends   map[string]Storage // Unwrapped storage per tenant
+	factory    TenantFactory      // Creates storage for new tenants
+	maxSeries  int                // Series quota per tenant (0 means unlimited)
+	maxTenants int                // Maximum number of tenants besides the default one (0 means unlimited)
+	mu         sync.Mutex         // Protects stores and backends
+}
+
+// NewTenantRegistry creates a registry that serves defaultStore for the default tenant
+// and creates stores for other tenants with the factory.
+//
+// Parameters:
+//   - defaultStore: Storage used for the default tenant
+//   - factory: Creates storage for other tenants
+//   - maxSeries: Maximum number of series per tenant (0 means unlimited)
+//   - maxTenants: Maximum number of tenants besides the default one (0 means unlimited)
+//
+// Returns:
+//   - *TenantRegistry: Ready-to-use registry
+func NewTenantRegistry(defaultStore Storage, factory TenantFactory, maxSeries, maxTenants int) *TenantRegistry {
+	r := &TenantRegistry{
+		stores:     make(map[string]Storage),
+		backends:   make(map[string]Storage),
+		factory:    factory,
+		maxSeries:  maxSeries,
+		maxTenants: maxTenants,
+	}
+	r.add(DefaultTenant, defaultStore)
+	return r
+}
+
+// add registers a backend for a tenant, wrapping it with the quota if one is configured.
+func (r *TenantRegistry) add(tenant string, backend Storage) Storage {
+	store := backend
+	if r.maxSeries > 0 {
+		store = NewQuotaStorage(backend, r.maxSeries)
+	}
+	r.backends[tenant] = backend
+	r.stores[tenant] = store
+	return store
+}
+
+// Get returns the storage of the tenant, creating it on first use.
+//
+// Parameters:
+//   - ctx: Context for backend initialization
+//   - tenant: Tenant identifier
+//
+// Returns:
+//   - Storage: The tenant's storage
+//   - error: ErrInvalidTenant, ErrTooManyTenants or an error from the factory
+func (r *TenantRegistry) Get(ctx context.Context, tenant string) (Storage, error) {
+	if !ValidTenantID(tenant) {
+		return nil, ErrInvalidTenant
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.stores[tenant]; ok {
+		return s, nil
+	}
+	// The default tenant is always registered and does not count
+	if r.maxTenants > 0 && len(r.stores)-1 >= r.maxTenants {
+		return nil, ErrTooManyTenants
+	}
+
+	backend, err := r.factory(ctx, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("create storage for tenant %s: %w", tenant, err)
+	}
+	return r.add(tenant, backend), nil
+}
+
+// Each calls fn for the unwrapped storage of every known tenant in name order.
+// It is used by background jobs such as periodic saving.
+//
+// Parameters:
+//   - fn: Callback receiving the tenant identifier and its storage backend
+func (r *TenantRegistry) Each(fn func(tenant string, s Storage)) {
+	r.mu.Lock()
+	tenants := make([]string, 0, len(r.backends))
+	for t := range r.backends {
+		tenants = append(tenants, t)
+	}
+	backends := make(map[string]Storage, len(r.backends))
+	for t, s := range r.backends {
+		backends[t] = s
+	}
+	r.mu.Unlock()
+
+	sort.Strings(tenants)
+	for _, t := range tenants {
+		fn(t, backends[t])
+	}
+}
+
+// Close closes the backends of all non-default tenants that hold resources.
+// The default tenant's storage is owned by the caller and is left open.
+//
+// Returns:
+//   - error: The first error encountered while closing
+func (r *TenantRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var firstErr error
+	for t, s := range r.backends {
+		if t == DefaultTenant {
+			continue
+		}
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// QuotaStorage wraps a Storage and rejects writes that would create more
+// than maxSeries distinct series. Updates of existing series are always allowed.
+type QuotaStorage struct {
+	Storage              // Wrapped storage
+	maxSeries int        // Maximum number of series
+	mu        sync.Mutex // Serializes creation of new series
+}
+
+// NewQuotaStorage wraps the storage with a series quota.
+//
+// Parameters:
+//   - inner: Storage to wrap
+//   - maxSeries: Maximum number of distinct series
+//
+// Returns:
+//   - *QuotaStorage: Storage enforcing the quota
+func NewQuotaStorage(inner Storage, maxSeries int) *QuotaStorage {
+	return &QuotaStorage{Storage: inner, maxSeries: maxSeries}
+}
+
+// Unwrap returns the wrapped storage.
+func (s *QuotaStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// admit checks whether a write to a series that does not exist yet fits into the quota.
+func (s *QuotaStorage) admit() error {
+	all, err := s.Storage.GetAll()
+	if err != nil {
+		return err
+	}
+	if len(all) >= s.maxSeries {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// UpdateGauge updates a gauge, checking the quota when the gauge is new.
+func (s *QuotaStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	if _, ok := s.Storage.GetGauge(name); ok {
+		return s.Storage.UpdateGauge(ctx, name, value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Storage.GetGauge(name); !ok {
+		if err := s.admit(); err != nil {
+			return err
+		}
+	}
+	return s.Storage.UpdateGauge(ctx, name, value)
+}
+
+// UpdateCounter updates a counter, checking the quota when the counter is new.
+func (s *QuotaStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
+	if _, ok := s.Storage.GetCounter(name); ok {
+		return s.Storage.UpdateCounter(ctx, name, delta)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Storage.GetCounter(name); !ok {
+		if err := s.admit(); err != nil {
+			return err
+		}
+	}
+	return s.Storage.UpdateCounter(ctx, name, delta)
+}
+
+// SetCounter sets a counter, checking the quota when the counter is new.
+func (s *QuotaStorage) SetCounter(ctx context.Context, name string, value int64) error {
+	if _, ok := s.Storage.GetCounter(name); ok {
+		return s.Storage.SetCounter(ctx, name, value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Storage.GetCounter(name); !ok {
+		if err := s.admit(); err != nil {
+			return err
+		}
+	}
+	return s.Storage.SetCounter(ctx, name, value)
+}
+
+// UpdateHistogram merges a histogram, checking the quota when the histogram is new.
+func (s *QuotaStorage) UpdateHistogram(ctx context.Context, name string, h metrics.Histogram) error {
+	if _, ok := s.Storage.GetHistogram(name); ok {
+		return s.Storage.UpdateHistogram(ctx, name, h)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Storage.GetHistogram(name); !ok {
+		if err := s.admit(); err != nil {
+			return err
+		}
+	}
+	return s.Storage.UpdateHistogram(ctx, name, h)
+}
+
+// UpdateSummary merges a summary, checking the quota when the summary is new.
+func (s *QuotaStorage) UpdateSummary(ctx context.Context, name string, sm metrics.Summary) error {
+	if _, ok := s.Storage.GetSummary(name); ok {
+		return s.Storage.UpdateSummary(ctx, name, sm)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Storage.GetSummary(name); !ok {
+		if err := s.admit(); err != nil {
+			return err
+		}
+	}
+	return s.Storage.UpdateSummary(ctx, name, sm)
+}
+
+// UpdateBatch applies a batch, rejecting it as a whole if the new series it
+// introduces do not fit into the quota. The items creating series beyond the quota
+// are reported in a *BatchError wrapping ErrQuotaExceeded.
+func (s *QuotaStorage) UpdateBatch(ctx context.Context, batch []metrics.Metrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.Storage.GetAll()
+	if err != nil {
+		return err
+	}
+	free := s.maxSeries - len(all)
+
+	// Count each new series once, in batch order
+	type series struct{ mtype, id string }
+	seen := make(map[series]bool)
+	var failed []BatchItemError
+	for i, m := range batch {
+		key := series{m.MType, m.ID}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		var exists bool
+		switch m.MType {
+		case "gauge":
+			_, exists = s.Storage.GetGauge(m.ID)
+		case "counter":
+			_, exists = s.Storage.GetCounter(m.ID)
+		case "histogram":
+			_, exists = s.Storage.GetHistogram(m.ID)
+		case "summary":
+			_, exists = s.Storage.GetSummary(m.ID)
+		default:
+			// Invalid items are reported by the wrapped storage
+			continue
+		}
+		if exists {
+			continue
+		}
+		if free > 0 {
+			free--
+			continue
+		}
+		failed = append(failed, BatchItemError{Index: i, ID: m.ID, MType: m.MType, Err: ErrQuotaExceeded})
+	}
+	if len(failed) > 0 {
+		return &BatchError{Items: failed}
+	}
+	return s.Storage.UpdateBatch(ctx, batch)
+}
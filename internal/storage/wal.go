@@ -0,0 +1,418 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+)
+
+// ErrWALCorrupt is returned when a write-ahead log segment other than the last one
+// contains a damaged record. Damage at the tail of the last segment is a torn write
+// from a crash and is truncated silently.
+var ErrWALCorrupt = errors.New("corrupt write-ahead log")
+
+// Write-ahead log record operations.
+const (
+	walUpdate = "update" // Gauges are set, counters are incremented
+	walSet    = "set"    // Gauges and counters are set to absolute values
+	walDelete = "delete" // Series are removed
+	walMeta   = "meta"   // Metadata of a metric is registered
+)
+
+const (
+	// walHeaderSize is the size of a frame header: payload length and CRC-32C, both little endian
+	walHeaderSize = 8
+	// walMaxRecordSize bounds the payload length read from a header, so that a damaged
+	// header cannot cause a huge allocation
+	walMaxRecordSize = 64 << 20
+)
+
+// walCRC is the CRC-32C (Castagnoli) table used for record checksums.
+var walCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is one logged write. A record is applied atomically on replay.
+type walRecord struct {
+	LSN   uint64            `json:"lsn"`            // Log sequence number, increasing by one per record
+	Op    string            `json:"op"`             // walUpdate, walSet, walDelete or walMeta
+	Items []metrics.Metrics `json:"items"`          // Affected series
+	Meta  *metrics.Metadata `json:"meta,omitempty"` // Registered metadata (walMeta only)
+}
+
+// wal is an append-only log split into numbered segment files next to the snapshot
+// ("<snapshot>.wal.000001", ...). Each record is framed as
+//
+//	[payload length uint32][CRC-32C of payload uint32][JSON payload]
+//
+// Appends are made durable with fsync. With a zero sync interval, callers wait for
+// an fsync covering their record and concurrent writers share one fsync (group commit).
+// With a positive interval, a background goroutine syncs periodically and callers
+// return immediately, trading the last interval of writes for latency.
+type wal struct {
+	base         string        // Snapshot path the segment names are derived from
+	syncInterval time.Duration // Background sync interval (0 to sync before acknowledging)
+
+	mu      sync.Mutex // Protects the fields below
+	cond    *sync.Cond // Signals completed syncs
+	file    *os.File   // Active segment
+	seq     uint64     // Number of the active segment
+	size    int64      // Size of the active segment
+	written uint64     // LSN of the last appended record
+	synced  uint64     // LSN of the last durable record
+	syncing bool       // Whether an fsync is in progress
+	err     error      // Sticky error after a failed fsync or a failed append rollback
+
+	stop chan struct{} // Closed to stop the background syncer
+	done chan struct{} // Closed when the background syncer exited
+}
+
+// walSegmentPath returns the path of a segment file.
+//
+// Parameters:
+//   - base: Snapshot path
+//   - seq: Segment number
+//
+// Returns:
+//   - string: Segment path
+func walSegmentPath(base string, seq uint64) string {
+	return fmt.Sprintf("%s.wal.%06d", base, seq)
+}
+
+// walSegments lists the segment numbers of the log in ascending order.
+//
+// Parameters:
+//   - base: Snapshot path
+//
+// Returns:
+//   - []uint64: Existing segment numbers
+//   - error: Any error listing the directory
+func walSegments(base string) ([]uint64, error) {
+	paths, err := filepath.Glob(base + ".wal.*")
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, p := range paths {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(p, base+".wal."), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// readWALSegment reads all intact records of a segment.
+//
+// Parameters:
+//   - path: Segment path
+//
+// Returns:
+//   - []walRecord: Records up to the first damaged frame
+//   - int64: Size of the intact prefix
+//   - bool: true if the segment ends with a damaged or incomplete frame
+//   - error: Any error reading the file
+func readWALSegment(path string) ([]walRecord, int64, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	var records []walRecord
+	var offset int64
+	for int64(len(data)) > offset {
+		rest := data[offset:]
+		if len(rest) < walHeaderSize {
+			return records, offset, true, nil
+		}
+		length := binary.LittleEndian.Uint32(rest[0:4])
+		sum := binary.LittleEndian.Uint32(rest[4:8])
+		if length > walMaxRecordSize || int64(length) > int64(len(rest)-walHeaderSize) {
+			return records, offset, true, nil
+		}
+		payload := rest[walHeaderSize : walHeaderSize+int(length)]
+		if crc32.Checksum(payload, walCRC) != sum {
+			return records, offset, true, nil
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return records, offset, true, nil
+		}
+		records = append(records, rec)
+		offset += walHeaderSize + int64(length)
+	}
+	return records, offset, false, nil
+}
+
+// openWAL opens a segment for appending and starts the background syncer if needed.
+//
+// Parameters:
+//   - base: Snapshot path
+//   - seq: Number of the segment to append to
+//   - lsn: LSN of the last record already in the log
+//   - syncInterval: Background sync interval (0 to sync before acknowledging)
+//
+// Returns:
+//   - *wal: Open log
+//   - error: Any error opening the segment
+func openWAL(base string, seq uint64, lsn uint64, syncInterval time.Duration) (*wal, error) {
+	file, size, err := openWALSegment(base, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{
+		base:         base,
+		syncInterval: syncInterval,
+		file:         file,
+		seq:          seq,
+		size:         size,
+		written:      lsn,
+		synced:       lsn,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	if syncInterval > 0 {
+		go w.syncLoop()
+	} else {
+		close(w.done)
+	}
+	return w, nil
+}
+
+// openWALSegment opens or creates a segment file for appending.
+//
+// Parameters:
+//   - base: Snapshot path
+//   - seq: Segment number
+//
+// Returns:
+//   - *os.File: Segment opened for appending
+//   - int64: Current size of the segment
+//   - error: Any error opening the file
+func openWALSegment(base string, seq uint64) (*os.File, int64, error) {
+	file, err := os.OpenFile(walSegmentPath(base, seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open WAL segment: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("stat WAL segment: %w", err)
+	}
+	return file, info.Size(), nil
+}
+
+// append writes a record to the active segment. Records must be appended in LSN order.
+// If the write fails, the segment is truncated back so that no partial frame is left
+// in front of later records.
+//
+// Parameters:
+//   - rec: Record to append
+//
+// Returns:
+//   - error: Any error encoding or writing the record
+func (w *wal) append(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode WAL record: %w", err)
+	}
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, walCRC))
+	copy(frame[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := w.file.Write(frame); err != nil {
+		if terr := w.file.Truncate(w.size); terr != nil {
+			w.err = fmt.Errorf("roll back partial WAL write: %w", terr)
+		}
+		return fmt.Errorf("write WAL record: %w", err)
+	}
+	w.size += int64(len(frame))
+	w.written = rec.LSN
+	return nil
+}
+
+// activeSize returns the size of the active segment.
+//
+// Returns:
+//   - int64: Size in bytes
+func (w *wal) activeSize() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// waitDurable blocks until the record with the given LSN is on disk.
+// It returns immediately when background syncing is enabled.
+//
+// Parameters:
+//   - lsn: LSN of the record
+//
+// Returns:
+//   - error: Error of the fsync covering the record
+func (w *wal) waitDurable(lsn uint64) error {
+	if w.syncInterval > 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.synced < lsn {
+		if w.err != nil {
+			return w.err
+		}
+		if w.syncing {
+			// Another writer's fsync is in progress; it may cover this record too
+			w.cond.Wait()
+			continue
+		}
+		w.syncLocked()
+	}
+	return w.err
+}
+
+// syncLocked fsyncs the active segment, releasing w.mu during the system call so that
+// other writers can append in the meantime. Must be called with w.mu held and no
+// sync in progress.
+func (w *wal) syncLocked() {
+	w.syncing = true
+	target := w.written
+	file := w.file
+	w.mu.Unlock()
+
+	err := file.Sync()
+
+	w.mu.Lock()
+	w.syncing = false
+	if err != nil && w.err == nil {
+		// After a failed fsync the state of the page cache is unknown; refuse further writes
+		w.err = fmt.Errorf("sync WAL: %w", err)
+	}
+	if err == nil && target > w.synced {
+		w.synced = target
+	}
+	w.cond.Broadcast()
+}
+
+// syncLoop periodically syncs the log when background syncing is enabled.
+func (w *wal) syncLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			for w.syncing {
+				w.cond.Wait()
+			}
+			if w.synced < w.written && w.err == nil {
+				w.syncLocked()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// rotate syncs and closes the active segment and continues in a new one.
+// Records appended afterwards are not part of any older segment.
+//
+// Returns:
+//   - uint64: Number of the new segment
+//   - error: Any error syncing the old or creating the new segment
+func (w *wal) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.err = fmt.Errorf("sync WAL: %w", err)
+		return 0, w.err
+	}
+
+	file, size, err := openWALSegment(w.base, w.seq+1)
+	if err != nil {
+		return 0, err
+	}
+	w.file.Close()
+	w.file = file
+	w.seq++
+	w.size = size
+	w.synced = w.written
+	w.cond.Broadcast()
+	return w.seq, nil
+}
+
+// removeBefore deletes all segments older than seq.
+//
+// Parameters:
+//   - seq: First segment to keep
+//
+// Returns:
+//   - error: The first error encountered while deleting
+func (w *wal) removeBefore(seq uint64) error {
+	seqs, err := walSegments(w.base)
+	if err != nil {
+		return err
+	}
+	for _, old := range seqs {
+		if old >= seq {
+			break
+		}
+		if err := os.Remove(walSegmentPath(w.base, old)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// close stops the background syncer, syncs and closes the active segment.
+//
+// Returns:
+//   - error: Any error syncing or closing the segment
+func (w *wal) close() error {
+	if w.syncInterval > 0 {
+		close(w.stop)
+	}
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.syncing {
+		w.cond.Wait()
+	}
+	syncErr := w.file.Sync()
+	closeErr := w.file.Close()
+	if syncErr != nil {
+		return syncErr
+	}
+	return closeErr
+}
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE gauge ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE gauge DROP CONSTRAINT IF EXISTS gauge_pkey;
+ALTER TABLE gauge ADD PRIMARY KEY (tenant_id, name);
+
+ALTER TABLE counter ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE counter DROP CONSTRAINT IF EXISTS counter_pkey;
+ALTER TABLE counter ADD PRIMARY KEY (tenant_id, name);
+
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE api_tokens DROP COLUMN IF EXISTS tenant;
+
+DELETE FROM counter WHERE tenant_id <> '';
+ALTER TABLE counter DROP CONSTRAINT IF EXISTS counter_pkey;
+ALTER TABLE counter DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE counter ADD PRIMARY KEY (name);
+
+DELETE FROM gauge WHERE tenant_id <> '';
+ALTER TABLE gauge DROP CONSTRAINT IF EXISTS gauge_pkey;
+ALTER TABLE gauge DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE gauge ADD PRIMARY KEY (name);
+-- +goose StatementEnd
@@ -0,0 +1,75 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE SEQUENCE IF NOT EXISTS metric_version_seq;
+
+ALTER TABLE gauge ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE counter ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Every write gets a new version. Writes to the same row are serialized by the row
+-- lock, so versions of one series grow in commit order.
+CREATE OR REPLACE FUNCTION metric_set_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := nextval('metric_version_seq');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Publish every change on the metric_changes channel. Notifications are delivered
+-- when the transaction commits, in commit order.
+CREATE OR REPLACE FUNCTION metric_notify_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('metric_changes', json_build_object(
+            'op', 'delete',
+            'tenant', OLD.tenant_id,
+            'type', TG_TABLE_NAME,
+            'name', OLD.name,
+            'version', nextval('metric_version_seq')
+        )::text);
+        RETURN OLD;
+    END IF;
+
+    PERFORM pg_notify('metric_changes', json_build_object(
+        'op', 'set',
+        'tenant', NEW.tenant_id,
+        'type', TG_TABLE_NAME,
+        'name', NEW.name,
+        'value', NEW.value,
+        'version', NEW.version
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER gauge_set_version BEFORE INSERT OR UPDATE ON gauge
+    FOR EACH ROW EXECUTE FUNCTION metric_set_version();
+CREATE TRIGGER gauge_notify_change AFTER INSERT OR UPDATE OR DELETE ON gauge
+    FOR EACH ROW EXECUTE FUNCTION metric_notify_change();
+
+CREATE TRIGGER counter_set_version BEFORE INSERT OR UPDATE ON counter
+    FOR EACH ROW EXECUTE FUNCTION metric_set_version();
+CREATE TRIGGER counter_notify_change AFTER INSERT OR UPDATE OR DELETE ON counter
+    FOR EACH ROW EXECUTE FUNCTION metric_notify_change();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS counter_notify_change ON counter;
+DROP TRIGGER IF EXISTS counter_set_version ON counter;
+DROP TRIGGER IF EXISTS gauge_notify_change ON gauge;
+DROP TRIGGER IF EXISTS gauge_set_version ON gauge;
+
+DROP FUNCTION IF EXISTS metric_notify_change();
+DROP FUNCTION IF EXISTS metric_set_version();
+
+ALTER TABLE counter DROP COLUMN IF EXISTS version;
+ALTER TABLE gauge DROP COLUMN IF EXISTS version;
+
+DROP SEQUENCE IF EXISTS metric_version_seq;
+-- +goose StatementEnd
@@ -0,0 +1,71 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS metric_metadata (
+    tenant_id TEXT NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL,
+    type TEXT NOT NULL CHECK (type IN ('gauge', 'counter')),
+    description TEXT NOT NULL DEFAULT '',
+    unit TEXT NOT NULL DEFAULT '',
+    owner TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (tenant_id, name)
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Reject writes whose table differs from the registered type of the metric. The check
+-- runs in the writing transaction, so it covers the writes of every server instance.
+CREATE OR REPLACE FUNCTION metric_check_type() RETURNS trigger AS $$
+DECLARE
+    registered TEXT;
+BEGIN
+    SELECT type INTO registered FROM metric_metadata
+        WHERE tenant_id = NEW.tenant_id AND name = NEW.name
+        FOR SHARE;
+    IF registered IS NOT NULL AND registered <> TG_TABLE_NAME THEN
+        RAISE EXCEPTION 'metric % is registered as %', NEW.name, registered
+            USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Publish registered metadata on the metric_changes channel, so that other instances
+-- update their caches.
+CREATE OR REPLACE FUNCTION metric_notify_metadata() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('metric_changes', json_build_object(
+        'op', 'meta',
+        'tenant', NEW.tenant_id,
+        'type', NEW.type,
+        'name', NEW.name,
+        'description', NEW.description,
+        'unit', NEW.unit,
+        'owner', NEW.owner
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER gauge_check_type BEFORE INSERT OR UPDATE ON gauge
+    FOR EACH ROW EXECUTE FUNCTION metric_check_type();
+CREATE TRIGGER counter_check_type BEFORE INSERT OR UPDATE ON counter
+    FOR EACH ROW EXECUTE FUNCTION metric_check_type();
+CREATE TRIGGER metadata_notify_change AFTER INSERT OR UPDATE ON metric_metadata
+    FOR EACH ROW EXECUTE FUNCTION metric_notify_metadata();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS metadata_notify_change ON metric_metadata;
+DROP TRIGGER IF EXISTS counter_check_type ON counter;
+DROP TRIGGER IF EXISTS gauge_check_type ON gauge;
+
+DROP FUNCTION IF EXISTS metric_notify_metadata();
+DROP FUNCTION IF EXISTS metric_check_type();
+
+DROP TABLE IF EXISTS metric_metadata;
+-- +goose StatementEnd
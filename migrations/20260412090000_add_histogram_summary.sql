@@ -0,0 +1,100 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS histogram (
+    tenant_id TEXT NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL,
+    bounds DOUBLE PRECISION[] NOT NULL,
+    counts BIGINT[] NOT NULL,
+    count BIGINT NOT NULL,
+    sum DOUBLE PRECISION NOT NULL,
+    version BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (tenant_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS summary (
+    tenant_id TEXT NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL,
+    count BIGINT NOT NULL,
+    sum DOUBLE PRECISION NOT NULL,
+    quantiles DOUBLE PRECISION[] NOT NULL,
+    quantile_values DOUBLE PRECISION[] NOT NULL,
+    version BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (tenant_id, name)
+);
+
+ALTER TABLE metric_metadata DROP CONSTRAINT IF EXISTS metric_metadata_type_check;
+ALTER TABLE metric_metadata ADD CONSTRAINT metric_metadata_type_check
+    CHECK (type IN ('gauge', 'counter', 'histogram', 'summary'));
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Publish writes of histograms and summaries on the metric_changes channel. The value
+-- is the stored distribution in the JSON layout of the API. Deletions are published
+-- by metric_notify_change.
+CREATE OR REPLACE FUNCTION metric_notify_distribution() RETURNS trigger AS $$
+DECLARE
+    dist JSON;
+BEGIN
+    IF TG_TABLE_NAME = 'histogram' THEN
+        dist := json_build_object(
+            'bounds', NEW.bounds,
+            'counts', NEW.counts,
+            'count', NEW.count,
+            'sum', NEW.sum
+        );
+    ELSE
+        dist := json_build_object(
+            'count', NEW.count,
+            'sum', NEW.sum,
+            'quantiles', COALESCE((
+                SELECT json_agg(json_build_object('quantile', q, 'value', v) ORDER BY i)
+                FROM unnest(NEW.quantiles, NEW.quantile_values) WITH ORDINALITY AS t(q, v, i)
+            ), '[]'::json)
+        );
+    END IF;
+
+    PERFORM pg_notify('metric_changes', json_build_object(
+        'op', 'set',
+        'tenant', NEW.tenant_id,
+        'type', TG_TABLE_NAME,
+        'name', NEW.name,
+        'value', dist,
+        'version', NEW.version
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER histogram_check_type BEFORE INSERT OR UPDATE ON histogram
+    FOR EACH ROW EXECUTE FUNCTION metric_check_type();
+CREATE TRIGGER histogram_set_version BEFORE INSERT OR UPDATE ON histogram
+    FOR EACH ROW EXECUTE FUNCTION metric_set_version();
+CREATE TRIGGER histogram_notify_change AFTER INSERT OR UPDATE ON histogram
+    FOR EACH ROW EXECUTE FUNCTION metric_notify_distribution();
+CREATE TRIGGER histogram_notify_delete AFTER DELETE ON histogram
+    FOR EACH ROW EXECUTE FUNCTION metric_notify_change();
+
+CREATE TRIGGER summary_check_type BEFORE INSERT OR UPDATE ON summary
+    FOR EACH ROW EXECUTE FUNCTION metric_check_type();
+CREATE TRIGGER summary_set_version BEFORE INSERT OR UPDATE ON summary
+    FOR EACH ROW EXECUTE FUNCTION metric_set_version();
+CREATE TRIGGER summary_notify_change AFTER INSERT OR UPDATE ON summary
+    FOR EACH ROW EXECUTE FUNCTION metric_notify_distribution();
+CREATE TRIGGER summary_notify_delete AFTER DELETE ON summary
+    FOR EACH ROW EXECUTE FUNCTION metric_notify_change();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS summary;
+DROP TABLE IF EXISTS histogram;
+
+DROP FUNCTION IF EXISTS metric_notify_distribution();
+
+DELETE FROM metric_metadata WHERE type IN ('histogram', 'summary');
+ALTER TABLE metric_metadata DROP CONSTRAINT IF EXISTS metric_metadata_type_check;
+ALTER TABLE metric_metadata ADD CONSTRAINT metric_metadata_type_check
+    CHECK (type IN ('gauge', 'counter'));
+-- +goose StatementEnd
@@ -0,0 +1,303 @@
+// Package client pushes metrics to the metrics server from any Go application.
+//
+// It speaks the protocol of the server's JSON API: request bodies are gzip-compressed,
+// optionally encrypted with the server's RSA public key, signed with an HMAC-SHA256
+// hash in the HashSHA256 header and authorized with a bearer token. Failed requests
+// are retried on network errors, 5xx and 429 responses, honouring Retry-After.
+//
+// Applications usually create one Client and report through typed handles, which
+// aggregate in memory and are sent in batches in the background:
+//
+//	c, err := client.New(client.Config{Address: "localhost:8080", Key: "secret"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer c.Close(context.Background())
+//
+//	orders := c.Counter("OrdersPlaced")
+//	queue := c.Gauge("QueueDepth")
+//	orders.Inc()
+//	queue.Set(17)
+//
+// Histograms, summaries and metrics with metadata are queued with Push. Send and
+// Post give direct control over single requests; the metrics agent uses them.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/crypto"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/sha256"
+)
+
+const (
+	// DefaultFlushInterval is how often the handles and pushed metrics are sent by default.
+	DefaultFlushInterval = 10 * time.Second
+	// DefaultBatchMaxCount is the default maximum number of metrics per /updates request.
+	DefaultBatchMaxCount = 100
+	// DefaultBatchMaxBytes is the default maximum size of the uncompressed JSON body of a
+	// batch, well below the server's default body limit of 1 MiB.
+	DefaultBatchMaxBytes = 512 << 10
+	// DefaultMaxPending is the default number of pushed metrics buffered between flushes.
+	DefaultMaxPending = 10000
+)
+
+// Config configures a Client. Only Address is required.
+type Config struct {
+	// Address is the server address in "host:port" format, or a base URL such as
+	// "https://metrics.example.com" to use another scheme.
+	Address string
+
+	// Key is the secret for the HMAC-SHA256 signature of the request bodies; empty disables signing.
+	Key string
+
+	// PublicKey encrypts the request bodies for the server; nil sends them in plain text.
+	// See LoadPublicKey.
+	PublicKey *rsa.PublicKey
+
+	// Token is sent as a bearer token in the Authorization header; empty omits the header.
+	Token string
+
+	// RealIP is sent in the X-Real-IP header for the server's trusted subnet check; empty omits it.
+	RealIP string
+
+	// SourceID identifies this process to the server. With a source ID, counters are sent
+	// as cumulative totals, which the server turns into increments per source, so a lost
+	// or repeated request does not skew them. Without one they are sent as increments.
+	SourceID string
+
+	// Start is when the source started reporting, sent in X-Source-Start together with
+	// the source ID. It defaults to the time New is called.
+	Start time.Time
+
+	// HTTPClient sends the requests; nil uses a client with a 10 second timeout.
+	HTTPClient *http.Client
+
+	// RetryDelays are the delays before the attempts of a request; nil uses DefaultRetryDelays
+	// and a single zero delay disables retries.
+	RetryDelays []time.Duration
+
+	// FlushInterval is how often the handles and pushed metrics are sent; zero uses DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// BatchMaxCount bounds the number of metrics per request; zero uses DefaultBatchMaxCount.
+	BatchMaxCount int
+
+	// BatchMaxBytes bounds the uncompressed body of a request; zero uses DefaultBatchMaxBytes.
+	// A larger single metric is sent alone.
+	BatchMaxBytes int
+
+	// MaxPending bounds the pushed metrics waiting for the next flush; zero uses DefaultMaxPending.
+	MaxPending int
+
+	// OnError is called with the errors of background flushes; nil logs them with the log package.
+	OnError func(error)
+}
+
+// Client sends metrics to the server. It is safe for concurrent use.
+//
+// The handles and Push only record metrics; a background goroutine, started with the
+// first of them, sends them every FlushInterval and whenever a full batch is pending.
+// Close sends what is left and stops it.
+type Client struct {
+	cfg     Config // Configuration with the defaults applied
+	baseURL string // Scheme and address of the server, without a trailing slash
+
+	mu       sync.Mutex               // Guards the fields below
+	gauges   map[string]*gaugeState   // Gauges by name
+	counters map[string]*counterState // Counters by name
+	pending  []Metric                 // Pushed metrics in push order
+	closed   bool                     // Set by Close
+
+	flushMu sync.Mutex    // Serializes flushes so that counters are sent in order
+	start   sync.Once     // Starts the background loop
+	wake    chan struct{} // Asks the background loop to flush early
+	stop    chan struct{} // Closed to stop the background loop
+	done    chan struct{} // Closed when the background loop has stopped
+}
+
+// New creates a client for the server at cfg.Address.
+//
+// Parameters:
+//   - cfg: Client configuration
+//
+// Returns:
+//   - *Client: Client ready for use
+//   - error: Error if the address is missing or invalid
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("server address is required")
+	}
+	baseURL := strings.TrimSuffix(cfg.Address, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	if _, err := http.NewRequest(http.MethodPost, baseURL, nil); err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %w", cfg.Address, err)
+	}
+
+	if cfg.Start.IsZero() {
+		cfg.Start = time.Now()
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.RetryDelays == nil {
+		cfg.RetryDelays = DefaultRetryDelays
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.BatchMaxCount <= 0 {
+		cfg.BatchMaxCount = DefaultBatchMaxCount
+	}
+	if cfg.BatchMaxBytes <= 0 {
+		cfg.BatchMaxBytes = DefaultBatchMaxBytes
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = DefaultMaxPending
+	}
+
+	return &Client{
+		cfg:      cfg,
+		baseURL:  baseURL,
+		gauges:   make(map[string]*gaugeState),
+		counters: make(map[string]*counterState),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// LoadPublicKey loads the server's RSA public key from a PEM file for Config.PublicKey.
+//
+// Parameters:
+//   - path: Path to the PEM file
+//
+// Returns:
+//   - *rsa.PublicKey: Public key
+//   - error: Error if the file cannot be read or holds no RSA public key
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	return crypto.LoadRSAPublicKey(path)
+}
+
+// bufferPool is a sync.Pool for reusing bytes.Buffer instances to reduce memory allocations
+// when compressing request bodies with gzip.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// Send sends a batch of metrics through /updates, retrying on network errors, 5xx and
+// 429 responses. The server applies a batch atomically.
+//
+// Parameters:
+//   - ctx: Context bounding the request and the waits between retries
+//   - batch: Metrics to send; an empty batch sends nothing
+//
+// Returns:
+//   - error: nil if the server accepted the batch, otherwise the last error; a
+//     *StatusError if the server rejected it
+func (c *Client) Send(ctx context.Context, batch []Metric) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	return Retry(ctx, c.cfg.RetryDelays, func() error {
+		return c.Post(ctx, "/updates", body, c.cfg.Start)
+	})
+}
+
+// Post makes a single attempt to send a JSON body to an endpoint of the server. It
+// compresses the body with gzip, encrypts it if a public key is configured, and adds
+// the HMAC-SHA256 hash of the plain body, the bearer token, X-Real-IP and the source
+// headers.
+//
+// Parameters:
+//   - ctx: Context bounding the request
+//   - path: Endpoint of the server, e.g. "/updates" or "/update"
+//   - body: JSON body
+//   - start: Start time of the source run that collected the metrics in body, sent in
+//     X-Source-Start; it differs from Config.Start for metrics kept from an earlier run
+//
+// Returns:
+//   - error: nil if the server answered 200 OK, a *StatusError with the response body
+//     for other status codes, otherwise the error of the request
+func (c *Client) Post(ctx context.Context, path string, body []byte, start time.Time) error {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	// Encrypt the body if a public key is provided
+	reqBody := body
+	if c.cfg.PublicKey != nil {
+		encrypted, err := crypto.EncryptWithPublicKey(c.cfg.PublicKey, body)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt request body: %w", err)
+		}
+		reqBody = encrypted
+	}
+
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(reqBody); err != nil {
+		gz.Close()
+		return fmt.Errorf("failed to compress body: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if c.cfg.Key != "" {
+		req.Header.Set("HashSHA256", sha256.ComputeHMACSHA256(body, c.cfg.Key))
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	if c.cfg.RealIP != "" {
+		req.Header.Set("X-Real-IP", c.cfg.RealIP)
+	}
+	// The server tracks cumulative counters per source and run
+	if c.cfg.SourceID != "" {
+		req.Header.Set("X-Source-ID", c.cfg.SourceID)
+		req.Header.Set("X-Source-Start", start.UTC().Format(time.RFC3339Nano))
+	}
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(msg),
+			RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	// Drain the body so that the connection is reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/crypto"
+	"github.com/SergeyDolin/metrics-and-alerting/internal/sha256"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a test server that records the batches it receives.
+type recorder struct {
+	mu      sync.Mutex
+	status  int             // Status to answer with; 0 answers 200 OK
+	batches [][]Metric      // Received batches in order
+	headers []http.Header   // Headers of the received batches
+	private *rsa.PrivateKey // Decrypts the bodies if set
+}
+
+func (rec *recorder) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		if rec.private != nil {
+			body, err = crypto.DecryptWithPrivateKey(rec.private, body)
+			require.NoError(t, err)
+		}
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if rec.status != 0 && rec.status != http.StatusOK {
+			w.WriteHeader(rec.status)
+			return
+		}
+		var batch []Metric
+		require.NoError(t, json.Unmarshal(body, &batch))
+		rec.batches = append(rec.batches, batch)
+		rec.headers = append(rec.headers, r.Header.Clone())
+	}
+}
+
+func (rec *recorder) setStatus(status int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.status = status
+}
+
+// received returns the received samples as "id=value" strings in order.
+func (rec *recorder) received() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var out []string
+	for _, batch := range rec.batches {
+		for _, m := range batch {
+			switch {
+			case m.Value != nil:
+				out = append(out, m.ID+"="+formatFloat(*m.Value))
+			case m.Delta != nil:
+				out = append(out, m.ID+"="+formatFloat(float64(*m.Delta)))
+			default:
+				out = append(out, m.ID)
+			}
+		}
+	}
+	return out
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// newTestClient creates a client for a recorder without retries.
+func newTestClient(t *testing.T, rec *recorder, cfg Config) *Client {
+	server := httptest.NewServer(rec.handler(t))
+	t.Cleanup(server.Close)
+	cfg.Address = server.URL
+	if cfg.RetryDelays == nil {
+		cfg.RetryDelays = []time.Duration{0}
+	}
+	c, err := New(cfg)
+	require.NoError(t, err)
+	return c
+}
+
+func Test_New(t *testing.T) {
+	tests := []struct {
+		name          string
+		address       string
+		expectedURL   string
+		expectedError string
+	}{
+		{name: "Host and port", address: "localhost:8080", expectedURL: "http://localhost:8080"},
+		{name: "Base URL", address: "https://metrics.example.com/", expectedURL: "https://metrics.example.com"},
+		{name: "Missing", expectedError: "server address is required"},
+		{name: "Invalid", address: "local host:80", expectedError: "invalid server address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(Config{Address: tt.address})
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedURL, c.baseURL)
+			assert.Equal(t, DefaultRetryDelays, c.cfg.RetryDelays)
+			assert.False(t, c.cfg.Start.IsZero())
+		})
+	}
+}
+
+func Test_Client_Post(t *testing.T) {
+	rec := &recorder{}
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestClient(t, rec, Config{
+		Key:      "secret",
+		Token:    "token-1",
+		RealIP:   "10.0.0.7",
+		SourceID: "checkout-1",
+		Start:    start,
+	})
+
+	body := []byte(`[{"id":"OrdersPlaced","type":"counter","delta":3}]`)
+	require.NoError(t, c.Post(t.Context(), "/updates", body, start.Add(-time.Hour)))
+
+	require.Len(t, rec.headers, 1)
+	h := rec.headers[0]
+	assert.Equal(t, "application/json", h.Get("Content-Type"))
+	assert.Equal(t, "gzip", h.Get("Content-Encoding"))
+	assert.Equal(t, sha256.ComputeHMACSHA256(body, "secret"), h.Get("HashSHA256"))
+	assert.Equal(t, "Bearer token-1", h.Get("Authorization"))
+	assert.Equal(t, "10.0.0.7", h.Get("X-Real-IP"))
+	assert.Equal(t, "checkout-1", h.Get("X-Source-ID"))
+	assert.Equal(t, "2026-03-01T11:00:00Z", h.Get("X-Source-Start"), "the start of the run that collected the metrics")
+	assert.Equal(t, []string{"OrdersPlaced=3"}, rec.received())
+}
+
+func Test_Client_Post_WithoutOptionalHeaders(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{})
+
+	require.NoError(t, c.Post(t.Context(), "/updates", []byte(`[]`), c.cfg.Start))
+	require.Len(t, rec.headers, 1)
+	for _, name := range []string{"HashSHA256", "Authorization", "X-Real-IP", "X-Source-ID", "X-Source-Start"} {
+		assert.Empty(t, rec.headers[0].Get(name), name)
+	}
+}
+
+func Test_Client_Post_Encrypted(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rec := &recorder{private: private}
+	c := newTestClient(t, rec, Config{PublicKey: &private.PublicKey})
+
+	require.NoError(t, c.Post(t.Context(), "/updates", []byte(`[{"id":"QueueDepth","type":"gauge","value":17}]`), c.cfg.Start))
+	assert.Equal(t, []string{"QueueDepth=17"}, rec.received())
+}
+
+func Test_Client_Post_StatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	c, err := New(Config{Address: server.URL})
+	require.NoError(t, err)
+
+	err = c.Post(t.Context(), "/updates", []byte(`[]`), c.cfg.Start)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusTooManyRequests, statusErr.StatusCode)
+	assert.Equal(t, "slow down\n", statusErr.Body)
+	assert.Equal(t, 7*time.Second, statusErr.RetryAfter)
+	assert.True(t, statusErr.Retriable())
+}
+
+func Test_Client_Send(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "/updates", r.URL.Path)
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	c, err := New(Config{Address: server.URL, RetryDelays: []time.Duration{0, time.Millisecond}})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Send(t.Context(), nil))
+	assert.Equal(t, 0, calls, "an empty batch is not sent")
+
+	value := 1.5
+	require.NoError(t, c.Send(t.Context(), []Metric{{ID: "Load", MType: "gauge", Value: &value}}))
+	assert.Equal(t, 2, calls, "a 503 is retried")
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrClosed is returned by Push once the client is closed.
+	ErrClosed = errors.New("client is closed")
+
+	// ErrBufferFull is returned by Push when MaxPending metrics are waiting for the next flush.
+	ErrBufferFull = errors.New("too many metrics waiting to be sent")
+)
+
+// flushItem is a metric taken for a flush.
+type flushItem struct {
+	metric Metric // Metric to send
+	size   int    // Size of the metric encoded as JSON
+	pushed bool   // Whether the metric was pushed; it is queued again if it cannot be sent
+	commit func() // Records that a gauge or counter was delivered; called with the lock held
+}
+
+// Push queues a metric of any type, e.g. a histogram or a sample with metadata, for
+// the next flush. A counter pushed this way is sent as it is, so its Delta must be
+// an increment unless its Temporality says otherwise.
+//
+// Parameters:
+//   - m: Metric to send
+//
+// Returns:
+//   - error: ErrClosed once the client is closed, ErrBufferFull if MaxPending metrics
+//     are already waiting, or an error if the metric has no ID or type
+func (c *Client) Push(m Metric) error {
+	if m.ID == "" || m.MType == "" {
+		return errors.New("metric needs an ID and a type")
+	}
+	c.startLoop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if len(c.pending) >= c.cfg.MaxPending {
+		return ErrBufferFull
+	}
+	c.pending = append(c.pending, m)
+	if len(c.pending) >= c.cfg.BatchMaxCount {
+		// A full batch is waiting; it is sent without waiting for the interval
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush sends the changed gauges and counters and the pushed metrics now, in batches
+// bounded by BatchMaxCount and BatchMaxBytes. Metrics that cannot be delivered are
+// kept for the next flush; those the server rejects with a client error are dropped.
+//
+// Parameters:
+//   - ctx: Context bounding the requests and their retries
+//
+// Returns:
+//   - error: nil if everything was delivered, otherwise the errors of the batches
+func (c *Client) Flush(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	items := c.take()
+	var errs []error
+	for len(items) > 0 {
+		n := c.batchLen(items)
+		batch := make([]Metric, n)
+		for i, item := range items[:n] {
+			batch[i] = item.metric
+		}
+
+		err := c.Send(ctx, batch)
+		var statusErr *StatusError
+		if err != nil && (!errors.As(err, &statusErr) || statusErr.Retriable()) {
+			// The server cannot be reached; keep the rest for the next flush
+			c.requeue(items)
+			errs = append(errs, err)
+			break
+		}
+		if err != nil {
+			// Sending the rejected metrics again would not help
+			errs = append(errs, fmt.Errorf("server rejected batch of %d metric(s) starting with %s: %w", n, batch[0].ID, err))
+		}
+		c.mu.Lock()
+		for _, item := range items[:n] {
+			if item.commit != nil {
+				item.commit()
+			}
+		}
+		c.mu.Unlock()
+		items = items[n:]
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the background flushes and sends what is left. Afterwards the handles
+// ignore updates and Push fails with ErrClosed.
+//
+// Parameters:
+//   - ctx: Context bounding the final flush
+//
+// Returns:
+//   - error: Error of the final flush, or the context error
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	// Without handles or pushed metrics the loop never started
+	c.start.Do(func() { close(c.done) })
+	close(c.stop)
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return c.Flush(ctx)
+}
+
+// startLoop starts the background flushes unless they are running or the client is closed.
+func (c *Client) startLoop() {
+	c.start.Do(func() { go c.loop() })
+}
+
+// loop flushes every FlushInterval and whenever Push asks for it, until Close. A flush
+// in progress is cancelled by Close, which sends its metrics again.
+func (c *Client) loop() {
+	defer close(c.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+		if err := c.Flush(ctx); err != nil && ctx.Err() == nil {
+			c.report(err)
+		}
+	}
+}
+
+// report passes the error of a background flush to OnError.
+//
+// Parameters:
+//   - err: Flush error
+func (c *Client) report(err error) {
+	if c.cfg.OnError != nil {
+		c.cfg.OnError(err)
+		return
+	}
+	log.Printf("metrics client: %v\n", err)
+}
+
+// take collects the metrics of a flush: the gauges and counters that changed since
+// they were delivered, in name order, followed by the pushed metrics in push order.
+//
+// Returns:
+//   - []flushItem: Metrics to send
+func (c *Client) take() []flushItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var items []flushItem
+	for _, name := range slices.Sorted(maps.Keys(c.gauges)) {
+		s := c.gauges[name]
+		if s.version == s.sent {
+			continue
+		}
+		value, version := s.value, s.version
+		items = append(items, flushItem{
+			metric: Metric{ID: name, MType: "gauge", Value: &value},
+			commit: func() { s.sent = version },
+		})
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.counters)) {
+		s := c.counters[name]
+		if s.total == s.sent {
+			continue
+		}
+		total := s.total
+		m := Metric{ID: name, MType: "counter"}
+		if c.cfg.SourceID != "" {
+			// The server derives the increment from the total, so a lost request does not matter
+			m.Delta, m.Temporality = &total, TemporalityCumulative
+		} else {
+			delta := total - s.sent
+			m.Delta = &delta
+		}
+		items = append(items, flushItem{metric: m, commit: func() { s.sent = total }})
+	}
+	for _, m := range c.pending {
+		items = append(items, flushItem{metric: m, pushed: true})
+	}
+	c.pending = nil
+
+	for i := range items {
+		items[i].size = encodedSize(items[i].metric)
+	}
+	return items
+}
+
+// requeue puts the pushed metrics of a failed flush back in front of those pushed
+// since, dropping the oldest beyond MaxPending.
+//
+// Parameters:
+//   - items: Metrics that were not delivered
+func (c *Client) requeue(items []flushItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pending []Metric
+	for _, item := range items {
+		if item.pushed {
+			pending = append(pending, item.metric)
+		}
+	}
+	pending = append(pending, c.pending...)
+	if n := len(pending) - c.cfg.MaxPending; n > 0 {
+		pending = pending[n:]
+	}
+	c.pending = pending
+}
+
+// batchLen returns how many of the items go into the next batch: at most BatchMaxCount,
+// and no more than fit into BatchMaxBytes, but at least one.
+//
+// Parameters:
+//   - items: Metrics waiting to be sent
+//
+// Returns:
+//   - int: Number of items for the batch
+func (c *Client) batchLen(items []flushItem) int {
+	size := 2 // Brackets of the array
+	for i, item := range items {
+		if i == c.cfg.BatchMaxCount {
+			return i
+		}
+		if i > 0 {
+			// One byte for the separating comma
+			size++
+		}
+		size += item.size
+		if i > 0 && size > c.cfg.BatchMaxBytes {
+			return i
+		}
+	}
+	return len(items)
+}
+
+// encodedSize returns the size of a metric encoded as JSON.
+//
+// Parameters:
+//   - m: Metric to measure
+//
+// Returns:
+//   - int: Size in bytes, or 0 if the metric cannot be encoded
+func encodedSize(m Metric) int {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return 0
+	}
+	return len(body)
+}
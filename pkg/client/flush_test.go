@@ -0,0 +1,147 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Client_Handles(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{FlushInterval: time.Hour})
+	defer c.Close(t.Context())
+
+	queue := c.Gauge("QueueDepth")
+	orders := c.Counter("OrdersPlaced")
+	queue.Set(17)
+	orders.Inc()
+	orders.Add(2)
+	orders.Add(-5)
+	c.Counter("OrdersPlaced").Inc()
+	c.Gauge("Idle")
+
+	require.NoError(t, c.Flush(t.Context()))
+	assert.Equal(t, []string{"QueueDepth=17", "OrdersPlaced=4"}, rec.received(), "handles of a name share their state")
+
+	require.NoError(t, c.Flush(t.Context()))
+	assert.Len(t, rec.batches, 1, "nothing changed, nothing is sent")
+
+	queue.Add(-2)
+	orders.Inc()
+	require.NoError(t, c.Flush(t.Context()))
+	assert.Equal(t, []string{"QueueDepth=17", "OrdersPlaced=4", "QueueDepth=15", "OrdersPlaced=1"}, rec.received(), "counters are sent as increments")
+	assert.Empty(t, rec.batches[1][1].Temporality)
+}
+
+func Test_Client_CumulativeCounters(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{SourceID: "checkout-1", FlushInterval: time.Hour})
+	defer c.Close(t.Context())
+
+	orders := c.Counter("OrdersPlaced")
+	orders.Add(3)
+	require.NoError(t, c.Flush(t.Context()))
+	orders.Add(2)
+	require.NoError(t, c.Flush(t.Context()))
+
+	assert.Equal(t, []string{"OrdersPlaced=3", "OrdersPlaced=5"}, rec.received(), "counters are sent as totals")
+	assert.Equal(t, TemporalityCumulative, rec.batches[1][0].Temporality)
+	assert.Equal(t, "checkout-1", rec.headers[1].Get("X-Source-ID"))
+}
+
+func Test_Client_Flush_KeepsMetricsOnFailure(t *testing.T) {
+	rec := &recorder{status: http.StatusServiceUnavailable}
+	c := newTestClient(t, rec, Config{FlushInterval: time.Hour})
+	defer c.Close(t.Context())
+
+	orders := c.Counter("OrdersPlaced")
+	orders.Add(3)
+	require.NoError(t, c.Push(Metric{ID: "Latency", MType: "histogram", Histogram: &Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5}}))
+	assert.ErrorContains(t, c.Flush(t.Context()), "server returned status 503")
+
+	// The increments and pushed metrics of the failed flush are sent with the next one
+	orders.Add(2)
+	rec.setStatus(http.StatusOK)
+	require.NoError(t, c.Flush(t.Context()))
+	assert.Equal(t, []string{"OrdersPlaced=5", "Latency"}, rec.received())
+}
+
+func Test_Client_Flush_DropsRejectedMetrics(t *testing.T) {
+	rec := &recorder{status: http.StatusBadRequest}
+	c := newTestClient(t, rec, Config{FlushInterval: time.Hour})
+	defer c.Close(t.Context())
+
+	c.Gauge("QueueDepth").Set(1)
+	require.NoError(t, c.Push(Metric{ID: "Orders", MType: "gauge"}))
+	err := c.Flush(t.Context())
+	assert.ErrorContains(t, err, "server rejected batch of 2 metric(s) starting with QueueDepth")
+
+	rec.setStatus(http.StatusOK)
+	require.NoError(t, c.Flush(t.Context()))
+	assert.Empty(t, rec.received(), "sending them again would not help")
+}
+
+func Test_Client_Flush_Batches(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{BatchMaxCount: 2, BatchMaxBytes: 90, FlushInterval: time.Hour})
+	defer c.Close(t.Context())
+
+	for _, name := range []string{"A", "B", "C", "LongerThanTheOthersTogether_LongerThanTheOthersTogether_Longer"} {
+		c.Gauge(name).Set(1)
+	}
+	require.NoError(t, c.Flush(t.Context()))
+
+	var sizes []int
+	for _, batch := range rec.batches {
+		sizes = append(sizes, len(batch))
+	}
+	assert.Equal(t, []int{2, 1, 1}, sizes, "at most 2 metrics, and a metric above the byte limit alone")
+}
+
+func Test_Client_Push(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{BatchMaxCount: 3, FlushInterval: time.Hour})
+	defer c.Close(t.Context())
+
+	assert.ErrorContains(t, c.Push(Metric{MType: "gauge"}), "metric needs an ID and a type")
+
+	value := 1.0
+	for _, id := range []string{"A", "B", "C"} {
+		require.NoError(t, c.Push(Metric{ID: id, MType: "gauge", Value: &value}))
+	}
+	// A full batch is sent without waiting for the flush interval
+	require.Eventually(t, func() bool { return len(rec.received()) == 3 }, 5*time.Second, 5*time.Millisecond)
+
+	full := newTestClient(t, rec, Config{MaxPending: 2, FlushInterval: time.Hour})
+	defer full.Close(t.Context())
+	for _, id := range []string{"D", "E"} {
+		require.NoError(t, full.Push(Metric{ID: id, MType: "gauge", Value: &value}))
+	}
+	assert.True(t, errors.Is(full.Push(Metric{ID: "F", MType: "gauge", Value: &value}), ErrBufferFull))
+}
+
+func Test_Client_Close(t *testing.T) {
+	var errs []error
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{FlushInterval: time.Hour, OnError: func(err error) { errs = append(errs, err) }})
+
+	queue := c.Gauge("QueueDepth")
+	queue.Set(3)
+	require.NoError(t, c.Close(t.Context()))
+	assert.Equal(t, []string{"QueueDepth=3"}, rec.received(), "what is left is sent on close")
+
+	queue.Set(4)
+	c.Counter("OrdersPlaced").Inc()
+	assert.True(t, errors.Is(c.Push(Metric{ID: "A", MType: "gauge"}), ErrClosed))
+	require.NoError(t, c.Close(t.Context()))
+	assert.Len(t, rec.batches, 1, "updates after close are ignored")
+	assert.Empty(t, errs)
+
+	unused, err := New(Config{Address: "localhost:8080"})
+	require.NoError(t, err)
+	assert.NoError(t, unused.Close(t.Context()), "a client without handles closes without requests")
+}
@@ -0,0 +1,117 @@
+package client
+
+// gaugeState is the value of a gauge and the version the server has received.
+type gaugeState struct {
+	value   float64 // Latest value
+	version uint64  // Incremented by every change of the value
+	sent    uint64  // Version of the value sent last
+}
+
+// counterState is the running total of a counter and the part the server has received.
+type counterState struct {
+	total int64 // Sum of all increments since the client was created
+	sent  int64 // Total sent last
+}
+
+// Gauge is a handle to a metric whose value goes up and down, e.g. a queue depth.
+// The latest value is sent with the next flush after it changed.
+type Gauge struct {
+	c *Client     // Client that sends the gauge
+	s *gaugeState // State shared by all handles of the gauge
+}
+
+// Counter is a handle to a metric that counts events, e.g. placed orders.
+// The increments are summed up and sent with the next flush.
+type Counter struct {
+	c *Client       // Client that sends the counter
+	s *counterState // State shared by all handles of the counter
+}
+
+// Gauge returns the handle to a gauge. Handles of the same name share their value.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - *Gauge: Gauge handle
+func (c *Client) Gauge(name string) *Gauge {
+	c.startLoop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.gauges[name]
+	if !ok {
+		s = &gaugeState{}
+		c.gauges[name] = s
+	}
+	return &Gauge{c: c, s: s}
+}
+
+// Counter returns the handle to a counter. Handles of the same name share their total.
+//
+// Parameters:
+//   - name: Metric name
+//
+// Returns:
+//   - *Counter: Counter handle
+func (c *Client) Counter(name string) *Counter {
+	c.startLoop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.counters[name]
+	if !ok {
+		s = &counterState{}
+		c.counters[name] = s
+	}
+	return &Counter{c: c, s: s}
+}
+
+// Set sets the value of the gauge. It is ignored once the client is closed.
+//
+// Parameters:
+//   - value: New value
+func (g *Gauge) Set(value float64) {
+	g.c.mu.Lock()
+	defer g.c.mu.Unlock()
+	if g.c.closed {
+		return
+	}
+	g.s.value = value
+	g.s.version++
+}
+
+// Add adds to the value of the gauge; a negative delta decreases it. It is ignored
+// once the client is closed.
+//
+// Parameters:
+//   - delta: Change of the value
+func (g *Gauge) Add(delta float64) {
+	g.c.mu.Lock()
+	defer g.c.mu.Unlock()
+	if g.c.closed {
+		return
+	}
+	g.s.value += delta
+	g.s.version++
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds to the counter. Counters only go up, so a negative delta is ignored, as
+// is any delta once the client is closed.
+//
+// Parameters:
+//   - delta: Increment
+func (c *Counter) Add(delta int64) {
+	if delta <= 0 {
+		return
+	}
+	c.c.mu.Lock()
+	defer c.c.mu.Unlock()
+	if c.c.closed {
+		return
+	}
+	c.s.total += delta
+}
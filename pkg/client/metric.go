@@ -0,0 +1,176 @@
+package client
+
+// Temporalities of counter samples.
+const (
+	// TemporalityDelta marks a counter sample as an increment; this is the default
+	TemporalityDelta = "delta"
+
+	// TemporalityCumulative marks a counter sample as the running total of its source
+	// since the source started. The server converts it into an increment per source and
+	// needs the X-Source-ID and X-Source-Start headers to interpret it.
+	TemporalityCumulative = "cumulative"
+)
+
+// Metric is a single sample in the JSON format of the server API. It uses pointers
+// for optional fields to distinguish between zero values and omitted fields in JSON
+// serialization.
+//
+// The struct supports four types of metrics:
+//   - gauge: A floating-point value that can go up and down (e.g., CPU usage, memory usage)
+//   - counter: A monotonically increasing integer value (e.g., request count, poll count)
+//   - histogram: Observations counted in buckets (e.g., request latencies)
+//   - summary: Count and sum of observations with client-side quantiles
+//
+// Example JSON representations:
+//
+// Gauge metric:
+//
+//	{"id":"Alloc","type":"gauge","value":42.5}
+//
+// Counter metric:
+//
+//	{"id":"PollCount","type":"counter","delta":10}
+//
+// Cumulative counter metric (the running total of the sending source):
+//
+//	{"id":"PollCount","type":"counter","delta":1500,"temporality":"cumulative"}
+//
+// Histogram metric (observations since the last report, buckets up to 0.1, 0.5 and +Inf):
+//
+//	{"id":"RequestLatency","type":"histogram","histogram":{"bounds":[0.1,0.5],"counts":[7,2,1],"count":10,"sum":1.9}}
+//
+// Summary metric:
+//
+//	{"id":"RequestLatency","type":"summary","summary":{"count":10,"sum":1.9,"quantiles":[{"quantile":0.5,"value":0.08},{"quantile":0.99,"value":0.7}]}}
+//
+// Gauge metric with metadata:
+//
+//	{"id":"GCCPUFraction","type":"gauge","value":0.01,"meta":{"description":"Fraction of CPU time used by the GC","unit":"ratio"}}
+//
+// Signed metric (with HMAC):
+//
+//	{"id":"Alloc","type":"gauge","value":42.5,"hash":"5d4f3c8e2a1b9f7d6c5e4a3b2c1d0e9f8a7b6c5d"}
+type Metric struct {
+	// ID is the unique identifier/name of the metric.
+	// Examples: "Alloc", "PollCount", "CPUUtilization1", "TotalMemory"
+	ID string `json:"id"`
+
+	// MType specifies the metric type - "gauge", "counter", "histogram" or "summary".
+	// This field determines which of Delta, Value, Histogram or Summary should be used.
+	MType string `json:"type"`
+
+	// Delta is used for counter metrics and represents the change/increment value.
+	// It's a pointer to distinguish between a zero value (0) and no value being provided.
+	// This field is omitted from JSON when nil (using omitempty tag).
+	Delta *int64 `json:"delta,omitempty"`
+
+	// Value is used for gauge metrics and represents the current value.
+	// It's a pointer to distinguish between a zero value (0.0) and no value being provided.
+	// This field is omitted from JSON when nil (using omitempty tag).
+	Value *float64 `json:"value,omitempty"`
+
+	// Histogram is used for histogram metrics and holds the bucket counts of the
+	// observations since the previous report; stored histograms hold all observations.
+	// This field is omitted from JSON when nil (using omitempty tag).
+	Histogram *Histogram `json:"histogram,omitempty"`
+
+	// Summary is used for summary metrics and holds the count and sum of the observations
+	// since the previous report together with the quantiles computed by the sender.
+	// This field is omitted from JSON when nil (using omitempty tag).
+	Summary *Summary `json:"summary,omitempty"`
+
+	// Temporality tells how Delta of a counter is to be read: TemporalityDelta (or empty)
+	// for an increment, TemporalityCumulative for the running total of the source.
+	// This field is omitted from JSON when empty (using omitempty tag).
+	Temporality string `json:"temporality,omitempty"`
+
+	// Meta optionally carries metadata to register for the metric together with the sample.
+	// Its ID and MType are taken from the sample.
+	// This field is omitted from JSON when nil (using omitempty tag).
+	Meta *Metadata `json:"meta,omitempty"`
+
+	// Hash contains an optional HMAC-SHA256 signature of the metric data.
+	// Used for data integrity verification between agent and server.
+	// When present, the receiver should verify that the hash matches
+	// the calculated hash using the shared secret key.
+	// This field is omitted from JSON when empty (using omitempty tag).
+	Hash string `json:"hash,omitempty"`
+}
+
+// Metadata documents a metric: what it measures, its unit, who owns it and which
+// type its samples must have. Samples whose type differs from the registered type
+// are rejected.
+//
+// Example JSON representation:
+//
+//	{"id":"GCCPUFraction","type":"gauge","description":"Fraction of CPU time used by the GC","unit":"ratio","owner":"runtime"}
+type Metadata struct {
+	// ID is the name of the documented metric.
+	ID string `json:"id"`
+
+	// MType is the expected metric type - "gauge", "counter", "histogram" or "summary".
+	MType string `json:"type"`
+
+	// Description explains what the metric measures.
+	// This field is omitted from JSON when empty (using omitempty tag).
+	Description string `json:"description,omitempty"`
+
+	// Unit is the unit of the values, e.g. "bytes", "seconds" or "percent".
+	// This field is omitted from JSON when empty (using omitempty tag).
+	Unit string `json:"unit,omitempty"`
+
+	// Owner names the team or component responsible for the metric.
+	// This field is omitted from JSON when empty (using omitempty tag).
+	Owner string `json:"owner,omitempty"`
+}
+
+// Histogram is a distribution of observations counted in buckets. Bucket i counts the
+// observations v with Bounds[i-1] < v <= Bounds[i]; the last bucket counts those above
+// the largest bound. Counts are per bucket, not cumulative, so two histograms with
+// the same bounds are merged by adding their counts and sums.
+//
+// Example JSON representation:
+//
+//	{"bounds":[0.1,0.5],"counts":[7,2,1],"count":10,"sum":1.9}
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets in strictly ascending order.
+	Bounds []float64 `json:"bounds"`
+
+	// Counts holds the number of observations per bucket; it has one element more
+	// than Bounds for the observations above the largest bound.
+	Counts []int64 `json:"counts"`
+
+	// Count is the total number of observations, the sum of Counts.
+	Count int64 `json:"count"`
+
+	// Sum is the sum of all observed values.
+	Sum float64 `json:"sum"`
+}
+
+// Summary is a distribution of observations described by their count, their sum and
+// quantiles computed by the sender. Quantiles cannot be merged, so merging two
+// summaries adds their counts and sums and keeps the quantiles of the newer one.
+//
+// Example JSON representation:
+//
+//	{"count":10,"sum":1.9,"quantiles":[{"quantile":0.5,"value":0.08},{"quantile":0.99,"value":0.7}]}
+type Summary struct {
+	// Count is the number of observations.
+	Count int64 `json:"count"`
+
+	// Sum is the sum of all observed values.
+	Sum float64 `json:"sum"`
+
+	// Quantiles are the estimated quantiles in strictly ascending order of their rank.
+	// This field is omitted from JSON when empty (using omitempty tag).
+	Quantiles []Quantile `json:"quantiles,omitempty"`
+}
+
+// Quantile is a single quantile estimate of a summary.
+type Quantile struct {
+	// Quantile is the rank of the estimate, between 0 and 1 (e.g., 0.99).
+	Quantile float64 `json:"quantile"`
+
+	// Value is the estimated observation at that rank.
+	Value float64 `json:"value"`
+}
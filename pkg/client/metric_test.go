@@ -0,0 +1,36 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/SergeyDolin/metrics-and-alerting/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test_Metric_WireFormat checks that the public types encode like the types the
+// server decodes, field for field.
+func Test_Metric_WireFormat(t *testing.T) {
+	delta, value := int64(1500), 42.5
+	batch := []Metric{
+		{ID: "PollCount", MType: "counter", Delta: &delta, Temporality: TemporalityCumulative, Hash: "abc"},
+		{ID: "Alloc", MType: "gauge", Value: &value, Meta: &Metadata{ID: "Alloc", MType: "gauge", Description: "Heap bytes", Unit: "bytes", Owner: "runtime"}},
+		{ID: "RequestLatency", MType: "histogram", Histogram: &Histogram{Bounds: []float64{0.1, 0.5}, Counts: []int64{7, 2, 1}, Count: 10, Sum: 1.9}},
+		{ID: "GCPause", MType: "summary", Summary: &Summary{Count: 10, Sum: 1.9, Quantiles: []Quantile{{Quantile: 0.5, Value: 0.08}}}},
+	}
+	sent, err := json.Marshal(batch)
+	require.NoError(t, err)
+
+	var decoded []metrics.Metrics
+	dec := json.NewDecoder(bytes.NewReader(sent))
+	dec.DisallowUnknownFields()
+	require.NoError(t, dec.Decode(&decoded))
+	stored, err := json.Marshal(decoded)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(sent), string(stored))
+
+	assert.Equal(t, metrics.TemporalityDelta, TemporalityDelta)
+	assert.Equal(t, metrics.TemporalityCumulative, TemporalityCumulative)
+}
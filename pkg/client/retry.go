@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxRetryAfter caps the server-requested delay so that a misconfigured server
+// cannot stall the client indefinitely.
+const MaxRetryAfter = time.Minute
+
+// DefaultRetryDelays are the default delays before the attempts of a request: the
+// first attempt is immediate, then the delays increase.
+var DefaultRetryDelays = []time.Duration{0, 1 * time.Second, 3 * time.Second, 5 * time.Second}
+
+// StatusError is returned when the server answers with a status other than 200 OK.
+type StatusError struct {
+	StatusCode int           // HTTP status code returned by the server (e.g., 500, 502, 404)
+	Body       string        // Response body content for additional error details
+	RetryAfter time.Duration // Delay requested by the server in the Retry-After header, if any
+}
+
+// Error implements the error interface for StatusError.
+// Returns a formatted string containing the status code and response message.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// Retriable reports whether the status indicates a temporary issue that might be
+// resolved by retrying the request: a 5xx server error or 429 Too Many Requests.
+// Other client errors won't be resolved by retrying.
+//
+// Returns:
+//   - bool: true if the request is worth retrying
+func (e *StatusError) Retriable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || (e.StatusCode >= 500 && e.StatusCode <= 599)
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date.
+//
+// Parameters:
+//   - value: Header value
+//   - now: Current time, used to convert an HTTP date into a delay
+//
+// Returns:
+//   - time.Duration: The requested delay, capped at MaxRetryAfter; 0 if the value is empty or invalid
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	return min(delay, MaxRetryAfter)
+}
+
+// isRetriableNetworkError examines an error to determine if it represents
+// a temporary network issue that might be resolved by retrying the operation.
+//
+// It recursively unwraps *url.Error to examine the underlying error and checks for:
+//   - Network operation errors (*net.OpError)
+//   - Timeout errors (net.Error with Timeout() true)
+//
+// Parameters:
+//   - err: The error to examine, which may be nil or various network-related error types
+//
+// Returns:
+//   - bool: true if the error indicates a temporary network issue that can be retried,
+//     false if the error is nil or not retriable
+func isRetriableNetworkError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// Unwrap URL errors to examine the underlying cause
+	switch e := err.(type) {
+	case *url.Error:
+		return isRetriableNetworkError(e.Err)
+	case *net.OpError:
+		// Network operation errors (connection refused, timeout, etc.) are typically retriable
+		return true
+	case net.Error:
+		// Check if it's a timeout error (can be retried)
+		return e.Timeout()
+	}
+	// For any other error types, assume they might be retriable
+	return true
+}
+
+// Retry executes a function with backoff until it succeeds, fails with an error that
+// is not worth retrying, or the delays are used up.
+//
+// The function considers two types of errors as retriable:
+//   - Network errors (timeouts, connection refused, etc.)
+//   - A *StatusError with a 5xx Server Error or 429 Too Many Requests status code
+//
+// If the server sent a Retry-After header, the next attempt waits at least that long.
+//
+// Parameters:
+//   - ctx: Context that ends the waits between attempts
+//   - delays: Delays before the attempts, e.g. DefaultRetryDelays (0s, 1s, 3s, 5s)
+//   - fn: The function to execute, which returns an error if unsuccessful
+//
+// Returns:
+//   - error: nil if the function succeeds, or an error if:
+//   - All retry attempts fail with retriable errors
+//   - A non-retriable error occurs (4xx HTTP error, etc.)
+//   - The context ends while waiting for the next attempt
+func Retry(ctx context.Context, delays []time.Duration, fn func() error) error {
+	// Delay requested by the server for the next attempt
+	var retryAfter time.Duration
+
+	var err error
+	for i, delay := range delays {
+		// Honour the server's Retry-After if it asks to wait longer than the schedule
+		delay = max(delay, retryAfter)
+
+		// Apply delay before this attempt (except for first attempt with delay=0)
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("%w, last error: %w", ctx.Err(), err)
+			case <-timer.C:
+			}
+		}
+
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		// A context error of the attempt ends the retries
+		if ctx.Err() != nil {
+			return err
+		}
+
+		retriable := isRetriableNetworkError(err)
+		retryAfter = 0
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			retriable = statusErr.Retriable()
+			retryAfter = statusErr.RetryAfter
+		}
+
+		if !retriable {
+			return err
+		}
+		if i == len(delays)-1 {
+			return fmt.Errorf("failed after %d attempts: %w", len(delays), err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "Empty", value: "", want: 0},
+		{name: "Seconds", value: "3", want: 3 * time.Second},
+		{name: "HTTP date", value: now.Add(5 * time.Second).Format(http.TimeFormat), want: 5 * time.Second},
+		{name: "Date in the past", value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{name: "Capped", value: "3600", want: MaxRetryAfter},
+		{name: "Garbage", value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ParseRetryAfter(tt.value, now))
+		})
+	}
+}
+
+func Test_Retry_RetryAfter(t *testing.T) {
+	var attempts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "2")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c, err := New(Config{Address: server.URL})
+	require.NoError(t, err)
+	err = Retry(t.Context(), DefaultRetryDelays, func() error {
+		return c.Post(t.Context(), "/update", []byte(`{"id":"TestGauge","type":"gauge","value":1}`), c.cfg.Start)
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, attempts, 2) {
+		// The schedule would retry after 1s; the server asked for 2s
+		assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 2*time.Second)
+	}
+}
+
+func Test_Retry_ClientErrorNotRetried(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	}))
+	defer server.Close()
+
+	c, err := New(Config{Address: server.URL})
+	require.NoError(t, err)
+	err = Retry(t.Context(), DefaultRetryDelays, func() error {
+		return c.Post(t.Context(), "/update", []byte(`{"id":"TestGauge","type":"gauge","value":1}`), c.cfg.Start)
+	})
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, statusErr.StatusCode)
+	assert.Equal(t, 1, calls)
+}
+
+func Test_Retry_GivesUp(t *testing.T) {
+	calls := 0
+	err := Retry(t.Context(), []time.Duration{0, time.Millisecond, time.Millisecond}, func() error {
+		calls++
+		return &StatusError{StatusCode: http.StatusBadGateway}
+	})
+	assert.ErrorContains(t, err, "failed after 3 attempts: server returned status 502")
+	assert.Equal(t, 3, calls)
+}
+
+func Test_Retry_ContextEndsWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Retry(ctx, []time.Duration{0, time.Hour}, func() error {
+		return &StatusError{StatusCode: http.StatusServiceUnavailable}
+	})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.ErrorContains(t, err, "server returned status 503")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}